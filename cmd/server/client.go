@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// gRPC server address used by client commands when --addr is not set.
+const defaultClientAddr = "localhost:9000"
+
+// Connection flags shared by commands talking to the gRPC API.
+type clientFlags struct {
+	addr    string
+	timeout time.Duration
+}
+
+// Registers --addr and --timeout flags on cmd and its subcommands.
+// Address defaults to USERSERVICE_GRPC_ADDR, same as the server.
+func addClientFlags(cmd *cobra.Command) *clientFlags {
+	flags := &clientFlags{}
+	addr := os.Getenv("USERSERVICE_GRPC_ADDR")
+	if addr == "" {
+		addr = defaultClientAddr
+	}
+	cmd.PersistentFlags().StringVar(&flags.addr, "addr", addr, "gRPC server address ($USERSERVICE_GRPC_ADDR)")
+	cmd.PersistentFlags().DurationVar(&flags.timeout, "timeout", 10*time.Second, "timeout of a request, 0 disables it")
+	return flags
+}
+
+// Connects to the gRPC server without TLS.
+func (f *clientFlags) dial(ctx context.Context, opts ...grpc.DialOption) (*grpc.ClientConn, error) {
+	opts = append(opts, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.DialContext(ctx, f.addr, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", f.addr, err)
+	}
+	return conn, nil
+}
+
+// Returns request context limited by --timeout.
+func (f *clientFlags) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, f.timeout)
+}
+
+// Writes message as a single line of JSON, same as the REST API returns it.
+func printJSON(w io.Writer, m proto.Message) error {
+	b, err := protojson.MarshalOptions{EmitUnpopulated: true}.Marshal(m)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(w, string(b))
+	return err
+}
+
+// Formats gRPC error as "<code>: <message>".
+func rpcError(err error) error {
+	st := status.Convert(err)
+	return fmt.Errorf("%s: %s", st.Code(), st.Message())
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Creates healthcheck command. It fails unless the server reports
+// SERVING, so it can be used as container health check.
+func newHealthcheckCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "healthcheck",
+		Short: "Check that the gRPC server is serving",
+		Args:  cobra.NoArgs,
+	}
+	api := addClientFlags(cmd)
+	service := cmd.Flags().String("service", "", "service name, empty checks the whole server")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx, cancel := api.context(cmd.Context())
+		defer cancel()
+		conn, err := api.dial(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		resp, err := healthpb.NewHealthClient(conn).Check(ctx, &healthpb.HealthCheckRequest{Service: *service})
+		if err != nil {
+			return rpcError(err)
+		}
+		fmt.Fprintln(cmd.OutOrStdout(), resp.Status.String())
+		if resp.Status != healthpb.HealthCheckResponse_SERVING {
+			return fmt.Errorf("server is %s", resp.Status.String())
+		}
+		return nil
+	}
+	return cmd
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/kroksys/user-service-example/pkg/config"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/spf13/cobra"
+)
+
+// Creates keys command managing keyring of encryption.keyring_file:
+//   - add creates the keyring or adds a new primary key to it
+//   - rotate rewraps data keys of users, webhook secrets, dead letters and
+//     audit events with the primary key and encrypts ones stored before
+//     encryption was enabled
+func newKeysCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "keys",
+		Short: "Manage keys encrypting personal data of users",
+	}
+	flags := config.RegisterFlags(cmd.PersistentFlags())
+	cmd.AddCommand(&cobra.Command{
+		Use:   "add",
+		Short: "Create the keyring or add a new primary key to it",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := flags.Load()
+			if err != nil {
+				return err
+			}
+			return addKey(cfg.Encryption.KeyringFile, cmd.OutOrStdout())
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "rotate",
+		Short: "Encrypt users and webhook secrets with the primary key",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			cfg, err := flags.Load()
+			if err != nil {
+				return err
+			}
+			return rotateKeys(cmd.Context(), cfg, cmd.OutOrStdout())
+		},
+	})
+	return cmd
+}
+
+// Adds primary key to keyring file, the file is created when it does not
+// exist.
+func addKey(path string, w io.Writer) error {
+	if path == "" {
+		return fmt.Errorf("encryption.keyring_file is not configured")
+	}
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		keyring, err := encryption.NewKeyring()
+		if err != nil {
+			return err
+		}
+		if err := keyring.Save(path); err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "created keyring %s with key %s\n", path, keyring.Primary())
+		return nil
+	}
+	keyring, err := encryption.LoadKeyring(path)
+	if err != nil {
+		return err
+	}
+	if err := keyring.AddKey(); err != nil {
+		return err
+	}
+	if err := keyring.Save(path); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "added primary key %s to %s, run keys rotate after servers load it\n", keyring.Primary(), path)
+	return nil
+}
+
+// Rewraps data keys and encrypts plaintext users and webhook secrets of
+// configured database.
+func rotateKeys(ctx context.Context, cfg config.Config, w io.Writer) error {
+	if strings.HasPrefix(cfg.Database.ConnectionString, db.MemoryConnectionString) {
+		return fmt.Errorf("in-memory storage is not encrypted")
+	}
+	keyring, err := cfg.Keyring()
+	if err != nil {
+		return err
+	}
+	if keyring == nil {
+		return fmt.Errorf("encryption.keyring_file is not configured")
+	}
+
+	database, err := db.Connect(cfg.Database.ConnectionString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	if sqlDB, err := database.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	users, err := db.NewEncryptedUserRepository(database, keyring).RotateKeys(ctx)
+	if err != nil {
+		return err
+	}
+	webhookRepo := db.NewEncryptedWebhookRepository(database, keyring)
+	webhooks, err := webhookRepo.RotateKeys(ctx)
+	if err != nil {
+		return err
+	}
+	deadLetters, err := webhookRepo.RotateDeadLetterKeys(ctx)
+	if err != nil {
+		return err
+	}
+	events, err := db.NewEncryptedAuditRepository(database, keyring).RotateKeys(ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "encrypted %d users, %d webhooks, %d dead letters and %d audit events with key %s\n",
+		users, webhooks, deadLetters, events, keyring.Primary())
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/service"
+	"github.com/stretchr/testify/require"
+)
+
+var grpcAddr = "localhost:1990"
+
+// Runs CLI with args and returns its output.
+func run(t *testing.T, args ...string) (string, error) {
+	return runWithInput(t, "", args...)
+}
+
+// Runs CLI with args and stdin and returns its output.
+func runWithInput(t *testing.T, in string, args ...string) (string, error) {
+	out := &bytes.Buffer{}
+	cmd := newRootCommand()
+	cmd.SetArgs(args)
+	cmd.SetIn(strings.NewReader(in))
+	cmd.SetOut(out)
+	cmd.SetErr(&bytes.Buffer{})
+	err := cmd.Execute()
+	return out.String(), err
+}
+
+// Buffer safe to read while watch writes to it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestCLI(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := service.StartGrpcServer(ctx, grpcAddr, db.NewMemoryRepositories(),
+		service.Options{EventBus: events.Config{Driver: "memory"}})
+	require.NoError(t, err)
+	defer server.Stop()
+
+	out, err := run(t, "healthcheck", "--addr", grpcAddr)
+	require.NoError(t, err)
+	require.Equal(t, "SERVING\n", out)
+
+	// Watch prints changes as JSON lines
+	watchOut := &syncBuffer{}
+	watchCtx, stopWatch := context.WithCancel(context.Background())
+	watchDone := make(chan error)
+	go func() {
+		watchDone <- watch(watchCtx, &clientFlags{addr: grpcAddr}, watchOut)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	// Password is read from stdin instead of arguments
+	_, err = runWithInput(t, "\n", "user", "add", "--addr", grpcAddr, "--email", "cli@email.com", "--password-stdin")
+	require.ErrorContains(t, err, "password read from stdin is empty")
+	out, err = runWithInput(t, "s3cret\n", "user", "add", "--addr", grpcAddr, "--email", "cli@email.com", "--first-name", "Cli", "--country", "LV", "--password-stdin")
+	require.NoError(t, err)
+	user := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(out), &user))
+	require.Equal(t, "cli@email.com", user["email"])
+	require.Equal(t, "Cli", user["first_name"])
+	require.Equal(t, "s3cret", user["password"])
+	id := user["id"].(string)
+
+	// Modify changes only fields set by flags
+	out, err = run(t, "user", "modify", id, "--addr", grpcAddr, "--last-name", "Tool")
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal([]byte(out), &user))
+	require.Equal(t, "Cli", user["first_name"])
+	require.Equal(t, "Tool", user["last_name"])
+
+	out, err = run(t, "user", "get", id, "--addr", grpcAddr)
+	require.NoError(t, err)
+	require.Contains(t, out, `"last_name":"Tool"`)
+
+	out, err = run(t, "user", "list", "--addr", grpcAddr, "--country", "LV", "--limit", "1")
+	require.NoError(t, err)
+	list := struct{ Users []map[string]interface{} }{}
+	require.NoError(t, json.Unmarshal([]byte(out), &list))
+	require.Len(t, list.Users, 1)
+
+	// Export holds the user and its audit trail, erase anonymizes them
+	out, err = run(t, "user", "export", id, "--addr", grpcAddr)
+	require.NoError(t, err)
+	export := struct {
+		User        map[string]interface{}
+		AuditEvents []map[string]interface{} `json:"audit_events"`
+	}{}
+	require.NoError(t, json.Unmarshal([]byte(out), &export))
+	require.Equal(t, "cli@email.com", export.User["email"])
+	require.Len(t, export.AuditEvents, 2)
+	_, err = run(t, "user", "erase", id, "--addr", grpcAddr)
+	require.NoError(t, err)
+	out, err = run(t, "user", "get", id, "--addr", grpcAddr)
+	require.NoError(t, err)
+	require.Contains(t, out, `"first_name":""`)
+
+	_, err = run(t, "user", "remove", id, "--addr", grpcAddr)
+	require.NoError(t, err)
+	_, err = run(t, "user", "get", id, "--addr", grpcAddr)
+	require.ErrorContains(t, err, "NotFound")
+
+	require.Eventually(t, func() bool {
+		return strings.Count(watchOut.String(), "\n") == 4
+	}, time.Second, 10*time.Millisecond)
+	stopWatch()
+	require.NoError(t, <-watchDone)
+	lines := strings.Split(strings.TrimSpace(watchOut.String()), "\n")
+	require.Contains(t, lines[0], `"method":"CREATE"`)
+	require.Contains(t, lines[1], `"method":"UPDATE"`)
+	require.Contains(t, lines[2], `"method":"ERASE"`)
+	require.Contains(t, lines[3], `"method":"DELETE"`)
+}
+
+func TestMigrateMemory(t *testing.T) {
+	_, err := run(t, "migrate", "status", "--database.connection-string", "memory://")
+	require.ErrorContains(t, err, "in-memory storage does not need migrations")
+
+	_, err = run(t, "user", "get")
+	require.ErrorContains(t, err, "accepts 1 arg")
+}
+
+func TestKeys(t *testing.T) {
+	dir := t.TempDir()
+	keyring := "--encryption.keyring-file=" + filepath.Join(dir, "keyring.json")
+	database := "--database.connection-string=sqlite://" + filepath.Join(dir, "users.db")
+
+	out, err := run(t, "keys", "add", keyring)
+	require.NoError(t, err)
+	require.Contains(t, out, "with key 1")
+
+	// Users stored before encryption was enabled are encrypted by rotate
+	_, err = run(t, "migrate", "up", database)
+	require.NoError(t, err)
+	gdb, err := db.Connect("sqlite://" + filepath.Join(dir, "users.db"))
+	require.NoError(t, err)
+	require.NoError(t, db.NewUserRepository(gdb).CreateUser(context.Background(), &models.User{Email: "john@email.com"}))
+	out, err = run(t, "keys", "rotate", keyring, database)
+	require.NoError(t, err)
+	require.Equal(t, "encrypted 1 users, 0 webhooks, 0 dead letters and 0 audit events with key 1\n", out)
+
+	out, err = run(t, "keys", "add", keyring)
+	require.NoError(t, err)
+	require.Contains(t, out, "added primary key 2")
+	out, err = run(t, "keys", "rotate", keyring, database)
+	require.NoError(t, err)
+	require.Equal(t, "encrypted 1 users, 0 webhooks, 0 dead letters and 0 audit events with key 2\n", out)
+
+	_, err = run(t, "keys", "rotate", database)
+	require.ErrorContains(t, err, "encryption.keyring_file is not configured")
+}
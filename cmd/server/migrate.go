@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/kroksys/user-service-example/pkg/config"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/spf13/cobra"
+)
+
+// Creates migrate command:
+//   - up applies all pending migrations
+//   - down rolls back the latest applied migration
+//   - status lists migrations and whether they are applied
+func newMigrateCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "migrate",
+		Short: "Apply, roll back or list database migrations",
+	}
+	flags := config.RegisterFlags(cmd.PersistentFlags())
+	actions := []struct{ name, short string }{
+		{"up", "Apply all pending migrations"},
+		{"down", "Roll back the latest applied migration"},
+		{"status", "List migrations and whether they are applied"},
+	}
+	for _, a := range actions {
+		action := a.name
+		cmd.AddCommand(&cobra.Command{
+			Use:   action,
+			Short: a.short,
+			Args:  cobra.NoArgs,
+			RunE: func(cmd *cobra.Command, args []string) error {
+				cfg, err := flags.Load()
+				if err != nil {
+					return err
+				}
+				return migrate(cmd.Context(), cfg.Database.ConnectionString, action, cmd.OutOrStdout())
+			},
+		})
+	}
+	return cmd
+}
+
+// Runs migration action and writes applied changes to w.
+func migrate(ctx context.Context, connectionString, action string, w io.Writer) error {
+	if strings.HasPrefix(connectionString, db.MemoryConnectionString) {
+		return fmt.Errorf("in-memory storage does not need migrations")
+	}
+
+	database, err := db.Connect(connectionString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %v", err)
+	}
+	if sqlDB, err := database.DB(); err == nil {
+		defer sqlDB.Close()
+	}
+	migrator, err := db.NewMigrator(database)
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		for _, m := range applied {
+			fmt.Fprintf(w, "applied %04d_%s\n", m.Version, m.Name)
+		}
+		if err != nil {
+			return err
+		}
+		if len(applied) == 0 {
+			fmt.Fprintln(w, "no pending migrations")
+		}
+	case "down":
+		m, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		if m == nil {
+			fmt.Fprintln(w, "no applied migrations")
+			return nil
+		}
+		fmt.Fprintf(w, "rolled back %04d_%s\n", m.Version, m.Name)
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range status {
+			state := "pending"
+			if s.Applied {
+				state = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Fprintf(w, "%04d_%-30s %s\n", s.Version, s.Name, state)
+		}
+	default:
+		return fmt.Errorf("unknown migrate action %q", action)
+	}
+	return nil
+}
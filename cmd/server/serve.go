@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/config"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/service"
+	"github.com/kroksys/user-service-example/pkg/tracing"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/spf13/cobra"
+)
+
+// Creates serve command starting gRPC and HTTP servers.
+func newServeCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Start gRPC and HTTP servers",
+		Args:  cobra.NoArgs,
+	}
+	flags := config.RegisterFlags(cmd.Flags())
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		cfg, err := flags.Load()
+		if err != nil {
+			return err
+		}
+		return serve(cfg)
+	}
+	return cmd
+}
+
+// Starts servers and blocks until SIGINT or SIGTERM shuts them down.
+func serve(cfg config.Config) error {
+	// Structured logs are written to stderr
+	if err := logging.Setup(os.Stderr, cfg.LoggingConfig()); err != nil {
+		return err
+	}
+
+	// Spans are exported until the server stops
+	stopTracing, err := tracing.Setup(context.Background(), cfg.TracingConfig())
+	if err != nil {
+		slog.Error("error setting up tracing", "error", err)
+		return err
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+		defer cancel()
+		if err := stopTracing(ctx); err != nil {
+			slog.Error("error flushing traces", "error", err)
+		}
+	}()
+
+	// Connect to database and migrate models.
+	// "memory://" keeps data in memory and does not need a database.
+	// Personal data of users is encrypted when keyring is configured.
+	dbOpts := cfg.DatabaseOptions()
+	if dbOpts.Keyring, err = cfg.Keyring(); err != nil {
+		slog.Error("error loading keyring", "error", err)
+		return err
+	}
+	repos, err := db.Open(cfg.Database.ConnectionString, dbOpts)
+	if err != nil {
+		slog.Error("error opening database", "error", err)
+		return err
+	}
+	// Closed after servers are shut down or when they fail to start
+	defer func() {
+		if err := repos.Close(); err != nil {
+			slog.Error("error closing database", "error", err)
+		}
+	}()
+	if err := repos.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+		slog.Error("error registering database metrics", "error", err)
+	}
+
+	// Context for both servers, canceled after they are shut down
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Start grpc server
+	slog.Info("starting gRPC server", "addr", cfg.Server.GRPCAddr)
+	grpcServer, err := service.StartGrpcServer(ctx, cfg.Server.GRPCAddr, repos, cfg.ServiceOptions())
+	if err != nil {
+		slog.Error("error starting gRPC server", "error", err)
+		return err
+	}
+
+	// Start HTTP server
+	slog.Info("starting HTTP server", "addr", cfg.Server.HTTPAddr)
+	httpServer, err := service.StartHTTPServer(ctx, cfg.Server.HTTPAddr, cfg.Server.GRPCAddr, cfg.ServiceOptions())
+	if err != nil {
+		slog.Error("error starting HTTP server", "error", err)
+		grpcServer.Stop()
+		return err
+	}
+
+	// Wait for SIGINT or SIGTERM. Second signal stops the process immediately.
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	<-signalCtx.Done()
+	stopSignals()
+
+	shutdown(cfg, grpcServer, httpServer)
+	slog.Info("server stopped")
+	return nil
+}
+
+// Stops servers in order so no request is lost:
+//  1. health status is set to NOT_SERVING and load balancers are given
+//     drain delay to stop sending new requests
+//  2. Watch streams are closed
+//  3. HTTP server finishes proxied requests
+//  4. grpc server finishes running requests, event bus is closed
+//
+// Database connections are closed by the caller after that. Servers are
+// stopped forcefully when shutdown timeout expires.
+func shutdown(cfg config.Config, grpcServer *service.Server, httpServer *http.Server) {
+	slog.Info("shutting down")
+	grpcServer.SetNotServing()
+	if cfg.Server.DrainDelay > 0 {
+		slog.Info("waiting for load balancers to stop sending requests", "drain_delay", cfg.Server.DrainDelay)
+		time.Sleep(cfg.Server.DrainDelay)
+	}
+	grpcServer.CloseWatchStreams()
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+	if err := httpServer.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down HTTP server", "error", err)
+	}
+	if err := grpcServer.Shutdown(ctx); err != nil {
+		slog.Error("error shutting down gRPC server", "error", err)
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"strings"
+
+	"github.com/kroksys/user-service-example/pkg/client"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/protobuf/proto"
+)
+
+// Creates user command managing users through the gRPC API:
+//   - add creates a user
+//   - get prints a user by id
+//   - list prints users filtered by country
+//   - modify updates fields set by flags
+//   - remove deletes a user by id
+//   - export prints all data stored about a user
+//   - erase anonymizes personal data of a user
+func newUserCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "user",
+		Short: "Manage users through the gRPC API",
+	}
+	api := addClientFlags(cmd)
+	cmd.AddCommand(
+		newUserAddCommand(api),
+		newUserGetCommand(api),
+		newUserListCommand(api),
+		newUserModifyCommand(api),
+		newUserRemoveCommand(api),
+		newUserExportCommand(api),
+		newUserEraseCommand(api),
+	)
+	return cmd
+}
+
+// User fields settable by add and modify commands. Password is read from
+// stdin, so it does not show up in the process list and shell history.
+type userFlags struct {
+	firstName, lastName, nickname, email, country string
+	passwordStdin                                 bool
+}
+
+func addUserFlags(cmd *cobra.Command) *userFlags {
+	f := &userFlags{}
+	cmd.Flags().StringVar(&f.firstName, "first-name", "", "first name")
+	cmd.Flags().StringVar(&f.lastName, "last-name", "", "last name")
+	cmd.Flags().StringVar(&f.nickname, "nickname", "", "nickname")
+	cmd.Flags().BoolVar(&f.passwordStdin, "password-stdin", false, "read password from the first line of stdin")
+	cmd.Flags().StringVar(&f.email, "email", "", "email")
+	cmd.Flags().StringVar(&f.country, "country", "", "country code")
+	return f
+}
+
+// Reads password from the first line of r.
+func readPassword(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", errors.New("password read from stdin is empty")
+	}
+	return password, nil
+}
+
+// Fills add request with user flags.
+func (f *userFlags) addRequest(cmd *cobra.Command) (*pb.AddUserRequest, error) {
+	req := &pb.AddUserRequest{
+		FirstName: f.firstName,
+		LastName:  f.lastName,
+		Nickname:  f.nickname,
+		Email:     f.email,
+		Country:   f.country,
+	}
+	if f.passwordStdin {
+		password, err := readPassword(cmd.InOrStdin())
+		if err != nil {
+			return nil, err
+		}
+		req.Password = password
+	}
+	return req, nil
+}
+
+// Fills modify request with user flags set on the command line, so
+// omitted fields are left unchanged.
+func (f *userFlags) modifyRequest(cmd *cobra.Command, id string) (*pb.ModifyUserRequest, error) {
+	req := &pb.ModifyUserRequest{Id: id}
+	changed := func(name string, value string, field **string) {
+		if cmd.Flags().Changed(name) {
+			v := value
+			*field = &v
+		}
+	}
+	changed("first-name", f.firstName, &req.FirstName)
+	changed("last-name", f.lastName, &req.LastName)
+	changed("nickname", f.nickname, &req.Nickname)
+	changed("email", f.email, &req.Email)
+	changed("country", f.country, &req.Country)
+	if f.passwordStdin {
+		password, err := readPassword(cmd.InOrStdin())
+		if err != nil {
+			return nil, err
+		}
+		req.Password = &password
+	}
+	return req, nil
+}
+
+func newUserAddCommand(api *clientFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "add",
+		Short: "Create a user",
+		Args:  cobra.NoArgs,
+	}
+	user := addUserFlags(cmd)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		req, err := user.addRequest(cmd)
+		if err != nil {
+			return err
+		}
+		return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+			return c.AddUser(ctx, req)
+		})
+	}
+	return cmd
+}
+
+func newUserGetCommand(api *clientFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "get <id>",
+		Short: "Print a user",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+				return c.GetUser(ctx, &pb.GetUserRequest{Id: args[0]})
+			})
+		},
+	}
+}
+
+func newUserListCommand(api *clientFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "list",
+		Short: "Print users",
+		Args:  cobra.NoArgs,
+	}
+	country := cmd.Flags().String("country", "", "only users from country")
+	limit := cmd.Flags().Int32("limit", 0, "maximum number of users, server default when not set")
+	offset := cmd.Flags().Int32("offset", 0, "number of users to skip")
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		req := &pb.ListUsersRequest{Country: *country}
+		if cmd.Flags().Changed("limit") {
+			req.Limit = limit
+		}
+		if cmd.Flags().Changed("offset") {
+			req.Offset = offset
+		}
+		return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+			return c.ListUsers(ctx, req)
+		})
+	}
+	return cmd
+}
+
+func newUserModifyCommand(api *clientFlags) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "modify <id>",
+		Short: "Update user fields set by flags",
+		Args:  cobra.ExactArgs(1),
+	}
+	user := addUserFlags(cmd)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		req, err := user.modifyRequest(cmd, args[0])
+		if err != nil {
+			return err
+		}
+		return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+			return c.ModifyUser(ctx, req)
+		})
+	}
+	return cmd
+}
+
+func newUserRemoveCommand(api *clientFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "remove <id>",
+		Short: "Delete a user",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+				return c.RemoveUser(ctx, &pb.RemoveUserRequest{Id: args[0]})
+			})
+		},
+	}
+}
+
+func newUserExportCommand(api *clientFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "export <id>",
+		Short: "Print all data stored about a user, including audit events",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+				return c.UserData(ctx, args[0])
+			})
+		},
+	}
+}
+
+func newUserEraseCommand(api *clientFlags) *cobra.Command {
+	return &cobra.Command{
+		Use:   "erase <id>",
+		Short: "Anonymize personal data of a user and its audit events",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return callUserService(cmd, api, func(ctx context.Context, c *client.Client) (proto.Message, error) {
+				return c.EraseUser(ctx, &pb.EraseUserRequest{Id: args[0]})
+			})
+		},
+	}
+}
+
+// Connects to the server, runs call and prints its response as JSON.
+// Idempotent calls are retried on temporary errors.
+func callUserService(cmd *cobra.Command, api *clientFlags, call func(context.Context, *client.Client) (proto.Message, error)) error {
+	ctx, cancel := api.context(cmd.Context())
+	defer cancel()
+	conn, err := api.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	resp, err := call(ctx, client.New(conn, client.DefaultOptions()))
+	if err != nil {
+		return rpcError(err)
+	}
+	return printJSON(cmd.OutOrStdout(), resp)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/spf13/cobra"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Creates watch command writing user changes to stdout as JSON lines
+// until interrupted or the server closes the stream.
+func newWatchCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "watch",
+		Short: "Print user changes as JSON lines",
+		Args:  cobra.NoArgs,
+	}
+	api := addClientFlags(cmd)
+	cmd.RunE = func(cmd *cobra.Command, args []string) error {
+		ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		return watch(ctx, api, cmd.OutOrStdout())
+	}
+	return cmd
+}
+
+// Streams changes to w. Timeout applies only to connecting, the stream
+// stays open until ctx is done.
+func watch(ctx context.Context, api *clientFlags, w io.Writer) error {
+	dialCtx, cancel := api.context(ctx)
+	defer cancel()
+	conn, err := api.dial(dialCtx, grpc.WithBlock())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewUserServiceClient(conn).Watch(ctx, &pb.WatchRequest{})
+	if err != nil {
+		return rpcError(err)
+	}
+	for {
+		resp, err := stream.Recv()
+		if errors.Is(err, io.EOF) || status.Code(err) == codes.Canceled && ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return rpcError(err)
+		}
+		if err := printJSON(w, resp); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,59 @@
+// Package cache keeps results of user reads in Redis or memory. Cached
+// entries are removed when users change and expire after TTL, which
+// limits how long a missed change can be served.
+package cache
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Default time cached entries are kept.
+const (
+	DefaultTTL     = 5 * time.Minute
+	DefaultListTTL = 30 * time.Second
+)
+
+// Hits, misses and errors of the cache exposed at /metrics.
+var (
+	cacheRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "cache_requests_total",
+		Help:      "Cached reads by operation (get or list) and result (hit or miss).",
+	}, []string{"operation", "result"})
+
+	cacheErrors = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "cache_errors_total",
+		Help:      "Failed cache store operations, reads fall back to the database.",
+	})
+)
+
+// Returned by Store.Get when key is not cached.
+var ErrMiss = errors.New("cache: miss")
+
+// Storage of cached values.
+type Store interface {
+	// Returns value of the key or ErrMiss.
+	Get(ctx context.Context, key string) ([]byte, error)
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	Delete(ctx context.Context, keys ...string) error
+	// Increments number stored at key, missing key is 0.
+	Incr(ctx context.Context, key string) (int64, error)
+	Close() error
+}
+
+// Config used to select and configure the cache.
+type Config struct {
+	// Driver name: redis or memory. Cache is disabled when empty.
+	Driver string
+
+	// Time users and lists of users are cached. DefaultTTL and
+	// DefaultListTTL when zero.
+	TTL     time.Duration
+	ListTTL time.Duration
+}
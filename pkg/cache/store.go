@@ -0,0 +1,124 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// Prefix of keys written to redis.
+const redisKeyPrefix = "userservice:cache:"
+
+// Store keeping values in redis, shared by all instances of the service.
+type RedisStore struct {
+	client *redis.Client
+	shared bool
+}
+
+// Creates store using redis client. Client is closed by Close.
+func NewRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client}
+}
+
+// Creates store using redis client owned by someone else, e.g. the event
+// bus. Client is left open by Close.
+func NewSharedRedisStore(client *redis.Client) *RedisStore {
+	return &RedisStore{client: client, shared: true}
+}
+
+func (s *RedisStore) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := s.client.Get(ctx, redisKeyPrefix+key).Bytes()
+	if err == redis.Nil {
+		return nil, ErrMiss
+	}
+	return value, err
+}
+
+func (s *RedisStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return s.client.Set(ctx, redisKeyPrefix+key, value, ttl).Err()
+}
+
+func (s *RedisStore) Delete(ctx context.Context, keys ...string) error {
+	prefixed := make([]string, len(keys))
+	for i, key := range keys {
+		prefixed[i] = redisKeyPrefix + key
+	}
+	return s.client.Del(ctx, prefixed...).Err()
+}
+
+func (s *RedisStore) Incr(ctx context.Context, key string) (int64, error) {
+	return s.client.Incr(ctx, redisKeyPrefix+key).Result()
+}
+
+func (s *RedisStore) Close() error {
+	if s.shared {
+		return nil
+	}
+	return s.client.Close()
+}
+
+// Store keeping values in memory of a single instance. Expired values are
+// removed when read.
+type MemoryStore struct {
+	mu      sync.Mutex
+	entries map[string]memoryEntry
+}
+
+type memoryEntry struct {
+	value   []byte
+	expires time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: map[string]memoryEntry{}}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, key string) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[key]
+	if !ok {
+		return nil, ErrMiss
+	}
+	if !e.expires.IsZero() && time.Now().After(e.expires) {
+		delete(s.entries, key)
+		return nil, ErrMiss
+	}
+	return e.value, nil
+}
+
+func (s *MemoryStore) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := memoryEntry{value: value}
+	if ttl > 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	s.entries[key] = e
+	return nil
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, keys ...string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, key := range keys {
+		delete(s.entries, key)
+	}
+	return nil
+}
+
+func (s *MemoryStore) Incr(ctx context.Context, key string) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n, _ := strconv.ParseInt(string(s.entries[key].value), 10, 64)
+	n++
+	s.entries[key] = memoryEntry{value: []byte(strconv.FormatInt(n, 10))}
+	return n, nil
+}
+
+func (s *MemoryStore) Close() error {
+	return nil
+}
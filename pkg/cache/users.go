@@ -0,0 +1,274 @@
+package cache
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"golang.org/x/sync/singleflight"
+)
+
+// Number incremented on every change of users. It is part of keys of
+// cached lists, so a change makes all cached lists unreachable.
+const listGenerationKey = "users:list:generation"
+
+// Delay before subscribing again after invalidation subscription ended.
+const resubscribeDelay = time.Second
+
+// Time limit of loading a missed key. Loads are shared by concurrent
+// misses, so they are not canceled together with the request that
+// started them.
+const loadTimeout = 5 * time.Second
+
+// User repository caching GetUser and ListUsers results. Concurrent
+// misses of the same key load it from the primary database once, so
+// changes are not cached again from a lagging replica. Passwords are not
+// cached, users read through the cache have empty Password like responses
+// of the service. Writes and Primary go to the wrapped repository.
+type Users struct {
+	db.UserRepository
+
+	store   Store
+	ttl     time.Duration
+	listTTL time.Duration
+	group   singleflight.Group
+}
+
+// Wraps repo with cache kept in store.
+func NewUsers(repo db.UserRepository, store Store, cfg Config) *Users {
+	if cfg.TTL == 0 {
+		cfg.TTL = DefaultTTL
+	}
+	if cfg.ListTTL == 0 {
+		cfg.ListTTL = DefaultListTTL
+	}
+	return &Users{UserRepository: repo, store: store, ttl: cfg.TTL, listTTL: cfg.ListTTL}
+}
+
+func userKey(id string) string {
+	return "users:" + id
+}
+
+func (u *Users) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	key := userKey(id.String())
+	user := &models.User{}
+	if u.get(ctx, key, user) {
+		cacheRequests.WithLabelValues("get", "hit").Inc()
+		return user, nil
+	}
+	cacheRequests.WithLabelValues("get", "miss").Inc()
+
+	v, err := u.load(ctx, key, func(ctx context.Context) (interface{}, error) {
+		user, err := u.UserRepository.Primary().GetUser(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		user.Password = ""
+		u.set(ctx, key, user, u.ttl)
+		return *user, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Callers sharing the load get their own copy
+	loaded := v.(models.User)
+	return &loaded, nil
+}
+
+func (u *Users) ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
+	generation, err := u.store.Get(ctx, listGenerationKey)
+	if err != nil && err != ErrMiss {
+		u.logError("reading list generation", err)
+		return u.UserRepository.ListUsers(ctx, limit, offset, country)
+	}
+	key := fmt.Sprintf("users:list:%s:%d:%d:%s", generation, limit, offset, country)
+	users := []models.User{}
+	if u.get(ctx, key, &users) {
+		cacheRequests.WithLabelValues("list", "hit").Inc()
+		return users, nil
+	}
+	cacheRequests.WithLabelValues("list", "miss").Inc()
+
+	v, err := u.load(ctx, key, func(ctx context.Context) (interface{}, error) {
+		users, err := u.UserRepository.Primary().ListUsers(ctx, limit, offset, country)
+		if err != nil {
+			return nil, err
+		}
+		for i := range users {
+			users[i].Password = ""
+		}
+		u.set(ctx, key, users, u.listTTL)
+		return users, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return append([]models.User{}, v.([]models.User)...), nil
+}
+
+func (u *Users) CreateUser(ctx context.Context, user *models.User) error {
+	if err := u.UserRepository.CreateUser(ctx, user); err != nil {
+		return err
+	}
+	u.Invalidate(ctx, user.ID.String())
+	return nil
+}
+
+func (u *Users) UpdateUser(ctx context.Context, user *models.User) error {
+	if err := u.UserRepository.UpdateUser(ctx, user); err != nil {
+		return err
+	}
+	u.Invalidate(ctx, user.ID.String())
+	return nil
+}
+
+func (u *Users) UpdateUserByMap(ctx context.Context, user *models.User, m map[string]interface{}) error {
+	if err := u.UserRepository.UpdateUserByMap(ctx, user, m); err != nil {
+		return err
+	}
+	u.Invalidate(ctx, user.ID.String())
+	return nil
+}
+
+func (u *Users) DeleteUser(ctx context.Context, userId uuid.UUID) error {
+	if err := u.UserRepository.DeleteUser(ctx, userId); err != nil {
+		return err
+	}
+	u.Invalidate(ctx, userId.String())
+	return nil
+}
+
+func (u *Users) UpdateUserByMapReturning(ctx context.Context, id uuid.UUID, m map[string]interface{}) (*models.User, *models.User, error) {
+	before, after, err := u.UserRepository.UpdateUserByMapReturning(ctx, id, m)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Invalidate(ctx, id.String())
+	return before, after, nil
+}
+
+func (u *Users) DeleteUserReturning(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	deleted, err := u.UserRepository.DeleteUserReturning(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	u.Invalidate(ctx, id.String())
+	return deleted, nil
+}
+
+func (u *Users) EraseUserReturning(ctx context.Context, id uuid.UUID, event *models.AuditEvent) (*models.User, *models.User, error) {
+	before, after, err := u.UserRepository.EraseUserReturning(ctx, id, event)
+	if err != nil {
+		return nil, nil, err
+	}
+	u.Invalidate(ctx, id.String())
+	return before, after, nil
+}
+
+// Removes cached user and all cached lists.
+func (u *Users) Invalidate(ctx context.Context, id string) {
+	if err := u.store.Delete(ctx, userKey(id)); err != nil {
+		u.logError("deleting user", err)
+	}
+	if _, err := u.store.Incr(ctx, listGenerationKey); err != nil {
+		u.logError("invalidating lists", err)
+	}
+}
+
+// Invalidates users changed by any instance of the service until ctx is
+// done or subscriber is closed. Subscribers buffering events disconnect
+// the cache instead of dropping events, whatever their overflow policy.
+// Subscription that ended because events were dropped is renewed after
+// invalidating all lists, users changed in the meantime are served from
+// the cache until they expire.
+func (u *Users) Watch(ctx context.Context, subscriber events.EventSubscriber) {
+	for {
+		sub, err := subscribe(ctx, subscriber)
+		if err != nil {
+			if ctx.Err() == nil && err != events.ErrBufferClosed {
+				u.logError("subscribing to user changes", err)
+			}
+			return
+		}
+		for event := range sub.Events() {
+			u.Invalidate(ctx, event.GetUser().GetId())
+		}
+		err = sub.Err()
+		sub.Close()
+		if ctx.Err() != nil || err == nil {
+			return
+		}
+		slog.Warn("cache: user changes subscription ended", "error", err)
+		if _, err := u.store.Incr(ctx, listGenerationKey); err != nil {
+			u.logError("invalidating lists", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(resubscribeDelay):
+		}
+	}
+}
+
+// Subscribes with Disconnect overflow policy when subscriber supports it.
+func subscribe(ctx context.Context, subscriber events.EventSubscriber) (events.Subscription, error) {
+	if ps, ok := subscriber.(events.PolicySubscriber); ok {
+		return ps.SubscribeWithPolicy(ctx, events.Disconnect)
+	}
+	return subscriber.Subscribe(ctx)
+}
+
+// Loads missed key once for concurrent callers. Load runs without
+// cancellation of the caller that started it and with its own time limit,
+// every caller stops waiting when its own ctx is done.
+func (u *Users) load(ctx context.Context, key string, load func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+	result := u.group.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), loadTimeout)
+		defer cancel()
+		return load(ctx)
+	})
+	select {
+	case r := <-result:
+		return r.Val, r.Err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Reads cached value into v. Returns false on miss or error.
+func (u *Users) get(ctx context.Context, key string, v interface{}) bool {
+	data, err := u.store.Get(ctx, key)
+	if err == ErrMiss {
+		return false
+	}
+	if err == nil {
+		err = json.Unmarshal(data, v)
+	}
+	if err != nil {
+		u.logError("reading "+key, err)
+		return false
+	}
+	return true
+}
+
+// Caches value. Errors are logged, value is loaded again next time.
+func (u *Users) set(ctx context.Context, key string, v interface{}, ttl time.Duration) {
+	data, err := json.Marshal(v)
+	if err == nil {
+		err = u.store.Set(ctx, key, data, ttl)
+	}
+	if err != nil {
+		u.logError("writing "+key, err)
+	}
+}
+
+func (u *Users) logError(action string, err error) {
+	cacheErrors.Inc()
+	slog.Error("cache: error "+action, "error", err)
+}
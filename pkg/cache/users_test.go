@@ -0,0 +1,204 @@
+package cache
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts reads reaching the repository. Reads wait for release when it
+// is set.
+type countingUsers struct {
+	db.UserRepository
+	gets, lists int32
+	release     chan struct{}
+}
+
+func (r *countingUsers) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	atomic.AddInt32(&r.gets, 1)
+	if r.release != nil {
+		<-r.release
+	}
+	return r.UserRepository.GetUser(ctx, id)
+}
+
+func (r *countingUsers) ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
+	atomic.AddInt32(&r.lists, 1)
+	return r.UserRepository.ListUsers(ctx, limit, offset, country)
+}
+
+// Reads from primary are counted too.
+func (r *countingUsers) Primary() db.UserRepository {
+	return r
+}
+
+// Records overflow policy requested by the subscriber.
+type policySubscriber struct {
+	events.EventSubscriber
+	policy events.OverflowPolicy
+}
+
+func (s *policySubscriber) SubscribeWithPolicy(ctx context.Context, policy events.OverflowPolicy) (events.Subscription, error) {
+	s.policy = policy
+	return s.Subscribe(ctx)
+}
+
+func newTestUsers(t *testing.T, cfg Config) (*Users, *countingUsers) {
+	repo := &countingUsers{UserRepository: db.NewMemoryUserRepository()}
+	return NewUsers(repo, NewMemoryStore(), cfg), repo
+}
+
+func TestUsers(t *testing.T) {
+	ctx := context.Background()
+	users, repo := newTestUsers(t, Config{})
+
+	user := &models.User{Email: "john@email.com", Country: "LV"}
+	require.NoError(t, users.CreateUser(ctx, user))
+
+	// Second read is served from cache
+	for i := 0; i < 2; i++ {
+		cached, err := users.GetUser(ctx, user.ID)
+		require.NoError(t, err)
+		require.Equal(t, "john@email.com", cached.Email)
+
+		list, err := users.ListUsers(ctx, 10, 0, "LV")
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+	}
+	require.Equal(t, int32(1), repo.gets)
+	require.Equal(t, int32(1), repo.lists)
+
+	// Writes invalidate user and lists
+	require.NoError(t, users.UpdateUserByMap(ctx, user, map[string]interface{}{"country": "EE"}))
+	cached, err := users.GetUser(ctx, user.ID)
+	require.NoError(t, err)
+	require.Equal(t, "EE", cached.Country)
+	list, err := users.ListUsers(ctx, 10, 0, "LV")
+	require.NoError(t, err)
+	require.Empty(t, list)
+	require.Equal(t, int32(2), repo.gets)
+	require.Equal(t, int32(2), repo.lists)
+
+	// Missing users are not cached
+	require.NoError(t, users.DeleteUser(ctx, user.ID))
+	_, err = users.GetUser(ctx, user.ID)
+	require.ErrorIs(t, err, db.ErrNotFound)
+	_, err = users.GetUser(ctx, user.ID)
+	require.ErrorIs(t, err, db.ErrNotFound)
+	require.Equal(t, int32(4), repo.gets)
+}
+
+func TestUsersSingleflight(t *testing.T) {
+	ctx := context.Background()
+	users, repo := newTestUsers(t, Config{})
+	user := &models.User{Email: "john@email.com"}
+	require.NoError(t, users.CreateUser(ctx, user))
+
+	repo.release = make(chan struct{})
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			cached, err := users.GetUser(ctx, user.ID)
+			require.NoError(t, err)
+			require.Equal(t, user.ID, cached.ID)
+		}()
+	}
+	// Concurrent misses wait for a single load
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&repo.gets) == 1 }, time.Second, time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	close(repo.release)
+	wg.Wait()
+	require.Equal(t, int32(1), repo.gets)
+}
+
+func TestUsersCanceledLoad(t *testing.T) {
+	users, repo := newTestUsers(t, Config{})
+	user := &models.User{Email: "john@email.com", Password: "secret"}
+	require.NoError(t, users.CreateUser(context.Background(), user))
+	repo.release = make(chan struct{})
+
+	// Caller that started the load stops waiting when it cancels
+	ctx, cancel := context.WithCancel(context.Background())
+	canceled := make(chan error)
+	go func() {
+		_, err := users.GetUser(ctx, user.ID)
+		canceled <- err
+	}()
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&repo.gets) == 1 }, time.Second, time.Millisecond)
+	waiting := make(chan error)
+	go func() {
+		_, err := users.GetUser(context.Background(), user.ID)
+		waiting <- err
+	}()
+	cancel()
+	require.ErrorIs(t, <-canceled, context.Canceled)
+
+	// Other callers get the loaded user
+	close(repo.release)
+	require.NoError(t, <-waiting)
+	require.Equal(t, int32(1), repo.gets)
+
+	// Password is not cached
+	cached, err := users.GetUser(context.Background(), user.ID)
+	require.NoError(t, err)
+	require.Equal(t, "john@email.com", cached.Email)
+	require.Empty(t, cached.Password)
+	data, err := users.store.Get(context.Background(), userKey(user.ID.String()))
+	require.NoError(t, err)
+	require.NotContains(t, string(data), "secret")
+}
+
+func TestUsersTTL(t *testing.T) {
+	ctx := context.Background()
+	users, repo := newTestUsers(t, Config{ListTTL: 10 * time.Millisecond})
+
+	_, err := users.ListUsers(ctx, 10, 0, "")
+	require.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	_, err = users.ListUsers(ctx, 10, 0, "")
+	require.NoError(t, err)
+	require.Equal(t, int32(2), repo.lists)
+}
+
+func TestUsersWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	users, repo := newTestUsers(t, Config{})
+	user := &models.User{Email: "john@email.com"}
+	require.NoError(t, users.CreateUser(ctx, user))
+	_, err := users.GetUser(ctx, user.ID)
+	require.NoError(t, err)
+
+	bus := events.NewMemoryBus()
+	defer bus.Close()
+	subscriber := &policySubscriber{EventSubscriber: bus}
+	done := make(chan struct{})
+	go func() {
+		users.Watch(ctx, subscriber)
+		close(done)
+	}()
+
+	// User changed by another instance is invalidated by its event
+	require.NoError(t, repo.UserRepository.UpdateUserByMap(ctx, user, map[string]interface{}{"nickname": "johnny"}))
+	require.Eventually(t, func() bool {
+		bus.Publish(ctx, &pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: user.ToUserResponse()})
+		cached, err := users.GetUser(ctx, user.ID)
+		return err == nil && cached.Nickname == "johnny"
+	}, time.Second, 10*time.Millisecond)
+
+	cancel()
+	<-done
+	// Dropped events would leave changed users cached
+	require.Equal(t, events.Disconnect, subscriber.policy)
+}
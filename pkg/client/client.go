@@ -0,0 +1,224 @@
+// Package client is a Go client of the user service. It wraps generated
+// pb.UserServiceClient with retries of read-only calls, pagination over
+// ListUsers and a Watch iterator that reconnects after errors.
+package client
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Defaults used for zero Options fields.
+const (
+	DefaultRetryBackoff    = 100 * time.Millisecond
+	DefaultMaxRetryBackoff = 5 * time.Second
+	DefaultPageSize        = 100
+)
+
+// Header with time of the client's last write in unix milliseconds. Server
+// reads from the primary database when it is recent.
+const LastWriteHeader = "x-last-write"
+
+// Client options.
+type Options struct {
+	// Options of the connection made by Dial. Connection is not encrypted
+	// when empty.
+	DialOptions []grpc.DialOption
+
+	// Number of times read-only calls are retried after Unavailable or
+	// Aborted errors, 0 disables retries. Delay between attempts starts at
+	// RetryBackoff and is doubled up to MaxRetryBackoff. Watch reconnects
+	// with the same delays.
+	MaxRetries      int
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Number of users requested by a single ListUsers call of UserIterator.
+	PageSize int32
+}
+
+// Default client options with 3 retries.
+func DefaultOptions() Options {
+	return Options{
+		MaxRetries:      3,
+		RetryBackoff:    DefaultRetryBackoff,
+		MaxRetryBackoff: DefaultMaxRetryBackoff,
+		PageSize:        DefaultPageSize,
+	}
+}
+
+// Client of the user service. Calls that are not retried are sent by
+// embedded generated client.
+type Client struct {
+	pb.UserServiceClient
+	conn *grpc.ClientConn
+	opts Options
+}
+
+// Connects to the user service at addr.
+func Dial(ctx context.Context, addr string, opts Options) (*Client, error) {
+	dialOpts := opts.DialOptions
+	if len(dialOpts) == 0 {
+		dialOpts = []grpc.DialOption{grpc.WithTransportCredentials(insecure.NewCredentials())}
+	}
+	conn, err := grpc.DialContext(ctx, addr, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to %s: %v", addr, err)
+	}
+	c := New(conn, opts)
+	c.conn = conn
+	return c, nil
+}
+
+// Creates client using existing connection. Close does not close it.
+func New(conn grpc.ClientConnInterface, opts Options) *Client {
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.MaxRetryBackoff <= 0 {
+		opts.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	if opts.PageSize <= 0 {
+		opts.PageSize = DefaultPageSize
+	}
+	return &Client{
+		UserServiceClient: pb.NewUserServiceClient(conn),
+		opts:              opts,
+	}
+}
+
+// Closes connection made by Dial.
+func (c *Client) Close() error {
+	if c.conn == nil {
+		return nil
+	}
+	return c.conn.Close()
+}
+
+// Returns context sending reads made with it to the primary database, so
+// they see all committed writes instead of lagging replicas.
+func PrimaryRead(ctx context.Context) context.Context {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	return metadata.AppendToOutgoingContext(ctx, LastWriteHeader, now)
+}
+
+// Returns a user, retried on temporary errors.
+func (c *Client) GetUser(ctx context.Context, in *pb.GetUserRequest, opts ...grpc.CallOption) (resp *pb.UserResponse, err error) {
+	err = c.retry(ctx, func() error {
+		resp, err = c.UserServiceClient.GetUser(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// Returns a page of users, retried on temporary errors. See Users for
+// iterating over all pages.
+func (c *Client) ListUsers(ctx context.Context, in *pb.ListUsersRequest, opts ...grpc.CallOption) (resp *pb.ListUsersResponse, err error) {
+	err = c.retry(ctx, func() error {
+		resp, err = c.UserServiceClient.ListUsers(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// Returns registered webhooks, retried on temporary errors.
+func (c *Client) ListWebhooks(ctx context.Context, in *pb.ListWebhooksRequest, opts ...grpc.CallOption) (resp *pb.ListWebhooksResponse, err error) {
+	err = c.retry(ctx, func() error {
+		resp, err = c.UserServiceClient.ListWebhooks(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// Returns audit events, retried on temporary errors.
+func (c *Client) ListAuditEvents(ctx context.Context, in *pb.ListAuditEventsRequest, opts ...grpc.CallOption) (resp *pb.ListAuditEventsResponse, err error) {
+	err = c.retry(ctx, func() error {
+		resp, err = c.UserServiceClient.ListAuditEvents(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// Returns JSON archive of all data of a user, retried on temporary
+// errors. UserData decodes it.
+func (c *Client) ExportUserData(ctx context.Context, in *pb.ExportUserDataRequest, opts ...grpc.CallOption) (resp *httpbody.HttpBody, err error) {
+	err = c.retry(ctx, func() error {
+		resp, err = c.UserServiceClient.ExportUserData(ctx, in, opts...)
+		return err
+	})
+	return resp, err
+}
+
+// Returns all data stored about the user, including its audit events.
+func (c *Client) UserData(ctx context.Context, id string) (*pb.UserDataExport, error) {
+	body, err := c.ExportUserData(ctx, &pb.ExportUserDataRequest{Id: id})
+	if err != nil {
+		return nil, err
+	}
+	export := &pb.UserDataExport{}
+	if err := protojson.Unmarshal(body.GetData(), export); err != nil {
+		return nil, fmt.Errorf("failed to decode user data: %v", err)
+	}
+	return export, nil
+}
+
+// Calls fn until it succeeds, fails with an error that is not temporary
+// or retries are used up.
+func (c *Client) retry(ctx context.Context, fn func() error) error {
+	b := c.newBackoff()
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= c.opts.MaxRetries || !temporary(err) {
+			return err
+		}
+		if !b.wait(ctx) {
+			return err
+		}
+	}
+}
+
+// Reports whether the call may succeed when repeated.
+func temporary(err error) bool {
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted:
+		return true
+	}
+	return false
+}
+
+// Exponential delay between attempts.
+type backoff struct {
+	next, max time.Duration
+}
+
+func (c *Client) newBackoff() *backoff {
+	return &backoff{next: c.opts.RetryBackoff, max: c.opts.MaxRetryBackoff}
+}
+
+// Sleeps the current delay and doubles it. Returns false when ctx is done
+// first.
+func (b *backoff) wait(ctx context.Context) bool {
+	timer := time.NewTimer(b.next)
+	defer timer.Stop()
+	b.next *= 2
+	if b.next > b.max {
+		b.next = b.max
+	}
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
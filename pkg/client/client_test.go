@@ -0,0 +1,228 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var grpcAddr = "localhost:1991"
+
+var testOptions = Options{
+	MaxRetries:      3,
+	RetryBackoff:    time.Millisecond,
+	MaxRetryBackoff: 10 * time.Millisecond,
+}
+
+// Fails calls with errors until they are used up.
+type flakyServer struct {
+	pb.UnimplementedUserServiceServer
+	mu      sync.Mutex
+	errs    []error
+	calls   int
+	watches int
+}
+
+func (s *flakyServer) nextErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if len(s.errs) == 0 {
+		return nil
+	}
+	err := s.errs[0]
+	s.errs = s.errs[1:]
+	return err
+}
+
+func (s *flakyServer) GetUser(ctx context.Context, in *pb.GetUserRequest) (*pb.UserResponse, error) {
+	if err := s.nextErr(); err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{Id: in.Id}, nil
+}
+
+func (s *flakyServer) ModifyUser(ctx context.Context, in *pb.ModifyUserRequest) (*pb.UserResponse, error) {
+	if err := s.nextErr(); err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{Id: in.Id}, nil
+}
+
+func (s *flakyServer) EraseUser(ctx context.Context, in *pb.EraseUserRequest) (*pb.EraseUserResponse, error) {
+	if err := s.nextErr(); err != nil {
+		return nil, err
+	}
+	return &pb.EraseUserResponse{}, nil
+}
+
+func (s *flakyServer) AddUser(ctx context.Context, in *pb.AddUserRequest) (*pb.UserResponse, error) {
+	if err := s.nextErr(); err != nil {
+		return nil, err
+	}
+	return &pb.UserResponse{Id: "1"}, nil
+}
+
+// Sends an event with number of the stream, then ends the stream with
+// the next error or waits until the client leaves.
+func (s *flakyServer) Watch(in *pb.WatchRequest, stream pb.UserService_WatchServer) error {
+	s.mu.Lock()
+	s.watches++
+	id := fmt.Sprint(s.watches)
+	s.mu.Unlock()
+	if err := stream.Send(&pb.WatchResponse{User: &pb.UserResponse{Id: id}}); err != nil {
+		return err
+	}
+	if err := s.nextErr(); err != nil {
+		return err
+	}
+	<-stream.Context().Done()
+	return nil
+}
+
+func startFlakyServer(t *testing.T, errs ...error) (*Client, *flakyServer) {
+	lis, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	fake := &flakyServer{errs: errs}
+	server := grpc.NewServer()
+	pb.RegisterUserServiceServer(server, fake)
+	go server.Serve(lis)
+	t.Cleanup(server.Stop)
+
+	c, err := Dial(context.Background(), lis.Addr().String(), testOptions)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c, fake
+}
+
+func TestRetry(t *testing.T) {
+	unavailable := status.Error(codes.Unavailable, "unavailable")
+
+	// Read-only calls are retried
+	c, fake := startFlakyServer(t, unavailable, unavailable)
+	resp, err := c.GetUser(context.Background(), &pb.GetUserRequest{Id: "1"})
+	require.NoError(t, err)
+	require.Equal(t, "1", resp.Id)
+	require.Equal(t, 3, fake.calls)
+
+	// Retries are limited
+	c, fake = startFlakyServer(t, unavailable, unavailable, unavailable, unavailable)
+	_, err = c.GetUser(context.Background(), &pb.GetUserRequest{Id: "1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 4, fake.calls)
+
+	// Errors that are not temporary are returned at once
+	c, fake = startFlakyServer(t, status.Error(codes.NotFound, "not found"))
+	_, err = c.GetUser(context.Background(), &pb.GetUserRequest{Id: "1"})
+	require.Equal(t, codes.NotFound, status.Code(err))
+	require.Equal(t, 1, fake.calls)
+
+	// AddUser is not idempotent
+	c, fake = startFlakyServer(t, unavailable)
+	_, err = c.AddUser(context.Background(), &pb.AddUserRequest{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, fake.calls)
+
+	// Repeated ModifyUser would overwrite changes made in between and
+	// EraseUser would publish the erasure again
+	c, fake = startFlakyServer(t, unavailable)
+	_, err = c.ModifyUser(context.Background(), &pb.ModifyUserRequest{Id: "1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, fake.calls)
+
+	c, fake = startFlakyServer(t, unavailable)
+	_, err = c.EraseUser(context.Background(), &pb.EraseUserRequest{Id: "1"})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Equal(t, 1, fake.calls)
+}
+
+func TestWatchReconnect(t *testing.T) {
+	c, fake := startFlakyServer(t,
+		status.Error(codes.Unavailable, "restarting"),
+		status.Error(codes.ResourceExhausted, "too slow"),
+	)
+	it := c.WatchChanges(context.Background())
+	for _, id := range []string{"1", "2", "3"} {
+		require.True(t, it.Next())
+		require.Equal(t, id, it.Event().User.Id)
+	}
+	require.Equal(t, 3, fake.watches)
+
+	// Close stops waiting for the next change
+	time.AfterFunc(10*time.Millisecond, it.Close)
+	require.False(t, it.Next())
+	require.ErrorIs(t, it.Err(), context.Canceled)
+
+	// Errors that are not temporary stop the iteration
+	c, _ = startFlakyServer(t, status.Error(codes.PermissionDenied, "denied"))
+	it = c.WatchChanges(context.Background())
+	defer it.Close()
+	require.True(t, it.Next())
+	require.False(t, it.Next())
+	require.Equal(t, codes.PermissionDenied, status.Code(it.Err()))
+}
+
+func TestUsers(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server, err := service.StartGrpcServer(ctx, grpcAddr, db.NewMemoryRepositories(),
+		service.Options{EventBus: events.Config{Driver: "memory"}})
+	require.NoError(t, err)
+	defer server.Stop()
+
+	opts := testOptions
+	opts.PageSize = 2
+	c, err := Dial(ctx, grpcAddr, opts)
+	require.NoError(t, err)
+	defer c.Close()
+
+	for i := 0; i < 5; i++ {
+		country := "LV"
+		if i%2 == 1 {
+			country = "EE"
+		}
+		_, err := c.AddUser(ctx, &pb.AddUserRequest{Email: fmt.Sprintf("user%d@email.com", i), Country: country})
+		require.NoError(t, err)
+	}
+
+	emails := []string{}
+	it := c.Users(ctx, "")
+	for it.Next() {
+		emails = append(emails, it.User().Email)
+	}
+	require.NoError(t, it.Err())
+	require.ElementsMatch(t, []string{"user0@email.com", "user1@email.com", "user2@email.com", "user3@email.com", "user4@email.com"}, emails)
+
+	count := 0
+	it = c.Users(ctx, "EE")
+	for it.Next() {
+		require.Equal(t, "EE", it.User().Country)
+		count++
+	}
+	require.NoError(t, it.Err())
+	require.Equal(t, 2, count)
+}
+
+func TestPrimaryRead(t *testing.T) {
+	require.Equal(t, service.LastWriteHeader, LastWriteHeader)
+	md, _ := metadata.FromOutgoingContext(PrimaryRead(context.Background()))
+	values := md.Get(LastWriteHeader)
+	require.Len(t, values, 1)
+	ms, err := strconv.ParseInt(values[0], 10, 64)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), time.UnixMilli(ms), time.Second)
+}
@@ -0,0 +1,73 @@
+package client
+
+import (
+	"context"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+)
+
+// Iterates over users page by page:
+//
+//	it := c.Users(ctx, "LV")
+//	for it.Next() {
+//		fmt.Println(it.User().Email)
+//	}
+//	if err := it.Err(); err != nil { ... }
+type UserIterator struct {
+	ctx     context.Context
+	client  *Client
+	country string
+	offset  int32
+	page    []*pb.UserResponse
+	user    *pb.UserResponse
+	done    bool
+	err     error
+}
+
+// Returns iterator over users of the country, all users when country is
+// empty. Pages of Options.PageSize users are requested as needed.
+func (c *Client) Users(ctx context.Context, country string) *UserIterator {
+	return &UserIterator{ctx: ctx, client: c, country: country}
+}
+
+// Advances to the next user. Returns false when there are no more users
+// or an error occurred, see Err.
+func (it *UserIterator) Next() bool {
+	if len(it.page) == 0 && !it.done {
+		it.fetch()
+	}
+	if len(it.page) == 0 {
+		it.user = nil
+		return false
+	}
+	it.user, it.page = it.page[0], it.page[1:]
+	return true
+}
+
+// Requests the next page. Short page means it is the last one.
+func (it *UserIterator) fetch() {
+	limit, offset := it.client.opts.PageSize, it.offset
+	resp, err := it.client.ListUsers(it.ctx, &pb.ListUsersRequest{
+		Country: it.country,
+		Limit:   &limit,
+		Offset:  &offset,
+	})
+	if err != nil {
+		it.err = err
+		it.done = true
+		return
+	}
+	it.page = resp.Users
+	it.offset += int32(len(resp.Users))
+	it.done = int32(len(resp.Users)) < limit
+}
+
+// Returns the current user.
+func (it *UserIterator) User() *pb.UserResponse {
+	return it.user
+}
+
+// Returns error that stopped the iteration.
+func (it *UserIterator) Err() error {
+	return it.err
+}
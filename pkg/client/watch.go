@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Iterates over user changes and reconnects when the stream breaks:
+//
+//	it := c.WatchChanges(ctx)
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Event().Method, it.Event().User.Id)
+//	}
+//	if err := it.Err(); err != nil { ... }
+//
+// Watch has no resume position, changes made while reconnecting are not
+// received.
+type WatchIterator struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	client *Client
+	stream pb.UserService_WatchClient
+	event  *pb.WatchResponse
+	err    error
+}
+
+// Returns iterator over user changes. It reconnects after the server
+// closes the stream, becomes unavailable or disconnects a slow client,
+// until ctx is done or Close is called.
+func (c *Client) WatchChanges(ctx context.Context) *WatchIterator {
+	ctx, cancel := context.WithCancel(ctx)
+	return &WatchIterator{ctx: ctx, cancel: cancel, client: c}
+}
+
+// Waits for the next change. Returns false when the iterator is closed or
+// failed with an error that is not temporary, see Err.
+func (it *WatchIterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	b := it.client.newBackoff()
+	for {
+		if it.stream == nil {
+			stream, err := it.client.Watch(it.ctx, &pb.WatchRequest{})
+			if err != nil {
+				if !it.reconnect(b, err) {
+					return false
+				}
+				continue
+			}
+			it.stream = stream
+		}
+		event, err := it.stream.Recv()
+		if err == nil {
+			it.event = event
+			return true
+		}
+		it.stream = nil
+		if !it.reconnect(b, err) {
+			return false
+		}
+	}
+}
+
+// Waits before the next connection attempt. Returns false and records the
+// error when the iteration should stop.
+func (it *WatchIterator) reconnect(b *backoff, err error) bool {
+	if it.ctx.Err() != nil {
+		it.err = it.ctx.Err()
+		return false
+	}
+	if !reconnectable(err) {
+		it.err = err
+		return false
+	}
+	if !b.wait(it.ctx) {
+		it.err = it.ctx.Err()
+		return false
+	}
+	return true
+}
+
+// Reports whether Watch should reconnect after the stream ended with err.
+func reconnectable(err error) bool {
+	if errors.Is(err, io.EOF) {
+		return true
+	}
+	switch status.Code(err) {
+	case codes.Unavailable, codes.Aborted, codes.ResourceExhausted:
+		return true
+	}
+	return false
+}
+
+// Returns the current change.
+func (it *WatchIterator) Event() *pb.WatchResponse {
+	return it.event
+}
+
+// Returns error that stopped the iteration. It is context.Canceled after
+// Close.
+func (it *WatchIterator) Err() error {
+	return it.err
+}
+
+// Stops the iteration and closes the stream.
+func (it *WatchIterator) Close() {
+	it.cancel()
+}
@@ -0,0 +1,663 @@
+package config
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/cache"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/service"
+	"github.com/kroksys/user-service-example/pkg/tracing"
+	"github.com/kroksys/user-service-example/pkg/webhook"
+	"github.com/pelletier/go-toml/v2"
+	"github.com/spf13/pflag"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variable with path of configuration file. Used when -config
+// flag is not provided.
+const FileEnv = "USERSERVICE_CONFIG"
+
+// Configuration of the server. Every value can be set in a YAML or TOML
+// file, by environment variable and by command line flag.
+//
+// Fields are described by tags:
+//   - config: key in the file section, flag is <section>.<key> with dashes
+//   - env: environment variable
+//   - secret: "true" hides the value when printed, "dsn" hides password
+//     of a connection string
+//
+// Lists are comma separated and maps are comma separated key=value pairs
+// in environment variables and flags.
+type Config struct {
+	Server     ServerConfig     `config:"server"`
+	Database   DatabaseConfig   `config:"database"`
+	Redis      RedisConfig      `config:"redis"`
+	EventBus   EventBusConfig   `config:"event_bus"`
+	Cache      CacheConfig      `config:"cache"`
+	Watch      WatchConfig      `config:"watch"`
+	Webhook    WebhookConfig    `config:"webhook"`
+	Health     HealthConfig     `config:"health"`
+	Tracing    TracingConfig    `config:"tracing"`
+	Log        LogConfig        `config:"log"`
+	Encryption EncryptionConfig `config:"encryption"`
+}
+
+type ServerConfig struct {
+	GRPCAddr         string        `config:"grpc_addr" env:"USERSERVICE_GRPC_ADDR" usage:"gRPC server address"`
+	HTTPAddr         string        `config:"http_addr" env:"USERSERVICE_HTTP_ADDR" usage:"HTTP server address"`
+	WSAllowedOrigins []string      `config:"ws_allowed_origins" env:"USERSERVICE_WS_ALLOWED_ORIGINS" usage:"origins allowed to open websocket connections"`
+	TrustedProxies   []string      `config:"trusted_proxies" env:"USERSERVICE_TRUSTED_PROXIES" usage:"networks of proxies allowed to set X-Actor and X-Forwarded-For"`
+	DrainDelay       time.Duration `config:"drain_delay" env:"USERSERVICE_DRAIN_DELAY" usage:"time between reporting NOT_SERVING and stopping on shutdown"`
+	ShutdownTimeout  time.Duration `config:"shutdown_timeout" env:"USERSERVICE_SHUTDOWN_TIMEOUT" usage:"time running requests are given to finish on shutdown"`
+}
+
+type DatabaseConfig struct {
+	ConnectionString string                   `config:"connection_string" env:"USERSERVICE_CONNECTION_STRING" secret:"dsn" usage:"database connection string, memory:// keeps data in memory"`
+	Replicas         []string                 `config:"replicas" env:"USERSERVICE_REPLICA_CONNECTION_STRINGS" secret:"dsn" usage:"connection strings of read replicas"`
+	MaxOpenConns     int                      `config:"max_open_conns" env:"USERSERVICE_DB_MAX_OPEN_CONNS" usage:"maximum open connections"`
+	MaxIdleConns     int                      `config:"max_idle_conns" env:"USERSERVICE_DB_MAX_IDLE_CONNS" usage:"maximum idle connections"`
+	ConnMaxLifetime  time.Duration            `config:"conn_max_lifetime" env:"USERSERVICE_DB_CONN_MAX_LIFETIME" usage:"maximum time a connection is reused"`
+	ConnMaxIdleTime  time.Duration            `config:"conn_max_idle_time" env:"USERSERVICE_DB_CONN_MAX_IDLE_TIME" usage:"maximum time a connection is idle"`
+	ConnectAttempts  int                      `config:"connect_attempts" env:"USERSERVICE_DB_CONNECT_ATTEMPTS" usage:"connection attempts on startup"`
+	ConnectBackoff   time.Duration            `config:"connect_backoff" env:"USERSERVICE_DB_CONNECT_BACKOFF" usage:"delay before the first connection retry"`
+	StickyWindow     time.Duration            `config:"sticky_window" env:"USERSERVICE_DB_STICKY_WINDOW" usage:"time reads go to primary database after client's write"`
+	QueryTimeout     time.Duration            `config:"query_timeout" env:"USERSERVICE_DB_QUERY_TIMEOUT" usage:"time limit of database queries of an RPC, 0 disables it"`
+	QueryTimeouts    map[string]time.Duration `config:"query_timeouts" env:"USERSERVICE_DB_QUERY_TIMEOUTS" usage:"query time limits by RPC name, e.g. ListUsers=10s"`
+}
+
+type RedisConfig struct {
+	Addr     string `config:"addr" env:"USERSERVICE_REDIS_HOST" usage:"redis server address"`
+	Password string `config:"password" env:"USERSERVICE_REDIS_PASSWORD" secret:"true" usage:"redis password"`
+	DB       int    `config:"db" env:"USERSERVICE_REDIS_DB" usage:"redis database number"`
+
+	ConnectAttempts int           `config:"connect_attempts" env:"USERSERVICE_REDIS_CONNECT_ATTEMPTS" usage:"connection attempts on startup"`
+	ConnectBackoff  time.Duration `config:"connect_backoff" env:"USERSERVICE_REDIS_CONNECT_BACKOFF" usage:"delay before the first connection retry"`
+}
+
+type EventBusConfig struct {
+	Driver   string `config:"driver" env:"USERSERVICE_EVENT_BUS" usage:"event bus: redis, nats, kafka or memory"`
+	Addr     string `config:"addr" env:"USERSERVICE_EVENT_BUS_ADDR" usage:"nats url or comma separated kafka brokers"`
+	Topic    string `config:"topic" env:"USERSERVICE_EVENT_BUS_TOPIC" usage:"channel, subject or topic name"`
+	Encoding string `config:"encoding" env:"USERSERVICE_EVENT_ENCODING" usage:"proto, cloudevents-json, cloudevents-proto or cloudevents-binary"`
+	Source   string `config:"source" env:"USERSERVICE_EVENT_SOURCE" usage:"CloudEvents source attribute"`
+}
+
+type CacheConfig struct {
+	Driver  string        `config:"driver" env:"USERSERVICE_CACHE" usage:"cache of user reads: redis or memory, empty disables it"`
+	TTL     time.Duration `config:"ttl" env:"USERSERVICE_CACHE_TTL" usage:"time users are cached"`
+	ListTTL time.Duration `config:"list_ttl" env:"USERSERVICE_CACHE_LIST_TTL" usage:"time lists of users are cached"`
+}
+
+type WatchConfig struct {
+	BufferSize     int    `config:"buffer_size" env:"USERSERVICE_WATCH_BUFFER_SIZE" usage:"events buffered for each Watch client"`
+	OverflowPolicy string `config:"overflow_policy" env:"USERSERVICE_WATCH_OVERFLOW_POLICY" usage:"drop-oldest, disconnect or coalesce"`
+}
+
+type WebhookConfig struct {
+	AllowedNetworks []string `config:"allowed_networks" env:"USERSERVICE_WEBHOOK_ALLOWED_NETWORKS" usage:"private networks webhooks may be delivered to, e.g. 10.1.0.0/16"`
+}
+
+type HealthConfig struct {
+	CheckInterval time.Duration `config:"check_interval" env:"USERSERVICE_HEALTH_CHECK_INTERVAL" usage:"delay between dependency checks"`
+}
+
+type TracingConfig struct {
+	Exporter    string  `config:"exporter" env:"USERSERVICE_TRACING_EXPORTER" usage:"span exporter: otlp, stdout or file, empty disables tracing"`
+	Endpoint    string  `config:"endpoint" env:"USERSERVICE_TRACING_ENDPOINT" usage:"otlp collector address or file path of file exporter"`
+	SampleRatio float64 `config:"sample_ratio" env:"USERSERVICE_TRACING_SAMPLE_RATIO" usage:"fraction of traces sampled, 0 to 1"`
+}
+
+type LogConfig struct {
+	Level  string `config:"level" env:"USERSERVICE_LOG_LEVEL" usage:"lowest logged level: debug, info, warn or error"`
+	Format string `config:"format" env:"USERSERVICE_LOG_FORMAT" usage:"log format: json or text"`
+}
+
+type EncryptionConfig struct {
+	KeyringFile string `config:"keyring_file" env:"USERSERVICE_ENCRYPTION_KEYRING" usage:"keyring file encrypting personal data of users, empty stores it in plaintext"`
+}
+
+// Returns configuration with default values.
+func Default() Config {
+	dbOpts := db.DefaultOptions()
+	return Config{
+		Server: ServerConfig{
+			GRPCAddr:        "localhost:9000",
+			HTTPAddr:        "localhost:9001",
+			TrustedProxies:  service.DefaultTrustedProxies,
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Database: DatabaseConfig{
+			ConnectionString: "user:userpw@tcp(localhost:3306)/users?parseTime=true",
+			MaxOpenConns:     dbOpts.MaxOpenConns,
+			MaxIdleConns:     dbOpts.MaxIdleConns,
+			ConnMaxLifetime:  dbOpts.ConnMaxLifetime,
+			ConnMaxIdleTime:  dbOpts.ConnMaxIdleTime,
+			ConnectAttempts:  dbOpts.ConnectAttempts,
+			ConnectBackoff:   dbOpts.ConnectBackoff,
+			StickyWindow:     service.DefaultReadYourWritesWindow,
+			QueryTimeout:     service.DefaultQueryTimeout,
+		},
+		Redis: RedisConfig{
+			Addr:            service.DefaultRedisAddr,
+			ConnectAttempts: service.DefaultRedisConnectAttempts,
+			ConnectBackoff:  service.DefaultRedisConnectBackoff,
+		},
+		EventBus: EventBusConfig{
+			Driver:   "redis",
+			Topic:    events.DefaultTopic,
+			Encoding: "proto",
+		},
+		Cache: CacheConfig{
+			TTL:     cache.DefaultTTL,
+			ListTTL: cache.DefaultListTTL,
+		},
+		Watch: WatchConfig{
+			BufferSize:     events.DefaultBufferSize,
+			OverflowPolicy: string(events.DropOldest),
+		},
+		Health: HealthConfig{
+			CheckInterval: 5 * time.Second,
+		},
+		Tracing: TracingConfig{
+			SampleRatio: 1,
+		},
+		Log: LogConfig{
+			Level:  "info",
+			Format: "json",
+		},
+	}
+}
+
+// Command line flags overriding configuration values. Flags are applied
+// last, after file and environment variables.
+type Flags struct {
+	file   *string
+	values map[string]string
+}
+
+// Registers --config flag and a flag for every configuration value.
+func RegisterFlags(fs *pflag.FlagSet) *Flags {
+	flags := &Flags{
+		file:   fs.String("config", os.Getenv(FileEnv), "path to YAML or TOML configuration file ($"+FileEnv+")"),
+		values: map[string]string{},
+	}
+	cfg := Default()
+	for _, f := range cfg.fields() {
+		fs.Var(flagValue{name: f.flag(), kind: f.kind(), values: flags.values}, f.flag(), f.usage+" ($"+f.env+")")
+	}
+	return flags
+}
+
+// Loads configuration from defaults, file, environment variables and
+// parsed flags. Later sources override earlier ones. File is read from
+// --config flag or USERSERVICE_CONFIG and its format is selected by
+// extension: .yaml, .yml or .toml.
+func (flags *Flags) Load() (Config, error) {
+	cfg := Default()
+	fields := cfg.fields()
+	if *flags.file != "" {
+		if err := cfg.loadFile(*flags.file); err != nil {
+			return cfg, err
+		}
+	}
+	for _, f := range fields {
+		if v := os.Getenv(f.env); f.env != "" && v != "" {
+			if err := f.set(v); err != nil {
+				return cfg, fmt.Errorf("invalid %s: %v", f.env, err)
+			}
+		}
+	}
+	for _, f := range fields {
+		if v, ok := flags.values[f.flag()]; ok {
+			if err := f.set(v); err != nil {
+				return cfg, fmt.Errorf("invalid --%s: %v", f.flag(), err)
+			}
+		}
+	}
+	return cfg, cfg.Validate()
+}
+
+// Parses flags from args and loads configuration, see Flags.Load. Returns
+// arguments left after flags.
+func Load(name string, args []string) (Config, []string, error) {
+	fs := pflag.NewFlagSet(name, pflag.ContinueOnError)
+	flags := RegisterFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return Default(), nil, err
+	}
+	cfg, err := flags.Load()
+	return cfg, fs.Args(), err
+}
+
+// Reads values from YAML or TOML file. Unknown keys are errors so typos
+// don't go unnoticed.
+func (c *Config) loadFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config file: %v", err)
+	}
+	values := map[string]interface{}{}
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &values)
+	case ".toml":
+		err = toml.Unmarshal(data, &values)
+	default:
+		return fmt.Errorf("unsupported config file format %q, use .yaml, .yml or .toml", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse config file %s: %v", path, err)
+	}
+
+	byKey := map[string]field{}
+	for _, f := range c.fields() {
+		byKey[f.key] = f
+	}
+	for section, v := range values {
+		keys, ok := v.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("config file %s: %s must be a section", path, section)
+		}
+		for key, value := range keys {
+			f, ok := byKey[section+"."+key]
+			if !ok {
+				return fmt.Errorf("config file %s: unknown key %s.%s", path, section, key)
+			}
+			if err := f.set(fileValue(value)); err != nil {
+				return fmt.Errorf("config file %s: invalid %s: %v", path, f.key, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Converts value decoded from file to the format used by environment
+// variables and flags.
+func fileValue(value interface{}) string {
+	switch v := value.(type) {
+	case []interface{}:
+		items := []string{}
+		for _, item := range v {
+			items = append(items, fmt.Sprint(item))
+		}
+		return strings.Join(items, ",")
+	case map[string]interface{}:
+		pairs := []string{}
+		for k, item := range v {
+			pairs = append(pairs, k+"="+fmt.Sprint(item))
+		}
+		sort.Strings(pairs)
+		return strings.Join(pairs, ",")
+	}
+	return fmt.Sprint(value)
+}
+
+// Checks that values are usable. All problems are reported at once.
+func (c Config) Validate() error {
+	problems := []string{}
+	if c.Server.GRPCAddr == "" {
+		problems = append(problems, "server.grpc_addr must not be empty")
+	}
+	if c.Server.HTTPAddr == "" {
+		problems = append(problems, "server.http_addr must not be empty")
+	}
+	if _, err := service.ParseTrustedProxies(c.Server.TrustedProxies); err != nil {
+		problems = append(problems, "server.trusted_proxies: "+err.Error())
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		problems = append(problems, "server.shutdown_timeout must be positive")
+	}
+	if c.Database.ConnectionString == "" {
+		problems = append(problems, "database.connection_string must not be empty")
+	}
+	if c.Database.ConnectAttempts < 1 {
+		problems = append(problems, "database.connect_attempts must be at least 1")
+	}
+	if c.Redis.DB < 0 {
+		problems = append(problems, "redis.db must not be negative")
+	}
+	if c.Redis.ConnectAttempts < 1 {
+		problems = append(problems, "redis.connect_attempts must be at least 1")
+	}
+	switch c.EventBus.Driver {
+	case "redis", "memory":
+	case "nats", "kafka":
+		if c.EventBus.Addr == "" {
+			problems = append(problems, fmt.Sprintf("event_bus.addr is required by %s event bus", c.EventBus.Driver))
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported event_bus.driver %q", c.EventBus.Driver))
+	}
+	if codec, err := events.NewCodec(c.EventBus.Encoding, c.EventBus.Source); err != nil {
+		problems = append(problems, "event_bus.encoding: "+err.Error())
+	} else if events.RequiresHeaders(codec) && c.EventBus.Driver == "redis" {
+		problems = append(problems, fmt.Sprintf("event_bus.encoding %q is not supported by redis event bus", c.EventBus.Encoding))
+	}
+	switch c.Cache.Driver {
+	case "", "redis", "memory":
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported cache.driver %q", c.Cache.Driver))
+	}
+	if c.Cache.Driver == "redis" && c.Encryption.KeyringFile != "" {
+		// Cached users are not encrypted
+		problems = append(problems, `cache.driver "redis" is not supported with encryption.keyring_file`)
+	}
+	if c.Watch.BufferSize < 1 {
+		problems = append(problems, "watch.buffer_size must be at least 1")
+	}
+	if _, err := events.ParseOverflowPolicy(c.Watch.OverflowPolicy); err != nil {
+		problems = append(problems, "watch.overflow_policy: "+err.Error())
+	}
+	if _, err := webhook.NewAddressPolicy(c.Webhook.AllowedNetworks); err != nil {
+		problems = append(problems, "webhook.allowed_networks: "+err.Error())
+	}
+	if c.Health.CheckInterval <= 0 {
+		problems = append(problems, "health.check_interval must be positive")
+	}
+	switch c.Tracing.Exporter {
+	case "", "otlp", "stdout":
+	case "file":
+		if c.Tracing.Endpoint == "" {
+			problems = append(problems, "tracing.endpoint is required by file exporter")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unsupported tracing.exporter %q", c.Tracing.Exporter))
+	}
+	if c.Tracing.SampleRatio < 0 || c.Tracing.SampleRatio > 1 {
+		problems = append(problems, "tracing.sample_ratio must be between 0 and 1")
+	}
+	if _, err := logging.New(io.Discard, c.LoggingConfig()); err != nil {
+		problems = append(problems, "log: "+err.Error())
+	}
+	for _, f := range c.fields() {
+		switch v := f.value.Interface().(type) {
+		case int:
+			if v < 0 {
+				problems = append(problems, f.key+" must not be negative")
+			}
+		case time.Duration:
+			if v < 0 {
+				problems = append(problems, f.key+" must not be negative")
+			}
+		}
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Writes effective configuration as YAML with secrets redacted.
+func (c Config) Print(w io.Writer) error {
+	root := &yaml.Node{Kind: yaml.MappingNode}
+	var section *yaml.Node
+	for _, f := range c.fields() {
+		name, key, _ := strings.Cut(f.key, ".")
+		if section == nil || root.Content[len(root.Content)-2].Value != name {
+			section = &yaml.Node{Kind: yaml.MappingNode}
+			root.Content = append(root.Content, scalarNode(name), section)
+		}
+		section.Content = append(section.Content, scalarNode(key), f.node())
+	}
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(root); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// Returns database options of the configuration.
+func (c Config) DatabaseOptions() db.Options {
+	return db.Options{
+		MaxOpenConns:    c.Database.MaxOpenConns,
+		MaxIdleConns:    c.Database.MaxIdleConns,
+		ConnMaxLifetime: c.Database.ConnMaxLifetime,
+		ConnMaxIdleTime: c.Database.ConnMaxIdleTime,
+		ConnectAttempts: c.Database.ConnectAttempts,
+		ConnectBackoff:  c.Database.ConnectBackoff,
+		Replicas:        c.Database.Replicas,
+	}
+}
+
+// Loads keyring of the configuration. Returns nil when encryption is not
+// configured.
+func (c Config) Keyring() (*encryption.Keyring, error) {
+	if c.Encryption.KeyringFile == "" {
+		return nil, nil
+	}
+	return encryption.LoadKeyring(c.Encryption.KeyringFile)
+}
+
+// Returns options of grpc and HTTP servers of the configuration.
+func (c Config) ServiceOptions() service.Options {
+	return service.Options{
+		EventBus: events.Config{
+			Driver:   c.EventBus.Driver,
+			Addr:     c.EventBus.Addr,
+			Topic:    c.EventBus.Topic,
+			Encoding: c.EventBus.Encoding,
+			Source:   c.EventBus.Source,
+		},
+		Redis: service.RedisOptions{
+			Addr:     c.Redis.Addr,
+			Password: c.Redis.Password,
+			DB:       c.Redis.DB,
+
+			ConnectAttempts: c.Redis.ConnectAttempts,
+			ConnectBackoff:  c.Redis.ConnectBackoff,
+		},
+		Cache: cache.Config{
+			Driver:  c.Cache.Driver,
+			TTL:     c.Cache.TTL,
+			ListTTL: c.Cache.ListTTL,
+		},
+		Encrypted:            c.Encryption.KeyringFile != "",
+		WatchBufferSize:      c.Watch.BufferSize,
+		WatchOverflowPolicy:  events.OverflowPolicy(c.Watch.OverflowPolicy),
+		ReadYourWritesWindow: c.Database.StickyWindow,
+		QueryTimeouts: service.QueryTimeouts{
+			Default: c.Database.QueryTimeout,
+			Methods: c.Database.QueryTimeouts,
+		},
+		HealthCheckInterval:     c.Health.CheckInterval,
+		WebsocketAllowedOrigins: c.Server.WSAllowedOrigins,
+		WebhookAllowedNetworks:  c.Webhook.AllowedNetworks,
+		TrustedProxies:          c.Server.TrustedProxies,
+	}
+}
+
+// Returns tracing options of the configuration.
+func (c Config) TracingConfig() tracing.Config {
+	return tracing.Config{
+		Exporter:    c.Tracing.Exporter,
+		Endpoint:    c.Tracing.Endpoint,
+		SampleRatio: c.Tracing.SampleRatio,
+	}
+}
+
+// Returns logger options of the configuration.
+func (c Config) LoggingConfig() logging.Config {
+	return logging.Config{
+		Level:  c.Log.Level,
+		Format: c.Log.Format,
+	}
+}
+
+// Configuration value described by struct tags.
+type field struct {
+	key    string // <section>.<key>
+	env    string
+	secret string
+	usage  string
+	value  reflect.Value
+}
+
+// Returns fields of all sections in declaration order.
+func (c *Config) fields() []field {
+	fields := []field{}
+	root := reflect.ValueOf(c).Elem()
+	for i := 0; i < root.NumField(); i++ {
+		section := root.Field(i)
+		sectionName := root.Type().Field(i).Tag.Get("config")
+		for j := 0; j < section.NumField(); j++ {
+			tag := section.Type().Field(j).Tag
+			fields = append(fields, field{
+				key:    sectionName + "." + tag.Get("config"),
+				env:    tag.Get("env"),
+				secret: tag.Get("secret"),
+				usage:  tag.Get("usage"),
+				value:  section.Field(j),
+			})
+		}
+	}
+	return fields
+}
+
+// Flag name, e.g. database.max-open-conns.
+func (f field) flag() string {
+	return strings.ReplaceAll(f.key, "_", "-")
+}
+
+// Type of the value shown in flag usage.
+func (f field) kind() string {
+	switch f.value.Interface().(type) {
+	case int:
+		return "int"
+	case float64:
+		return "float"
+	case time.Duration:
+		return "duration"
+	case []string:
+		return "strings"
+	case map[string]time.Duration:
+		return "key=duration,..."
+	}
+	return "string"
+}
+
+// Parses value in environment variable format and sets the field.
+func (f field) set(s string) error {
+	switch v := f.value.Addr().Interface().(type) {
+	case *string:
+		*v = s
+	case *int:
+		n, err := strconv.Atoi(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		*v = n
+	case *float64:
+		n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", s)
+		}
+		*v = n
+	case *time.Duration:
+		d, err := time.ParseDuration(strings.TrimSpace(s))
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", s)
+		}
+		*v = d
+	case *[]string:
+		*v = splitList(s)
+	case *map[string]time.Duration:
+		m := map[string]time.Duration{}
+		for _, pair := range splitList(s) {
+			key, value, ok := strings.Cut(pair, "=")
+			d, err := time.ParseDuration(strings.TrimSpace(value))
+			if !ok || err != nil {
+				return fmt.Errorf("%q is not a key=duration pair", pair)
+			}
+			m[strings.TrimSpace(key)] = d
+		}
+		*v = m
+	default:
+		return fmt.Errorf("unsupported type %T", v)
+	}
+	return nil
+}
+
+// Returns YAML node of the value with secrets redacted.
+func (f field) node() *yaml.Node {
+	switch v := f.value.Interface().(type) {
+	case []string:
+		node := &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+		for _, item := range v {
+			node.Content = append(node.Content, scalarNode(f.redact(item)))
+		}
+		return node
+	case map[string]time.Duration:
+		node := &yaml.Node{Kind: yaml.MappingNode, Style: yaml.FlowStyle}
+		keys := []string{}
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			node.Content = append(node.Content, scalarNode(k), scalarNode(v[k].String()))
+		}
+		return node
+	}
+	if f.value.Kind() == reflect.String {
+		return scalarNode(f.redact(f.value.String()))
+	}
+	return &yaml.Node{Kind: yaml.ScalarNode, Value: fmt.Sprint(f.value.Interface())}
+}
+
+func (f field) redact(value string) string {
+	switch {
+	case value == "":
+		return value
+	case f.secret == "true":
+		return redacted
+	case f.secret == "dsn":
+		return redactDSN(value)
+	}
+	return value
+}
+
+func scalarNode(value string) *yaml.Node {
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+func splitList(s string) []string {
+	items := []string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Records flags so they can be applied after file and environment.
+type flagValue struct {
+	name   string
+	kind   string
+	values map[string]string
+}
+
+func (v flagValue) Type() string {
+	return v.kind
+}
+
+func (v flagValue) String() string {
+	return ""
+}
+
+func (v flagValue) Set(s string) error {
+	v.values[v.name] = s
+	return nil
+}
@@ -0,0 +1,252 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// Filter of listed audit events. Zero values don't filter.
+type AuditFilter struct {
+	UserID uuid.UUID
+
+	// Events created at or after Since and before Until.
+	Since time.Time
+	Until time.Time
+
+	// Same as for ListUsers: zero limit means no limit unless offset is
+	// provided.
+	Limit  int
+	Offset int
+}
+
+// Append-only storage of user changes. Events are modified only to erase
+// personal data.
+type AuditRepository interface {
+	CreateAuditEvent(ctx context.Context, e *models.AuditEvent) error
+	// Lists events oldest first.
+	ListAuditEvents(ctx context.Context, f AuditFilter) ([]models.AuditEvent, error)
+	// Erases recorded values of all events of the user.
+	EraseAuditEvents(ctx context.Context, userID uuid.UUID) error
+}
+
+// Audit repository backed by gorm database connection. Recorded values and
+// client addresses are sealed by Keyring when it is set.
+type GormAuditRepository struct {
+	DB      *gorm.DB
+	Keyring *encryption.Keyring
+}
+
+func NewAuditRepository(db *gorm.DB) *GormAuditRepository {
+	return &GormAuditRepository{DB: db}
+}
+
+// Creates repository sealing recorded values with the keyring.
+func NewEncryptedAuditRepository(db *gorm.DB, keyring *encryption.Keyring) *GormAuditRepository {
+	return &GormAuditRepository{DB: db, Keyring: keyring}
+}
+
+func (r *GormAuditRepository) CreateAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	if r.Keyring == nil {
+		return r.DB.WithContext(ctx).Create(e).Error
+	}
+	row := *e
+	row.Changes = append([]models.FieldChange{}, e.Changes...)
+	if err := r.sealEvent(&row); err != nil {
+		return err
+	}
+	if err := r.DB.WithContext(ctx).Create(&row).Error; err != nil {
+		return err
+	}
+	e.CreatedAt = row.CreatedAt
+	return nil
+}
+
+// Returns personal values of the event by name used as additional data.
+func auditValues(e *models.AuditEvent) map[string]*string {
+	values := map[string]*string{"client_ip": &e.ClientIP}
+	for i := range e.Changes {
+		c := &e.Changes[i]
+		values[fmt.Sprintf("changes.%d.old", i)] = &c.Old
+		values[fmt.Sprintf("changes.%d.new", i)] = &c.New
+	}
+	return values
+}
+
+// Additional data binding sealed value to its event and field.
+func auditData(id uuid.UUID, name string) []byte {
+	return []byte(id.String() + ":" + name)
+}
+
+// Reports whether value holds personal data. Erased values don't.
+func auditSecret(value string) bool {
+	return value != "" && value != models.ErasedValue
+}
+
+// Seals personal values of the event with the primary key. Values sealed
+// by other keys are sealed again.
+func (r *GormAuditRepository) sealEvent(e *models.AuditEvent) error {
+	for name, value := range auditValues(e) {
+		if !auditSecret(*value) || !r.Keyring.NeedsReseal(*value) {
+			continue
+		}
+		plaintext := *value
+		if encryption.IsSealed(plaintext) {
+			var err error
+			if plaintext, err = r.Keyring.Open(plaintext, auditData(e.ID, name)); err != nil {
+				return err
+			}
+		}
+		sealed, err := r.Keyring.Seal(plaintext, auditData(e.ID, name))
+		if err != nil {
+			return err
+		}
+		*value = sealed
+	}
+	return nil
+}
+
+// Replaces sealed values of the event with their plaintext. Values stored
+// before the keyring was configured are plaintext already.
+func (r *GormAuditRepository) openEvent(e *models.AuditEvent) error {
+	for name, value := range auditValues(e) {
+		if !encryption.IsSealed(*value) {
+			continue
+		}
+		if r.Keyring == nil {
+			return ErrKeyringRequired
+		}
+		plaintext, err := r.Keyring.Open(*value, auditData(e.ID, name))
+		if err != nil {
+			return fmt.Errorf("db: audit event %s: %v", e.ID, err)
+		}
+		*value = plaintext
+	}
+	return nil
+}
+
+// Reports whether any personal value of the event is plaintext or sealed
+// by other than primary key.
+func (r *GormAuditRepository) needsReseal(e *models.AuditEvent) bool {
+	for _, value := range auditValues(e) {
+		if auditSecret(*value) && r.Keyring.NeedsReseal(*value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Seals plaintext values and values sealed by other than primary key.
+// Returns number of changed events. Events are locked while they are
+// sealed, so concurrent erasure is not undone.
+func (r *GormAuditRepository) RotateKeys(ctx context.Context) (int, error) {
+	if r.Keyring == nil {
+		return 0, errors.New("db: keyring is not configured")
+	}
+	changed := 0
+	var lastID *uuid.UUID
+	for {
+		events := []models.AuditEvent{}
+		q := r.DB.WithContext(ctx).Order("id").Limit(rotateBatchSize)
+		if lastID != nil {
+			q = q.Where("id > ?", *lastID)
+		}
+		if err := q.Find(&events).Error; err != nil {
+			return changed, err
+		}
+		for i := range events {
+			if !r.needsReseal(&events[i]) {
+				continue
+			}
+			ok, err := r.rotateEvent(ctx, events[i].ID)
+			if err != nil {
+				return changed, fmt.Errorf("audit event %s: %v", events[i].ID, err)
+			}
+			if ok {
+				changed++
+			}
+		}
+		if len(events) < rotateBatchSize {
+			return changed, nil
+		}
+		lastID = &events[len(events)-1].ID
+	}
+}
+
+func (r *GormAuditRepository) rotateEvent(ctx context.Context, id uuid.UUID) (bool, error) {
+	changed := false
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		e := models.AuditEvent{}
+		if err := tx.Clauses(clause.Locking{Strength: "UPDATE"}).First(&e, "id = ?", id).Error; err != nil {
+			return err
+		}
+		if !r.needsReseal(&e) {
+			return nil
+		}
+		if err := r.sealEvent(&e); err != nil {
+			return err
+		}
+		changed = true
+		return tx.Model(&e).Select("changes", "client_ip").Updates(&e).Error
+	})
+	return changed, err
+}
+
+func (r *GormAuditRepository) ListAuditEvents(ctx context.Context, f AuditFilter) ([]models.AuditEvent, error) {
+	events := []models.AuditEvent{}
+	if f.Offset > 0 && f.Limit == 0 {
+		f.Limit = 1
+	}
+	q := r.DB.WithContext(ctx).Order("created_at, id")
+	if f.UserID != uuid.Nil {
+		q = q.Where("user_id = ?", f.UserID)
+	}
+	if !f.Since.IsZero() {
+		q = q.Where("created_at >= ?", f.Since)
+	}
+	if !f.Until.IsZero() {
+		q = q.Where("created_at < ?", f.Until)
+	}
+	if f.Limit > 0 {
+		q = q.Limit(f.Limit)
+	}
+	if f.Offset > 0 {
+		q = q.Offset(f.Offset)
+	}
+	if err := q.Find(&events).Error; err != nil {
+		return nil, err
+	}
+	for i := range events {
+		if err := r.openEvent(&events[i]); err != nil {
+			return nil, err
+		}
+	}
+	return events, nil
+}
+
+func (r *GormAuditRepository) EraseAuditEvents(ctx context.Context, userID uuid.UUID) error {
+	return r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		events := []models.AuditEvent{}
+		if err := tx.Where("user_id = ?", userID).Find(&events).Error; err != nil {
+			return err
+		}
+		for i := range events {
+			events[i].Erase()
+			err := tx.Model(&events[i]).Select("changes", "client_ip").Updates(&events[i]).Error
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
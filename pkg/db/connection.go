@@ -1,30 +1,306 @@
 package db
 
 import (
-	"github.com/kroksys/user-service-example/pkg/models"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/glebarez/sqlite"
+	"github.com/kroksys/user-service-example/pkg/encryption"
 	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/gorm"
+	"gorm.io/plugin/dbresolver"
 )
 
-var (
-	// shared database connection
-	DB *gorm.DB
-)
+// Connection string selecting in-memory repositories.
+const MemoryConnectionString = "memory://"
+
+// Longest delay between connection attempts.
+const maxConnectBackoff = 30 * time.Second
+
+// Repositories used by the service.
+type Repositories struct {
+	Users    UserRepository
+	Webhooks WebhookRepository
+	Audit    AuditRepository
+
+	// Database connection, nil for in-memory repositories
+	db *sql.DB
+
+	// Routes reads to replicas, nil when there are no replicas
+	resolver *dbresolver.DBResolver
+}
+
+// Creates repositories sharing provided database connection.
+func NewGormRepositories(db *gorm.DB) Repositories {
+	sqlDB, _ := db.DB()
+	return Repositories{
+		Users:    NewUserRepository(db),
+		Webhooks: NewWebhookRepository(db),
+		Audit:    NewAuditRepository(db),
+		db:       sqlDB,
+	}
+}
+
+// Checks that database and every replica are reachable. Errors name the
+// unreachable databases. In-memory repositories are always reachable.
+func (r Repositories) Ping(ctx context.Context) error {
+	pools, err := r.pools()
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, pool := range pools {
+		if err := pool.PingContext(ctx); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", pool.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Closes database connections including replicas. In-memory repositories
+// have nothing to close.
+func (r Repositories) Close() error {
+	pools, err := r.pools()
+	if err != nil {
+		return err
+	}
+	errs := []error{}
+	for _, pool := range pools {
+		if err := pool.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", pool.name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Connection pool of the primary database or a replica.
+type namedPool struct {
+	*sql.DB
+	name string
+}
+
+// Returns connection pools named primary and replica1, replica2, ...
+// In-memory repositories have no pools.
+func (r Repositories) pools() ([]namedPool, error) {
+	dbs := []*sql.DB{}
+	if r.resolver != nil {
+		// Primary is called first, then replicas
+		err := r.resolver.Call(func(pool gorm.ConnPool) error {
+			if db, ok := pool.(*sql.DB); ok {
+				dbs = append(dbs, db)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else if r.db != nil {
+		dbs = append(dbs, r.db)
+	}
+	pools := make([]namedPool, len(dbs))
+	for i, db := range dbs {
+		pools[i] = namedPool{DB: db, name: "primary"}
+		if i > 0 {
+			pools[i].name = fmt.Sprintf("replica%d", i)
+		}
+	}
+	return pools, nil
+}
+
+// Database connection options.
+type Options struct {
+	// Connection pool limits, see sql.DB setters for zero values.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	ConnMaxIdleTime time.Duration
+
+	// Number of connection attempts on startup. Delay between attempts
+	// starts at ConnectBackoff and is doubled up to 30 seconds.
+	ConnectAttempts int
+	ConnectBackoff  time.Duration
+
+	// Connection strings of read replicas. Reads are sent to replicas
+	// and writes to primary database.
+	Replicas []string
+
+	// Keyring encrypting personal fields of users, webhook secrets, dead
+	// letters and audit event changes, nil stores them in plaintext.
+	Keyring *encryption.Keyring
+}
+
+// Default connection pool and retry options.
+func DefaultOptions() Options {
+	return Options{
+		MaxOpenConns:    20,
+		MaxIdleConns:    10,
+		ConnMaxLifetime: 30 * time.Minute,
+		ConnMaxIdleTime: 5 * time.Minute,
+		ConnectAttempts: 10,
+		ConnectBackoff:  500 * time.Millisecond,
+	}
+}
+
+// Opens repositories for provided connection string. "memory://" returns
+// in-memory repositories, otherwise database is connected and migrated.
+func Open(connectionString string, opts Options) (Repositories, error) {
+	if strings.HasPrefix(connectionString, MemoryConnectionString) {
+		return NewMemoryRepositories(), nil
+	}
+	db, err := connectWithRetry(connectionString, opts)
+	if err != nil {
+		return Repositories{}, fmt.Errorf("failed to connect to database: %v", err)
+	}
+	if err := ConfigurePool(db, opts); err != nil {
+		closeDB(db)
+		return Repositories{}, err
+	}
+	if err := Migrate(db); err != nil {
+		closeDB(db)
+		return Repositories{}, fmt.Errorf("failed to migrate database: %v", err)
+	}
+	repos := NewGormRepositories(db)
+	if opts.Keyring != nil {
+		repos.Users = NewEncryptedUserRepository(db, opts.Keyring)
+		repos.Webhooks = NewEncryptedWebhookRepository(db, opts.Keyring)
+		repos.Audit = NewEncryptedAuditRepository(db, opts.Keyring)
+	}
+	if len(opts.Replicas) == 0 {
+		return repos, nil
+	}
+
+	resolver, err := useReplicas(db, opts)
+	if err != nil {
+		closeDB(db)
+		return Repositories{}, fmt.Errorf("failed to connect to replicas: %v", err)
+	}
+	repos.resolver = resolver
+	return repos, nil
+}
+
+// Closes connection pool of the database that can't be used.
+func closeDB(db *gorm.DB) {
+	if sqlDB, err := db.DB(); err == nil {
+		sqlDB.Close()
+	}
+}
+
+// Registers read replicas. Queries are sent to a random replica unless
+// primary is requested with dbresolver.Write clause.
+func useReplicas(db *gorm.DB, opts Options) (*dbresolver.DBResolver, error) {
+	replicas := []gorm.Dialector{}
+	for _, cs := range opts.Replicas {
+		replicas = append(replicas, Dialector(cs))
+	}
+	resolver := dbresolver.Register(dbresolver.Config{Replicas: replicas}).
+		SetMaxOpenConns(opts.MaxOpenConns).
+		SetMaxIdleConns(opts.MaxIdleConns).
+		SetConnMaxLifetime(opts.ConnMaxLifetime).
+		SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	if err := db.Use(resolver); err != nil {
+		return nil, err
+	}
+	return resolver, nil
+}
+
+// Connects to database retrying with exponential backoff, so the service
+// can start together with the database.
+func connectWithRetry(connectionString string, opts Options) (*gorm.DB, error) {
+	backoff := opts.ConnectBackoff
+	for attempt := 1; ; attempt++ {
+		db, err := Connect(connectionString)
+		if err == nil {
+			return db, nil
+		}
+		if attempt >= opts.ConnectAttempts {
+			return nil, err
+		}
+		slog.Warn("db: connection attempt failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > maxConnectBackoff {
+			backoff = maxConnectBackoff
+		}
+	}
+}
+
+// Applies connection pool limits. SQLite keeps a single connection.
+func ConfigurePool(db *gorm.DB, opts Options) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if db.Dialector.Name() != "sqlite" {
+		sqlDB.SetMaxOpenConns(opts.MaxOpenConns)
+	}
+	sqlDB.SetMaxIdleConns(opts.MaxIdleConns)
+	sqlDB.SetConnMaxLifetime(opts.ConnMaxLifetime)
+	sqlDB.SetConnMaxIdleTime(opts.ConnMaxIdleTime)
+	return nil
+}
 
-// Opens the database connection using ConnectionString. Database connection
-// can be accessed using globally accessible DB variable.
+// Opens the database connection using ConnectionString.
 // It is possible to pass optional Dialecot that's used for testing purposes.
-func Connect(connectionString string, d ...gorm.Dialector) error {
-	var err error
-	dl := mysql.Open(connectionString)
+func Connect(connectionString string, d ...gorm.Dialector) (*gorm.DB, error) {
+	dl := Dialector(connectionString)
 	if len(d) != 0 {
 		dl = d[0]
 	}
-	DB, err = gorm.Open(dl)
-	return err
+	db, err := gorm.Open(dl)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Use(queryMetrics{}); err != nil {
+		return nil, err
+	}
+	if err := db.Use(queryTracing{}); err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer and every connection to :memory:
+	// would open a separate database.
+	if db.Dialector.Name() == "sqlite" {
+		sqlDB, err := db.DB()
+		if err != nil {
+			return nil, err
+		}
+		sqlDB.SetMaxOpenConns(1)
+	}
+	return db, nil
+}
+
+// Selects database by connection string:
+//   - postgres://user:pw@host/db or postgresql://... for PostgreSQL
+//   - sqlite://users.db or file:users.db?... for SQLite
+//   - anything else is MySQL DSN user:pw@tcp(host)/db?parseTime=true
+func Dialector(connectionString string) gorm.Dialector {
+	switch {
+	case strings.HasPrefix(connectionString, "postgres://"),
+		strings.HasPrefix(connectionString, "postgresql://"):
+		return postgres.Open(connectionString)
+	case strings.HasPrefix(connectionString, "sqlite://"):
+		return sqlite.Open(strings.TrimPrefix(connectionString, "sqlite://"))
+	case strings.HasPrefix(connectionString, "file:"):
+		return sqlite.Open(connectionString)
+	}
+	return mysql.Open(connectionString)
 }
 
-// Auto migrates models for database
-func Migrate() error {
-	return DB.AutoMigrate(&models.User{})
+// Applies pending migrations to the database.
+func Migrate(db *gorm.DB) error {
+	migrator, err := NewMigrator(db)
+	if err != nil {
+		return err
+	}
+	applied, err := migrator.Up(context.Background())
+	for _, m := range applied {
+		slog.Info("db: applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
 }
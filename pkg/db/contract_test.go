@@ -0,0 +1,458 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+// Repository backends the contract tests run against. In-memory and SQLite
+// repositories, plain and encrypted, are always tested. Other database (MySQL, PostgreSQL) is
+// tested when USERSERVICE_TEST_CONNECTION_STRING is set.
+func contractBackends(t *testing.T) map[string]func(t *testing.T) Repositories {
+	backends := map[string]func(t *testing.T) Repositories{
+		"memory": func(t *testing.T) Repositories {
+			return NewMemoryRepositories()
+		},
+		"sqlite": func(t *testing.T) Repositories {
+			repos, err := Open("sqlite://"+filepath.Join(t.TempDir(), "users.db"), DefaultOptions())
+			require.NoError(t, err)
+			return repos
+		},
+		"sqlite-encrypted": func(t *testing.T) Repositories {
+			keyring, err := encryption.NewKeyring()
+			require.NoError(t, err)
+			opts := DefaultOptions()
+			opts.Keyring = keyring
+			repos, err := Open("sqlite://"+filepath.Join(t.TempDir(), "users.db"), opts)
+			require.NoError(t, err)
+			return repos
+		},
+	}
+	if cs := os.Getenv("USERSERVICE_TEST_CONNECTION_STRING"); cs != "" {
+		repos, err := Open(cs, DefaultOptions())
+		require.NoError(t, err)
+		// Database is shared by tests so they use unique emails and countries
+		backends[Dialector(cs).Name()] = func(t *testing.T) Repositories {
+			return repos
+		}
+	}
+	return backends
+}
+
+// Runs test against every backend.
+func runContract(t *testing.T, test func(t *testing.T, repos Repositories)) {
+	for name, open := range contractBackends(t) {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			test(t, open(t))
+		})
+	}
+}
+
+// Unique email so tests can share database
+func testEmail(name string) string {
+	return fmt.Sprintf("%s.%s@email.com", name, uuid.NewString())
+}
+
+func TestContractCreateAndGetUser(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		u := models.User{
+			FirstName: "John",
+			LastName:  "Doe",
+			Nickname:  "Johny",
+			Password:  "secret",
+			Email:     testEmail("john"),
+			Country:   "UK",
+		}
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &u))
+		require.NotEqual(t, uuid.Nil, u.ID)
+		require.False(t, u.CreatedAt.IsZero())
+		require.False(t, u.UpdatedAt.IsZero())
+
+		stored, err := repos.Users.GetUser(context.Background(), u.ID)
+		require.NoError(t, err)
+		require.Equal(t, u.ID, stored.ID)
+		require.Equal(t, u.FirstName, stored.FirstName)
+		require.Equal(t, u.LastName, stored.LastName)
+		require.Equal(t, u.Nickname, stored.Nickname)
+		require.Equal(t, u.Password, stored.Password)
+		require.Equal(t, u.Email, stored.Email)
+		require.Equal(t, u.Country, stored.Country)
+
+		_, err = repos.Users.GetUser(context.Background(), uuid.New())
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
+
+func TestContractUniqueEmail(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		email := testEmail("john")
+		john := models.User{FirstName: "John", Email: email}
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &john))
+
+		err := repos.Users.CreateUser(context.Background(), &models.User{Email: email})
+		require.ErrorIs(t, err, ErrDuplicateEmail)
+
+		jane := models.User{FirstName: "Jane", Email: testEmail("jane")}
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &jane))
+
+		err = repos.Users.UpdateUserByMap(context.Background(), &models.User{ID: jane.ID}, map[string]interface{}{"email": email})
+		require.ErrorIs(t, err, ErrDuplicateEmail)
+
+		jane.Email = email
+		err = repos.Users.UpdateUser(context.Background(), &jane)
+		require.ErrorIs(t, err, ErrDuplicateEmail)
+
+		// Email can be used again after user was removed
+		require.NoError(t, repos.Users.DeleteUser(context.Background(), john.ID))
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &models.User{Email: email}))
+	})
+}
+
+func TestContractUpdateUser(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		u := models.User{FirstName: "John", LastName: "Doe", Email: testEmail("john"), Country: "UK"}
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &u))
+
+		// Only provided columns are updated
+		update := &models.User{ID: u.ID}
+		err := repos.Users.UpdateUserByMap(context.Background(), update, map[string]interface{}{"first_name": "Johnny", "country": "AU"})
+		require.NoError(t, err)
+		require.Equal(t, "Johnny", update.FirstName)
+		require.Equal(t, "AU", update.Country)
+
+		stored, err := repos.Users.GetUser(context.Background(), u.ID)
+		require.NoError(t, err)
+		require.Equal(t, "Johnny", stored.FirstName)
+		require.Equal(t, "Doe", stored.LastName)
+		require.Equal(t, "AU", stored.Country)
+
+		// All fields are saved
+		stored.LastName = "Dow"
+		stored.Nickname = "Piggin"
+		require.NoError(t, repos.Users.UpdateUser(context.Background(), stored))
+
+		stored, err = repos.Users.GetUser(context.Background(), u.ID)
+		require.NoError(t, err)
+		require.Equal(t, "Dow", stored.LastName)
+		require.Equal(t, "Piggin", stored.Nickname)
+	})
+}
+
+func TestContractDeleteUser(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		u := models.User{Email: testEmail("john")}
+		require.NoError(t, repos.Users.CreateUser(context.Background(), &u))
+
+		require.NoError(t, repos.Users.DeleteUser(context.Background(), u.ID))
+		_, err := repos.Users.GetUser(context.Background(), u.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// Removing missing user is not an error
+		require.NoError(t, repos.Users.DeleteUser(context.Background(), u.ID))
+	})
+}
+
+func TestContractUpdateAndDeleteReturning(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		ctx := context.Background()
+		u := models.User{FirstName: "John", Email: testEmail("john"), Country: "UK"}
+		require.NoError(t, repos.Users.CreateUser(ctx, &u))
+		other := models.User{Email: testEmail("jane")}
+		require.NoError(t, repos.Users.CreateUser(ctx, &other))
+
+		before, after, err := repos.Users.UpdateUserByMapReturning(ctx, u.ID, map[string]interface{}{"country": "AU"})
+		require.NoError(t, err)
+		require.Equal(t, "UK", before.Country)
+		require.Equal(t, "AU", after.Country)
+		require.Equal(t, "John", after.FirstName)
+
+		_, _, err = repos.Users.UpdateUserByMapReturning(ctx, u.ID, map[string]interface{}{"email": other.Email})
+		require.ErrorIs(t, err, ErrDuplicateEmail)
+		_, _, err = repos.Users.UpdateUserByMapReturning(ctx, uuid.New(), map[string]interface{}{"country": "AU"})
+		require.ErrorIs(t, err, ErrNotFound)
+
+		deleted, err := repos.Users.DeleteUserReturning(ctx, u.ID)
+		require.NoError(t, err)
+		require.Equal(t, "AU", deleted.Country)
+		_, err = repos.Users.GetUser(ctx, u.ID)
+		require.ErrorIs(t, err, ErrNotFound)
+
+		// Removing missing user is not an error
+		deleted, err = repos.Users.DeleteUserReturning(ctx, u.ID)
+		require.NoError(t, err)
+		require.Nil(t, deleted)
+	})
+}
+
+func TestContractListUsers(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		uk, au := uuid.NewString(), uuid.NewString()
+		for i, country := range []string{uk, au, uk, au, uk} {
+			u := models.User{FirstName: fmt.Sprint(i), Email: testEmail(fmt.Sprint(i)), Country: country}
+			require.NoError(t, repos.Users.CreateUser(context.Background(), &u))
+		}
+
+		all, err := repos.Users.ListUsers(context.Background(), 0, 0, uk)
+		require.NoError(t, err)
+		require.Len(t, all, 3)
+		for _, u := range all {
+			require.Equal(t, uk, u.Country)
+		}
+
+		users, err := repos.Users.ListUsers(context.Background(), 0, 0, au)
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+
+		// Pages are stable
+		users, err = repos.Users.ListUsers(context.Background(), 2, 1, uk)
+		require.NoError(t, err)
+		require.Len(t, users, 2)
+		require.Equal(t, all[1].ID, users[0].ID)
+		require.Equal(t, all[2].ID, users[1].ID)
+
+		// Offset without limit returns a single user
+		users, err = repos.Users.ListUsers(context.Background(), 0, 1, uk)
+		require.NoError(t, err)
+		require.Len(t, users, 1)
+		require.Equal(t, all[1].ID, users[0].ID)
+
+		users, err = repos.Users.ListUsers(context.Background(), 10, 10, uk)
+		require.NoError(t, err)
+		require.Len(t, users, 0)
+	})
+}
+
+func TestContractListUsersAfter(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		ctx := context.Background()
+		users := []*models.User{}
+		for i := 0; i < 3; i++ {
+			u := models.User{FirstName: fmt.Sprint(i), Email: testEmail(fmt.Sprint(i))}
+			require.NoError(t, repos.Users.CreateUser(ctx, &u))
+			// Cursors are users as stored
+			stored, err := repos.Users.GetUser(ctx, u.ID)
+			require.NoError(t, err)
+			users = append(users, stored)
+		}
+
+		page, err := repos.Users.ListUsersAfter(ctx, users[0], 10)
+		require.NoError(t, err)
+		require.Len(t, page, 2)
+		require.Equal(t, users[1].ID, page[0].ID)
+		require.Equal(t, users[2].ID, page[1].ID)
+
+		page, err = repos.Users.ListUsersAfter(ctx, users[0], 1)
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		require.Equal(t, users[1].ID, page[0].ID)
+
+		// Deleted users don't shift next pages
+		require.NoError(t, repos.Users.DeleteUser(ctx, users[1].ID))
+		page, err = repos.Users.ListUsersAfter(ctx, users[1], 10)
+		require.NoError(t, err)
+		require.Len(t, page, 1)
+		require.Equal(t, users[2].ID, page[0].ID)
+	})
+}
+
+func TestContractCanceledContext(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err := repos.Users.CreateUser(ctx, &models.User{Email: testEmail("john")})
+		require.ErrorIs(t, err, context.Canceled)
+		_, err = repos.Users.ListUsers(ctx, 0, 0, "")
+		require.ErrorIs(t, err, context.Canceled)
+		_, err = repos.Webhooks.ListWebhooks(ctx)
+		require.ErrorIs(t, err, context.Canceled)
+	})
+}
+
+func TestContractWebhooks(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		w := models.Webhook{URL: "http://example.com/" + uuid.NewString(), Methods: "DELETE"}
+		require.NoError(t, repos.Webhooks.CreateWebhook(context.Background(), &w))
+		require.NotEqual(t, uuid.Nil, w.ID)
+
+		webhooks, err := repos.Webhooks.ListWebhooks(context.Background())
+		require.NoError(t, err)
+		require.Contains(t, webhookIDs(webhooks), w.ID)
+
+		require.NoError(t, repos.Webhooks.CreateWebhookDelivery(context.Background(), &models.WebhookDelivery{WebhookID: w.ID, EventID: uuid.New()}))
+		require.NoError(t, repos.Webhooks.CreateWebhookDeadLetter(context.Background(), &models.WebhookDeadLetter{WebhookID: w.ID, EventID: uuid.New()}))
+
+		require.NoError(t, repos.Webhooks.DeleteWebhook(context.Background(), w.ID))
+		webhooks, err = repos.Webhooks.ListWebhooks(context.Background())
+		require.NoError(t, err)
+		require.NotContains(t, webhookIDs(webhooks), w.ID)
+	})
+}
+
+func TestContractUserDeadLetters(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		ctx := context.Background()
+		userID, otherID := uuid.New(), uuid.New()
+		for _, id := range []uuid.UUID{userID, userID, otherID} {
+			require.NoError(t, repos.Webhooks.CreateWebhookDeadLetter(ctx, &models.WebhookDeadLetter{
+				WebhookID: uuid.New(),
+				UserID:    id,
+				Payload:   []byte(`{"user":{"id":"` + id.String() + `"}}`),
+			}))
+		}
+
+		// Dead letters stored before user was recorded are found by payload
+		if gormRepo, ok := repos.Webhooks.(*GormWebhookRepository); ok {
+			legacy := &models.WebhookDeadLetter{WebhookID: uuid.New(), Payload: []byte(`{"user":{"id":"` + userID.String() + `"}}`)}
+			require.NoError(t, gormRepo.CreateWebhookDeadLetter(ctx, legacy))
+			require.NoError(t, gormRepo.DB.Model(legacy).UpdateColumn("user_id", nil).Error)
+			deadLetters, err := repos.Webhooks.ListUserDeadLetters(ctx, userID)
+			require.NoError(t, err)
+			require.Len(t, deadLetters, 3)
+			require.NoError(t, gormRepo.DB.Delete(legacy).Error)
+		}
+
+		deadLetters, err := repos.Webhooks.ListUserDeadLetters(ctx, userID)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 2)
+		require.Contains(t, string(deadLetters[0].Payload), userID.String())
+
+		require.NoError(t, repos.Webhooks.DeleteUserDeadLetters(ctx, userID))
+		deadLetters, err = repos.Webhooks.ListUserDeadLetters(ctx, userID)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 0)
+		deadLetters, err = repos.Webhooks.ListUserDeadLetters(ctx, otherID)
+		require.NoError(t, err)
+		require.Len(t, deadLetters, 1)
+	})
+}
+
+func webhookIDs(webhooks []models.Webhook) []uuid.UUID {
+	ids := []uuid.UUID{}
+	for _, w := range webhooks {
+		ids = append(ids, w.ID)
+	}
+	return ids
+}
+
+func TestContractAuditEvents(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		userID := uuid.New()
+		start := time.Now().UTC().Truncate(time.Millisecond)
+		for i, method := range []string{"AddUser", "ModifyUser", "RemoveUser"} {
+			e := models.AuditEvent{
+				UserID:    userID,
+				Actor:     "admin",
+				Method:    method,
+				Changes:   []models.FieldChange{{Field: "country", Old: "UK", New: "LV"}},
+				ClientIP:  "127.0.0.1",
+				RequestID: method,
+				CreatedAt: start.Add(time.Duration(i) * time.Second),
+			}
+			require.NoError(t, repos.Audit.CreateAuditEvent(context.Background(), &e))
+			require.NotEqual(t, uuid.Nil, e.ID)
+		}
+		require.NoError(t, repos.Audit.CreateAuditEvent(context.Background(), &models.AuditEvent{UserID: uuid.New(), Method: "AddUser"}))
+
+		// Events of the user are listed oldest first with their changes
+		events, err := repos.Audit.ListAuditEvents(context.Background(), AuditFilter{UserID: userID})
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		require.Equal(t, []string{"AddUser", "ModifyUser", "RemoveUser"}, auditMethods(events))
+		require.Equal(t, []models.FieldChange{{Field: "country", Old: "UK", New: "LV"}}, events[0].Changes)
+		require.Equal(t, "admin", events[0].Actor)
+		require.Equal(t, "127.0.0.1", events[0].ClientIP)
+		require.Equal(t, "AddUser", events[0].RequestID)
+
+		// Time range includes Since and excludes Until
+		events, err = repos.Audit.ListAuditEvents(context.Background(), AuditFilter{UserID: userID, Since: start.Add(time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, []string{"ModifyUser", "RemoveUser"}, auditMethods(events))
+		events, err = repos.Audit.ListAuditEvents(context.Background(), AuditFilter{UserID: userID, Until: start.Add(time.Second)})
+		require.NoError(t, err)
+		require.Equal(t, []string{"AddUser"}, auditMethods(events))
+
+		events, err = repos.Audit.ListAuditEvents(context.Background(), AuditFilter{UserID: userID, Limit: 1, Offset: 1})
+		require.NoError(t, err)
+		require.Equal(t, []string{"ModifyUser"}, auditMethods(events))
+
+		// Erased events keep names of changed fields only
+		require.NoError(t, repos.Audit.EraseAuditEvents(context.Background(), userID))
+		events, err = repos.Audit.ListAuditEvents(context.Background(), AuditFilter{UserID: userID})
+		require.NoError(t, err)
+		require.Len(t, events, 3)
+		for _, e := range events {
+			require.Equal(t, []models.FieldChange{{Field: "country", Old: models.ErasedValue, New: models.ErasedValue}}, e.Changes)
+			require.Equal(t, models.ErasedValue, e.ClientIP)
+			require.Equal(t, "admin", e.Actor)
+		}
+	})
+}
+
+func auditMethods(events []models.AuditEvent) []string {
+	methods := []string{}
+	for _, e := range events {
+		methods = append(methods, e.Method)
+	}
+	return methods
+}
+
+func TestContractEraseUser(t *testing.T) {
+	runContract(t, func(t *testing.T, repos Repositories) {
+		ctx := context.Background()
+		user := models.User{FirstName: "Erin", Password: "secret", Email: testEmail("erin"), Country: "UK"}
+		require.NoError(t, repos.Users.CreateUser(ctx, &user))
+		require.NoError(t, repos.Audit.CreateAuditEvent(ctx, &models.AuditEvent{
+			UserID:  user.ID,
+			Method:  "AddUser",
+			Changes: []models.FieldChange{{Field: "first_name", New: "Erin"}},
+		}))
+		require.NoError(t, repos.Webhooks.CreateWebhookDeadLetter(ctx, &models.WebhookDeadLetter{
+			WebhookID: uuid.New(),
+			UserID:    user.ID,
+			Payload:   []byte(`{"user":{"first_name":"Erin"}}`),
+		}))
+
+		before, after, err := repos.Users.EraseUserReturning(ctx, user.ID, &models.AuditEvent{Method: "EraseUser"})
+		require.NoError(t, err)
+		require.Equal(t, "Erin", before.FirstName)
+		require.Empty(t, after.FirstName)
+		erased, err := repos.Users.Primary().GetUser(ctx, user.ID)
+		require.NoError(t, err)
+		require.Empty(t, erased.FirstName)
+		require.Empty(t, erased.Password)
+
+		// Erasure is recorded, values of all events are erased
+		events, err := repos.Audit.ListAuditEvents(ctx, AuditFilter{UserID: user.ID})
+		require.NoError(t, err)
+		require.Equal(t, []string{"AddUser", "EraseUser"}, auditMethods(events))
+		for _, e := range events {
+			for _, c := range e.Changes {
+				require.NotContains(t, []string{c.Old, c.New}, "Erin")
+			}
+		}
+		deadLetters, err := repos.Webhooks.ListUserDeadLetters(ctx, user.ID)
+		require.NoError(t, err)
+		require.Empty(t, deadLetters)
+
+		// Erasing again records nothing
+		_, _, err = repos.Users.EraseUserReturning(ctx, user.ID, &models.AuditEvent{Method: "EraseUser"})
+		require.NoError(t, err)
+		events, err = repos.Audit.ListAuditEvents(ctx, AuditFilter{UserID: user.ID})
+		require.NoError(t, err)
+		require.Len(t, events, 2)
+
+		_, _, err = repos.Users.EraseUserReturning(ctx, uuid.New(), nil)
+		require.ErrorIs(t, err, ErrNotFound)
+	})
+}
@@ -0,0 +1,411 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Returned when encrypted users or webhook secrets are read by repository
+// without keyring.
+var ErrKeyringRequired = errors.New("db: data is encrypted, keyring is required")
+
+// Row of users table written by repository with keyring. Personal fields
+// are encrypted with data key of the user, email and country are searched
+// by blind indexes.
+type encryptedUser struct {
+	models.User
+	EmailIndex   *string
+	CountryIndex *string
+	DataKey      *string
+}
+
+func (encryptedUser) TableName() string {
+	return "users"
+}
+
+// Returns encrypted fields of the user by column. Password is encrypted
+// like the other fields rather than hashed, the service stores it as given.
+func personalFields(u *models.User) map[string]*string {
+	return map[string]*string{
+		"first_name": &u.FirstName,
+		"last_name":  &u.LastName,
+		"nickname":   &u.Nickname,
+		"password":   &u.Password,
+		"email":      &u.Email,
+		"country":    &u.Country,
+	}
+}
+
+// Returns blind index column of searched columns.
+func indexColumn(column string) (string, bool) {
+	switch column {
+	case "email":
+		return "email_index", true
+	case "country":
+		return "country_index", true
+	}
+	return "", false
+}
+
+// Returns blind index of the column value. Emails are indexed trimmed and
+// lowercased, so they are unique regardless of case like with the
+// case-insensitive unique key of MySQL users table.
+func (r *GormUserRepository) blindIndex(column, value string) string {
+	if column == "email" {
+		value = normalizeEmail(value)
+	}
+	return r.Keyring.BlindIndex(column, value)
+}
+
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// Returns ErrDuplicateEmail when another user stored before encryption
+// was enabled has the email. Such users have plaintext email and are not
+// in the email blind index until keys are rotated.
+func plaintextEmailTaken(tx *gorm.DB, email string, id uuid.UUID) error {
+	var count int64
+	err := tx.Model(&encryptedUser{}).
+		Where("email_index IS NULL AND LOWER(TRIM(email)) = ? AND id <> ?", normalizeEmail(email), id).
+		Count(&count).Error
+	if err != nil {
+		return err
+	}
+	if count > 0 {
+		return ErrDuplicateEmail
+	}
+	return nil
+}
+
+// Additional data binding encrypted value to its user and column.
+func fieldData(id uuid.UUID, column string) []byte {
+	return []byte(id.String() + ":" + column)
+}
+
+// Returns row of the user with personal fields encrypted by data key.
+func (r *GormUserRepository) encryptUser(u *models.User, dataKey []byte) (*encryptedUser, error) {
+	row := &encryptedUser{User: *u}
+	for column, value := range personalFields(&row.User) {
+		encrypted, err := encryption.Encrypt(dataKey, *value, fieldData(u.ID, column))
+		if err != nil {
+			return nil, err
+		}
+		*value = encrypted
+	}
+	email := r.blindIndex("email", u.Email)
+	country := r.blindIndex("country", u.Country)
+	row.EmailIndex, row.CountryIndex = &email, &country
+	return row, nil
+}
+
+// Returns user with decrypted personal fields. Plaintext fields written
+// before encryption was enabled are returned as they are.
+func (r *GormUserRepository) decryptUser(row *encryptedUser) (*models.User, error) {
+	u := row.User
+	var dataKey []byte
+	for column, value := range personalFields(&u) {
+		if !encryption.IsEncrypted(*value) {
+			continue
+		}
+		if dataKey == nil {
+			if row.DataKey == nil {
+				return nil, fmt.Errorf("db: user %s has no data key", u.ID)
+			}
+			key, err := r.Keyring.UnwrapDataKey(*row.DataKey, u.ID[:])
+			if err != nil {
+				return nil, fmt.Errorf("db: user %s: %v", u.ID, err)
+			}
+			dataKey = key
+		}
+		plaintext, err := encryption.Decrypt(dataKey, *value, fieldData(u.ID, column))
+		if err != nil {
+			return nil, fmt.Errorf("db: user %s: %v", u.ID, err)
+		}
+		*value = plaintext
+	}
+	return &u, nil
+}
+
+// Returns ErrKeyringRequired when user read by repository without keyring
+// is encrypted.
+func requirePlaintext(u *models.User) error {
+	for _, value := range personalFields(u) {
+		if encryption.IsEncrypted(*value) {
+			return ErrKeyringRequired
+		}
+	}
+	return nil
+}
+
+// Returns data key of the user and whether the user exists. User without
+// data key gets a new one. Data key of a user never changes, so values
+// encrypted by concurrent writes stay readable.
+func (r *GormUserRepository) userDataKey(tx *gorm.DB, id uuid.UUID) ([]byte, bool, error) {
+	row := encryptedUser{}
+	err := tx.Select("id", "data_key").First(&row, "id = ?", id).Error
+	if errors.Is(err, ErrNotFound) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	if row.DataKey != nil && *row.DataKey != "" {
+		key, err := r.Keyring.UnwrapDataKey(*row.DataKey, id[:])
+		return key, true, err
+	}
+
+	key, wrapped, err := r.Keyring.NewDataKey(id[:])
+	if err != nil {
+		return nil, false, err
+	}
+	result := tx.Model(&encryptedUser{}).
+		Where("id = ? AND (data_key IS NULL OR data_key = '')", id).
+		UpdateColumn("data_key", wrapped)
+	if result.Error != nil {
+		return nil, false, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// Stored by concurrent write
+		return r.userDataKey(tx, id)
+	}
+	return key, true, nil
+}
+
+func (r *GormUserRepository) createEncryptedUser(ctx context.Context, u *models.User) error {
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	dataKey, wrapped, err := r.Keyring.NewDataKey(u.ID[:])
+	if err != nil {
+		return err
+	}
+	row, err := r.encryptUser(u, dataKey)
+	if err != nil {
+		return err
+	}
+	row.DataKey = &wrapped
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := plaintextEmailTaken(tx, u.Email, u.ID); err != nil {
+			return err
+		}
+		return tx.Create(row).Error
+	})
+	if err != nil {
+		return userError(err)
+	}
+	u.CreatedAt, u.UpdatedAt = row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+func (r *GormUserRepository) getEncryptedUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	row := &encryptedUser{}
+	if err := r.DB.WithContext(ctx).First(row, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+	return r.decryptUser(row)
+}
+
+func (r *GormUserRepository) updateEncryptedUser(ctx context.Context, u *models.User) error {
+	if u.ID == uuid.Nil {
+		return gorm.ErrMissingWhereClause
+	}
+	return userError(r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := plaintextEmailTaken(tx, u.Email, u.ID); err != nil {
+			return err
+		}
+		dataKey, exists, err := r.userDataKey(tx, u.ID)
+		if err != nil {
+			return err
+		}
+		var wrapped string
+		if !exists {
+			if dataKey, wrapped, err = r.Keyring.NewDataKey(u.ID[:]); err != nil {
+				return err
+			}
+		}
+		row, err := r.encryptUser(u, dataKey)
+		if err != nil {
+			return err
+		}
+		if wrapped != "" {
+			row.DataKey = &wrapped
+		} else {
+			row.DataKey = nil
+			tx = tx.Omit("data_key")
+		}
+		if err := tx.Save(row).Error; err != nil {
+			return err
+		}
+		u.CreatedAt, u.UpdatedAt = row.CreatedAt, row.UpdatedAt
+		return nil
+	}))
+}
+
+func (r *GormUserRepository) updateEncryptedUserByMap(ctx context.Context, u *models.User, m map[string]interface{}) error {
+	updated := models.User{}
+	if err := applyUserUpdates(&updated, m); err != nil {
+		return err
+	}
+	fields := personalFields(&updated)
+	return userError(r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		dataKey, exists, err := r.userDataKey(tx, u.ID)
+		if err != nil || !exists {
+			return err
+		}
+		if _, ok := m["email"]; ok {
+			if err := plaintextEmailTaken(tx, updated.Email, u.ID); err != nil {
+				return err
+			}
+		}
+		values := map[string]interface{}{}
+		for column, value := range m {
+			field, ok := fields[column]
+			if !ok {
+				values[column] = value
+				continue
+			}
+			if values[column], err = encryption.Encrypt(dataKey, *field, fieldData(u.ID, column)); err != nil {
+				return err
+			}
+			if index, ok := indexColumn(column); ok {
+				values[index] = r.blindIndex(column, *field)
+			}
+		}
+		row := &encryptedUser{User: models.User{ID: u.ID}}
+		if err := tx.Model(row).Updates(values).Error; err != nil {
+			return err
+		}
+		u.UpdatedAt = row.UpdatedAt
+		return applyUserUpdates(u, m)
+	}))
+}
+
+func (r *GormUserRepository) listEncryptedUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
+	tx := r.DB.WithContext(ctx).Order("created_at, id").Limit(limit).Offset(offset)
+	if country != "" {
+		// Users written before encryption was enabled have plaintext country
+		tx.Where("country_index = ? OR country = ?", r.blindIndex("country", country), country)
+	}
+	return r.findEncryptedUsers(tx)
+}
+
+// Finds users of the query and decrypts them.
+func (r *GormUserRepository) findEncryptedUsers(tx *gorm.DB) ([]models.User, error) {
+	rows := []encryptedUser{}
+	if err := tx.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	users := []models.User{}
+	for i := range rows {
+		u, err := r.decryptUser(&rows[i])
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, *u)
+	}
+	return users, nil
+}
+
+// Wraps data keys of all users with the primary key of the keyring and
+// encrypts plaintext fields written before encryption was enabled.
+// Returns number of changed users. Each value is changed only if it was
+// not modified concurrently, so rotation can run while the service is
+// serving requests.
+func (r *GormUserRepository) RotateKeys(ctx context.Context) (int, error) {
+	if r.Keyring == nil {
+		return 0, errors.New("db: keyring is not configured")
+	}
+	changed := 0
+	var lastID *uuid.UUID
+	for {
+		rows := []encryptedUser{}
+		q := r.DB.WithContext(ctx).Order("id").Limit(rotateBatchSize)
+		if lastID != nil {
+			q = q.Where("id > ?", *lastID)
+		}
+		if err := q.Find(&rows).Error; err != nil {
+			return changed, err
+		}
+		for i := range rows {
+			ok, err := r.rotateUser(ctx, &rows[i])
+			if err != nil {
+				return changed, fmt.Errorf("user %s: %v", rows[i].ID, err)
+			}
+			if ok {
+				changed++
+			}
+		}
+		if len(rows) < rotateBatchSize {
+			return changed, nil
+		}
+		lastID = &rows[len(rows)-1].ID
+	}
+}
+
+// Users read at once by RotateKeys.
+const rotateBatchSize = 100
+
+// Rewraps data key and encrypts plaintext fields of the user.
+func (r *GormUserRepository) rotateUser(ctx context.Context, row *encryptedUser) (bool, error) {
+	changed := false
+	db := r.DB.WithContext(ctx)
+	id := row.ID
+	var dataKey []byte
+	if row.DataKey != nil && *row.DataKey != "" {
+		key, err := r.Keyring.UnwrapDataKey(*row.DataKey, id[:])
+		if err != nil {
+			return false, err
+		}
+		dataKey = key
+		if r.Keyring.NeedsRewrap(*row.DataKey) {
+			wrapped, err := r.Keyring.WrapDataKey(dataKey, id[:])
+			if err != nil {
+				return false, err
+			}
+			result := db.Model(&encryptedUser{}).
+				Where("id = ? AND data_key = ?", id, *row.DataKey).
+				UpdateColumn("data_key", wrapped)
+			if result.Error != nil {
+				return false, result.Error
+			}
+			changed = result.RowsAffected > 0
+		}
+	}
+
+	for column, value := range personalFields(&row.User) {
+		if encryption.IsEncrypted(*value) {
+			continue
+		}
+		if dataKey == nil {
+			key, exists, err := r.userDataKey(db, id)
+			if err != nil || !exists {
+				return changed, err
+			}
+			dataKey = key
+		}
+		encrypted, err := encryption.Encrypt(dataKey, *value, fieldData(id, column))
+		if err != nil {
+			return changed, err
+		}
+		values := map[string]interface{}{column: encrypted}
+		if index, ok := indexColumn(column); ok {
+			values[index] = r.blindIndex(column, *value)
+		}
+		result := db.Model(&encryptedUser{}).
+			Where("id = ? AND "+column+" = ?", id, *value).
+			UpdateColumns(values)
+		if result.Error != nil {
+			return changed, userError(result.Error)
+		}
+		changed = changed || result.RowsAffected > 0
+	}
+	return changed, nil
+}
@@ -0,0 +1,254 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptedUsers(t *testing.T) {
+	gdb, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	require.NoError(t, Migrate(gdb))
+	keyring, err := encryption.NewKeyring()
+	require.NoError(t, err)
+	plain := NewUserRepository(gdb)
+	encrypted := NewEncryptedUserRepository(gdb, keyring)
+	ctx := context.Background()
+
+	// Stored values are encrypted and readable only with the keyring
+	john := models.User{FirstName: "John", LastName: "Doe", Password: "secret", Email: "john@email.com", Country: "UK"}
+	require.NoError(t, encrypted.CreateUser(ctx, &john))
+	stored := encryptedUser{}
+	require.NoError(t, gdb.First(&stored, "id = ?", john.ID).Error)
+	require.True(t, encryption.IsEncrypted(stored.Email))
+	require.True(t, encryption.IsEncrypted(stored.FirstName))
+	require.True(t, encryption.IsEncrypted(stored.Password))
+	require.NotContains(t, stored.Email, "john")
+	require.Equal(t, keyring.BlindIndex("email", "john@email.com"), *stored.EmailIndex)
+
+	_, err = plain.GetUser(ctx, john.ID)
+	require.ErrorIs(t, err, ErrKeyringRequired)
+	_, err = plain.ListUsers(ctx, 0, 0, "")
+	require.ErrorIs(t, err, ErrKeyringRequired)
+
+	// Users written before encryption was enabled are readable and found
+	// by country
+	jane := models.User{FirstName: "Jane", Email: "jane@email.com", Country: "UK"}
+	require.NoError(t, plain.CreateUser(ctx, &jane))
+	users, err := encrypted.ListUsers(ctx, 0, 0, "UK")
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+	require.Equal(t, "John", users[0].FirstName)
+	require.Equal(t, "Jane", users[1].FirstName)
+
+	// Emails are unique regardless of case, also among users stored before
+	// encryption was enabled
+	err = encrypted.CreateUser(ctx, &models.User{Email: " John@Email.com"})
+	require.ErrorIs(t, err, ErrDuplicateEmail)
+	err = encrypted.CreateUser(ctx, &models.User{Email: "JANE@email.com"})
+	require.ErrorIs(t, err, ErrDuplicateEmail)
+	err = encrypted.UpdateUserByMap(ctx, &models.User{ID: john.ID}, map[string]interface{}{"email": "jane@email.com"})
+	require.ErrorIs(t, err, ErrDuplicateEmail)
+	err = encrypted.UpdateUser(ctx, &models.User{ID: john.ID, Email: "Jane@email.com"})
+	require.ErrorIs(t, err, ErrDuplicateEmail)
+
+	// Partial update encrypts changed fields only
+	require.NoError(t, encrypted.UpdateUserByMap(ctx, &models.User{ID: jane.ID}, map[string]interface{}{"nickname": "J"}))
+	stored = encryptedUser{}
+	require.NoError(t, gdb.First(&stored, "id = ?", jane.ID).Error)
+	require.True(t, encryption.IsEncrypted(stored.Nickname))
+	require.Equal(t, "Jane", stored.FirstName)
+	user, err := encrypted.GetUser(ctx, jane.ID)
+	require.NoError(t, err)
+	require.Equal(t, "J", user.Nickname)
+	require.Equal(t, "jane@email.com", user.Email)
+
+	// Rotation adds plaintext users to blind indexes
+	changed, err := encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+	stored = encryptedUser{}
+	require.NoError(t, gdb.First(&stored, "id = ?", jane.ID).Error)
+	require.True(t, encryption.IsEncrypted(stored.FirstName))
+	require.True(t, encryption.IsEncrypted(stored.Email))
+	require.True(t, encryption.IsEncrypted(stored.Country))
+	require.Equal(t, keyring.BlindIndex("email", "jane@email.com"), *stored.EmailIndex)
+	err = encrypted.CreateUser(ctx, &models.User{Email: "Jane@email.com"})
+	require.ErrorIs(t, err, ErrDuplicateEmail)
+	users, err = encrypted.ListUsers(ctx, 0, 0, "UK")
+	require.NoError(t, err)
+	require.Len(t, users, 2)
+
+	// Data keys are rewrapped by new primary key, values stay the same
+	require.NoError(t, keyring.AddKey())
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, changed)
+	rows := []encryptedUser{}
+	require.NoError(t, gdb.Find(&rows).Error)
+	for _, row := range rows {
+		require.True(t, strings.HasPrefix(*row.DataKey, keyring.Primary()+":"))
+	}
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, changed)
+
+	// Full update keeps data key of the user
+	user, err = encrypted.Primary().GetUser(ctx, john.ID)
+	require.NoError(t, err)
+	user.Country = "AU"
+	require.NoError(t, encrypted.UpdateUser(ctx, user))
+	user, err = encrypted.GetUser(ctx, john.ID)
+	require.NoError(t, err)
+	require.Equal(t, "John", user.FirstName)
+	require.Equal(t, "secret", user.Password)
+	require.Equal(t, "AU", user.Country)
+	users, err = encrypted.ListUsers(ctx, 0, 0, "AU")
+	require.NoError(t, err)
+	require.Len(t, users, 1)
+}
+
+func TestEncryptedWebhooks(t *testing.T) {
+	gdb, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	require.NoError(t, Migrate(gdb))
+	keyring, err := encryption.NewKeyring()
+	require.NoError(t, err)
+	plain := NewWebhookRepository(gdb)
+	encrypted := NewEncryptedWebhookRepository(gdb, keyring)
+	ctx := context.Background()
+
+	// Secrets are sealed at rest and returned in plaintext
+	sealed := models.Webhook{URL: "https://example.com/a", Secret: "secret-a"}
+	require.NoError(t, encrypted.CreateWebhook(ctx, &sealed))
+	require.Equal(t, "secret-a", sealed.Secret)
+	stored := models.Webhook{}
+	require.NoError(t, gdb.First(&stored, "id = ?", sealed.ID).Error)
+	require.True(t, encryption.IsSealed(stored.Secret))
+	require.NotContains(t, stored.Secret, "secret-a")
+	_, err = plain.ListWebhooks(ctx)
+	require.ErrorIs(t, err, ErrKeyringRequired)
+
+	// Secrets stored before encryption was enabled are sealed by rotation
+	legacy := models.Webhook{URL: "https://example.com/b", Secret: "secret-b"}
+	require.NoError(t, plain.CreateWebhook(ctx, &legacy))
+	webhooks, err := encrypted.ListWebhooks(ctx)
+	require.NoError(t, err)
+	require.Len(t, webhooks, 2)
+	require.Equal(t, "secret-a", webhooks[0].Secret)
+	require.Equal(t, "secret-b", webhooks[1].Secret)
+
+	changed, err := encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+	require.NoError(t, keyring.AddKey())
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, changed)
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, changed)
+
+	webhooks, err = encrypted.ListWebhooks(ctx)
+	require.NoError(t, err)
+	require.Equal(t, "secret-a", webhooks[0].Secret)
+	require.Equal(t, "secret-b", webhooks[1].Secret)
+}
+
+func TestEncryptedDeadLetters(t *testing.T) {
+	gdb, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	require.NoError(t, Migrate(gdb))
+	keyring, err := encryption.NewKeyring()
+	require.NoError(t, err)
+	plain := NewWebhookRepository(gdb)
+	encrypted := NewEncryptedWebhookRepository(gdb, keyring)
+	ctx := context.Background()
+	userID := uuid.New()
+
+	// Payloads are sealed at rest and returned in plaintext
+	payload := []byte(`{"user":{"id":"` + userID.String() + `","email":"john@email.com"}}`)
+	sealed := models.WebhookDeadLetter{UserID: userID, Payload: payload}
+	require.NoError(t, encrypted.CreateWebhookDeadLetter(ctx, &sealed))
+	stored := models.WebhookDeadLetter{}
+	require.NoError(t, gdb.First(&stored, "id = ?", sealed.ID).Error)
+	require.True(t, encryption.IsSealed(string(stored.Payload)))
+	require.NotContains(t, string(stored.Payload), "john")
+	_, err = plain.ListUserDeadLetters(ctx, userID)
+	require.ErrorIs(t, err, ErrKeyringRequired)
+
+	// Payloads stored before encryption was enabled are sealed by rotation
+	require.NoError(t, plain.CreateWebhookDeadLetter(ctx, &models.WebhookDeadLetter{UserID: userID, Payload: payload}))
+	changed, err := encrypted.RotateDeadLetterKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+	require.NoError(t, keyring.AddKey())
+	changed, err = encrypted.RotateDeadLetterKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, changed)
+
+	deadLetters, err := encrypted.ListUserDeadLetters(ctx, userID)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 2)
+	for _, d := range deadLetters {
+		require.Equal(t, payload, d.Payload)
+	}
+}
+
+func TestEncryptedAuditEvents(t *testing.T) {
+	gdb, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	require.NoError(t, Migrate(gdb))
+	keyring, err := encryption.NewKeyring()
+	require.NoError(t, err)
+	plain := NewAuditRepository(gdb)
+	encrypted := NewEncryptedAuditRepository(gdb, keyring)
+	ctx := context.Background()
+	userID := uuid.New()
+
+	// Changed values and client address are sealed at rest
+	changes := []models.FieldChange{{Field: "first_name", Old: "John", New: "Johnny"}}
+	e := models.AuditEvent{UserID: userID, Method: "ModifyUser", Changes: changes, ClientIP: "10.0.0.1"}
+	require.NoError(t, encrypted.CreateAuditEvent(ctx, &e))
+	require.Equal(t, "John", e.Changes[0].Old)
+	stored := models.AuditEvent{}
+	require.NoError(t, gdb.First(&stored, "id = ?", e.ID).Error)
+	require.True(t, encryption.IsSealed(stored.Changes[0].Old))
+	require.True(t, encryption.IsSealed(stored.Changes[0].New))
+	require.True(t, encryption.IsSealed(stored.ClientIP))
+	_, err = plain.ListAuditEvents(ctx, AuditFilter{UserID: userID})
+	require.ErrorIs(t, err, ErrKeyringRequired)
+
+	// Events stored before encryption was enabled are sealed by rotation
+	require.NoError(t, plain.CreateAuditEvent(ctx, &models.AuditEvent{UserID: userID, Method: "AddUser", Changes: changes}))
+	changed, err := encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 1, changed)
+	require.NoError(t, keyring.AddKey())
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 2, changed)
+
+	events, err := encrypted.ListAuditEvents(ctx, AuditFilter{UserID: userID})
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	for _, e := range events {
+		require.Equal(t, changes, e.Changes)
+	}
+
+	// Erased events hold no sealed values and need no keyring
+	require.NoError(t, encrypted.EraseAuditEvents(ctx, userID))
+	events, err = plain.ListAuditEvents(ctx, AuditFilter{UserID: userID})
+	require.NoError(t, err)
+	require.Equal(t, models.ErasedValue, events[0].Changes[0].Old)
+	changed, err = encrypted.RotateKeys(ctx)
+	require.NoError(t, err)
+	require.Equal(t, 0, changed)
+}
@@ -0,0 +1,557 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/models"
+)
+
+// Number of latest webhook deliveries kept by MemoryWebhookRepository.
+const memoryDeliveryLimit = 1000
+
+// Creates in-memory repositories. Data is lost when process exits.
+func NewMemoryRepositories() Repositories {
+	users := NewMemoryUserRepository()
+	users.webhooks = NewMemoryWebhookRepository()
+	users.audit = NewMemoryAuditRepository()
+	return Repositories{
+		Users:    users,
+		Webhooks: users.webhooks,
+		Audit:    users.audit,
+	}
+}
+
+// Thread-safe in-memory user repository. Useful for tests and demos as it
+// behaves the same way as GormUserRepository: email is unique, users are
+// listed in the order they were created and canceled context is an error.
+type MemoryUserRepository struct {
+	mu    sync.RWMutex
+	users map[uuid.UUID]*models.User
+	order []uuid.UUID
+
+	// Data of users erased with them, nil when not stored.
+	webhooks *MemoryWebhookRepository
+	audit    *MemoryAuditRepository
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[uuid.UUID]*models.User{}}
+}
+
+// In-memory repository has no replicas.
+func (r *MemoryUserRepository) Primary() UserRepository {
+	return r
+}
+
+func (r *MemoryUserRepository) CreateUser(ctx context.Context, u *models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.create(u)
+}
+
+// Must be called with mu held.
+func (r *MemoryUserRepository) create(u *models.User) error {
+	if u.ID == uuid.Nil {
+		u.ID = uuid.New()
+	}
+	if _, ok := r.users[u.ID]; ok {
+		return fmt.Errorf("duplicate user id %s", u.ID)
+	}
+	if r.emailTaken(u.Email, u.ID) {
+		return ErrDuplicateEmail
+	}
+
+	now := time.Now()
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = now
+	}
+	if u.UpdatedAt.IsZero() {
+		u.UpdatedAt = now
+	}
+	rec := *u
+	r.users[u.ID] = &rec
+	r.order = append(r.order, u.ID)
+	return nil
+}
+
+func (r *MemoryUserRepository) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	rec, ok := r.users[id]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	u := *rec
+	return &u, nil
+}
+
+// Saves all fields of the user. User is created when it does not exist.
+func (r *MemoryUserRepository) UpdateUser(ctx context.Context, u *models.User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.users[u.ID]
+	if !ok {
+		return r.create(u)
+	}
+	if r.emailTaken(u.Email, u.ID) {
+		return ErrDuplicateEmail
+	}
+	if u.CreatedAt.IsZero() {
+		u.CreatedAt = rec.CreatedAt
+	}
+	u.UpdatedAt = time.Now()
+	*rec = *u
+	return nil
+}
+
+// Updates columns provided in the map. Updated columns are set on u as
+// well. Missing user is not an error, same as for gorm update.
+func (r *MemoryUserRepository) UpdateUserByMap(ctx context.Context, u *models.User, m map[string]interface{}) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.users[u.ID]
+	if !ok {
+		return nil
+	}
+
+	updated := *rec
+	if err := applyUserUpdates(&updated, m); err != nil {
+		return err
+	}
+	if r.emailTaken(updated.Email, u.ID) {
+		return ErrDuplicateEmail
+	}
+	updated.UpdatedAt = time.Now()
+	*rec = updated
+
+	if err := applyUserUpdates(u, m); err != nil {
+		return err
+	}
+	u.UpdatedAt = updated.UpdatedAt
+	return nil
+}
+
+func (r *MemoryUserRepository) UpdateUserByMapReturning(ctx context.Context, id uuid.UUID, m map[string]interface{}) (before, after *models.User, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.users[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	old, updated := *rec, *rec
+	if err := applyUserUpdates(&updated, m); err != nil {
+		return nil, nil, err
+	}
+	if r.emailTaken(updated.Email, id) {
+		return nil, nil, ErrDuplicateEmail
+	}
+	updated.UpdatedAt = time.Now()
+	*rec = updated
+	return &old, &updated, nil
+}
+
+func (r *MemoryUserRepository) DeleteUserReturning(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.users[id]
+	if !ok {
+		return nil, nil
+	}
+	r.delete(id)
+	return rec, nil
+}
+
+// Audit events and dead letters are erased while the user is locked, so
+// erasure is atomic for readers of users only.
+func (r *MemoryUserRepository) EraseUserReturning(ctx context.Context, id uuid.UUID, event *models.AuditEvent) (before, after *models.User, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, nil, err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	rec, ok := r.users[id]
+	if !ok {
+		return nil, nil, ErrNotFound
+	}
+	old, erased := *rec, *rec
+	erased.Erase()
+	erased.UpdatedAt = time.Now()
+	*rec = erased
+
+	if r.audit != nil {
+		if recordErasure(event, &old, &erased) {
+			if err := r.audit.CreateAuditEvent(ctx, event); err != nil {
+				return nil, nil, err
+			}
+		}
+		if err := r.audit.EraseAuditEvents(ctx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	if r.webhooks != nil {
+		if err := r.webhooks.DeleteUserDeadLetters(ctx, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	return &old, &erased, nil
+}
+
+func (r *MemoryUserRepository) DeleteUser(ctx context.Context, userId uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.delete(userId)
+	return nil
+}
+
+// Must be called with mu held.
+func (r *MemoryUserRepository) delete(userId uuid.UUID) {
+	if _, ok := r.users[userId]; !ok {
+		return
+	}
+	delete(r.users, userId)
+	for i, id := range r.order {
+		if id == userId {
+			r.order = append(r.order[:i], r.order[i+1:]...)
+			break
+		}
+	}
+}
+
+// Lists users same way as GormUserRepository. Zero limit means no limit
+// unless offset is provided, then a single user is returned.
+func (r *MemoryUserRepository) ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if offset > 0 && limit == 0 {
+		limit = 1
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := []models.User{}
+	skipped := 0
+	for _, id := range r.order {
+		u := r.users[id]
+		if country != "" && u.Country != country {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		if limit > 0 && len(users) >= limit {
+			break
+		}
+		users = append(users, *u)
+	}
+	return users, nil
+}
+
+func (r *MemoryUserRepository) ListUsersAfter(ctx context.Context, after *models.User, limit int) ([]models.User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	users := []models.User{}
+	for _, u := range r.users {
+		if after == nil || userAfter(u, after) {
+			users = append(users, *u)
+		}
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return userAfter(&users[j], &users[i])
+	})
+	if limit > 0 && len(users) > limit {
+		users = users[:limit]
+	}
+	return users, nil
+}
+
+// Reports whether user a follows user b in created_at and id order.
+func userAfter(a, b *models.User) bool {
+	if !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.After(b.CreatedAt)
+	}
+	return a.ID.String() > b.ID.String()
+}
+
+// Checks if email is used by other user. Must be called with mu held.
+func (r *MemoryUserRepository) emailTaken(email string, id uuid.UUID) bool {
+	for _, u := range r.users {
+		if u.Email == email && u.ID != id {
+			return true
+		}
+	}
+	return false
+}
+
+// Sets user fields from map of column names as used by gorm.
+func applyUserUpdates(u *models.User, m map[string]interface{}) error {
+	for column, value := range m {
+		s, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("invalid value type %T for column %s", value, column)
+		}
+		switch column {
+		case "first_name":
+			u.FirstName = s
+		case "last_name":
+			u.LastName = s
+		case "nickname":
+			u.Nickname = s
+		case "password":
+			u.Password = s
+		case "email":
+			u.Email = s
+		case "country":
+			u.Country = s
+		default:
+			return fmt.Errorf("unknown user column %s", column)
+		}
+	}
+	return nil
+}
+
+// Thread-safe in-memory webhook repository. Only the latest deliveries
+// are kept.
+type MemoryWebhookRepository struct {
+	mu          sync.RWMutex
+	webhooks    []models.Webhook
+	deliveries  []models.WebhookDelivery
+	deadLetters []models.WebhookDeadLetter
+}
+
+func NewMemoryWebhookRepository() *MemoryWebhookRepository {
+	return &MemoryWebhookRepository{}
+}
+
+func (r *MemoryWebhookRepository) CreateWebhook(ctx context.Context, w *models.Webhook) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	now := time.Now()
+	if w.CreatedAt.IsZero() {
+		w.CreatedAt = now
+	}
+	if w.UpdatedAt.IsZero() {
+		w.UpdatedAt = now
+	}
+	r.webhooks = append(r.webhooks, *w)
+	return nil
+}
+
+func (r *MemoryWebhookRepository) ListWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]models.Webhook{}, r.webhooks...), nil
+}
+
+func (r *MemoryWebhookRepository) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i, w := range r.webhooks {
+		if w.ID == id {
+			r.webhooks = append(r.webhooks[:i], r.webhooks[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (r *MemoryWebhookRepository) CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	r.deliveries = append(r.deliveries, *d)
+	if len(r.deliveries) > memoryDeliveryLimit {
+		r.deliveries = r.deliveries[len(r.deliveries)-memoryDeliveryLimit:]
+	}
+	return nil
+}
+
+func (r *MemoryWebhookRepository) CreateWebhookDeadLetter(ctx context.Context, d *models.WebhookDeadLetter) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	if d.CreatedAt.IsZero() {
+		d.CreatedAt = time.Now()
+	}
+	r.deadLetters = append(r.deadLetters, *d)
+	return nil
+}
+
+func (r *MemoryWebhookRepository) ListUserDeadLetters(ctx context.Context, userID uuid.UUID) ([]models.WebhookDeadLetter, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	deadLetters := []models.WebhookDeadLetter{}
+	for _, d := range r.deadLetters {
+		if d.UserID == userID {
+			deadLetters = append(deadLetters, d)
+		}
+	}
+	return deadLetters, nil
+}
+
+func (r *MemoryWebhookRepository) DeleteUserDeadLetters(ctx context.Context, userID uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	kept := []models.WebhookDeadLetter{}
+	for _, d := range r.deadLetters {
+		if d.UserID != userID {
+			kept = append(kept, d)
+		}
+	}
+	r.deadLetters = kept
+	return nil
+}
+
+// Returns the latest webhook deliveries.
+func (r *MemoryWebhookRepository) Deliveries() []models.WebhookDelivery {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]models.WebhookDelivery{}, r.deliveries...)
+}
+
+// Returns events which could not be delivered.
+func (r *MemoryWebhookRepository) DeadLetters() []models.WebhookDeadLetter {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return append([]models.WebhookDeadLetter{}, r.deadLetters...)
+}
+
+// Thread-safe in-memory audit repository.
+type MemoryAuditRepository struct {
+	mu     sync.RWMutex
+	events []models.AuditEvent
+}
+
+func NewMemoryAuditRepository() *MemoryAuditRepository {
+	return &MemoryAuditRepository{}
+}
+
+func (r *MemoryAuditRepository) CreateAuditEvent(ctx context.Context, e *models.AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if e.ID == uuid.Nil {
+		e.ID = uuid.New()
+	}
+	if e.CreatedAt.IsZero() {
+		e.CreatedAt = time.Now()
+	}
+	rec := *e
+	rec.Changes = append([]models.FieldChange{}, e.Changes...)
+	r.events = append(r.events, rec)
+	return nil
+}
+
+// Lists events in the order they were created.
+func (r *MemoryAuditRepository) ListAuditEvents(ctx context.Context, f AuditFilter) ([]models.AuditEvent, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if f.Offset > 0 && f.Limit == 0 {
+		f.Limit = 1
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	events := []models.AuditEvent{}
+	skipped := 0
+	for _, e := range r.events {
+		if f.UserID != uuid.Nil && e.UserID != f.UserID {
+			continue
+		}
+		if !f.Since.IsZero() && e.CreatedAt.Before(f.Since) {
+			continue
+		}
+		if !f.Until.IsZero() && !e.CreatedAt.Before(f.Until) {
+			continue
+		}
+		if skipped < f.Offset {
+			skipped++
+			continue
+		}
+		if f.Limit > 0 && len(events) >= f.Limit {
+			break
+		}
+		e.Changes = append([]models.FieldChange{}, e.Changes...)
+		events = append(events, e)
+	}
+	return events, nil
+}
+
+func (r *MemoryAuditRepository) EraseAuditEvents(ctx context.Context, userID uuid.UUID) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.events {
+		if r.events[i].UserID == userID {
+			r.events[i].Erase()
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryUserConcurrentAccess(t *testing.T) {
+	repo := NewMemoryUserRepository()
+	wg := sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			u := models.User{Email: fmt.Sprintf("%d@email.com", i)}
+			require.NoError(t, repo.CreateUser(context.Background(), &u))
+			_, err := repo.ListUsers(context.Background(), 0, 0, "")
+			require.NoError(t, err)
+			require.NoError(t, repo.UpdateUserByMap(context.Background(), &models.User{ID: u.ID}, map[string]interface{}{"country": "UK"}))
+		}(i)
+	}
+	wg.Wait()
+
+	users, err := repo.ListUsers(context.Background(), 0, 0, "UK")
+	require.NoError(t, err)
+	require.Len(t, users, 20)
+}
+
+func TestMemoryWebhooks(t *testing.T) {
+	repo := NewMemoryWebhookRepository()
+	w := models.Webhook{URL: "http://example.com"}
+	require.NoError(t, repo.CreateWebhook(context.Background(), &w))
+	require.NotEqual(t, uuid.Nil, w.ID)
+
+	webhooks, err := repo.ListWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, webhooks, 1)
+
+	require.NoError(t, repo.CreateWebhookDelivery(context.Background(), &models.WebhookDelivery{WebhookID: w.ID}))
+	require.NoError(t, repo.CreateWebhookDeadLetter(context.Background(), &models.WebhookDeadLetter{WebhookID: w.ID}))
+	require.Len(t, repo.Deliveries(), 1)
+	require.Len(t, repo.DeadLetters(), 1)
+
+	require.NoError(t, repo.DeleteWebhook(context.Background(), w.ID))
+	webhooks, err = repo.ListWebhooks(context.Background())
+	require.NoError(t, err)
+	require.Len(t, webhooks, 0)
+}
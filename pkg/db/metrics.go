@@ -0,0 +1,84 @@
+package db
+
+import (
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"gorm.io/gorm"
+)
+
+// Duration of gorm queries exposed at /metrics.
+var queryDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+	Namespace: "userservice",
+	Name:      "db_query_duration_seconds",
+	Help:      "Duration of database queries by operation and table.",
+	Buckets:   prometheus.DefBuckets,
+}, []string{"operation", "table"})
+
+// Key of query start time in gorm statement.
+const queryStartKey = "metrics:start"
+
+// Gorm plugin measuring duration of queries.
+type queryMetrics struct{}
+
+func (queryMetrics) Name() string {
+	return "metrics"
+}
+
+// Registers callbacks around every gorm operation.
+func (queryMetrics) Initialize(db *gorm.DB) error {
+	type register func(name string, fn func(*gorm.DB)) error
+	c := db.Callback()
+	operations := []struct {
+		name          string
+		before, after register
+	}{
+		{"create", c.Create().Before("gorm:create").Register, c.Create().After("gorm:create").Register},
+		{"query", c.Query().Before("gorm:query").Register, c.Query().After("gorm:query").Register},
+		{"update", c.Update().Before("gorm:update").Register, c.Update().After("gorm:update").Register},
+		{"delete", c.Delete().Before("gorm:delete").Register, c.Delete().After("gorm:delete").Register},
+		{"row", c.Row().Before("gorm:row").Register, c.Row().After("gorm:row").Register},
+		{"raw", c.Raw().Before("gorm:raw").Register, c.Raw().After("gorm:raw").Register},
+	}
+	for _, op := range operations {
+		if err := op.before("metrics:before_"+op.name, startQuery); err != nil {
+			return err
+		}
+		if err := op.after("metrics:after_"+op.name, observeQuery(op.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startQuery(db *gorm.DB) {
+	db.InstanceSet(queryStartKey, time.Now())
+}
+
+func observeQuery(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		start, ok := db.InstanceGet(queryStartKey)
+		if !ok {
+			return
+		}
+		queryDuration.WithLabelValues(operation, db.Statement.Table).Observe(time.Since(start.(time.Time)).Seconds())
+	}
+}
+
+// Registers connection pool statistics of the database and its replicas,
+// labeled primary and replica1, replica2, ... In-memory repositories have
+// no pools.
+func (r Repositories) RegisterMetrics(reg prometheus.Registerer) error {
+	pools, err := r.pools()
+	if err != nil {
+		return err
+	}
+	for _, pool := range pools {
+		if err := reg.Register(collectors.NewDBStatsCollector(pool.DB, pool.name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,324 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Migration files are stored per database in migrations/<dialect> as
+// <version>_<name>.up.sql and <version>_<name>.down.sql.
+//
+//go:embed migrations
+var migrationFiles embed.FS
+
+var (
+	migrationFileName = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+	statementEnd      = regexp.MustCompile(`;\s*\n`)
+)
+
+const (
+	// Table storing applied migration versions.
+	migrationsTable = "schema_migrations"
+
+	// Name of MySQL lock and key of PostgreSQL advisory lock held while
+	// migrating so concurrent instances don't apply migrations twice.
+	migrationLockName       = "user_service_schema_migrations"
+	migrationLockKey  int64 = 7305011812
+
+	// How long MySQL waits for migration lock.
+	migrationLockTimeout = 60 * time.Second
+)
+
+// Versioned schema change.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// Migration and whether it is applied to the database.
+type MigrationStatus struct {
+	Migration
+	Applied   bool
+	AppliedAt time.Time
+}
+
+// Applies and rolls back embedded SQL migrations. Applied versions are
+// stored in schema_migrations table.
+type Migrator struct {
+	db         *sql.DB
+	dialect    string
+	migrations []Migration
+}
+
+// Creates migrator for the database loading migrations of its dialect.
+func NewMigrator(db *gorm.DB) (*Migrator, error) {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return nil, err
+	}
+	dialect := db.Dialector.Name()
+	migrations, err := loadMigrations(dialect)
+	if err != nil {
+		return nil, err
+	}
+	return &Migrator{db: sqlDB, dialect: dialect, migrations: migrations}, nil
+}
+
+// Reads migrations of the dialect ordered by version.
+func loadMigrations(dialect string) ([]Migration, error) {
+	dir := path.Join("migrations", dialect)
+	entries, err := migrationFiles.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("no migrations for %s database", dialect)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		match := migrationFileName.FindStringSubmatch(e.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", e.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := migrationFiles.ReadFile(path.Join(dir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %d has different names: %s and %s", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both up and down files", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Applies all pending migrations. Returns applied migrations.
+func (m *Migrator) Up(ctx context.Context) ([]Migration, error) {
+	result := []Migration{}
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, mig := range m.migrations {
+			if _, ok := applied[mig.Version]; ok {
+				continue
+			}
+			err := m.run(ctx, conn, mig.Up, fmt.Sprintf("INSERT INTO %s (version, name, applied_at) VALUES (%s, %s, %s)",
+				migrationsTable, m.placeholder(1), m.placeholder(2), m.placeholder(3)),
+				mig.Version, mig.Name, time.Now().UTC())
+			if err != nil {
+				return fmt.Errorf("migration %d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+			result = append(result, mig)
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Rolls back the latest applied migration. Returns nil when there is no
+// migration to roll back.
+func (m *Migrator) Down(ctx context.Context) (*Migration, error) {
+	var result *Migration
+	err := m.locked(ctx, func(conn *sql.Conn) error {
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			mig := m.migrations[i]
+			if _, ok := applied[mig.Version]; !ok {
+				continue
+			}
+			err := m.run(ctx, conn, mig.Down, fmt.Sprintf("DELETE FROM %s WHERE version = %s",
+				migrationsTable, m.placeholder(1)), mig.Version)
+			if err != nil {
+				return fmt.Errorf("rollback of %d_%s failed: %v", mig.Version, mig.Name, err)
+			}
+			result = &mig
+			return nil
+		}
+		return nil
+	})
+	return result, err
+}
+
+// Lists all migrations and whether they are applied.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if err := m.createTable(ctx, conn); err != nil {
+		return nil, err
+	}
+	applied, err := m.applied(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+	result := []MigrationStatus{}
+	for _, mig := range m.migrations {
+		appliedAt, ok := applied[mig.Version]
+		result = append(result, MigrationStatus{Migration: mig, Applied: ok, AppliedAt: appliedAt})
+	}
+	return result, nil
+}
+
+// Runs fn holding migration lock on a single connection.
+func (m *Migrator) locked(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	unlock, err := m.lock(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("failed to acquire migration lock: %v", err)
+	}
+	defer unlock()
+
+	if err := m.createTable(ctx, conn); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+// Acquires lock held by the connection. SQLite allows a single writer so
+// it relies on migration transactions instead.
+func (m *Migrator) lock(ctx context.Context, conn *sql.Conn) (func(), error) {
+	switch m.dialect {
+	case "mysql":
+		var ok sql.NullInt64
+		err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, ?)", migrationLockName, int(migrationLockTimeout.Seconds())).Scan(&ok)
+		if err != nil {
+			return nil, err
+		}
+		if ok.Int64 != 1 {
+			return nil, fmt.Errorf("timeout after %s", migrationLockTimeout)
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLockName)
+		}, nil
+	case "postgres":
+		if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationLockKey); err != nil {
+			return nil, err
+		}
+		return func() {
+			conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", migrationLockKey)
+		}, nil
+	}
+	return func() {}, nil
+}
+
+func (m *Migrator) createTable(ctx context.Context, conn *sql.Conn) error {
+	appliedAt := "DATETIME(3)"
+	switch m.dialect {
+	case "postgres":
+		appliedAt = "TIMESTAMPTZ"
+	case "sqlite":
+		appliedAt = "DATETIME"
+	}
+	_, err := conn.ExecContext(ctx, fmt.Sprintf(
+		"CREATE TABLE IF NOT EXISTS %s (version BIGINT NOT NULL PRIMARY KEY, name VARCHAR(255) NOT NULL, applied_at %s NOT NULL)",
+		migrationsTable, appliedAt,
+	))
+	if err != nil {
+		return fmt.Errorf("failed to create %s table: %v", migrationsTable, err)
+	}
+	return nil
+}
+
+// Returns applied versions with time they were applied.
+func (m *Migrator) applied(ctx context.Context, conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT version, applied_at FROM %s", migrationsTable))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
+
+// Executes migration script and records it in a single transaction. MySQL
+// commits schema changes implicitly so there only recording is transactional.
+func (m *Migrator) run(ctx context.Context, conn *sql.Conn, script, record string, args ...interface{}) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, stmt := range splitStatements(script) {
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) placeholder(n int) string {
+	if m.dialect == "postgres" {
+		return "$" + strconv.Itoa(n)
+	}
+	return "?"
+}
+
+// Splits script into statements ending with semicolon at the end of line.
+func splitStatements(script string) []string {
+	statements := []string{}
+	for _, stmt := range statementEnd.Split(script+"\n", -1) {
+		stmt = strings.TrimSpace(stmt)
+		if stmt != "" {
+			statements = append(statements, stmt)
+		}
+	}
+	return statements
+}
@@ -0,0 +1,98 @@
+package db
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadMigrations(t *testing.T) {
+	versions := map[string][]int{}
+	for _, dialect := range []string{"mysql", "postgres", "sqlite"} {
+		migrations, err := loadMigrations(dialect)
+		require.NoError(t, err)
+		require.NotEmpty(t, migrations)
+		for _, m := range migrations {
+			require.NotEmpty(t, splitStatements(m.Up))
+			require.NotEmpty(t, splitStatements(m.Down))
+			versions[dialect] = append(versions[dialect], m.Version)
+		}
+	}
+
+	// Every database has the same migrations
+	require.Equal(t, versions["mysql"], versions["postgres"])
+	require.Equal(t, versions["mysql"], versions["sqlite"])
+
+	_, err := loadMigrations("oracle")
+	require.Error(t, err)
+}
+
+func TestMigratorUpDown(t *testing.T) {
+	gdb, err := Connect("sqlite://" + filepath.Join(t.TempDir(), "users.db"))
+	require.NoError(t, err)
+	m, err := NewMigrator(gdb)
+	require.NoError(t, err)
+	ctx := context.Background()
+
+	status, err := m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range status {
+		require.False(t, s.Applied)
+	}
+
+	applied, err := m.Up(ctx)
+	require.NoError(t, err)
+	require.Len(t, applied, len(status))
+	require.True(t, gdb.Migrator().HasTable("users"))
+	require.True(t, gdb.Migrator().HasTable("webhooks"))
+	require.True(t, gdb.Migrator().HasTable("audit_events"))
+	require.True(t, gdb.Migrator().HasColumn("users", "email_index"))
+	require.True(t, gdb.Migrator().HasColumn("webhook_dead_letters", "user_id"))
+	require.True(t, gdb.Migrator().HasIndex("users", "idx_users_created_at_id"))
+
+	// Nothing left to apply
+	applied, err = m.Up(ctx)
+	require.NoError(t, err)
+	require.Len(t, applied, 0)
+
+	status, err = m.Status(ctx)
+	require.NoError(t, err)
+	for _, s := range status {
+		require.True(t, s.Applied)
+		require.False(t, s.AppliedAt.IsZero())
+	}
+
+	// Latest migration is rolled back first
+	rolledBack, err := m.Down(ctx)
+	require.NoError(t, err)
+	require.Equal(t, status[len(status)-1].Version, rolledBack.Version)
+	require.False(t, gdb.Migrator().HasIndex("users", "idx_users_created_at_id"))
+	require.True(t, gdb.Migrator().HasColumn("webhook_dead_letters", "user_id"))
+
+	_, err = m.Down(ctx)
+	require.NoError(t, err)
+	require.False(t, gdb.Migrator().HasColumn("webhook_dead_letters", "user_id"))
+	require.True(t, gdb.Migrator().HasColumn("users", "email_index"))
+
+	_, err = m.Down(ctx)
+	require.NoError(t, err)
+	require.False(t, gdb.Migrator().HasColumn("users", "email_index"))
+	require.True(t, gdb.Migrator().HasTable("audit_events"))
+
+	_, err = m.Down(ctx)
+	require.NoError(t, err)
+	require.False(t, gdb.Migrator().HasTable("audit_events"))
+	require.True(t, gdb.Migrator().HasTable("webhooks"))
+
+	for range status[3:] {
+		_, err = m.Down(ctx)
+		require.NoError(t, err)
+	}
+	require.False(t, gdb.Migrator().HasTable("users"))
+
+	rolledBack, err = m.Down(ctx)
+	require.NoError(t, err)
+	require.Nil(t, rolledBack)
+}
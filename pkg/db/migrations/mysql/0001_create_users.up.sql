@@ -0,0 +1,14 @@
+-- Table may already exist when it was created by gorm AutoMigrate.
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` char(36) NOT NULL,
+  `first_name` longtext,
+  `last_name` longtext,
+  `nickname` longtext,
+  `password` longtext,
+  `email` varchar(191) DEFAULT NULL,
+  `country` longtext,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `email` (`email`)
+);
@@ -0,0 +1,39 @@
+-- Tables may already exist when they were created by gorm AutoMigrate.
+CREATE TABLE IF NOT EXISTS `webhooks` (
+  `id` char(36) NOT NULL,
+  `url` longtext,
+  `methods` longtext,
+  `secret` longtext,
+  `created_at` datetime(3) DEFAULT NULL,
+  `updated_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+  `id` char(36) NOT NULL,
+  `webhook_id` char(36) DEFAULT NULL,
+  `event_id` char(36) DEFAULT NULL,
+  `method` longtext,
+  `attempt` bigint DEFAULT NULL,
+  `status_code` bigint DEFAULT NULL,
+  `error` longtext,
+  `success` tinyint(1) DEFAULT NULL,
+  `duration` bigint DEFAULT NULL,
+  `created_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_webhook_deliveries_webhook_id` (`webhook_id`),
+  KEY `idx_webhook_deliveries_event_id` (`event_id`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_dead_letters` (
+  `id` char(36) NOT NULL,
+  `webhook_id` char(36) DEFAULT NULL,
+  `event_id` char(36) DEFAULT NULL,
+  `method` longtext,
+  `payload` longblob,
+  `attempts` bigint DEFAULT NULL,
+  `last_error` longtext,
+  `created_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_webhook_dead_letters_webhook_id` (`webhook_id`)
+);
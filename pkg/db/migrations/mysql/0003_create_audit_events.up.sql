@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS `audit_events` (
+  `id` char(36) NOT NULL,
+  `user_id` char(36) DEFAULT NULL,
+  `actor` longtext,
+  `method` longtext,
+  `changes` longtext,
+  `client_ip` longtext,
+  `request_id` longtext,
+  `created_at` datetime(3) DEFAULT NULL,
+  PRIMARY KEY (`id`),
+  KEY `idx_audit_events_user_id` (`user_id`),
+  KEY `idx_audit_events_created_at` (`created_at`)
+);
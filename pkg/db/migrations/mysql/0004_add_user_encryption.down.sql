@@ -0,0 +1,7 @@
+DROP INDEX `idx_users_country_index` ON `users`;
+DROP INDEX `idx_users_email_index` ON `users`;
+ALTER TABLE `users`
+  DROP COLUMN `data_key`,
+  DROP COLUMN `country_index`,
+  DROP COLUMN `email_index`,
+  MODIFY `email` varchar(191) DEFAULT NULL;
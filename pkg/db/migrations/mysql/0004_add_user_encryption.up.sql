@@ -0,0 +1,9 @@
+-- Encrypted emails are longer than plaintext ones. Uniqueness of encrypted
+-- emails is enforced by email_index blind index.
+ALTER TABLE `users`
+  MODIFY `email` varchar(512) DEFAULT NULL,
+  ADD COLUMN `email_index` char(64) DEFAULT NULL,
+  ADD COLUMN `country_index` char(64) DEFAULT NULL,
+  ADD COLUMN `data_key` text;
+CREATE UNIQUE INDEX `idx_users_email_index` ON `users` (`email_index`);
+CREATE INDEX `idx_users_country_index` ON `users` (`country_index`);
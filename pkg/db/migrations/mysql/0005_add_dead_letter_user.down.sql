@@ -0,0 +1,2 @@
+DROP INDEX `idx_webhook_dead_letters_user_id` ON `webhook_dead_letters`;
+ALTER TABLE `webhook_dead_letters` DROP COLUMN `user_id`;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS users (
+  id uuid NOT NULL PRIMARY KEY,
+  first_name text,
+  last_name text,
+  nickname text,
+  password text,
+  email text CONSTRAINT users_email_key UNIQUE,
+  country text,
+  created_at timestamptz,
+  updated_at timestamptz
+);
@@ -0,0 +1,35 @@
+CREATE TABLE IF NOT EXISTS webhooks (
+  id uuid NOT NULL PRIMARY KEY,
+  url text,
+  methods text,
+  secret text,
+  created_at timestamptz,
+  updated_at timestamptz
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+  id uuid NOT NULL PRIMARY KEY,
+  webhook_id uuid,
+  event_id uuid,
+  method text,
+  attempt bigint,
+  status_code bigint,
+  error text,
+  success boolean,
+  duration bigint,
+  created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_webhook_id ON webhook_deliveries (webhook_id);
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_event_id ON webhook_deliveries (event_id);
+
+CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+  id uuid NOT NULL PRIMARY KEY,
+  webhook_id uuid,
+  event_id uuid,
+  method text,
+  payload bytea,
+  attempts bigint,
+  last_error text,
+  created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_webhook_id ON webhook_dead_letters (webhook_id);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS audit_events (
+  id uuid NOT NULL PRIMARY KEY,
+  user_id uuid,
+  actor text,
+  method text,
+  changes text,
+  client_ip text,
+  request_id text,
+  created_at timestamptz
+);
+CREATE INDEX IF NOT EXISTS idx_audit_events_user_id ON audit_events (user_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON audit_events (created_at);
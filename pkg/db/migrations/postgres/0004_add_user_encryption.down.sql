@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS idx_users_country_index;
+DROP INDEX IF EXISTS idx_users_email_index;
+ALTER TABLE users
+  DROP COLUMN IF EXISTS data_key,
+  DROP COLUMN IF EXISTS country_index,
+  DROP COLUMN IF EXISTS email_index;
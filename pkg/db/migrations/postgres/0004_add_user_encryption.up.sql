@@ -0,0 +1,7 @@
+-- Uniqueness of encrypted emails is enforced by email_index blind index.
+ALTER TABLE users
+  ADD COLUMN IF NOT EXISTS email_index text,
+  ADD COLUMN IF NOT EXISTS country_index text,
+  ADD COLUMN IF NOT EXISTS data_key text;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_users_email_index ON users (email_index);
+CREATE INDEX IF NOT EXISTS idx_users_country_index ON users (country_index);
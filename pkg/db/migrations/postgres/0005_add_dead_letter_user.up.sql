@@ -0,0 +1,3 @@
+-- Dead letters hold user data, user_id finds them on export and erasure.
+ALTER TABLE webhook_dead_letters ADD COLUMN IF NOT EXISTS user_id uuid;
+CREATE INDEX IF NOT EXISTS idx_webhook_dead_letters_user_id ON webhook_dead_letters (user_id);
@@ -0,0 +1,12 @@
+CREATE TABLE IF NOT EXISTS `users` (
+  `id` text NOT NULL,
+  `first_name` text,
+  `last_name` text,
+  `nickname` text,
+  `password` text,
+  `email` text UNIQUE,
+  `country` text,
+  `created_at` datetime,
+  `updated_at` datetime,
+  PRIMARY KEY (`id`)
+);
@@ -0,0 +1,38 @@
+CREATE TABLE IF NOT EXISTS `webhooks` (
+  `id` text NOT NULL,
+  `url` text,
+  `methods` text,
+  `secret` text,
+  `created_at` datetime,
+  `updated_at` datetime,
+  PRIMARY KEY (`id`)
+);
+
+CREATE TABLE IF NOT EXISTS `webhook_deliveries` (
+  `id` text NOT NULL,
+  `webhook_id` text,
+  `event_id` text,
+  `method` text,
+  `attempt` integer,
+  `status_code` integer,
+  `error` text,
+  `success` numeric,
+  `duration` integer,
+  `created_at` datetime,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_webhook_id` ON `webhook_deliveries` (`webhook_id`);
+CREATE INDEX IF NOT EXISTS `idx_webhook_deliveries_event_id` ON `webhook_deliveries` (`event_id`);
+
+CREATE TABLE IF NOT EXISTS `webhook_dead_letters` (
+  `id` text NOT NULL,
+  `webhook_id` text,
+  `event_id` text,
+  `method` text,
+  `payload` blob,
+  `attempts` integer,
+  `last_error` text,
+  `created_at` datetime,
+  PRIMARY KEY (`id`)
+);
+CREATE INDEX IF NOT EXISTS `idx_webhook_dead_letters_webhook_id` ON `webhook_dead_letters` (`webhook_id`);
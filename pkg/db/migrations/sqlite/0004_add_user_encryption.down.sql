@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS `idx_users_country_index`;
+DROP INDEX IF EXISTS `idx_users_email_index`;
+ALTER TABLE `users` DROP COLUMN `data_key`;
+ALTER TABLE `users` DROP COLUMN `country_index`;
+ALTER TABLE `users` DROP COLUMN `email_index`;
@@ -0,0 +1,6 @@
+-- Uniqueness of encrypted emails is enforced by email_index blind index.
+ALTER TABLE `users` ADD COLUMN `email_index` text;
+ALTER TABLE `users` ADD COLUMN `country_index` text;
+ALTER TABLE `users` ADD COLUMN `data_key` text;
+CREATE UNIQUE INDEX IF NOT EXISTS `idx_users_email_index` ON `users` (`email_index`);
+CREATE INDEX IF NOT EXISTS `idx_users_country_index` ON `users` (`country_index`);
@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS `idx_webhook_dead_letters_user_id`;
+ALTER TABLE `webhook_dead_letters` DROP COLUMN `user_id`;
@@ -0,0 +1,2 @@
+-- Watch snapshots page users by created_at and id.
+CREATE INDEX IF NOT EXISTS `idx_users_created_at_id` ON `users` (`created_at`, `id`);
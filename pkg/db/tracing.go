@@ -0,0 +1,79 @@
+package db
+
+import (
+	"errors"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+	"gorm.io/gorm"
+)
+
+// Tracer of database queries.
+var tracer = otel.Tracer("github.com/kroksys/user-service-example/pkg/db")
+
+// Key of query span in gorm statement.
+const querySpanKey = "tracing:span"
+
+// Gorm plugin recording a span for every query. Spans are children of
+// the span in query context.
+type queryTracing struct{}
+
+func (queryTracing) Name() string {
+	return "tracing"
+}
+
+// Registers callbacks around every gorm operation.
+func (queryTracing) Initialize(db *gorm.DB) error {
+	type register func(name string, fn func(*gorm.DB)) error
+	c := db.Callback()
+	operations := []struct {
+		name          string
+		before, after register
+	}{
+		{"create", c.Create().Before("gorm:create").Register, c.Create().After("gorm:create").Register},
+		{"query", c.Query().Before("gorm:query").Register, c.Query().After("gorm:query").Register},
+		{"update", c.Update().Before("gorm:update").Register, c.Update().After("gorm:update").Register},
+		{"delete", c.Delete().Before("gorm:delete").Register, c.Delete().After("gorm:delete").Register},
+		{"row", c.Row().Before("gorm:row").Register, c.Row().After("gorm:row").Register},
+		{"raw", c.Raw().Before("gorm:raw").Register, c.Raw().After("gorm:raw").Register},
+	}
+	for _, op := range operations {
+		if err := op.before("tracing:before_"+op.name, startSpan(op.name)); err != nil {
+			return err
+		}
+		if err := op.after("tracing:after_"+op.name, endSpan); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startSpan(operation string) func(*gorm.DB) {
+	return func(db *gorm.DB) {
+		ctx, span := tracer.Start(db.Statement.Context, "gorm."+operation,
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				semconv.DBSystemKey.String(db.Dialector.Name()),
+				semconv.DBOperationKey.String(operation),
+				semconv.DBSQLTableKey.String(db.Statement.Table),
+			))
+		db.Statement.Context = ctx
+		db.InstanceSet(querySpanKey, span)
+	}
+}
+
+func endSpan(db *gorm.DB) {
+	v, ok := db.InstanceGet(querySpanKey)
+	if !ok {
+		return
+	}
+	span := v.(trace.Span)
+	span.SetAttributes(semconv.DBStatementKey.String(db.Statement.SQL.String()))
+	if db.Error != nil && !errors.Is(db.Error, ErrNotFound) {
+		span.RecordError(db.Error)
+		span.SetStatus(codes.Error, db.Error.Error())
+	}
+	span.End()
+}
@@ -1,35 +1,273 @@
 package db
 
 import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
 	"github.com/google/uuid"
+	"github.com/jackc/pgconn"
+	"github.com/kroksys/user-service-example/pkg/encryption"
 	"github.com/kroksys/user-service-example/pkg/models"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+	"gorm.io/plugin/dbresolver"
+)
+
+var (
+	// Returned when requested record does not exist.
+	ErrNotFound = gorm.ErrRecordNotFound
+
+	// Returned when user email is already used by another user.
+	ErrDuplicateEmail = errors.New("db: email already exists")
 )
 
-func CreateUser(u *models.User) error {
-	return DB.Create(u).Error
+// Storage of users used by the service. Queries are aborted when context
+// is canceled or its deadline is exceeded.
+type UserRepository interface {
+	CreateUser(ctx context.Context, u *models.User) error
+	GetUser(ctx context.Context, id uuid.UUID) (*models.User, error)
+	UpdateUser(ctx context.Context, u *models.User) error
+	UpdateUserByMap(ctx context.Context, u *models.User, m map[string]interface{}) error
+	DeleteUser(ctx context.Context, userId uuid.UUID) error
+	ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error)
+
+	// Lists up to limit users following after in creation order, from the
+	// first user when after is nil. Users are ordered by created_at and id,
+	// so paging by the last listed user doesn't skip users when earlier
+	// ones are deleted meanwhile.
+	ListUsersAfter(ctx context.Context, after *models.User, limit int) ([]models.User, error)
+
+	// Updates columns provided in the map and returns the user before and
+	// after the update. User is locked from the first read until the
+	// update is committed, so no other change comes between them.
+	// ErrNotFound when the user does not exist.
+	UpdateUserByMapReturning(ctx context.Context, id uuid.UUID, m map[string]interface{}) (before, after *models.User, err error)
+
+	// Deletes the user and returns it as it was when deleted. Nil when the
+	// user does not exist.
+	DeleteUserReturning(ctx context.Context, id uuid.UUID) (*models.User, error)
+
+	// Anonymizes the user, erases values of its audit events and deletes
+	// its webhook dead letters in one transaction. Returns the user before
+	// and after erasure. Event, unless nil, is recorded with changes of the
+	// erasure before audit events are erased, so only names of erased
+	// fields are left. Nothing is recorded when the user was already
+	// erased. ErrNotFound when the user does not exist.
+	EraseUserReturning(ctx context.Context, id uuid.UUID, event *models.AuditEvent) (before, after *models.User, err error)
+
+	// Returns repository reading from primary database instead of
+	// replicas, so recent writes are visible.
+	Primary() UserRepository
+}
+
+// User repository backed by gorm database connection.
+type GormUserRepository struct {
+	DB *gorm.DB
+
+	// Encrypts personal fields of users, nil stores them in plaintext.
+	Keyring *encryption.Keyring
+}
+
+func NewUserRepository(db *gorm.DB) *GormUserRepository {
+	return &GormUserRepository{DB: db}
+}
+
+// Creates repository encrypting personal fields of users with keys of the
+// keyring.
+func NewEncryptedUserRepository(db *gorm.DB, keyring *encryption.Keyring) *GormUserRepository {
+	return &GormUserRepository{DB: db, Keyring: keyring}
+}
+
+func (r *GormUserRepository) Primary() UserRepository {
+	return &GormUserRepository{DB: r.DB.Clauses(dbresolver.Write).Session(&gorm.Session{}), Keyring: r.Keyring}
 }
 
-func UpdateUser(u *models.User) error {
-	return DB.Save(u).Error
+func (r *GormUserRepository) CreateUser(ctx context.Context, u *models.User) error {
+	if r.Keyring != nil {
+		return r.createEncryptedUser(ctx, u)
+	}
+	return userError(r.DB.WithContext(ctx).Create(u).Error)
 }
 
-func UpdateUserByMap(u *models.User, m map[string]interface{}) error {
-	return DB.Model(u).Updates(m).Error
+func (r *GormUserRepository) GetUser(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	if r.Keyring != nil {
+		return r.getEncryptedUser(ctx, id)
+	}
+	u := &models.User{}
+	err := r.DB.WithContext(ctx).First(u, "id = ?", id).Error
+	if err != nil {
+		return nil, err
+	}
+	if err := requirePlaintext(u); err != nil {
+		return nil, err
+	}
+	return u, nil
 }
 
-func DeleteUser(userId uuid.UUID) error {
-	return DB.Delete(&models.User{}, userId).Error
+func (r *GormUserRepository) UpdateUser(ctx context.Context, u *models.User) error {
+	if r.Keyring != nil {
+		return r.updateEncryptedUser(ctx, u)
+	}
+	return userError(r.DB.WithContext(ctx).Save(u).Error)
 }
 
-func ListUsers(limit, offset int, country string) ([]models.User, error) {
+func (r *GormUserRepository) UpdateUserByMap(ctx context.Context, u *models.User, m map[string]interface{}) error {
+	if r.Keyring != nil {
+		return r.updateEncryptedUserByMap(ctx, u, m)
+	}
+	return userError(r.DB.WithContext(ctx).Model(u).Updates(m).Error)
+}
+
+func (r *GormUserRepository) DeleteUser(ctx context.Context, userId uuid.UUID) error {
+	return r.DB.WithContext(ctx).Delete(&models.User{}, userId).Error
+}
+
+func (r *GormUserRepository) UpdateUserByMapReturning(ctx context.Context, id uuid.UUID, m map[string]interface{}) (before, after *models.User, err error) {
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if before, err = r.lockUser(ctx, tx, id); err != nil {
+			return err
+		}
+		repo := &GormUserRepository{DB: tx, Keyring: r.Keyring}
+		if err := repo.UpdateUserByMap(ctx, &models.User{ID: id}, m); err != nil {
+			return err
+		}
+		after, err = repo.GetUser(ctx, id)
+		return err
+	})
+	if err != nil {
+		return nil, nil, userError(err)
+	}
+	return before, after, nil
+}
+
+func (r *GormUserRepository) DeleteUserReturning(ctx context.Context, id uuid.UUID) (*models.User, error) {
+	var deleted *models.User
+	err := r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		u, err := r.lockUser(ctx, tx, id)
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		deleted = u
+		return tx.Delete(&models.User{}, id).Error
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (r *GormUserRepository) EraseUserReturning(ctx context.Context, id uuid.UUID, event *models.AuditEvent) (before, after *models.User, err error) {
+	err = r.DB.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if before, err = r.lockUser(ctx, tx, id); err != nil {
+			return err
+		}
+		erased := *before
+		erased.Erase()
+		repo := &GormUserRepository{DB: tx, Keyring: r.Keyring}
+		if err := repo.UpdateUser(ctx, &erased); err != nil {
+			return err
+		}
+		after = &erased
+
+		audit := &GormAuditRepository{DB: tx, Keyring: r.Keyring}
+		if recordErasure(event, before, after) {
+			if err := audit.CreateAuditEvent(ctx, event); err != nil {
+				return err
+			}
+		}
+		if err := audit.EraseAuditEvents(ctx, id); err != nil {
+			return err
+		}
+		webhooks := &GormWebhookRepository{DB: tx, Keyring: r.Keyring}
+		return webhooks.DeleteUserDeadLetters(ctx, id)
+	})
+	if err != nil {
+		return nil, nil, userError(err)
+	}
+	return before, after, nil
+}
+
+// Sets user and changes of erasure audit event. Returns false when there is
+// no event or nothing was erased.
+func recordErasure(event *models.AuditEvent, before, after *models.User) bool {
+	if event == nil {
+		return false
+	}
+	event.UserID = before.ID
+	event.Changes = models.UserChanges(before, after)
+	return len(event.Changes) > 0
+}
+
+// Reads the user with SELECT ... FOR UPDATE within transaction tx.
+func (r *GormUserRepository) lockUser(ctx context.Context, tx *gorm.DB, id uuid.UUID) (*models.User, error) {
+	locked := &GormUserRepository{DB: tx.Clauses(clause.Locking{Strength: "UPDATE"}), Keyring: r.Keyring}
+	return locked.GetUser(ctx, id)
+}
+
+func (r *GormUserRepository) ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
 	users := []models.User{}
 	if offset > 0 && limit == 0 {
 		limit = 1
 	}
-	tx := DB.Limit(limit).Offset(offset)
+	if r.Keyring != nil {
+		return r.listEncryptedUsers(ctx, limit, offset, country)
+	}
+	tx := r.DB.WithContext(ctx).Order("created_at, id").Limit(limit).Offset(offset)
 	if country != "" {
 		tx.Where("country = ?", country)
 	}
-	err := tx.Find(&users).Error
-	return users, err
+	if err := tx.Find(&users).Error; err != nil {
+		return users, err
+	}
+	for i := range users {
+		if err := requirePlaintext(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+func (r *GormUserRepository) ListUsersAfter(ctx context.Context, after *models.User, limit int) ([]models.User, error) {
+	tx := r.DB.WithContext(ctx).Order("created_at, id").Limit(limit)
+	if after != nil {
+		tx = tx.Where("created_at > ? OR (created_at = ? AND id > ?)", after.CreatedAt, after.CreatedAt, after.ID)
+	}
+	if r.Keyring != nil {
+		return r.findEncryptedUsers(tx)
+	}
+	users := []models.User{}
+	if err := tx.Find(&users).Error; err != nil {
+		return nil, err
+	}
+	for i := range users {
+		if err := requirePlaintext(&users[i]); err != nil {
+			return nil, err
+		}
+	}
+	return users, nil
+}
+
+// Translates violation of unique user email to ErrDuplicateEmail.
+func userError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 && strings.Contains(mysqlErr.Message, "email") {
+		return ErrDuplicateEmail
+	}
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" && strings.Contains(pgErr.ConstraintName, "email") {
+		return ErrDuplicateEmail
+	}
+	// SQLite: UNIQUE constraint failed: users.email
+	if strings.Contains(err.Error(), "UNIQUE constraint failed") && strings.Contains(err.Error(), ".email") {
+		return ErrDuplicateEmail
+	}
+	return err
 }
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"context"
 	"regexp"
 	"testing"
 	"time"
@@ -14,7 +15,7 @@ import (
 
 func TestCreateUser(t *testing.T) {
 	sqlDB, gdb, mock := test.NewMockDatabase(t)
-	DB = gdb
+	repo := NewUserRepository(gdb)
 	defer sqlDB.Close()
 
 	rec := models.User{
@@ -30,7 +31,7 @@ func TestCreateUser(t *testing.T) {
 	mock.ExpectExec(regexp.QuoteMeta(`INSERT`)).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err := CreateUser(&rec)
+	err := repo.CreateUser(context.Background(), &rec)
 	require.NoError(t, err)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("TestCreateUser: %s", err)
@@ -51,7 +52,7 @@ func TestCreateUser(t *testing.T) {
 
 func TestUpdateUser(t *testing.T) {
 	sqlDB, gdb, mock := test.NewMockDatabase(t)
-	DB = gdb
+	repo := NewUserRepository(gdb)
 	defer sqlDB.Close()
 
 	id, _ := uuid.Parse("cc9b61e3-0cba-473f-8e95-944661c46051")
@@ -71,7 +72,7 @@ func TestUpdateUser(t *testing.T) {
 	mock.ExpectExec(regexp.QuoteMeta(`UPDATE`)).WillReturnResult(sqlmock.NewResult(1, 1))
 	mock.ExpectCommit()
 
-	err := UpdateUser(&rec)
+	err := repo.UpdateUser(context.Background(), &rec)
 	require.NoError(t, err)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("TestUpdateUser: %s", err)
@@ -82,13 +83,13 @@ func TestUpdateUser(t *testing.T) {
 	}
 
 	// Update user with emtpy ID should return error
-	err = UpdateUser(&models.User{})
+	err = repo.UpdateUser(context.Background(), &models.User{})
 	require.Error(t, err)
 }
 
 func TestDeleteUser(t *testing.T) {
 	sqlDB, gdb, mock := test.NewMockDatabase(t)
-	DB = gdb
+	repo := NewUserRepository(gdb)
 	defer sqlDB.Close()
 
 	id, _ := uuid.Parse("cc9b61e3-0cba-473f-8e95-944661c46051")
@@ -100,7 +101,7 @@ func TestDeleteUser(t *testing.T) {
 	mock.ExpectExec(regexp.QuoteMeta(`DELETE`)).WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	err := DeleteUser(rec.ID)
+	err := repo.DeleteUser(context.Background(), rec.ID)
 	require.NoError(t, err)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("TestDeleteUser: %s", err)
@@ -109,7 +110,7 @@ func TestDeleteUser(t *testing.T) {
 
 func TestListUser(t *testing.T) {
 	sqlDB, gdb, mock := test.NewMockDatabase(t)
-	DB = gdb
+	repo := NewUserRepository(gdb)
 	defer sqlDB.Close()
 
 	rs := mock.NewRows([]string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "updated_at", "created_at"}).
@@ -119,7 +120,7 @@ func TestListUser(t *testing.T) {
 
 	mock.ExpectQuery(regexp.QuoteMeta(`SELECT`)).WillReturnRows(rs)
 
-	users, err := ListUsers(0, 0, "UK")
+	users, err := repo.ListUsers(context.Background(), 0, 0, "UK")
 	require.NoError(t, err)
 	if err := mock.ExpectationsWereMet(); err != nil {
 		t.Errorf("TestListUser: %s", err)
@@ -129,3 +130,28 @@ func TestListUser(t *testing.T) {
 		t.Error("TestListUser: found less users than provided")
 	}
 }
+
+func TestGetUser(t *testing.T) {
+	sqlDB, gdb, mock := test.NewMockDatabase(t)
+	repo := NewUserRepository(gdb)
+	defer sqlDB.Close()
+
+	id := uuid.New()
+	rs := mock.NewRows([]string{"id", "first_name", "last_name", "nickname", "password", "email", "country", "updated_at", "created_at"}).
+		AddRow(id, "John", "Doe", "johny", "secret", "johndoe@email.com", "UK", time.Now(), time.Now())
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT`)).WillReturnRows(rs)
+
+	user, err := repo.GetUser(context.Background(), id)
+	require.NoError(t, err)
+	require.Equal(t, id, user.ID)
+	require.Equal(t, "John", user.FirstName)
+
+	// Missing user should return ErrNotFound
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT`)).WillReturnRows(mock.NewRows([]string{"id"}))
+	_, err = repo.GetUser(context.Background(), uuid.New())
+	require.ErrorIs(t, err, ErrNotFound)
+
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Errorf("TestGetUser: %s", err)
+	}
+}
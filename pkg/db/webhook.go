@@ -0,0 +1,279 @@
+package db
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/encryption"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"gorm.io/gorm"
+)
+
+// Storage of webhooks, their deliveries and dead letters.
+type WebhookRepository interface {
+	CreateWebhook(ctx context.Context, w *models.Webhook) error
+	ListWebhooks(ctx context.Context) ([]models.Webhook, error)
+	DeleteWebhook(ctx context.Context, id uuid.UUID) error
+	CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error
+	CreateWebhookDeadLetter(ctx context.Context, d *models.WebhookDeadLetter) error
+
+	// Lists and deletes dead letters holding data of the user.
+	ListUserDeadLetters(ctx context.Context, userID uuid.UUID) ([]models.WebhookDeadLetter, error)
+	DeleteUserDeadLetters(ctx context.Context, userID uuid.UUID) error
+}
+
+// Webhook repository backed by gorm database connection. Secrets and dead
+// letter payloads are sealed by Keyring when it is set.
+type GormWebhookRepository struct {
+	DB      *gorm.DB
+	Keyring *encryption.Keyring
+}
+
+func NewWebhookRepository(db *gorm.DB) *GormWebhookRepository {
+	return &GormWebhookRepository{DB: db}
+}
+
+// Creates repository sealing webhook secrets and dead letter payloads with
+// the keyring.
+func NewEncryptedWebhookRepository(db *gorm.DB, keyring *encryption.Keyring) *GormWebhookRepository {
+	return &GormWebhookRepository{DB: db, Keyring: keyring}
+}
+
+func (r *GormWebhookRepository) CreateWebhook(ctx context.Context, w *models.Webhook) error {
+	if r.Keyring == nil {
+		return r.DB.WithContext(ctx).Create(w).Error
+	}
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	row := *w
+	sealed, err := r.Keyring.Seal(w.Secret, w.ID[:])
+	if err != nil {
+		return err
+	}
+	row.Secret = sealed
+	if err := r.DB.WithContext(ctx).Create(&row).Error; err != nil {
+		return err
+	}
+	w.CreatedAt, w.UpdatedAt = row.CreatedAt, row.UpdatedAt
+	return nil
+}
+
+func (r *GormWebhookRepository) ListWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	webhooks := []models.Webhook{}
+	err := r.DB.WithContext(ctx).Order("created_at").Find(&webhooks).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range webhooks {
+		if err := r.openSecret(&webhooks[i]); err != nil {
+			return nil, err
+		}
+	}
+	return webhooks, nil
+}
+
+// Replaces sealed secret of the webhook with its plaintext. Secrets stored
+// before the keyring was configured are plaintext already.
+func (r *GormWebhookRepository) openSecret(w *models.Webhook) error {
+	if !encryption.IsSealed(w.Secret) {
+		return nil
+	}
+	if r.Keyring == nil {
+		return ErrKeyringRequired
+	}
+	secret, err := r.Keyring.Open(w.Secret, w.ID[:])
+	if err != nil {
+		return err
+	}
+	w.Secret = secret
+	return nil
+}
+
+// Seals plaintext secrets and secrets sealed by other than primary key.
+// Returns number of changed webhooks. Secrets are changed only if they were
+// not modified concurrently.
+func (r *GormWebhookRepository) RotateKeys(ctx context.Context) (int, error) {
+	if r.Keyring == nil {
+		return 0, errors.New("db: keyring is not configured")
+	}
+	webhooks := []models.Webhook{}
+	if err := r.DB.WithContext(ctx).Find(&webhooks).Error; err != nil {
+		return 0, err
+	}
+	changed := 0
+	for _, w := range webhooks {
+		if !r.Keyring.NeedsReseal(w.Secret) {
+			continue
+		}
+		stored := w.Secret
+		if err := r.openSecret(&w); err != nil {
+			return changed, fmt.Errorf("webhook %s: %v", w.ID, err)
+		}
+		sealed, err := r.Keyring.Seal(w.Secret, w.ID[:])
+		if err != nil {
+			return changed, err
+		}
+		result := r.DB.WithContext(ctx).Model(&models.Webhook{}).
+			Where("id = ? AND secret = ?", w.ID, stored).
+			UpdateColumn("secret", sealed)
+		if result.Error != nil {
+			return changed, result.Error
+		}
+		if result.RowsAffected > 0 {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+func (r *GormWebhookRepository) DeleteWebhook(ctx context.Context, id uuid.UUID) error {
+	return r.DB.WithContext(ctx).Delete(&models.Webhook{}, id).Error
+}
+
+func (r *GormWebhookRepository) CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	return r.DB.WithContext(ctx).Create(d).Error
+}
+
+func (r *GormWebhookRepository) CreateWebhookDeadLetter(ctx context.Context, d *models.WebhookDeadLetter) error {
+	if r.Keyring == nil {
+		return r.DB.WithContext(ctx).Create(d).Error
+	}
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	row := *d
+	sealed, err := r.Keyring.Seal(string(d.Payload), d.ID[:])
+	if err != nil {
+		return err
+	}
+	row.Payload = []byte(sealed)
+	if err := r.DB.WithContext(ctx).Create(&row).Error; err != nil {
+		return err
+	}
+	d.CreatedAt = row.CreatedAt
+	return nil
+}
+
+func (r *GormWebhookRepository) ListUserDeadLetters(ctx context.Context, userID uuid.UUID) ([]models.WebhookDeadLetter, error) {
+	if err := r.assignDeadLetterUsers(ctx); err != nil {
+		return nil, err
+	}
+	deadLetters := []models.WebhookDeadLetter{}
+	err := r.DB.WithContext(ctx).Where("user_id = ?", userID).Order("created_at").Find(&deadLetters).Error
+	if err != nil {
+		return nil, err
+	}
+	for i := range deadLetters {
+		if err := r.openPayload(&deadLetters[i]); err != nil {
+			return nil, err
+		}
+	}
+	return deadLetters, nil
+}
+
+// Replaces sealed payload of the dead letter with its plaintext. Payloads
+// stored before the keyring was configured are plaintext already.
+func (r *GormWebhookRepository) openPayload(d *models.WebhookDeadLetter) error {
+	if !encryption.IsSealed(string(d.Payload)) {
+		return nil
+	}
+	if r.Keyring == nil {
+		return ErrKeyringRequired
+	}
+	payload, err := r.Keyring.Open(string(d.Payload), d.ID[:])
+	if err != nil {
+		return fmt.Errorf("db: dead letter %s: %v", d.ID, err)
+	}
+	d.Payload = []byte(payload)
+	return nil
+}
+
+// Seals plaintext payloads and payloads sealed by other than primary key.
+// Returns number of changed dead letters. Payloads are changed only if
+// dead letters were not deleted concurrently.
+func (r *GormWebhookRepository) RotateDeadLetterKeys(ctx context.Context) (int, error) {
+	if r.Keyring == nil {
+		return 0, errors.New("db: keyring is not configured")
+	}
+	changed := 0
+	var lastID *uuid.UUID
+	for {
+		deadLetters := []models.WebhookDeadLetter{}
+		q := r.DB.WithContext(ctx).Order("id").Limit(rotateBatchSize)
+		if lastID != nil {
+			q = q.Where("id > ?", *lastID)
+		}
+		if err := q.Find(&deadLetters).Error; err != nil {
+			return changed, err
+		}
+		for _, d := range deadLetters {
+			if !r.Keyring.NeedsReseal(string(d.Payload)) {
+				continue
+			}
+			stored := d.Payload
+			if err := r.openPayload(&d); err != nil {
+				return changed, err
+			}
+			sealed, err := r.Keyring.Seal(string(d.Payload), d.ID[:])
+			if err != nil {
+				return changed, err
+			}
+			result := r.DB.WithContext(ctx).Model(&models.WebhookDeadLetter{}).
+				Where("id = ? AND payload = ?", d.ID, stored).
+				UpdateColumn("payload", []byte(sealed))
+			if result.Error != nil {
+				return changed, result.Error
+			}
+			if result.RowsAffected > 0 {
+				changed++
+			}
+		}
+		if len(deadLetters) < rotateBatchSize {
+			return changed, nil
+		}
+		lastID = &deadLetters[len(deadLetters)-1].ID
+	}
+}
+
+func (r *GormWebhookRepository) DeleteUserDeadLetters(ctx context.Context, userID uuid.UUID) error {
+	if err := r.assignDeadLetterUsers(ctx); err != nil {
+		return err
+	}
+	return r.DB.WithContext(ctx).Where("user_id = ?", userID).Delete(&models.WebhookDeadLetter{}).Error
+}
+
+// Sets user of dead letters stored before it was recorded from their
+// payload. Dead letters without user get nil id so they are read once.
+func (r *GormWebhookRepository) assignDeadLetterUsers(ctx context.Context) error {
+	deadLetters := []models.WebhookDeadLetter{}
+	if err := r.DB.WithContext(ctx).Where("user_id IS NULL").Find(&deadLetters).Error; err != nil {
+		return err
+	}
+	for _, d := range deadLetters {
+		payload := struct {
+			User struct {
+				ID string `json:"id"`
+			} `json:"user"`
+		}{}
+		userID := uuid.Nil
+		if err := r.openPayload(&d); err != nil {
+			return err
+		}
+		if json.Unmarshal(d.Payload, &payload) == nil {
+			if id, err := uuid.Parse(payload.User.ID); err == nil {
+				userID = id
+			}
+		}
+		err := r.DB.WithContext(ctx).Model(&models.WebhookDeadLetter{}).
+			Where("id = ?", d.ID).
+			UpdateColumn("user_id", userID).Error
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
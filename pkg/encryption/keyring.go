@@ -0,0 +1,328 @@
+// Package encryption implements envelope encryption of personal data.
+//
+// Every record is encrypted with its own random data key. Data keys are
+// stored next to the record wrapped by a key encryption key from the
+// keyring, so rotating the keyring only rewraps data keys. Encrypted
+// values can't be searched, so searched values are stored as blind
+// indexes: HMAC of the value with the index key of the keyring.
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Length of all keys, AES-256 and HMAC-SHA256.
+const KeySize = 32
+
+// Prefix of encrypted values. Values without it are plaintext written
+// before encryption was enabled.
+const encryptedPrefix = "enc:"
+
+// Prefix of values encrypted by Keyring.Seal.
+const sealedPrefix = "sealed:"
+
+// Returned when a value or data key can't be decrypted.
+var ErrDecrypt = errors.New("encryption: failed to decrypt")
+
+// Key encryption keys by id and index key. The primary key wraps new data
+// keys, others are kept to unwrap data keys until they are rotated.
+type Keyring struct {
+	primary  string
+	keys     map[string][]byte
+	indexKey []byte
+}
+
+// Keyring file format. Keys are base64 encoded.
+type keyringFile struct {
+	Primary  string            `json:"primary"`
+	Keys     map[string]string `json:"keys"`
+	IndexKey string            `json:"index_key"`
+}
+
+// Creates keyring with one random primary key and random index key.
+func NewKeyring() (*Keyring, error) {
+	indexKey, err := randomKey()
+	if err != nil {
+		return nil, err
+	}
+	k := &Keyring{keys: map[string][]byte{}, indexKey: indexKey}
+	if err := k.AddKey(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Adds a random key and makes it primary. Ids are increasing numbers.
+func (k *Keyring) AddKey() error {
+	key, err := randomKey()
+	if err != nil {
+		return err
+	}
+	next := 1
+	for id := range k.keys {
+		if n, err := strconv.Atoi(id); err == nil && n >= next {
+			next = n + 1
+		}
+	}
+	id := strconv.Itoa(next)
+	k.keys[id] = key
+	k.primary = id
+	return nil
+}
+
+// Returns id of the primary key.
+func (k *Keyring) Primary() string {
+	return k.primary
+}
+
+// Returns ids of all keys.
+func (k *Keyring) KeyIDs() []string {
+	ids := []string{}
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// Reads keyring from JSON file.
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read keyring: %v", err)
+	}
+	f := keyringFile{}
+	if err := json.Unmarshal(data, &f); err != nil {
+		return nil, fmt.Errorf("failed to parse keyring %s: %v", path, err)
+	}
+	k := &Keyring{primary: f.Primary, keys: map[string][]byte{}}
+	for id, encoded := range f.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("keyring %s: invalid key id %q", path, id)
+		}
+		if k.keys[id], err = decodeKey(encoded); err != nil {
+			return nil, fmt.Errorf("keyring %s: key %s: %v", path, id, err)
+		}
+	}
+	if _, ok := k.keys[k.primary]; !ok {
+		return nil, fmt.Errorf("keyring %s: primary key %q does not exist", path, k.primary)
+	}
+	if k.indexKey, err = decodeKey(f.IndexKey); err != nil {
+		return nil, fmt.Errorf("keyring %s: index key: %v", path, err)
+	}
+	return k, nil
+}
+
+// Writes keyring to JSON file readable only by the owner.
+func (k *Keyring) Save(path string) error {
+	f := keyringFile{
+		Primary:  k.primary,
+		Keys:     map[string]string{},
+		IndexKey: base64.StdEncoding.EncodeToString(k.indexKey),
+	}
+	for id, key := range k.keys {
+		f.Keys[id] = base64.StdEncoding.EncodeToString(key)
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(data, '\n'), 0600)
+}
+
+// Creates random data key and returns it with its wrapped form. Additional
+// data binds the wrapped key to its record and must be the same when it
+// is unwrapped.
+func (k *Keyring) NewDataKey(additionalData []byte) ([]byte, string, error) {
+	dataKey, err := randomKey()
+	if err != nil {
+		return nil, "", err
+	}
+	wrapped, err := k.WrapDataKey(dataKey, additionalData)
+	if err != nil {
+		return nil, "", err
+	}
+	return dataKey, wrapped, nil
+}
+
+// Encrypts data key with the primary key. Wrapped key is
+// <key id>:<base64 nonce and ciphertext>.
+func (k *Keyring) WrapDataKey(dataKey, additionalData []byte) (string, error) {
+	sealed, err := seal(k.keys[k.primary], dataKey, additionalData)
+	if err != nil {
+		return "", err
+	}
+	return k.primary + ":" + sealed, nil
+}
+
+// Decrypts data key wrapped by any key of the keyring.
+func (k *Keyring) UnwrapDataKey(wrapped string, additionalData []byte) ([]byte, error) {
+	id, sealed, ok := strings.Cut(wrapped, ":")
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid data key", ErrDecrypt)
+	}
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: key %q is not in the keyring", ErrDecrypt, id)
+	}
+	return open(key, sealed, additionalData)
+}
+
+// Reports whether data key is wrapped by a key other than primary.
+func (k *Keyring) NeedsRewrap(wrapped string) bool {
+	id, _, _ := strings.Cut(wrapped, ":")
+	return id != k.primary
+}
+
+// Encrypts standalone value with a new data key. Wrapped data key is part
+// of the returned value: sealed:<key id>:<wrapped data key>:<ciphertext>.
+func (k *Keyring) Seal(value string, additionalData []byte) (string, error) {
+	dataKey, wrapped, err := k.NewDataKey(additionalData)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(dataKey, []byte(value), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + wrapped + ":" + sealed, nil
+}
+
+// Decrypts value returned by Seal.
+func (k *Keyring) Open(value string, additionalData []byte) (string, error) {
+	rest, ok := strings.CutPrefix(value, sealedPrefix)
+	i := strings.LastIndex(rest, ":")
+	if !ok || i < 0 {
+		return "", fmt.Errorf("%w: value is not sealed", ErrDecrypt)
+	}
+	dataKey, err := k.UnwrapDataKey(rest[:i], additionalData)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := open(dataKey, rest[i+1:], additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reports whether value was returned by Seal.
+func IsSealed(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix)
+}
+
+// Reports whether value is plaintext or sealed by a key other than
+// primary.
+func (k *Keyring) NeedsReseal(value string) bool {
+	return !IsSealed(value) || k.NeedsRewrap(strings.TrimPrefix(value, sealedPrefix))
+}
+
+// Returns hex encoded HMAC of the value. Name separates indexes of
+// different values, so equal values of different fields don't match.
+func (k *Keyring) BlindIndex(name, value string) string {
+	mac := hmac.New(sha256.New, k.indexKey)
+	mac.Write([]byte(name))
+	mac.Write([]byte{0})
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Encrypts value with data key. Additional data binds the value to its
+// record and field.
+func Encrypt(dataKey []byte, value string, additionalData []byte) (string, error) {
+	sealed, err := seal(dataKey, []byte(value), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + sealed, nil
+}
+
+// Decrypts value returned by Encrypt.
+func Decrypt(dataKey []byte, value string, additionalData []byte) (string, error) {
+	if !IsEncrypted(value) {
+		return "", fmt.Errorf("%w: value is not encrypted", ErrDecrypt)
+	}
+	plaintext, err := open(dataKey, strings.TrimPrefix(value, encryptedPrefix), additionalData)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reports whether value was returned by Encrypt.
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypts with AES-GCM and returns base64 encoded nonce and ciphertext.
+func seal(key, plaintext, additionalData []byte) (string, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, plaintext, additionalData)), nil
+}
+
+func open(key []byte, sealed string, additionalData []byte) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, fmt.Errorf("%w: ciphertext too short", ErrDecrypt)
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	plaintext, err := aead.Open(nil, nonce, ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDecrypt, err)
+	}
+	return plaintext, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func randomKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func decodeKey(encoded string) ([]byte, error) {
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %d bytes, got %d", KeySize, len(key))
+	}
+	return key, nil
+}
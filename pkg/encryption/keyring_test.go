@@ -0,0 +1,124 @@
+package encryption
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	k, err := NewKeyring()
+	require.NoError(t, err)
+	dataKey, wrapped, err := k.NewDataKey([]byte("user-1"))
+	require.NoError(t, err)
+
+	value, err := Encrypt(dataKey, "john@email.com", []byte("user-1:email"))
+	require.NoError(t, err)
+	require.True(t, IsEncrypted(value))
+	require.NotContains(t, value, "john")
+	require.False(t, IsEncrypted("john@email.com"))
+
+	// Same value is encrypted differently every time
+	again, err := Encrypt(dataKey, "john@email.com", []byte("user-1:email"))
+	require.NoError(t, err)
+	require.NotEqual(t, value, again)
+
+	unwrapped, err := k.UnwrapDataKey(wrapped, []byte("user-1"))
+	require.NoError(t, err)
+	plaintext, err := Decrypt(unwrapped, value, []byte("user-1:email"))
+	require.NoError(t, err)
+	require.Equal(t, "john@email.com", plaintext)
+
+	// Values and data keys can't be moved to other records or fields
+	_, err = Decrypt(unwrapped, value, []byte("user-2:email"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = k.UnwrapDataKey(wrapped, []byte("user-2"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = Decrypt(unwrapped, "john@email.com", nil)
+	require.ErrorIs(t, err, ErrDecrypt)
+}
+
+func TestKeyRotation(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	k, err := NewKeyring()
+	require.NoError(t, err)
+	require.NoError(t, k.Save(path))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	dataKey, wrapped, err := k.NewDataKey(nil)
+	require.NoError(t, err)
+	require.False(t, k.NeedsRewrap(wrapped))
+	index := k.BlindIndex("email", "john@email.com")
+
+	require.NoError(t, k.AddKey())
+	require.Equal(t, "2", k.Primary())
+	require.Equal(t, []string{"1", "2"}, k.KeyIDs())
+	require.NoError(t, k.Save(path))
+
+	loaded, err := LoadKeyring(path)
+	require.NoError(t, err)
+	require.Equal(t, "2", loaded.Primary())
+
+	// Data keys wrapped by old key are still readable and are rewrapped
+	// by the new primary key
+	require.True(t, loaded.NeedsRewrap(wrapped))
+	unwrapped, err := loaded.UnwrapDataKey(wrapped, nil)
+	require.NoError(t, err)
+	require.Equal(t, dataKey, unwrapped)
+	rewrapped, err := loaded.WrapDataKey(unwrapped, nil)
+	require.NoError(t, err)
+	require.False(t, loaded.NeedsRewrap(rewrapped))
+
+	// Index key is not rotated
+	require.Equal(t, index, loaded.BlindIndex("email", "john@email.com"))
+	require.NotEqual(t, index, loaded.BlindIndex("email", "jane@email.com"))
+	require.NotEqual(t, index, loaded.BlindIndex("country", "john@email.com"))
+}
+
+func TestSeal(t *testing.T) {
+	k, err := NewKeyring()
+	require.NoError(t, err)
+	sealed, err := k.Seal("webhook secret", []byte("webhook-1"))
+	require.NoError(t, err)
+	require.True(t, IsSealed(sealed))
+	require.NotContains(t, sealed, "secret")
+	require.False(t, k.NeedsReseal(sealed))
+	require.True(t, k.NeedsReseal("webhook secret"))
+
+	value, err := k.Open(sealed, []byte("webhook-1"))
+	require.NoError(t, err)
+	require.Equal(t, "webhook secret", value)
+	_, err = k.Open(sealed, []byte("webhook-2"))
+	require.ErrorIs(t, err, ErrDecrypt)
+	_, err = k.Open("webhook secret", nil)
+	require.ErrorIs(t, err, ErrDecrypt)
+
+	// Sealed values stay readable after rotation until they are sealed again
+	require.NoError(t, k.AddKey())
+	require.True(t, k.NeedsReseal(sealed))
+	value, err = k.Open(sealed, []byte("webhook-1"))
+	require.NoError(t, err)
+	require.Equal(t, "webhook secret", value)
+}
+
+func TestLoadKeyringErrors(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"invalid json":    `{`,
+		"missing primary": `{"primary": "2", "keys": {"1": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, "index_key": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		"short key":       `{"primary": "1", "keys": {"1": "AAAA"}, "index_key": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+		"missing index":   `{"primary": "1", "keys": {"1": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}}`,
+		"invalid id":      `{"primary": "a:b", "keys": {"a:b": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}, "index_key": "AAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAAA="}`,
+	} {
+		path := filepath.Join(dir, "keyring.json")
+		require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+		_, err := LoadKeyring(path)
+		require.Error(t, err, name)
+	}
+	_, err := LoadKeyring(filepath.Join(dir, "missing.json"))
+	require.Error(t, err)
+}
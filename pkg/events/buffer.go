@@ -0,0 +1,181 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+)
+
+// Decides what happens when a subscriber buffer is full.
+type OverflowPolicy string
+
+const (
+	// Oldest buffered event is dropped to make room for the new one.
+	DropOldest OverflowPolicy = "drop-oldest"
+
+	// Subscriber is disconnected with ErrBufferOverflow.
+	Disconnect OverflowPolicy = "disconnect"
+
+	// New event replaces buffered event of the same user. Oldest event is
+	// dropped when there is no event of the same user.
+	Coalesce OverflowPolicy = "coalesce"
+)
+
+// Default size of subscriber buffer.
+const DefaultBufferSize = 100
+
+var (
+	// Returned by Buffer.Pop when subscriber was disconnected because
+	// buffer overflowed.
+	ErrBufferOverflow = errors.New("events: subscriber buffer overflow")
+
+	// Returned by Buffer.Pop when buffer is closed and drained.
+	ErrBufferClosed = errors.New("events: buffer closed")
+)
+
+// Parses overflow policy name. Empty name returns DropOldest.
+func ParseOverflowPolicy(name string) (OverflowPolicy, error) {
+	switch p := OverflowPolicy(name); p {
+	case "":
+		return DropOldest, nil
+	case DropOldest, Disconnect, Coalesce:
+		return p, nil
+	}
+	return "", fmt.Errorf("unsupported overflow policy: %q", name)
+}
+
+// Bounded queue between an event subscription and a slow consumer. Push
+// never blocks, overflow is handled by the policy.
+type Buffer struct {
+	size   int
+	policy OverflowPolicy
+
+	mu         sync.Mutex
+	queue      []*pb.WatchResponse
+	closed     bool
+	overflowed bool
+	ready      chan struct{}
+	overflow   chan struct{}
+}
+
+// Creates buffer holding up to size events. Zero size uses
+// DefaultBufferSize and empty policy uses DropOldest.
+func NewBuffer(size int, policy OverflowPolicy) *Buffer {
+	if size <= 0 {
+		size = DefaultBufferSize
+	}
+	if policy == "" {
+		policy = DropOldest
+	}
+	return &Buffer{
+		size:     size,
+		policy:   policy,
+		ready:    make(chan struct{}, 1),
+		overflow: make(chan struct{}),
+	}
+}
+
+// Adds event to the buffer applying overflow policy when it is full.
+func (b *Buffer) Push(event *pb.WatchResponse) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+
+	if len(b.queue) >= b.size {
+		switch b.policy {
+		case Disconnect:
+			bufferEvents.WithLabelValues("dropped").Add(float64(len(b.queue) + 1))
+			bufferDisconnects.Inc()
+			b.queue = nil
+			b.overflowed = true
+			b.closed = true
+			close(b.overflow)
+			b.signal()
+			return
+		case Coalesce:
+			if b.coalesce(event) {
+				bufferEvents.WithLabelValues("coalesced").Inc()
+				return
+			}
+			fallthrough
+		default:
+			b.queue = b.queue[1:]
+			bufferEvents.WithLabelValues("dropped").Inc()
+		}
+	}
+	b.queue = append(b.queue, event)
+	b.signal()
+}
+
+// Replaces buffered event of the same user. Created user stays created
+// with updated data. Returns false when there is no event to replace.
+func (b *Buffer) coalesce(event *pb.WatchResponse) bool {
+	id := event.GetUser().GetId()
+	for i := len(b.queue) - 1; i >= 0; i-- {
+		if b.queue[i].GetUser().GetId() != id {
+			continue
+		}
+		if b.queue[i].Method == pb.WatchResponse_CREATE && event.Method == pb.WatchResponse_UPDATE {
+			event = &pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: event.User}
+		}
+		b.queue[i] = event
+		return true
+	}
+	return false
+}
+
+// Waits for next event. Returns ErrBufferOverflow when subscriber was
+// disconnected, ErrBufferClosed when buffer is closed and empty or context
+// error when context is done.
+func (b *Buffer) Pop(ctx context.Context) (*pb.WatchResponse, error) {
+	for {
+		b.mu.Lock()
+		if b.overflowed {
+			b.mu.Unlock()
+			return nil, ErrBufferOverflow
+		}
+		if len(b.queue) > 0 {
+			event := b.queue[0]
+			b.queue = b.queue[1:]
+			b.mu.Unlock()
+			return event, nil
+		}
+		if b.closed {
+			b.mu.Unlock()
+			return nil, ErrBufferClosed
+		}
+		b.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-b.ready:
+		}
+	}
+}
+
+// Returns channel closed when subscriber is disconnected by Disconnect policy.
+func (b *Buffer) Overflow() <-chan struct{} {
+	return b.overflow
+}
+
+// Closes buffer. Buffered events can still be popped.
+func (b *Buffer) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.signal()
+}
+
+// Wakes up waiting Pop. Must be called with mu held.
+func (b *Buffer) signal() {
+	select {
+	case b.ready <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,104 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func event(method pb.WatchResponse_METHOD, id, name string) *pb.WatchResponse {
+	return &pb.WatchResponse{Method: method, User: &pb.UserResponse{Id: id, FirstName: name}}
+}
+
+// Pops all buffered events
+func drain(t *testing.T, b *Buffer) []*pb.WatchResponse {
+	b.Close()
+	result := []*pb.WatchResponse{}
+	for {
+		e, err := b.Pop(context.Background())
+		if err == ErrBufferClosed {
+			return result
+		}
+		require.NoError(t, err)
+		result = append(result, e)
+	}
+}
+
+func TestBufferDropOldest(t *testing.T) {
+	b := NewBuffer(2, DropOldest)
+	b.Push(event(pb.WatchResponse_CREATE, "1", ""))
+	b.Push(event(pb.WatchResponse_CREATE, "2", ""))
+	b.Push(event(pb.WatchResponse_CREATE, "3", ""))
+
+	result := drain(t, b)
+	require.Len(t, result, 2)
+	require.Equal(t, "2", result[0].User.Id)
+	require.Equal(t, "3", result[1].User.Id)
+}
+
+func TestBufferDisconnect(t *testing.T) {
+	disconnects := testutil.ToFloat64(bufferDisconnects)
+	b := NewBuffer(1, Disconnect)
+	b.Push(event(pb.WatchResponse_CREATE, "1", ""))
+	b.Push(event(pb.WatchResponse_CREATE, "2", ""))
+
+	_, err := b.Pop(context.Background())
+	require.Equal(t, ErrBufferOverflow, err)
+	require.Equal(t, disconnects+1, testutil.ToFloat64(bufferDisconnects))
+}
+
+func TestBufferCoalesce(t *testing.T) {
+	b := NewBuffer(2, Coalesce)
+	b.Push(event(pb.WatchResponse_CREATE, "1", "John"))
+	b.Push(event(pb.WatchResponse_CREATE, "2", ""))
+	b.Push(event(pb.WatchResponse_UPDATE, "1", "Johnny"))
+	b.Push(event(pb.WatchResponse_UPDATE, "3", ""))
+
+	result := drain(t, b)
+	require.Len(t, result, 2)
+	// Updated user "1" was merged into its create event and then dropped
+	// as the oldest event when user "3" had nothing to coalesce with.
+	require.Equal(t, "2", result[0].User.Id)
+	require.Equal(t, "3", result[1].User.Id)
+
+	b = NewBuffer(1, Coalesce)
+	b.Push(event(pb.WatchResponse_CREATE, "1", "John"))
+	b.Push(event(pb.WatchResponse_UPDATE, "1", "Johnny"))
+	result = drain(t, b)
+	require.Len(t, result, 1)
+	require.Equal(t, pb.WatchResponse_CREATE, result[0].Method)
+	require.Equal(t, "Johnny", result[0].User.FirstName)
+}
+
+func TestBufferPopWaits(t *testing.T) {
+	b := NewBuffer(0, "")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		b.Push(event(pb.WatchResponse_DELETE, "1", ""))
+	}()
+	e, err := b.Pop(context.Background())
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchResponse_DELETE, e.Method)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = b.Pop(ctx)
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestParseOverflowPolicy(t *testing.T) {
+	p, err := ParseOverflowPolicy("")
+	require.NoError(t, err)
+	require.Equal(t, DropOldest, p)
+
+	p, err = ParseOverflowPolicy("coalesce")
+	require.NoError(t, err)
+	require.Equal(t, Coalesce, p)
+
+	_, err = ParseOverflowPolicy("block")
+	require.Error(t, err)
+}
@@ -0,0 +1,369 @@
+package events
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// CloudEvents specification version produced by cloudevents codecs.
+	cloudEventsSpecVersion = "1.0"
+
+	// Source used when codec source is empty.
+	DefaultSource = "/user-service"
+
+	// Prefix of the CloudEvents type attribute, e.g. user.v1.created
+	cloudEventsTypePrefix = "user.v1."
+)
+
+// CloudEvents type suffix for each watch method.
+var cloudEventsTypes = map[pb.WatchResponse_METHOD]string{
+	pb.WatchResponse_CREATE: "created",
+	pb.WatchResponse_UPDATE: "updated",
+	pb.WatchResponse_DELETE: "deleted",
+	pb.WatchResponse_ERASE:  "erased",
+}
+
+// Returned by codecs which need message headers when used with transport
+// carrying raw bytes only.
+var ErrHeadersRequired = errors.New("events: encoding requires transport with message headers")
+
+// Encodes events for transports carrying raw bytes.
+type Codec interface {
+	Marshal(event *pb.WatchResponse) ([]byte, error)
+	Unmarshal(data []byte) (*pb.WatchResponse, error)
+}
+
+// Implemented by codecs carrying event attributes in message headers.
+// Attributes are keyed by CloudEvents attribute names, transports map them
+// to headers of their protocol binding.
+type AttributesCodec interface {
+	MarshalAttributes(event *pb.WatchResponse) (map[string]string, []byte, error)
+	UnmarshalAttributes(attrs map[string]string, data []byte) (*pb.WatchResponse, error)
+}
+
+// Returns codec by its name: proto (default), cloudevents-json,
+// cloudevents-proto or cloudevents-binary. Source is used by cloudevents
+// codecs.
+func NewCodec(name, source string) (Codec, error) {
+	switch name {
+	case "", "proto":
+		return ProtoCodec{}, nil
+	case "cloudevents-json":
+		return CloudEventsJSONCodec{Source: source}, nil
+	case "cloudevents-proto":
+		return CloudEventsProtoCodec{Source: source}, nil
+	case "cloudevents-binary":
+		return CloudEventsBinaryCodec{Source: source}, nil
+	}
+	return nil, fmt.Errorf("unsupported event encoding: %q", name)
+}
+
+// Reports whether codec needs transport with message headers.
+func RequiresHeaders(codec Codec) bool {
+	_, ok := codec.(AttributesCodec)
+	return ok
+}
+
+// Encodes WatchResponse as raw protobuf message.
+type ProtoCodec struct{}
+
+func (ProtoCodec) Marshal(event *pb.WatchResponse) ([]byte, error) {
+	return proto.Marshal(event)
+}
+
+func (ProtoCodec) Unmarshal(data []byte) (*pb.WatchResponse, error) {
+	event := &pb.WatchResponse{}
+	err := proto.Unmarshal(data, event)
+	return event, err
+}
+
+// JSON representation of CloudEvents structured content mode.
+type cloudEventJSON struct {
+	SpecVersion     string          `json:"specversion"`
+	ID              string          `json:"id"`
+	Source          string          `json:"source"`
+	Type            string          `json:"type"`
+	Subject         string          `json:"subject,omitempty"`
+	Time            time.Time       `json:"time"`
+	DataContentType string          `json:"datacontenttype"`
+	Data            json.RawMessage `json:"data"`
+
+	// Distributed tracing extension
+	TraceParent string `json:"traceparent,omitempty"`
+	TraceState  string `json:"tracestate,omitempty"`
+}
+
+// Event metadata keys carried as CloudEvents distributed tracing
+// extension attributes.
+var traceAttributes = []string{"traceparent", "tracestate"}
+
+// Encodes events as CloudEvents 1.0 in structured JSON mode
+// (application/cloudevents+json). Data holds the user as JSON.
+type CloudEventsJSONCodec struct {
+	Source string
+}
+
+func (c CloudEventsJSONCodec) Marshal(event *pb.WatchResponse) ([]byte, error) {
+	ceType, err := CloudEventType(event.Method)
+	if err != nil {
+		return nil, err
+	}
+	data, err := protojson.Marshal(userOrEmpty(event))
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(cloudEventJSON{
+		SpecVersion:     cloudEventsSpecVersion,
+		ID:              uuid.NewString(),
+		Source:          sourceOrDefault(c.Source),
+		Type:            ceType,
+		Subject:         event.GetUser().GetId(),
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+		TraceParent:     event.GetMetadata()["traceparent"],
+		TraceState:      event.GetMetadata()["tracestate"],
+	})
+}
+
+func (c CloudEventsJSONCodec) Unmarshal(data []byte) (*pb.WatchResponse, error) {
+	ce := cloudEventJSON{}
+	if err := json.Unmarshal(data, &ce); err != nil {
+		return nil, err
+	}
+	method, err := methodFromCloudEventType(ce.Type)
+	if err != nil {
+		return nil, err
+	}
+	user := &pb.UserResponse{}
+	if len(ce.Data) > 0 {
+		if err := protojson.Unmarshal(ce.Data, user); err != nil {
+			return nil, err
+		}
+	}
+	return &pb.WatchResponse{
+		Method:   method,
+		User:     user,
+		Metadata: traceMetadata(map[string]string{"traceparent": ce.TraceParent, "tracestate": ce.TraceState}),
+	}, nil
+}
+
+// Encodes events as CloudEvents 1.0 protobuf format in structured content
+// mode (application/cloudevents+protobuf). Data holds the WatchResponse.
+type CloudEventsProtoCodec struct {
+	Source string
+}
+
+func (c CloudEventsProtoCodec) Marshal(event *pb.WatchResponse) ([]byte, error) {
+	ceType, err := CloudEventType(event.Method)
+	if err != nil {
+		return nil, err
+	}
+	data, err := anypb.New(event)
+	if err != nil {
+		return nil, err
+	}
+	attrs := map[string]*pb.CloudEvent_CloudEventAttributeValue{
+		"time": {Attr: &pb.CloudEvent_CloudEventAttributeValue_CeTimestamp{
+			CeTimestamp: timestamppb.Now(),
+		}},
+		"datacontenttype": {Attr: &pb.CloudEvent_CloudEventAttributeValue_CeString{
+			CeString: "application/protobuf",
+		}},
+	}
+	if id := event.GetUser().GetId(); id != "" {
+		attrs["subject"] = &pb.CloudEvent_CloudEventAttributeValue{
+			Attr: &pb.CloudEvent_CloudEventAttributeValue_CeString{CeString: id},
+		}
+	}
+	for _, key := range traceAttributes {
+		if value := event.GetMetadata()[key]; value != "" {
+			attrs[key] = &pb.CloudEvent_CloudEventAttributeValue{
+				Attr: &pb.CloudEvent_CloudEventAttributeValue_CeString{CeString: value},
+			}
+		}
+	}
+	return proto.Marshal(&pb.CloudEvent{
+		Id:          uuid.NewString(),
+		Source:      sourceOrDefault(c.Source),
+		SpecVersion: cloudEventsSpecVersion,
+		Type:        ceType,
+		Attributes:  attrs,
+		Data:        &pb.CloudEvent_ProtoData{ProtoData: data},
+	})
+}
+
+func (c CloudEventsProtoCodec) Unmarshal(data []byte) (*pb.WatchResponse, error) {
+	ce := &pb.CloudEvent{}
+	if err := proto.Unmarshal(data, ce); err != nil {
+		return nil, err
+	}
+	if _, err := methodFromCloudEventType(ce.Type); err != nil {
+		return nil, err
+	}
+	event := &pb.WatchResponse{}
+	if err := ce.GetProtoData().UnmarshalTo(event); err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// Encodes events in CloudEvents 1.0 binary content mode. Attributes are
+// carried in message headers and data holds the user as protobuf
+// (application/protobuf). Only transports with message headers (nats and
+// kafka) support it.
+type CloudEventsBinaryCodec struct {
+	Source string
+}
+
+func (CloudEventsBinaryCodec) Marshal(event *pb.WatchResponse) ([]byte, error) {
+	return nil, ErrHeadersRequired
+}
+
+func (CloudEventsBinaryCodec) Unmarshal(data []byte) (*pb.WatchResponse, error) {
+	return nil, ErrHeadersRequired
+}
+
+func (c CloudEventsBinaryCodec) MarshalAttributes(event *pb.WatchResponse) (map[string]string, []byte, error) {
+	ceType, err := CloudEventType(event.Method)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := proto.Marshal(userOrEmpty(event))
+	if err != nil {
+		return nil, nil, err
+	}
+	attrs := map[string]string{
+		"specversion":     cloudEventsSpecVersion,
+		"id":              uuid.NewString(),
+		"source":          sourceOrDefault(c.Source),
+		"type":            ceType,
+		"time":            time.Now().UTC().Format(time.RFC3339Nano),
+		"datacontenttype": "application/protobuf",
+	}
+	if id := event.GetUser().GetId(); id != "" {
+		attrs["subject"] = id
+	}
+	for _, key := range traceAttributes {
+		if value := event.GetMetadata()[key]; value != "" {
+			attrs[key] = value
+		}
+	}
+	return attrs, data, nil
+}
+
+func (c CloudEventsBinaryCodec) UnmarshalAttributes(attrs map[string]string, data []byte) (*pb.WatchResponse, error) {
+	if attrs["specversion"] != cloudEventsSpecVersion {
+		return nil, fmt.Errorf("unsupported cloudevents specversion: %q", attrs["specversion"])
+	}
+	method, err := methodFromCloudEventType(attrs["type"])
+	if err != nil {
+		return nil, err
+	}
+	user := &pb.UserResponse{}
+	if err := proto.Unmarshal(data, user); err != nil {
+		return nil, err
+	}
+	return &pb.WatchResponse{Method: method, User: user, Metadata: traceMetadata(attrs)}, nil
+}
+
+// Maps CloudEvents attributes to message headers named with protocol
+// binding prefix, e.g. ce_type for kafka. Data content type is carried in
+// content-type header.
+func attributesToHeaders(attrs map[string]string, prefix string) map[string]string {
+	headers := make(map[string]string, len(attrs))
+	for key, value := range attrs {
+		if key == "datacontenttype" {
+			headers["content-type"] = value
+			continue
+		}
+		headers[prefix+key] = value
+	}
+	return headers
+}
+
+// Reverse of attributesToHeaders. Headers without prefix are ignored.
+func headersToAttributes(headers map[string]string, prefix string) map[string]string {
+	attrs := map[string]string{}
+	for key, value := range headers {
+		key = strings.ToLower(key)
+		if key == "content-type" {
+			attrs["datacontenttype"] = value
+		} else if strings.HasPrefix(key, prefix) {
+			attrs[strings.TrimPrefix(key, prefix)] = value
+		}
+	}
+	return attrs
+}
+
+// Encodes event for transport supporting message headers. Headers are nil
+// unless codec carries attributes in them.
+func encodeMessage(codec Codec, prefix string, event *pb.WatchResponse) (map[string]string, []byte, error) {
+	ac, ok := codec.(AttributesCodec)
+	if !ok {
+		data, err := codec.Marshal(event)
+		return nil, data, err
+	}
+	attrs, data, err := ac.MarshalAttributes(event)
+	if err != nil {
+		return nil, nil, err
+	}
+	return attributesToHeaders(attrs, prefix), data, nil
+}
+
+// Returns CloudEvents type for watch method, e.g. user.v1.created.
+func CloudEventType(method pb.WatchResponse_METHOD) (string, error) {
+	suffix, ok := cloudEventsTypes[method]
+	if !ok {
+		return "", fmt.Errorf("no cloudevents type for method %s", method.String())
+	}
+	return cloudEventsTypePrefix + suffix, nil
+}
+
+func methodFromCloudEventType(ceType string) (pb.WatchResponse_METHOD, error) {
+	suffix := strings.TrimPrefix(ceType, cloudEventsTypePrefix)
+	for method, s := range cloudEventsTypes {
+		if s == suffix && suffix != ceType {
+			return method, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown cloudevents type: %q", ceType)
+}
+
+// Returns trace context metadata found in CloudEvents attributes, nil when
+// there is none.
+func traceMetadata(attrs map[string]string) map[string]string {
+	if attrs["traceparent"] == "" {
+		return nil
+	}
+	metadata := map[string]string{"traceparent": attrs["traceparent"]}
+	if attrs["tracestate"] != "" {
+		metadata["tracestate"] = attrs["tracestate"]
+	}
+	return metadata
+}
+
+func userOrEmpty(event *pb.WatchResponse) *pb.UserResponse {
+	if event.User == nil {
+		return &pb.UserResponse{}
+	}
+	return event.User
+}
+
+func sourceOrDefault(source string) string {
+	if source == "" {
+		return DefaultSource
+	}
+	return source
+}
@@ -0,0 +1,116 @@
+package events
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/proto"
+)
+
+func TestCodecs(t *testing.T) {
+	event := &pb.WatchResponse{
+		Method: pb.WatchResponse_UPDATE,
+		User: &pb.UserResponse{
+			Id:        "cc9b61e3-0cba-473f-8e95-944661c46051",
+			FirstName: "John",
+			Email:     "john@email.com",
+			Country:   "UK",
+		},
+		Metadata: map[string]string{
+			"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+			"tracestate":  "vendor=value",
+		},
+	}
+
+	for _, name := range []string{"proto", "cloudevents-json", "cloudevents-proto"} {
+		codec, err := NewCodec(name, "/test")
+		require.NoError(t, err, name)
+
+		data, err := codec.Marshal(event)
+		require.NoError(t, err, name)
+
+		decoded, err := codec.Unmarshal(data)
+		require.NoError(t, err, name)
+		require.True(t, proto.Equal(event, decoded), "TestCodecs(%s)=%v, wanted %v", name, decoded, event)
+	}
+
+	_, err := NewCodec("xml", "")
+	require.Error(t, err)
+}
+
+func TestCloudEventsJSONCodec(t *testing.T) {
+	data, err := CloudEventsJSONCodec{}.Marshal(&pb.WatchResponse{
+		Method: pb.WatchResponse_CREATE,
+		User:   &pb.UserResponse{Id: "1", FirstName: "John"},
+	})
+	require.NoError(t, err)
+
+	ce := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(data, &ce))
+	require.Equal(t, "1.0", ce["specversion"])
+	require.Equal(t, "user.v1.created", ce["type"])
+	require.Equal(t, DefaultSource, ce["source"])
+	require.Equal(t, "1", ce["subject"])
+	require.NotEmpty(t, ce["id"])
+	require.NotEmpty(t, ce["time"])
+	require.Equal(t, "John", ce["data"].(map[string]interface{})["first_name"])
+	require.NotContains(t, ce, "traceparent")
+
+	// Erasure has its own type
+	data, err = CloudEventsJSONCodec{}.Marshal(&pb.WatchResponse{Method: pb.WatchResponse_ERASE, User: &pb.UserResponse{Id: "1"}})
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"type":"user.v1.erased"`)
+	decoded, err := CloudEventsJSONCodec{}.Unmarshal(data)
+	require.NoError(t, err)
+	require.Equal(t, pb.WatchResponse_ERASE, decoded.Method)
+
+	// Unknown event types should not be decoded
+	_, err = CloudEventsJSONCodec{}.Unmarshal([]byte(`{"specversion":"1.0","type":"order.v1.created"}`))
+	require.Error(t, err)
+}
+
+func TestCloudEventsBinaryCodec(t *testing.T) {
+	event := &pb.WatchResponse{
+		Method:   pb.WatchResponse_UPDATE,
+		User:     &pb.UserResponse{Id: "1", FirstName: "John"},
+		Metadata: map[string]string{"traceparent": "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"},
+	}
+	codec, err := NewCodec("cloudevents-binary", "/test")
+	require.NoError(t, err)
+	require.True(t, RequiresHeaders(codec))
+	require.False(t, RequiresHeaders(ProtoCodec{}))
+
+	_, err = codec.Marshal(event)
+	require.ErrorIs(t, err, ErrHeadersRequired)
+
+	headers, data, err := encodeMessage(codec, kafkaHeaderPrefix, event)
+	require.NoError(t, err)
+	require.Equal(t, "1.0", headers["ce_specversion"])
+	require.Equal(t, "user.v1.updated", headers["ce_type"])
+	require.Equal(t, "/test", headers["ce_source"])
+	require.Equal(t, "1", headers["ce_subject"])
+	require.Equal(t, event.Metadata["traceparent"], headers["ce_traceparent"])
+	require.Equal(t, "application/protobuf", headers["content-type"])
+	require.NotEmpty(t, headers["ce_id"])
+	require.NotEmpty(t, headers["ce_time"])
+
+	decoded, ok := decodeMessage(codec, kafkaHeaderPrefix, headers, data)
+	require.True(t, ok)
+	require.Equal(t, pb.WatchResponse_UPDATE, decoded.Method)
+	require.Equal(t, "John", decoded.User.FirstName)
+	require.Equal(t, event.Metadata, decoded.Metadata)
+
+	// Headers of other protocol bindings are not attributes
+	_, ok = decodeMessage(codec, natsHeaderPrefix, headers, data)
+	require.False(t, ok)
+
+	// Codecs without attributes ignore headers
+	headers, data, err = encodeMessage(ProtoCodec{}, natsHeaderPrefix, event)
+	require.NoError(t, err)
+	require.Nil(t, headers)
+	decoded, ok = decodeMessage(ProtoCodec{}, natsHeaderPrefix, nil, data)
+	require.True(t, ok)
+	require.True(t, proto.Equal(event, decoded))
+}
@@ -0,0 +1,140 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+)
+
+// Default topic used to publish user changes. It is used as redis channel,
+// nats subject and kafka topic.
+const DefaultTopic = "users"
+
+// Publishes user change events.
+type EventPublisher interface {
+	Publish(ctx context.Context, event *pb.WatchResponse) error
+}
+
+// Subscribes to user change events.
+type EventSubscriber interface {
+	Subscribe(ctx context.Context) (Subscription, error)
+}
+
+// Implemented by subscribers buffering events, so a subscriber that must
+// not miss events can be disconnected instead.
+type PolicySubscriber interface {
+	SubscribeWithPolicy(ctx context.Context, policy OverflowPolicy) (Subscription, error)
+}
+
+// Subscription delivers events until it is closed or the context used to
+// create it is canceled. Events channel is closed after that.
+type Subscription interface {
+	Events() <-chan *pb.WatchResponse
+
+	// Reason events channel was closed. Nil when subscription was closed
+	// or its context was canceled.
+	Err() error
+
+	Close() error
+}
+
+// Bus is both publisher and subscriber sharing the same broker connection.
+type Bus interface {
+	EventPublisher
+	EventSubscriber
+	Close() error
+}
+
+// Implemented by buses which can check that their broker is reachable.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// Publishes every event to all publishers. Publishing continues when one of
+// the publishers fails and the first error is returned.
+type MultiPublisher []EventPublisher
+
+func (m MultiPublisher) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	var firstErr error
+	for _, p := range m {
+		if err := p.Publish(ctx, event); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Config used to select and configure event bus implementation.
+type Config struct {
+	// Driver name: redis, nats, kafka or memory.
+	Driver string
+
+	// Broker address. Kafka accepts comma separated list of brokers.
+	Addr string
+
+	// Topic the events are published to. DefaultTopic when empty.
+	Topic string
+
+	// Payload encoding, see NewCodec. Not used by memory driver.
+	Encoding string
+
+	// CloudEvents source attribute. DefaultSource when empty.
+	Source string
+}
+
+// Opens event bus selected by cfg.Driver. Redis driver is not supported here
+// because it reuses existing redis client, use NewRedisBus instead.
+func Open(cfg Config) (Bus, error) {
+	if cfg.Topic == "" {
+		cfg.Topic = DefaultTopic
+	}
+	codec, err := NewCodec(cfg.Encoding, cfg.Source)
+	if err != nil {
+		return nil, err
+	}
+	switch cfg.Driver {
+	case "memory":
+		return NewMemoryBus(), nil
+	case "nats":
+		bus, err := NewNatsBus(cfg.Addr, cfg.Topic)
+		if err != nil {
+			return nil, err
+		}
+		bus.Codec = codec
+		return bus, nil
+	case "kafka":
+		bus := NewKafkaBus(strings.Split(cfg.Addr, ","), cfg.Topic)
+		bus.Codec = codec
+		return bus, nil
+	}
+	return nil, fmt.Errorf("unsupported event bus driver: %q", cfg.Driver)
+}
+
+// Decodes event received from the transport. Returns false when data can not
+// be decoded so the message can be skipped.
+func decode(codec Codec, data []byte) (*pb.WatchResponse, bool) {
+	event, err := codec.Unmarshal(data)
+	if err != nil {
+		slog.Error("events: failed to decode event", "error", err)
+		return nil, false
+	}
+	return event, true
+}
+
+// Decodes event received with message headers. Headers are used only by
+// codecs carrying attributes in them.
+func decodeMessage(codec Codec, prefix string, headers map[string]string, data []byte) (*pb.WatchResponse, bool) {
+	ac, ok := codec.(AttributesCodec)
+	if !ok {
+		return decode(codec, data)
+	}
+	event, err := ac.UnmarshalAttributes(headersToAttributes(headers, prefix), data)
+	if err != nil {
+		slog.Error("events: failed to decode event", "error", err)
+		return nil, false
+	}
+	return event, true
+}
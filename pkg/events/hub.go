@@ -0,0 +1,223 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+)
+
+// Delay before hub subscribes again after upstream subscription failed.
+const hubRetryDelay = time.Second
+
+// Hub holds a single upstream subscription and fans out received events to
+// local subscribers. Every subscriber has its own bounded buffer so a slow
+// subscriber can't block the others.
+type Hub struct {
+	upstream   EventSubscriber
+	bufferSize int
+	policy     OverflowPolicy
+
+	mu     sync.Mutex
+	subs   map[*hubSubscription]struct{}
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed bool
+}
+
+// Creates hub on top of upstream subscriber. Subscribers get buffers of
+// bufferSize events handled by overflow policy.
+func NewHub(upstream EventSubscriber, bufferSize int, policy OverflowPolicy) *Hub {
+	return &Hub{
+		upstream:   upstream,
+		bufferSize: bufferSize,
+		policy:     policy,
+		subs:       map[*hubSubscription]struct{}{},
+		done:       make(chan struct{}),
+	}
+}
+
+// Subscribes to upstream and starts fanning out events until context is
+// canceled or hub is closed. Upstream is subscribed again when its
+// subscription ends unexpectedly.
+func (h *Hub) Start(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	sub, err := h.upstream.Subscribe(ctx)
+	if err != nil {
+		cancel()
+		return err
+	}
+
+	h.mu.Lock()
+	h.cancel = cancel
+	h.mu.Unlock()
+
+	go h.run(ctx, sub)
+	return nil
+}
+
+func (h *Hub) run(ctx context.Context, sub Subscription) {
+	defer close(h.done)
+	defer h.closeSubscriptions()
+
+	for {
+		for event := range sub.Events() {
+			h.broadcast(event)
+		}
+		sub.Close()
+
+		// Resubscribe until context is canceled
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(hubRetryDelay):
+			}
+			var err error
+			sub, err = h.upstream.Subscribe(ctx)
+			if err == nil {
+				break
+			}
+			slog.Error("events: hub failed to subscribe", "error", err)
+		}
+	}
+}
+
+func (h *Hub) broadcast(event *pb.WatchResponse) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for sub := range h.subs {
+		sub.buf.Push(event)
+	}
+}
+
+// Subscribes to events received by the hub. Subscription ends when context
+// is canceled, it is closed or subscriber is too slow and overflow policy
+// disconnects it.
+func (h *Hub) Subscribe(ctx context.Context) (Subscription, error) {
+	return h.SubscribeWithPolicy(ctx, h.policy)
+}
+
+// Subscribes like Subscribe with buffer handled by policy instead of the
+// hub's one.
+func (h *Hub) SubscribeWithPolicy(ctx context.Context, policy OverflowPolicy) (Subscription, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &hubSubscription{
+		hub:    h,
+		buf:    NewBuffer(h.bufferSize, policy),
+		ch:     make(chan *pb.WatchResponse),
+		cancel: cancel,
+	}
+
+	h.mu.Lock()
+	if h.closed {
+		h.mu.Unlock()
+		cancel()
+		return nil, ErrBufferClosed
+	}
+	h.subs[sub] = struct{}{}
+	h.mu.Unlock()
+
+	go sub.run(ctx)
+	return sub, nil
+}
+
+// Number of active subscribers.
+func (h *Hub) Len() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Stops upstream subscription and closes all subscribers.
+func (h *Hub) Close() error {
+	h.mu.Lock()
+	cancel := h.cancel
+	h.mu.Unlock()
+	if cancel == nil {
+		h.closeSubscriptions()
+		return nil
+	}
+	cancel()
+	<-h.done
+	return nil
+}
+
+// Closes buffers of all subscribers. They finish after receiving events
+// which are already buffered.
+func (h *Hub) closeSubscriptions() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subs {
+		delete(h.subs, sub)
+		sub.buf.Close()
+	}
+}
+
+func (h *Hub) remove(sub *hubSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subs, sub)
+}
+
+type hubSubscription struct {
+	hub    *Hub
+	buf    *Buffer
+	ch     chan *pb.WatchResponse
+	cancel context.CancelFunc
+
+	mu  sync.Mutex
+	err error
+}
+
+// Moves buffered events to events channel until subscription ends.
+func (s *hubSubscription) run(ctx context.Context) {
+	defer close(s.ch)
+	defer s.hub.remove(s)
+	defer s.cancel()
+
+	for {
+		event, err := s.buf.Pop(ctx)
+		if err != nil {
+			if errors.Is(err, ErrBufferOverflow) {
+				s.setErr(err)
+			}
+			return
+		}
+		select {
+		case s.ch <- event:
+		case <-s.buf.Overflow():
+			s.setErr(ErrBufferOverflow)
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *hubSubscription) setErr(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+}
+
+func (s *hubSubscription) Events() <-chan *pb.WatchResponse {
+	return s.ch
+}
+
+// Returns ErrBufferOverflow when subscriber was disconnected because it was
+// too slow.
+func (s *hubSubscription) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *hubSubscription) Close() error {
+	s.cancel()
+	return nil
+}
@@ -0,0 +1,121 @@
+package events
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts subscriptions made to the wrapped subscriber
+type countingSubscriber struct {
+	EventSubscriber
+	count int32
+}
+
+func (c *countingSubscriber) Subscribe(ctx context.Context) (Subscription, error) {
+	atomic.AddInt32(&c.count, 1)
+	return c.EventSubscriber.Subscribe(ctx)
+}
+
+func TestHub(t *testing.T) {
+	bus := NewMemoryBus()
+	upstream := &countingSubscriber{EventSubscriber: bus}
+	hub := NewHub(upstream, 10, DropOldest)
+	require.NoError(t, hub.Start(context.Background()))
+	defer hub.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	subs := []Subscription{}
+	for i := 0; i < 5; i++ {
+		sub, err := hub.Subscribe(ctx)
+		require.NoError(t, err)
+		subs = append(subs, sub)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&upstream.count), "hub should subscribe upstream only once")
+
+	require.NoError(t, bus.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_CREATE}))
+	for _, sub := range subs {
+		select {
+		case e := <-sub.Events():
+			require.Equal(t, pb.WatchResponse_CREATE, e.Method)
+		case <-time.After(time.Second):
+			t.Fatal("TestHub: subscriber did not receive event")
+		}
+	}
+
+	// Ending subscribers should remove them from the hub
+	subs[0].Close()
+	cancel()
+	require.Eventually(t, func() bool { return hub.Len() == 0 }, time.Second, 10*time.Millisecond)
+}
+
+func TestHubSlowSubscriber(t *testing.T) {
+	bus := NewMemoryBus()
+	hub := NewHub(bus, 1, Disconnect)
+	require.NoError(t, hub.Start(context.Background()))
+	defer hub.Close()
+
+	sub, err := hub.Subscribe(context.Background())
+	require.NoError(t, err)
+
+	// Subscriber does not read, so buffer overflows
+	for i := 0; i < 5; i++ {
+		bus.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE})
+	}
+	require.Eventually(t, func() bool { return hub.Len() == 0 }, time.Second, 10*time.Millisecond)
+
+	// Channel is closed, possibly after already received event
+	for range sub.Events() {
+	}
+	require.Equal(t, ErrBufferOverflow, sub.Err())
+}
+
+func TestHubSubscribeWithPolicy(t *testing.T) {
+	bus := NewMemoryBus()
+	hub := NewHub(bus, 1, DropOldest)
+	require.NoError(t, hub.Start(context.Background()))
+	defer hub.Close()
+
+	dropping, err := hub.Subscribe(context.Background())
+	require.NoError(t, err)
+	disconnecting, err := hub.SubscribeWithPolicy(context.Background(), Disconnect)
+	require.NoError(t, err)
+
+	// Neither subscriber reads, only the one with Disconnect policy ends
+	for i := 0; i < 5; i++ {
+		bus.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE})
+	}
+	require.Eventually(t, func() bool { return hub.Len() == 1 }, time.Second, 10*time.Millisecond)
+	for range disconnecting.Events() {
+	}
+	require.Equal(t, ErrBufferOverflow, disconnecting.Err())
+
+	dropping.Close()
+	for range dropping.Events() {
+	}
+	require.NoError(t, dropping.Err())
+}
+
+func TestHubClose(t *testing.T) {
+	hub := NewHub(NewMemoryBus(), 0, "")
+	require.NoError(t, hub.Start(context.Background()))
+
+	sub, err := hub.Subscribe(context.Background())
+	require.NoError(t, err)
+	require.NoError(t, hub.Close())
+
+	select {
+	case _, ok := <-sub.Events():
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("TestHubClose: subscription was not closed")
+	}
+	require.NoError(t, sub.Err())
+
+	_, err = hub.Subscribe(context.Background())
+	require.Error(t, err)
+}
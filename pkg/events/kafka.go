@@ -0,0 +1,225 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/segmentio/kafka-go"
+)
+
+// Header prefix of CloudEvents attributes in kafka protocol binding.
+const kafkaHeaderPrefix = "ce_"
+
+// Event bus for kafka protocol compatible brokers.
+type KafkaBus struct {
+	Brokers []string
+	Topic   string
+	Codec   Codec
+	writer  *kafka.Writer
+}
+
+// Creates kafka event bus. Connections to brokers are opened lazily.
+func NewKafkaBus(brokers []string, topic string) *KafkaBus {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	return &KafkaBus{
+		Brokers: brokers,
+		Topic:   topic,
+		Codec:   ProtoCodec{},
+		writer: &kafka.Writer{
+			Addr:                   kafka.TCP(brokers...),
+			Topic:                  topic,
+			Balancer:               &kafka.Hash{},
+			AllowAutoTopicCreation: true,
+		},
+	}
+}
+
+// Publishes event keyed by user id so changes of the same user keep order.
+func (b *KafkaBus) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	headers, data, err := encodeMessage(b.Codec, kafkaHeaderPrefix, event)
+	if err != nil {
+		return err
+	}
+	msg := kafka.Message{
+		Key:   []byte(event.GetUser().GetId()),
+		Value: data,
+	}
+	for key, value := range headers {
+		msg.Headers = append(msg.Headers, kafka.Header{Key: key, Value: []byte(value)})
+	}
+	return observePublish(ctx, "kafka", b.Topic, func(ctx context.Context) error {
+		return b.writer.WriteMessages(ctx, msg)
+	})
+}
+
+// Every subscription reads all partitions of the topic without consumer
+// group, starting at their last offsets, so each watcher receives all
+// events published after subscribing and no consumer groups are left on
+// the brokers. Partitions added later are read after subscribing again.
+func (b *KafkaBus) Subscribe(ctx context.Context) (Subscription, error) {
+	partitions, err := b.partitions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	readers := []*kafka.Reader{}
+	for _, partition := range partitions {
+		reader, err := b.partitionReader(ctx, partition)
+		if err != nil {
+			for _, r := range readers {
+				r.Close()
+			}
+			return nil, err
+		}
+		readers = append(readers, reader)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	sub := &kafkaSubscription{
+		codec:   b.Codec,
+		readers: readers,
+		cancel:  cancel,
+		ch:      make(chan *pb.WatchResponse),
+	}
+	sub.wg.Add(len(readers))
+	for _, reader := range readers {
+		go sub.run(ctx, reader)
+	}
+	go func() {
+		sub.wg.Wait()
+		close(sub.ch)
+	}()
+	return sub, nil
+}
+
+// Returns partitions of the topic. Brokers allowing automatic topic
+// creation create the topic when it does not exist yet.
+func (b *KafkaBus) partitions(ctx context.Context) ([]kafka.Partition, error) {
+	conn, err := b.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	partitions, err := conn.ReadPartitions(b.Topic)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitions) == 0 {
+		return nil, fmt.Errorf("kafka topic %q has no partitions", b.Topic)
+	}
+	return partitions, nil
+}
+
+// Creates reader of the partition starting at its current last offset.
+// Offset is read before returning, so messages published in between are
+// not skipped.
+func (b *KafkaBus) partitionReader(ctx context.Context, partition kafka.Partition) (*kafka.Reader, error) {
+	conn, err := kafka.DialPartition(ctx, "tcp", "", partition)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := conn.ReadLastOffset()
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+	reader := kafka.NewReader(kafka.ReaderConfig{
+		Brokers:   b.Brokers,
+		Topic:     b.Topic,
+		Partition: partition.ID,
+	})
+	if err := reader.SetOffset(offset); err != nil {
+		reader.Close()
+		return nil, err
+	}
+	return reader, nil
+}
+
+// Connects to the first broker accepting connections.
+func (b *KafkaBus) dial(ctx context.Context) (*kafka.Conn, error) {
+	var err error
+	for _, broker := range b.Brokers {
+		var conn *kafka.Conn
+		conn, err = kafka.DialContext(ctx, "tcp", broker)
+		if err == nil {
+			return conn, nil
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no kafka brokers configured")
+	}
+	return nil, err
+}
+
+// Checks that at least one broker accepts connections.
+func (b *KafkaBus) Ping(ctx context.Context) error {
+	conn, err := b.dial(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+func (b *KafkaBus) Close() error {
+	return b.writer.Close()
+}
+
+type kafkaSubscription struct {
+	codec   Codec
+	readers []*kafka.Reader
+	cancel  context.CancelFunc
+	ch      chan *pb.WatchResponse
+	wg      sync.WaitGroup
+	once    sync.Once
+}
+
+// Forwards decoded messages of a partition to events channel until
+// subscription is closed. Failure of one partition closes the subscription.
+func (s *kafkaSubscription) run(ctx context.Context, reader *kafka.Reader) {
+	defer s.wg.Done()
+	defer s.Close()
+
+	for {
+		msg, err := reader.ReadMessage(ctx)
+		if err != nil {
+			return
+		}
+		headers := make(map[string]string, len(msg.Headers))
+		for _, h := range msg.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		event, ok := decodeMessage(s.codec, kafkaHeaderPrefix, headers, msg.Value)
+		if !ok {
+			continue
+		}
+		select {
+		case s.ch <- event:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (s *kafkaSubscription) Events() <-chan *pb.WatchResponse {
+	return s.ch
+}
+
+func (s *kafkaSubscription) Err() error {
+	return nil
+}
+
+func (s *kafkaSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		s.cancel()
+		for _, reader := range s.readers {
+			if closeErr := reader.Close(); closeErr != nil && err == nil {
+				err = closeErr
+			}
+		}
+	})
+	return err
+}
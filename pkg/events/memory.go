@@ -0,0 +1,101 @@
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/proto"
+)
+
+// Size of each in-process subscription channel.
+const memoryBufferSize = 100
+
+// In-process event bus. Useful for tests and single instance deployments.
+type MemoryBus struct {
+	mu     sync.Mutex
+	subs   map[*memorySubscription]struct{}
+	closed bool
+}
+
+func NewMemoryBus() *MemoryBus {
+	return &MemoryBus{subs: map[*memorySubscription]struct{}{}}
+}
+
+// Publishes a copy of the event to every subscription. Subscriptions which
+// buffer is full miss the event instead of blocking the publisher.
+func (b *MemoryBus) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for sub := range b.subs {
+		select {
+		case sub.ch <- proto.Clone(event).(*pb.WatchResponse):
+		default:
+		}
+	}
+	return nil
+}
+
+func (b *MemoryBus) Subscribe(ctx context.Context) (Subscription, error) {
+	sub := &memorySubscription{
+		bus:  b,
+		ch:   make(chan *pb.WatchResponse, memoryBufferSize),
+		done: make(chan struct{}),
+	}
+
+	b.mu.Lock()
+	if b.closed {
+		close(sub.ch)
+	} else {
+		b.subs[sub] = struct{}{}
+	}
+	b.mu.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-sub.done:
+		}
+	}()
+	return sub, nil
+}
+
+// Closes all subscriptions.
+func (b *MemoryBus) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for sub := range b.subs {
+		sub.once.Do(func() { close(sub.done) })
+		delete(b.subs, sub)
+		close(sub.ch)
+	}
+	return nil
+}
+
+type memorySubscription struct {
+	bus  *MemoryBus
+	ch   chan *pb.WatchResponse
+	done chan struct{}
+	once sync.Once
+}
+
+func (s *memorySubscription) Events() <-chan *pb.WatchResponse {
+	return s.ch
+}
+
+func (s *memorySubscription) Err() error {
+	return nil
+}
+
+func (s *memorySubscription) Close() error {
+	s.once.Do(func() { close(s.done) })
+	s.bus.mu.Lock()
+	defer s.bus.mu.Unlock()
+	if _, ok := s.bus.subs[s]; ok {
+		delete(s.bus.subs, s)
+		close(s.ch)
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemoryBus(t *testing.T) {
+	bus := NewMemoryBus()
+	defer bus.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sub1, err := bus.Subscribe(ctx)
+	require.NoError(t, err)
+	sub2, err := bus.Subscribe(ctx)
+	require.NoError(t, err)
+
+	err = bus.Publish(ctx, &pb.WatchResponse{
+		Method: pb.WatchResponse_CREATE,
+		User:   &pb.UserResponse{Id: "1"},
+	})
+	require.NoError(t, err)
+
+	// Both subscribers should receive the event
+	for _, sub := range []Subscription{sub1, sub2} {
+		select {
+		case event := <-sub.Events():
+			require.Equal(t, pb.WatchResponse_CREATE, event.Method)
+			require.Equal(t, "1", event.User.Id)
+		case <-time.After(time.Second):
+			t.Fatal("TestMemoryBus: subscriber did not receive published event")
+		}
+	}
+
+	// Closed subscription should close its events channel
+	require.NoError(t, sub1.Close())
+	if _, ok := <-sub1.Events(); ok {
+		t.Error("TestMemoryBus: events channel should be closed after Close()")
+	}
+
+	// Canceled context should close subscription
+	cancel()
+	select {
+	case _, ok := <-sub2.Events():
+		if ok {
+			t.Error("TestMemoryBus: expected closed channel after context was canceled")
+		}
+	case <-time.After(time.Second):
+		t.Error("TestMemoryBus: subscription was not closed after context was canceled")
+	}
+}
+
+func TestOpen(t *testing.T) {
+	bus, err := Open(Config{Driver: "memory"})
+	require.NoError(t, err)
+	require.NoError(t, bus.Close())
+
+	_, err = Open(Config{Driver: "unknown"})
+	require.Error(t, err)
+}
@@ -0,0 +1,55 @@
+package events
+
+import (
+	"context"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Tracer of event bus operations.
+var tracer = otel.Tracer("github.com/kroksys/user-service-example/pkg/events")
+
+// Metrics of event buses and Watch buffers exposed at /metrics.
+var (
+	// Events lost or merged by slow subscribers: dropped, coalesced or
+	// disconnected.
+	bufferEvents = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "watch_buffer_events_total",
+		Help:      "Events dropped or coalesced for slow Watch subscribers.",
+	}, []string{"result"})
+
+	bufferDisconnects = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "watch_buffer_disconnects_total",
+		Help:      "Slow Watch subscribers disconnected because their buffer was full.",
+	})
+
+	publishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "event_publish_failures_total",
+		Help:      "Events that could not be published by event bus: redis, nats or kafka.",
+	}, []string{"bus"})
+)
+
+// Runs publish of the bus in a producer span and counts failures.
+func observePublish(ctx context.Context, bus, topic string, publish func(context.Context) error) error {
+	ctx, span := tracer.Start(ctx, bus+" publish", trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(
+			semconv.MessagingSystemKey.String(bus),
+			semconv.MessagingDestinationKey.String(topic),
+		))
+	defer span.End()
+	err := publish(ctx)
+	if err != nil {
+		publishFailures.WithLabelValues(bus).Inc()
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
@@ -0,0 +1,144 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/nats-io/nats.go"
+)
+
+// Header prefix of CloudEvents attributes in nats protocol binding.
+const natsHeaderPrefix = "ce-"
+
+// Event bus using nats core publish/subscribe.
+type NatsBus struct {
+	Conn    *nats.Conn
+	Subject string
+	Codec   Codec
+}
+
+// Connects to nats server at addr (e.g. nats://localhost:4222).
+func NewNatsBus(addr, subject string) (*NatsBus, error) {
+	if addr == "" {
+		addr = nats.DefaultURL
+	}
+	if subject == "" {
+		subject = DefaultTopic
+	}
+	conn, err := nats.Connect(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &NatsBus{Conn: conn, Subject: subject, Codec: ProtoCodec{}}, nil
+}
+
+func (b *NatsBus) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	headers, data, err := encodeMessage(b.Codec, natsHeaderPrefix, event)
+	if err != nil {
+		return err
+	}
+	msg := &nats.Msg{Subject: b.Subject, Data: data}
+	if len(headers) > 0 {
+		msg.Header = nats.Header{}
+		for key, value := range headers {
+			msg.Header.Set(key, value)
+		}
+	}
+	return observePublish(ctx, "nats", b.Subject, func(ctx context.Context) error {
+		return b.Conn.PublishMsg(msg)
+	})
+}
+
+func (b *NatsBus) Subscribe(ctx context.Context) (Subscription, error) {
+	msgs := make(chan *nats.Msg, nats.DefaultSubPendingMsgsLimit/1024)
+	natsSub, err := b.Conn.ChanSubscribe(b.Subject, msgs)
+	if err != nil {
+		return nil, err
+	}
+	// Make sure server registered the subscription before returning.
+	if err := b.Conn.FlushWithContext(ctx); err != nil {
+		natsSub.Unsubscribe()
+		return nil, err
+	}
+
+	sub := &natsSubscription{
+		codec: b.Codec,
+		sub:   natsSub,
+		ch:    make(chan *pb.WatchResponse),
+		done:  make(chan struct{}),
+	}
+	go sub.run(ctx, msgs)
+	return sub, nil
+}
+
+// Reports error while connection is not established. Nats client
+// reconnects in the background.
+func (b *NatsBus) Ping(ctx context.Context) error {
+	if status := b.Conn.Status(); status != nats.CONNECTED {
+		return fmt.Errorf("nats connection is %s", status)
+	}
+	return nil
+}
+
+// Drains pending messages and closes the connection.
+func (b *NatsBus) Close() error {
+	return b.Conn.Drain()
+}
+
+type natsSubscription struct {
+	codec Codec
+	sub   *nats.Subscription
+	ch    chan *pb.WatchResponse
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Forwards decoded messages to events channel until subscription is closed.
+func (s *natsSubscription) run(ctx context.Context, msgs <-chan *nats.Msg) {
+	defer close(s.ch)
+	defer s.Close()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case msg := <-msgs:
+			headers := make(map[string]string, len(msg.Header))
+			for key := range msg.Header {
+				headers[key] = msg.Header.Get(key)
+			}
+			event, ok := decodeMessage(s.codec, natsHeaderPrefix, headers, msg.Data)
+			if !ok {
+				continue
+			}
+			select {
+			case s.ch <- event:
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (s *natsSubscription) Events() <-chan *pb.WatchResponse {
+	return s.ch
+}
+
+func (s *natsSubscription) Err() error {
+	return nil
+}
+
+func (s *natsSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.sub.Unsubscribe()
+	})
+	return err
+}
@@ -0,0 +1,119 @@
+package events
+
+import (
+	"context"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+)
+
+// Event bus using redis pubsub.
+type RedisBus struct {
+	Client *redis.Client
+	Topic  string
+	Codec  Codec
+}
+
+// Creates redis event bus using already connected client. Closing the bus
+// closes the client.
+func NewRedisBus(client *redis.Client, topic string) *RedisBus {
+	if topic == "" {
+		topic = DefaultTopic
+	}
+	return &RedisBus{Client: client, Topic: topic, Codec: ProtoCodec{}}
+}
+
+func (b *RedisBus) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	data, err := b.Codec.Marshal(event)
+	if err != nil {
+		return err
+	}
+	return observePublish(ctx, "redis", b.Topic, func(ctx context.Context) error {
+		return b.Client.Publish(ctx, b.Topic, data).Err()
+	})
+}
+
+func (b *RedisBus) Subscribe(ctx context.Context) (Subscription, error) {
+	pubsub := b.Client.Subscribe(ctx, b.Topic)
+
+	// Wait for subscription to be confirmed so no events are missed after
+	// Subscribe returns.
+	if _, err := pubsub.Receive(ctx); err != nil {
+		pubsub.Close()
+		return nil, err
+	}
+
+	sub := &redisSubscription{
+		codec:  b.Codec,
+		pubsub: pubsub,
+		ch:     make(chan *pb.WatchResponse),
+		done:   make(chan struct{}),
+	}
+	go sub.run(ctx)
+	return sub, nil
+}
+
+func (b *RedisBus) Ping(ctx context.Context) error {
+	return b.Client.Ping(ctx).Err()
+}
+
+func (b *RedisBus) Close() error {
+	return b.Client.Close()
+}
+
+type redisSubscription struct {
+	codec  Codec
+	pubsub *redis.PubSub
+	ch     chan *pb.WatchResponse
+	done   chan struct{}
+	once   sync.Once
+}
+
+// Forwards decoded messages to events channel until subscription is closed.
+func (s *redisSubscription) run(ctx context.Context) {
+	defer close(s.ch)
+	defer s.Close()
+
+	msgs := s.pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.done:
+			return
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			event, ok := decode(s.codec, []byte(msg.Payload))
+			if !ok {
+				continue
+			}
+			select {
+			case s.ch <- event:
+			case <-ctx.Done():
+				return
+			case <-s.done:
+				return
+			}
+		}
+	}
+}
+
+func (s *redisSubscription) Events() <-chan *pb.WatchResponse {
+	return s.ch
+}
+
+func (s *redisSubscription) Err() error {
+	return nil
+}
+
+func (s *redisSubscription) Close() error {
+	var err error
+	s.once.Do(func() {
+		close(s.done)
+		err = s.pubsub.Close()
+	})
+	return err
+}
@@ -0,0 +1,293 @@
+// Package informer keeps a local copy of users in sync with the user
+// service, so services reading users on every request don't call
+// ListUsers. Users are received as a Watch snapshot on start and after
+// every broken stream, changes in between are received from the same
+// stream.
+package informer
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/client"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults of delays between attempts to list and watch users.
+const (
+	DefaultRetryBackoff    = 500 * time.Millisecond
+	DefaultMaxRetryBackoff = 30 * time.Second
+)
+
+// Informer options.
+type Options struct {
+	// Delay between failed attempts to list and watch users starts at
+	// RetryBackoff and is doubled up to MaxRetryBackoff.
+	RetryBackoff    time.Duration
+	MaxRetryBackoff time.Duration
+
+	// Called after a change received from Watch is applied.
+	OnChange func(*pb.WatchResponse)
+}
+
+// Local cache of users indexed by id, email and country. Returned users
+// are shared and must not be modified.
+type Informer struct {
+	client *client.Client
+	opts   Options
+
+	mu        sync.RWMutex
+	users     map[string]*pb.UserResponse
+	byEmail   map[string]string
+	byCountry map[string]map[string]struct{}
+	synced    chan struct{}
+	inSync    bool
+	// Time when the cache stopped receiving changes
+	staleSince time.Time
+}
+
+// Creates informer using client c. Cache is empty until Run receives
+// users.
+func New(c *client.Client, opts Options) *Informer {
+	if opts.RetryBackoff <= 0 {
+		opts.RetryBackoff = DefaultRetryBackoff
+	}
+	if opts.MaxRetryBackoff <= 0 {
+		opts.MaxRetryBackoff = DefaultMaxRetryBackoff
+	}
+	return &Informer{
+		client:     c,
+		opts:       opts,
+		users:      map[string]*pb.UserResponse{},
+		byEmail:    map[string]string{},
+		byCountry:  map[string]map[string]struct{}{},
+		synced:     make(chan struct{}),
+		staleSince: time.Now(),
+	}
+}
+
+// Keeps the cache in sync until ctx is done. Failed attempts to list or
+// watch users are retried.
+func (inf *Informer) Run(ctx context.Context) {
+	backoff := inf.opts.RetryBackoff
+	for ctx.Err() == nil {
+		synced, err := inf.syncAndWatch(ctx)
+		inf.setStale()
+		if ctx.Err() != nil {
+			return
+		}
+		if synced {
+			backoff = inf.opts.RetryBackoff
+		}
+		if status.Code(err) == codes.ResourceExhausted {
+			slog.Warn("informer: missed changes, resyncing", "backoff", backoff)
+		} else {
+			slog.Warn("informer: watch failed, retrying", "backoff", backoff, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > inf.opts.MaxRetryBackoff {
+			backoff = inf.opts.MaxRetryBackoff
+		}
+	}
+}
+
+// Opens Watch stream with a snapshot of users, replaces the cache with
+// the snapshot and applies changes until the stream breaks. Server sends
+// changes made during the snapshot after it and closes the stream with
+// RESOURCE_EXHAUSTED instead of dropping changes, so the cache is replaced
+// by a new snapshot whenever changes were missed. Reports whether the
+// snapshot was received.
+func (inf *Informer) syncAndWatch(ctx context.Context) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// Snapshot from a lagging replica would miss changes already skipped
+	// by the stream.
+	stream, err := inf.client.Watch(client.PrimaryRead(ctx), &pb.WatchRequest{Snapshot: true})
+	if err != nil {
+		return false, err
+	}
+
+	users := []*pb.UserResponse{}
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return false, err
+		}
+		if event.Method == pb.WatchResponse_SNAPSHOT_END {
+			break
+		}
+		if event.Method == pb.WatchResponse_SNAPSHOT && event.GetUser().GetId() != "" {
+			users = append(users, event.User)
+		}
+	}
+	inf.replace(users)
+
+	for {
+		event, err := stream.Recv()
+		if err != nil {
+			return true, err
+		}
+		inf.apply(event)
+		if inf.opts.OnChange != nil {
+			inf.opts.OnChange(event)
+		}
+	}
+}
+
+// Replaces cached users and marks the cache in sync.
+func (inf *Informer) replace(users []*pb.UserResponse) {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+	inf.users = map[string]*pb.UserResponse{}
+	inf.byEmail = map[string]string{}
+	inf.byCountry = map[string]map[string]struct{}{}
+	for _, u := range users {
+		inf.store(u)
+	}
+	inf.inSync = true
+	inf.staleSince = time.Time{}
+	select {
+	case <-inf.synced:
+	default:
+		close(inf.synced)
+	}
+}
+
+// Applies a change. Updates older than the cached user were already
+// included in the snapshot and are skipped.
+func (inf *Informer) apply(event *pb.WatchResponse) {
+	user := event.GetUser()
+	if user.GetId() == "" {
+		return
+	}
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+	if event.Method == pb.WatchResponse_DELETE {
+		inf.remove(user.Id)
+		return
+	}
+	if cached, ok := inf.users[user.Id]; ok {
+		if user.GetUpdatedAt().AsTime().Before(cached.GetUpdatedAt().AsTime()) {
+			return
+		}
+		inf.remove(user.Id)
+	}
+	inf.store(user)
+}
+
+// Adds user to the cache and indexes. Caller holds the lock.
+func (inf *Informer) store(user *pb.UserResponse) {
+	inf.users[user.Id] = user
+	if user.Email != "" {
+		inf.byEmail[user.Email] = user.Id
+	}
+	if inf.byCountry[user.Country] == nil {
+		inf.byCountry[user.Country] = map[string]struct{}{}
+	}
+	inf.byCountry[user.Country][user.Id] = struct{}{}
+}
+
+// Removes user from the cache and indexes. Caller holds the lock.
+func (inf *Informer) remove(id string) {
+	user, ok := inf.users[id]
+	if !ok {
+		return
+	}
+	delete(inf.users, id)
+	if inf.byEmail[user.Email] == id {
+		delete(inf.byEmail, user.Email)
+	}
+	delete(inf.byCountry[user.Country], id)
+	if len(inf.byCountry[user.Country]) == 0 {
+		delete(inf.byCountry, user.Country)
+	}
+}
+
+// Marks the cache out of sync after Watch stream broke.
+func (inf *Informer) setStale() {
+	inf.mu.Lock()
+	defer inf.mu.Unlock()
+	if inf.inSync {
+		inf.inSync = false
+		inf.staleSince = time.Now()
+	}
+}
+
+// Waits until users are listed for the first time. Returns false when
+// ctx is done first.
+func (inf *Informer) WaitForSync(ctx context.Context) bool {
+	select {
+	case <-inf.synced:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// Reports whether users were listed at least once.
+func (inf *Informer) HasSynced() bool {
+	select {
+	case <-inf.synced:
+		return true
+	default:
+		return false
+	}
+}
+
+// Returns how long the cache has not been receiving changes, 0 while
+// Watch stream is open. Cache may miss changes made during this time.
+func (inf *Informer) Staleness() time.Duration {
+	inf.mu.RLock()
+	defer inf.mu.RUnlock()
+	if inf.inSync {
+		return 0
+	}
+	return time.Since(inf.staleSince)
+}
+
+// Returns cached user by id.
+func (inf *Informer) Get(id string) (*pb.UserResponse, bool) {
+	inf.mu.RLock()
+	defer inf.mu.RUnlock()
+	user, ok := inf.users[id]
+	return user, ok
+}
+
+// Returns cached user by email.
+func (inf *Informer) GetByEmail(email string) (*pb.UserResponse, bool) {
+	inf.mu.RLock()
+	defer inf.mu.RUnlock()
+	user, ok := inf.users[inf.byEmail[email]]
+	return user, ok
+}
+
+// Returns cached users of the country in no particular order.
+func (inf *Informer) ListByCountry(country string) []*pb.UserResponse {
+	inf.mu.RLock()
+	defer inf.mu.RUnlock()
+	users := make([]*pb.UserResponse, 0, len(inf.byCountry[country]))
+	for id := range inf.byCountry[country] {
+		users = append(users, inf.users[id])
+	}
+	return users
+}
+
+// Returns all cached users in no particular order.
+func (inf *Informer) List() []*pb.UserResponse {
+	inf.mu.RLock()
+	defer inf.mu.RUnlock()
+	users := make([]*pb.UserResponse, 0, len(inf.users))
+	for _, user := range inf.users {
+		users = append(users, user)
+	}
+	return users
+}
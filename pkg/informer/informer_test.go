@@ -0,0 +1,115 @@
+package informer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/client"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/service"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+var grpcAddr = "localhost:1992"
+
+var testOptions = Options{RetryBackoff: 10 * time.Millisecond}
+
+func startServer(t *testing.T, ctx context.Context) *service.Server {
+	server, err := service.StartGrpcServer(ctx, grpcAddr, db.NewMemoryRepositories(),
+		service.Options{EventBus: events.Config{Driver: "memory"}})
+	require.NoError(t, err)
+	return server
+}
+
+func TestInformer(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	server := startServer(t, ctx)
+	defer server.Stop()
+
+	c, err := client.Dial(ctx, grpcAddr, client.DefaultOptions())
+	require.NoError(t, err)
+	defer c.Close()
+
+	// Users created before start are listed
+	john, err := c.AddUser(ctx, &pb.AddUserRequest{Email: "john@email.com", Country: "LV"})
+	require.NoError(t, err)
+
+	changes := make(chan *pb.WatchResponse, 10)
+	opts := testOptions
+	opts.OnChange = func(event *pb.WatchResponse) { changes <- event }
+	inf := New(c, opts)
+	require.False(t, inf.HasSynced())
+	require.Greater(t, inf.Staleness(), time.Duration(0))
+	go inf.Run(ctx)
+	require.True(t, inf.WaitForSync(ctx))
+	require.Equal(t, time.Duration(0), inf.Staleness())
+
+	user, ok := inf.GetByEmail("john@email.com")
+	require.True(t, ok)
+	require.Equal(t, john.Id, user.Id)
+
+	// Changes are received from Watch
+	jane, err := c.AddUser(ctx, &pb.AddUserRequest{Email: "jane@email.com", Country: "LV"})
+	require.NoError(t, err)
+	<-changes
+	require.Len(t, inf.ListByCountry("LV"), 2)
+
+	email, country := "john@example.com", "EE"
+	_, err = c.ModifyUser(ctx, &pb.ModifyUserRequest{Id: john.Id, Email: &email, Country: &country})
+	require.NoError(t, err)
+	<-changes
+	_, ok = inf.GetByEmail("john@email.com")
+	require.False(t, ok)
+	user, ok = inf.GetByEmail("john@example.com")
+	require.True(t, ok)
+	require.Equal(t, "EE", user.Country)
+	require.Len(t, inf.ListByCountry("LV"), 1)
+
+	_, err = c.RemoveUser(ctx, &pb.RemoveUserRequest{Id: jane.Id})
+	require.NoError(t, err)
+	<-changes
+	_, ok = inf.Get(jane.Id)
+	require.False(t, ok)
+	require.Len(t, inf.List(), 1)
+
+	// Cache reports staleness while server is down
+	server.Stop()
+	require.Eventually(t, func() bool { return inf.Staleness() > 0 }, time.Second, 10*time.Millisecond)
+
+	// Cache is replaced by a new snapshot. Server starts with an empty
+	// database, so users removed meanwhile are not kept.
+	server = startServer(t, ctx)
+	defer server.Stop()
+	var ann *pb.UserResponse
+	require.Eventually(t, func() bool {
+		ann, err = c.AddUser(ctx, &pb.AddUserRequest{Email: "ann@email.com", Country: "LT"})
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	require.Eventually(t, func() bool {
+		_, ok := inf.Get(ann.Id)
+		return ok && inf.Staleness() == 0
+	}, 5*time.Second, 10*time.Millisecond)
+	_, ok = inf.Get(john.Id)
+	require.False(t, ok)
+}
+
+func TestApplySkipsOldUpdates(t *testing.T) {
+	inf := New(nil, testOptions)
+	now := time.Now()
+	inf.replace([]*pb.UserResponse{{Id: "1", Email: "new@email.com", UpdatedAt: timestamppb.New(now)}})
+
+	inf.apply(&pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{
+		Id: "1", Email: "old@email.com", UpdatedAt: timestamppb.New(now.Add(-time.Second)),
+	}})
+	user, _ := inf.Get("1")
+	require.Equal(t, "new@email.com", user.Email)
+
+	inf.apply(&pb.WatchResponse{Method: pb.WatchResponse_DELETE, User: &pb.UserResponse{Id: "1"}})
+	_, ok := inf.Get("1")
+	require.False(t, ok)
+}
@@ -0,0 +1,124 @@
+// Package logging configures structured logging of the service and keeps
+// per-request loggers in context.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// HTTP header and grpc metadata key carrying the request id.
+const RequestIDHeader = "x-request-id"
+
+// Longest request id accepted from clients.
+const maxRequestIDLength = 128
+
+// Value logged instead of secrets.
+const redacted = "[REDACTED]"
+
+// Config of the logger.
+type Config struct {
+	// Lowest level logged: debug, info (default), warn or error.
+	Level string
+
+	// Output format: json (default) or text.
+	Format string
+}
+
+// Creates a logger writing to w. Password fields are redacted and emails
+// masked in all records.
+func New(w io.Writer, cfg Config) (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.Level != "" {
+		if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+			return nil, fmt.Errorf("invalid log level %q", cfg.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level, ReplaceAttr: redact}
+	switch cfg.Format {
+	case "", "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("unsupported log format %q", cfg.Format)
+}
+
+// Sets default logger writing to w. Output of the log package goes to it
+// as well.
+func Setup(w io.Writer, cfg Config) error {
+	logger, err := New(w, cfg)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	return nil
+}
+
+type loggerKey struct{}
+
+// Returns context carrying the logger.
+func NewContext(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// Returns logger of the request or default logger when ctx has none.
+func FromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+type requestIDKey struct{}
+
+// Returns context carrying the request id.
+func ContextWithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// Returns request id from context or empty string when ctx has none.
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Returns id sent by the client when it is usable, otherwise a new one.
+// Ids are limited in length and characters so clients can't forge log
+// lines.
+func RequestID(sent string) string {
+	if sent == "" || len(sent) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for _, r := range sent {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("-_.:", r)) {
+			return uuid.NewString()
+		}
+	}
+	return sent
+}
+
+// Hides values of password fields and local part of emails.
+func redact(groups []string, a slog.Attr) slog.Attr {
+	switch strings.ToLower(a.Key) {
+	case "password":
+		return slog.String(a.Key, redacted)
+	case "email":
+		return slog.String(a.Key, MaskEmail(a.Value.String()))
+	}
+	return a
+}
+
+// Keeps first letter and domain of the email, e.g. j***@email.com.
+func MaskEmail(email string) string {
+	local, domain, ok := strings.Cut(email, "@")
+	if !ok || local == "" {
+		return redacted
+	}
+	return string([]rune(local)[:1]) + "***@" + domain
+}
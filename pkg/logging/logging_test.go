@@ -0,0 +1,61 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedaction(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "debug"})
+	require.NoError(t, err)
+
+	logger.Debug("user added", slog.Group("user", "email", "john@email.com", "password", "secret", "country", "UK"))
+	record := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &record))
+	user := record["user"].(map[string]interface{})
+	require.Equal(t, "j***@email.com", user["email"])
+	require.Equal(t, "[REDACTED]", user["password"])
+	require.Equal(t, "UK", user["country"])
+	require.NotContains(t, buf.String(), "secret")
+}
+
+func TestLevelAndFormat(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{Level: "warn", Format: "text"})
+	require.NoError(t, err)
+	logger.Info("hidden")
+	logger.Warn("shown", "email", "jane@email.com")
+	require.Equal(t, "level=WARN msg=shown email=j***@email.com", strings.TrimSpace(buf.String()[strings.Index(buf.String(), "level="):]))
+
+	_, err = New(&buf, Config{Level: "verbose"})
+	require.ErrorContains(t, err, "invalid log level")
+	_, err = New(&buf, Config{Format: "xml"})
+	require.ErrorContains(t, err, "unsupported log format")
+}
+
+func TestContext(t *testing.T) {
+	var buf bytes.Buffer
+	logger, err := New(&buf, Config{})
+	require.NoError(t, err)
+
+	require.NotNil(t, FromContext(context.Background()))
+	ctx := NewContext(context.Background(), logger.With("request_id", "abc"))
+	FromContext(ctx).Info("handled")
+	require.Contains(t, buf.String(), `"request_id":"abc"`)
+}
+
+func TestRequestID(t *testing.T) {
+	require.Equal(t, "abc-123_x.y:z", RequestID("abc-123_x.y:z"))
+	for _, sent := range []string{"", "a b", "id\n{\"level\":\"ERROR\"}", strings.Repeat("a", 129)} {
+		id := RequestID(sent)
+		require.NotEqual(t, sent, id)
+		require.Len(t, id, 36, "generated uuid")
+	}
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Value recorded instead of changed passwords.
+const maskedPassword = "********"
+
+// Value of audit changes and client addresses of erased users.
+const ErasedValue = "[ERASED]"
+
+// Change of a user recorded in the audit trail. Events are only appended
+// and never deleted, recorded values are erased together with the user.
+type AuditEvent struct {
+	ID     uuid.UUID `gorm:"type:char(36);primaryKey"`
+	UserID uuid.UUID `gorm:"type:char(36);index"`
+	Actor  string
+	// RPC that made the change, e.g. ModifyUser.
+	Method    string
+	Changes   []FieldChange `gorm:"serializer:json"`
+	ClientIP  string
+	RequestID string
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// Old and new value of a user field. Sensitive values are masked.
+type FieldChange struct {
+	Field string `json:"field"`
+	Old   string `json:"old"`
+	New   string `json:"new"`
+}
+
+// Returns fields that differ between before and after. Nil before means
+// the user was created, nil after that it was deleted. Passwords are
+// replaced and emails masked.
+func UserChanges(before, after *User) []FieldChange {
+	var old, new User
+	if before != nil {
+		old = *before
+	}
+	if after != nil {
+		new = *after
+	}
+	changes := []FieldChange{}
+	for _, f := range []struct {
+		name     string
+		old, new string
+	}{
+		{"first_name", old.FirstName, new.FirstName},
+		{"last_name", old.LastName, new.LastName},
+		{"nickname", old.Nickname, new.Nickname},
+		{"password", old.Password, new.Password},
+		{"email", old.Email, new.Email},
+		{"country", old.Country, new.Country},
+	} {
+		if f.old == f.new {
+			continue
+		}
+		change := FieldChange{Field: f.name, Old: f.old, New: f.new}
+		switch f.name {
+		case "password":
+			change.Old, change.New = maskPassword(f.old), maskPassword(f.new)
+		case "email":
+			change.Old, change.New = maskEmail(f.old), maskEmail(f.new)
+		}
+		changes = append(changes, change)
+	}
+	return changes
+}
+
+func maskPassword(password string) string {
+	if password == "" {
+		return ""
+	}
+	return maskedPassword
+}
+
+func maskEmail(email string) string {
+	if email == "" {
+		return ""
+	}
+	return logging.MaskEmail(email)
+}
+
+// Replaces recorded values and client address. Changed field names are
+// kept.
+func (e *AuditEvent) Erase() {
+	for i, c := range e.Changes {
+		if c.Old != "" {
+			e.Changes[i].Old = ErasedValue
+		}
+		if c.New != "" {
+			e.Changes[i].New = ErasedValue
+		}
+	}
+	if e.ClientIP != "" {
+		e.ClientIP = ErasedValue
+	}
+}
+
+func (e *AuditEvent) ToAuditEventResponse() *pb.AuditEvent {
+	resp := &pb.AuditEvent{
+		Id:        e.ID.String(),
+		UserId:    e.UserID.String(),
+		Actor:     e.Actor,
+		Method:    e.Method,
+		ClientIp:  e.ClientIP,
+		RequestId: e.RequestID,
+		CreatedAt: timestamppb.New(e.CreatedAt),
+	}
+	for _, c := range e.Changes {
+		resp.Changes = append(resp.Changes, &pb.FieldChange{Field: c.Field, Old: c.Old, New: c.New})
+	}
+	return resp
+}
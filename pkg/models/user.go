@@ -42,3 +42,19 @@ func (u *User) BeforeCreate(tx *gorm.DB) error {
 	}
 	return nil
 }
+
+// Domain of emails of erased users. Reserved .invalid TLD can't receive
+// emails.
+const erasedEmailDomain = "erased.invalid"
+
+// Removes personal data of the user. ID and timestamps are kept. Email is
+// replaced by a placeholder unique to the user, so unique constraint
+// holds for all erased users.
+func (u *User) Erase() {
+	u.FirstName = ""
+	u.LastName = ""
+	u.Nickname = ""
+	u.Password = ""
+	u.Country = ""
+	u.Email = u.ID.String() + "@" + erasedEmailDomain
+}
@@ -0,0 +1,121 @@
+package models
+
+import (
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"gorm.io/gorm"
+)
+
+// Webhook subscription receiving user changes.
+type Webhook struct {
+	ID  uuid.UUID `gorm:"type:char(36);primaryKey"`
+	URL string
+	// Comma separated list of delivered methods (CREATE,UPDATE,DELETE,ERASE).
+	// Empty means all methods.
+	Methods   string
+	Secret    string
+	CreatedAt time.Time
+	UpdatedAt time.Time
+}
+
+// Single delivery attempt of an event to a webhook.
+type WebhookDelivery struct {
+	ID         uuid.UUID `gorm:"type:char(36);primaryKey"`
+	WebhookID  uuid.UUID `gorm:"type:char(36);index"`
+	EventID    uuid.UUID `gorm:"type:char(36);index"`
+	Method     string
+	Attempt    int
+	StatusCode int
+	Error      string
+	Success    bool
+	Duration   time.Duration
+	CreatedAt  time.Time
+}
+
+// Event that could not be delivered after all retry attempts.
+type WebhookDeadLetter struct {
+	ID        uuid.UUID `gorm:"type:char(36);primaryKey"`
+	WebhookID uuid.UUID `gorm:"type:char(36);index"`
+	EventID   uuid.UUID `gorm:"type:char(36)"`
+	// User of the event, payload holds its data.
+	UserID    uuid.UUID `gorm:"type:char(36);index"`
+	Method    string
+	Payload   []byte
+	Attempts  int
+	LastError string
+	CreatedAt time.Time
+}
+
+// Returns true when the webhook should receive events of provided method.
+func (w *Webhook) Accepts(method pb.WatchResponse_METHOD) bool {
+	if w.Methods == "" {
+		return true
+	}
+	for _, m := range strings.Split(w.Methods, ",") {
+		if m == method.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Converts webhook to protobuf response. Secret is included only when
+// withSecret is true.
+func (w *Webhook) ToWebhookResponse(withSecret bool) *pb.WebhookResponse {
+	resp := &pb.WebhookResponse{
+		Id:        w.ID.String(),
+		Url:       w.URL,
+		CreatedAt: timestamppb.New(w.CreatedAt),
+	}
+	if w.Methods != "" {
+		for _, m := range strings.Split(w.Methods, ",") {
+			resp.Methods = append(resp.Methods, pb.WatchResponse_METHOD(pb.WatchResponse_METHOD_value[m]))
+		}
+	}
+	if withSecret {
+		resp.Secret = w.Secret
+	}
+	return resp
+}
+
+// Converts dead letter to protobuf message.
+func (d *WebhookDeadLetter) ToWebhookDeadLetterResponse() *pb.WebhookDeadLetter {
+	return &pb.WebhookDeadLetter{
+		Id:        d.ID.String(),
+		WebhookId: d.WebhookID.String(),
+		EventId:   d.EventID.String(),
+		Method:    d.Method,
+		Payload:   string(d.Payload),
+		Attempts:  int32(d.Attempts),
+		LastError: d.LastError,
+		CreatedAt: timestamppb.New(d.CreatedAt),
+	}
+}
+
+// Gorm before create hook is executed before DB.Create()
+func (w *Webhook) BeforeCreate(tx *gorm.DB) error {
+	if w.ID == uuid.Nil {
+		w.ID = uuid.New()
+	}
+	return nil
+}
+
+// Gorm before create hook is executed before DB.Create()
+func (d *WebhookDelivery) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
+
+// Gorm before create hook is executed before DB.Create()
+func (d *WebhookDeadLetter) BeforeCreate(tx *gorm.DB) error {
+	if d.ID == uuid.Nil {
+		d.ID = uuid.New()
+	}
+	return nil
+}
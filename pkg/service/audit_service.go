@@ -0,0 +1,178 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Header naming who makes the request, recorded in the audit trail. It
+// should be set by an authenticating proxy in front of the service and is
+// accepted only from trusted proxies.
+const ActorHeader = "x-actor"
+
+// Proxies trusted by default: the HTTP gateway connects to the grpc server
+// from loopback address.
+var DefaultTrustedProxies = []string{"127.0.0.0/8", "::1/128"}
+
+// Actor recorded when request has no ActorHeader.
+const unknownActor = "unknown"
+
+func (s UserService) ListAuditEvents(ctx context.Context, in *pb.ListAuditEventsRequest) (*pb.ListAuditEventsResponse, error) {
+	if s.Audit == nil {
+		return nil, status.Errorf(codes.Unimplemented, "ListAuditEvents: audit trail is not configured")
+	}
+	filter := db.AuditFilter{
+		Limit:  int(in.GetLimit()),
+		Offset: int(in.GetOffset()),
+	}
+	if in.UserId != "" {
+		id, err := uuid.Parse(in.UserId)
+		if err != nil {
+			logging.FromContext(ctx).Debug("could not parse user id to uuid", "user_id", in.UserId, "error", err)
+			return nil, status.Errorf(codes.InvalidArgument, err.Error())
+		}
+		filter.UserID = id
+	}
+	if in.Since != nil {
+		filter.Since = in.Since.AsTime()
+	}
+	if in.Until != nil {
+		filter.Until = in.Until.AsTime()
+	}
+
+	qctx, cancel := s.queryContext(ctx, "ListAuditEvents")
+	defer cancel()
+	events, err := s.Audit.ListAuditEvents(qctx, filter)
+	if err != nil {
+		logging.FromContext(ctx).Error("error listing audit events", "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	result := []*pb.AuditEvent{}
+	for _, e := range events {
+		result = append(result, e.ToAuditEventResponse())
+	}
+	return &pb.ListAuditEventsResponse{Events: result}, nil
+}
+
+// Appends change of the user to the audit trail. Nil before means the user
+// was created and nil after that it was deleted. Failure to record is
+// logged, the change itself is already made.
+func (s UserService) audit(ctx context.Context, method string, userID uuid.UUID, before, after *models.User) {
+	if s.Audit == nil {
+		return
+	}
+	changes := models.UserChanges(before, after)
+	if len(changes) == 0 && before != nil && after != nil {
+		return
+	}
+	event := s.auditEvent(ctx, method)
+	event.UserID = userID
+	event.Changes = changes
+	// Recorded even when client cancels the request after the change
+	qctx, cancel := s.queryContext(context.WithoutCancel(ctx), method)
+	defer cancel()
+	if err := s.Audit.CreateAuditEvent(qctx, event); err != nil {
+		logging.FromContext(ctx).Error("error recording audit event", "user_id", userID, "error", err)
+	}
+}
+
+// Returns audit event of the request without user and changes.
+func (s UserService) auditEvent(ctx context.Context, method string) *models.AuditEvent {
+	return &models.AuditEvent{
+		Actor:     s.actor(ctx),
+		Method:    method,
+		ClientIP:  s.clientIP(ctx),
+		RequestID: logging.RequestIDFromContext(ctx),
+	}
+}
+
+// Returns actor from ActorHeader metadata when the request is sent by a
+// trusted proxy. Requests proxied by the gateway are from loopback, the
+// gateway drops the header of untrusted HTTP clients.
+func (s UserService) actor(ctx context.Context) string {
+	md, _ := metadata.FromIncomingContext(ctx)
+	actors := md.Get(ActorHeader)
+	if len(actors) == 0 || actors[0] == "" {
+		return unknownActor
+	}
+	if p, ok := peer.FromContext(ctx); !ok || !isTrustedProxy(s.TrustedProxies, p.Addr.String()) {
+		logging.FromContext(ctx).Debug("ignoring actor of untrusted client", "actor", actors[0])
+		return unknownActor
+	}
+	return actors[0]
+}
+
+// Returns address of the client. Requests proxied by the gateway or other
+// proxies carry it in x-forwarded-for metadata. Addresses are taken from
+// the nearest one, the peer, and x-forwarded-for entries from right to
+// left, the first address that is not a trusted proxy is the client.
+// Entries left of it could be forged by the client.
+func (s UserService) clientIP(ctx context.Context) string {
+	hops := []string{}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, forwarded := range md.Get("x-forwarded-for") {
+		for _, ip := range strings.Split(forwarded, ",") {
+			if ip = strings.TrimSpace(ip); ip != "" {
+				hops = append(hops, ip)
+			}
+		}
+	}
+	if p, ok := peer.FromContext(ctx); ok {
+		host, _, err := net.SplitHostPort(p.Addr.String())
+		if err != nil {
+			host = p.Addr.String()
+		}
+		hops = append(hops, host)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if i == 0 || !isTrustedProxy(s.TrustedProxies, hops[i]) {
+			return hops[i]
+		}
+	}
+	return ""
+}
+
+// Parses networks of trusted proxies in CIDR notation.
+func ParseTrustedProxies(networks []string) ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, network := range networks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxy network %q: %v", network, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+// Reports whether address, with or without port, is in trusted networks.
+func isTrustedProxy(trusted []netip.Prefix, addr string) bool {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		addrPort, err := netip.ParseAddrPort(addr)
+		if err != nil {
+			return false
+		}
+		ip = addrPort.Addr()
+	}
+	ip = ip.Unmap()
+	for _, prefix := range trusted {
+		if prefix.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
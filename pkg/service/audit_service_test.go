@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+func TestAuditEvents(t *testing.T) {
+	s := newTestService()
+	s.TrustedProxies, _ = ParseTrustedProxies([]string{"127.0.0.0/8", "10.0.0.2/32"})
+	start := time.Now()
+	// Request of 10.0.0.1 forwarded by trusted proxy 10.0.0.2 and the
+	// gateway. Leftmost entry is forged by the client.
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		ActorHeader, "admin@company.com",
+		"x-forwarded-for", "192.0.2.1, 10.0.0.1, 10.0.0.2",
+	))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}})
+
+	user, err := s.AddUser(ctx, &pb.AddUserRequest{Email: "audited@email.com", Password: "secret", Country: "UK"})
+	if err != nil {
+		t.Fatalf("TestAuditEvents: failed to add user: %v", err)
+	}
+	country, password := "LV", "new-secret"
+	if _, err := s.ModifyUser(ctx, &pb.ModifyUserRequest{Id: user.Id, Country: &country, Password: &password}); err != nil {
+		t.Fatalf("TestAuditEvents: failed to modify user: %v", err)
+	}
+	// Update without changes is not recorded
+	if _, err := s.ModifyUser(ctx, &pb.ModifyUserRequest{Id: user.Id, Country: &country}); err != nil {
+		t.Fatalf("TestAuditEvents: failed to modify user: %v", err)
+	}
+	if _, err := s.RemoveUser(ctx, &pb.RemoveUserRequest{Id: user.Id}); err != nil {
+		t.Fatalf("TestAuditEvents: failed to remove user: %v", err)
+	}
+
+	resp, err := s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{UserId: user.Id})
+	if err != nil {
+		t.Fatalf("TestAuditEvents: failed to list audit events: %v", err)
+	}
+	methods := []string{}
+	for _, e := range resp.Events {
+		methods = append(methods, e.Method)
+		if e.Actor != "admin@company.com" || e.ClientIp != "10.0.0.1" || e.UserId != user.Id {
+			t.Errorf("TestAuditEvents: event %s has actor %q, client ip %q and user %q", e.Method, e.Actor, e.ClientIp, e.UserId)
+		}
+	}
+	if len(methods) != 3 || methods[0] != "AddUser" || methods[1] != "ModifyUser" || methods[2] != "RemoveUser" {
+		t.Fatalf("TestAuditEvents: recorded methods %v, wanted [AddUser ModifyUser RemoveUser]", methods)
+	}
+
+	// Only changed fields are recorded, sensitive values are masked
+	changes := map[string]*pb.FieldChange{}
+	for _, c := range resp.Events[1].Changes {
+		changes[c.Field] = c
+	}
+	if len(changes) != 2 || changes["country"].GetOld() != "UK" || changes["country"].GetNew() != "LV" {
+		t.Errorf("TestAuditEvents: ModifyUser changes %v, wanted country and password", resp.Events[1].Changes)
+	}
+	if c := changes["password"]; c.GetOld() == "secret" || c.GetNew() == "new-secret" || c.GetNew() == "" {
+		t.Errorf("TestAuditEvents: password change should be masked. Got: %v", c)
+	}
+	for _, c := range resp.Events[0].Changes {
+		if c.Field == "email" && c.New != "a***@email.com" {
+			t.Errorf("TestAuditEvents: email should be masked. Got: %s", c.New)
+		}
+	}
+
+	// Time range excludes events made before Since
+	resp, err = s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{
+		UserId: user.Id,
+		Since:  timestamppb.New(time.Now()),
+	})
+	if err != nil {
+		t.Fatalf("TestAuditEvents: failed to list audit events: %v", err)
+	}
+	if len(resp.Events) != 0 {
+		t.Errorf("TestAuditEvents: expected no events after the changes. Got: %d", len(resp.Events))
+	}
+	resp, err = s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{
+		Since: timestamppb.New(start),
+		Until: timestamppb.New(time.Now()),
+		Limit: intPtr(1),
+	})
+	if err != nil || len(resp.Events) != 1 {
+		t.Errorf("TestAuditEvents: expected single event within time range. Got: %v, %v", resp, err)
+	}
+
+	if _, err := s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{UserId: "invalid"}); err == nil {
+		t.Errorf("TestAuditEvents: listing events of invalid user id should return error. Got: nil")
+	}
+}
+
+func TestAuditUntrustedClient(t *testing.T) {
+	s := newTestService()
+	s.TrustedProxies, _ = ParseTrustedProxies(DefaultTrustedProxies)
+	// Client connecting directly can't set actor or its address
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		ActorHeader, "admin@company.com",
+		"x-forwarded-for", "10.0.0.1",
+	))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: &net.TCPAddr{IP: net.IPv4(203, 0, 113, 5), Port: 50000}})
+
+	user, err := s.AddUser(ctx, &pb.AddUserRequest{Email: "untrusted@email.com"})
+	if err != nil {
+		t.Fatalf("TestAuditUntrustedClient: failed to add user: %v", err)
+	}
+	resp, err := s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{UserId: user.Id})
+	if err != nil || len(resp.Events) != 1 {
+		t.Fatalf("TestAuditUntrustedClient: expected single event. Got: %v, %v", resp, err)
+	}
+	if e := resp.Events[0]; e.Actor != unknownActor || e.ClientIp != "203.0.113.5" {
+		t.Errorf("TestAuditUntrustedClient: event has actor %q and client ip %q", e.Actor, e.ClientIp)
+	}
+}
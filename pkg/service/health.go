@@ -0,0 +1,84 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+const (
+	// Default delay between dependency checks.
+	defaultHealthCheckInterval = 5 * time.Second
+
+	// Time limit of a single dependency check.
+	healthCheckTimeout = 2 * time.Second
+)
+
+// Dependency the service needs to be serving.
+type healthCheck struct {
+	name  string
+	check func(ctx context.Context) error
+}
+
+// Periodically checks dependencies and sets health status of the service
+// to NOT_SERVING while any of them fails.
+type healthChecker struct {
+	server   *health.Server
+	checks   []healthCheck
+	interval time.Duration
+	serving  bool
+}
+
+// Creates checker running checks every interval. Zero interval uses
+// defaultHealthCheckInterval.
+func newHealthChecker(server *health.Server, interval time.Duration, checks ...healthCheck) *healthChecker {
+	if interval <= 0 {
+		interval = defaultHealthCheckInterval
+	}
+	return &healthChecker{server: server, checks: checks, interval: interval, serving: true}
+}
+
+// Checks dependencies and sets serving status. Returns true when all
+// dependencies are healthy.
+func (h *healthChecker) check(ctx context.Context) bool {
+	serving := true
+	for _, c := range h.checks {
+		checkCtx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+		err := c.check(checkCtx)
+		cancel()
+		if err != nil {
+			serving = false
+			slog.Warn("health: check failed", "dependency", c.name, "error", err)
+		}
+	}
+
+	status := healthpb.HealthCheckResponse_SERVING
+	if !serving {
+		status = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	if serving && !h.serving {
+		slog.Info("health: all dependencies are healthy again")
+	}
+	h.serving = serving
+	h.server.SetServingStatus("", status)
+	h.server.SetServingStatus(pb.UserService_ServiceDesc.ServiceName, status)
+	return serving
+}
+
+// Checks dependencies every interval until context is canceled.
+func (h *healthChecker) run(ctx context.Context) {
+	ticker := time.NewTicker(h.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			h.check(ctx)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+)
+
+func TestHealthChecker(t *testing.T) {
+	server := health.NewServer()
+	var dbErr error
+	checker := newHealthChecker(server, 0, healthCheck{name: "database", check: func(ctx context.Context) error {
+		return dbErr
+	}})
+
+	status := func() healthpb.HealthCheckResponse_ServingStatus {
+		resp, err := server.Check(context.Background(), &healthpb.HealthCheckRequest{
+			Service: pb.UserService_ServiceDesc.ServiceName,
+		})
+		require.NoError(t, err)
+		return resp.Status
+	}
+
+	require.True(t, checker.check(context.Background()))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status())
+
+	// Failing dependency makes service NOT_SERVING
+	dbErr = errors.New("connection refused")
+	require.False(t, checker.check(context.Background()))
+	require.Equal(t, healthpb.HealthCheckResponse_NOT_SERVING, status())
+
+	// And it is serving again after dependency recovers
+	dbErr = nil
+	require.True(t, checker.check(context.Background()))
+	require.Equal(t, healthpb.HealthCheckResponse_SERVING, status())
+}
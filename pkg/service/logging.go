@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// Puts logger with request id into context of unary requests and logs
+// finished requests. Request id is sent back in x-request-id header.
+func unaryLogging(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, logger, id := requestLogger(ctx, info.FullMethod)
+	grpc.SetHeader(ctx, metadata.Pairs(logging.RequestIDHeader, id))
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	logFinished(ctx, logger, start, err)
+	return resp, err
+}
+
+// Same as unaryLogging for streams.
+func streamLogging(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, logger, id := requestLogger(ss.Context(), info.FullMethod)
+	ss.SetHeader(metadata.Pairs(logging.RequestIDHeader, id))
+	start := time.Now()
+	err := handler(srv, &contextStream{ServerStream: ss, ctx: ctx})
+	logFinished(ctx, logger, start, err)
+	return err
+}
+
+// Server stream with context carrying request logger.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *contextStream) Context() context.Context {
+	return s.ctx
+}
+
+// Returns context with logger of the request and request id. Id is taken
+// from x-request-id metadata set by the gateway or client, or generated.
+func requestLogger(ctx context.Context, method string) (context.Context, *slog.Logger, string) {
+	sent := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(logging.RequestIDHeader); len(ids) > 0 {
+			sent = ids[0]
+		}
+	}
+	id := logging.RequestID(sent)
+	logger := slog.Default().With("request_id", id, "method", method)
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		logger = logger.With("trace_id", sc.TraceID().String())
+	}
+	ctx = logging.ContextWithRequestID(ctx, id)
+	return logging.NewContext(ctx, logger), logger, id
+}
+
+// Logs finished request. Server errors are logged at error level, client
+// errors at info level with the rest.
+func logFinished(ctx context.Context, logger *slog.Logger, start time.Time, err error) {
+	code := status.Code(err)
+	level := slog.LevelInfo
+	switch code {
+	case codes.Internal, codes.Unknown, codes.DataLoss:
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{slog.String("code", code.String()), slog.Duration("duration", time.Since(start))}
+	if err != nil {
+		attrs = append(attrs, slog.String("error", status.Convert(err).Message()))
+	}
+	logger.LogAttrs(ctx, level, "request finished", attrs...)
+}
+
+// Gin middleware logging HTTP requests. Request id sent in X-Request-Id
+// header, or a generated one, is passed to grpc server and sent back to
+// the client.
+func httpLogging(c *gin.Context) {
+	start := time.Now()
+	id := logging.RequestID(c.GetHeader(logging.RequestIDHeader))
+	c.Request.Header.Set(logging.RequestIDHeader, id)
+	c.Header(logging.RequestIDHeader, id)
+	c.Next()
+
+	level := slog.LevelInfo
+	if c.Writer.Status() >= http.StatusInternalServerError {
+		level = slog.LevelError
+	}
+	attrs := []slog.Attr{
+		slog.String("request_id", id),
+		slog.String("method", c.Request.Method),
+		slog.String("path", c.Request.URL.Path),
+		slog.String("route", c.FullPath()),
+		slog.Int("status", c.Writer.Status()),
+		slog.Duration("duration", time.Since(start)),
+		slog.String("client_ip", c.ClientIP()),
+	}
+	if sc := trace.SpanContextFromContext(c.Request.Context()); sc.IsValid() {
+		attrs = append(attrs, slog.String("trace_id", sc.TraceID().String()))
+	}
+	slog.Default().LogAttrs(c.Request.Context(), level, "http request finished", attrs...)
+}
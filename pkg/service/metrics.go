@@ -0,0 +1,79 @@
+package service
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Metrics of grpc and HTTP servers exposed at /metrics.
+var (
+	grpcRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "grpc_requests_total",
+		Help:      "Handled gRPC requests by method and status code.",
+	}, []string{"method", "code"})
+
+	grpcDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "userservice",
+		Name:      "grpc_request_duration_seconds",
+		Help:      "Time spent handling gRPC requests, streams are measured until they end.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "userservice",
+		Name:      "http_requests_total",
+		Help:      "Handled HTTP requests by method, route and status code.",
+	}, []string{"method", "route", "code"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "userservice",
+		Name:      "http_request_duration_seconds",
+		Help:      "Time spent handling HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	watchStreams = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: "userservice",
+		Name:      "watch_streams",
+		Help:      "Open Watch streams by transport: grpc, sse or websocket.",
+	}, []string{"transport"})
+)
+
+// Counts unary requests and measures their duration.
+func unaryMetrics(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeGrpc(info.FullMethod, start, err)
+	return resp, err
+}
+
+// Counts streams and measures how long they are open.
+func streamMetrics(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeGrpc(info.FullMethod, start, err)
+	return err
+}
+
+func observeGrpc(method string, start time.Time, err error) {
+	grpcRequests.WithLabelValues(method, status.Code(err).String()).Inc()
+	grpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// Gin middleware counting requests and measuring their duration. Routes
+// are labeled by their pattern, unmatched requests by empty route.
+func httpMetrics(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+	route := c.FullPath()
+	httpRequests.WithLabelValues(c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+	httpDuration.WithLabelValues(c.Request.Method, route).Observe(time.Since(start).Seconds())
+}
@@ -0,0 +1,123 @@
+package service
+
+import (
+	"context"
+	"errors"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/genproto/googleapis/api/httpbody"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Returns user data, its audit trail and undelivered webhook events as JSON
+// encoded pb.UserDataExport.
+func (s UserService) ExportUserData(ctx context.Context, in *pb.ExportUserDataRequest) (*httpbody.HttpBody, error) {
+	logger := logging.FromContext(ctx)
+	id, err := parseUserID("ExportUserData", in.Id)
+	if err != nil {
+		logger.Debug("invalid id provided", "id", in.Id, "error", err)
+		return nil, err
+	}
+
+	qctx, cancel := s.queryContext(ctx, "ExportUserData")
+	defer cancel()
+	user, err := s.Users.Primary().GetUser(qctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "ExportUserData: user not found")
+	}
+	if err != nil {
+		logger.Error("error reading user", "user_id", id, "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	export := &pb.UserDataExport{
+		User:       user.ToUserResponse(),
+		ExportedAt: timestamppb.Now(),
+	}
+	export.User.Password = ""
+
+	if s.Audit != nil {
+		events, err := s.Audit.ListAuditEvents(qctx, db.AuditFilter{UserID: id})
+		if err != nil {
+			logger.Error("error listing audit events", "user_id", id, "error", err)
+			return nil, dbStatus(qctx, err)
+		}
+		for _, e := range events {
+			export.AuditEvents = append(export.AuditEvents, e.ToAuditEventResponse())
+		}
+	}
+	if s.Webhooks != nil {
+		deadLetters, err := s.Webhooks.ListUserDeadLetters(qctx, id)
+		if err != nil {
+			logger.Error("error listing webhook dead letters", "user_id", id, "error", err)
+			return nil, dbStatus(qctx, err)
+		}
+		for _, d := range deadLetters {
+			export.WebhookDeadLetters = append(export.WebhookDeadLetters, d.ToWebhookDeadLetterResponse())
+		}
+	}
+
+	data, err := protojson.MarshalOptions{Multiline: true, EmitUnpopulated: true}.Marshal(export)
+	if err != nil {
+		logger.Error("error encoding export", "user_id", id, "error", err)
+		return nil, status.Errorf(codes.Internal, err.Error())
+	}
+	return &httpbody.HttpBody{ContentType: "application/json", Data: data}, nil
+}
+
+// Anonymizes the user and its audit trail and deletes undelivered webhook
+// events holding its data in one transaction. Erasure is recorded in the
+// audit trail and published as ERASE with the anonymized user.
+func (s UserService) EraseUser(ctx context.Context, in *pb.EraseUserRequest) (*pb.EraseUserResponse, error) {
+	logger := logging.FromContext(ctx)
+	id, err := parseUserID("EraseUser", in.Id)
+	if err != nil {
+		logger.Debug("invalid id provided", "id", in.Id, "error", err)
+		return nil, err
+	}
+
+	// Undelivered webhook events of the user are dropped, so they are not
+	// dead-lettered after its dead letters are deleted
+	forgotten := func() {}
+	if s.Dispatcher != nil {
+		forgotten = s.Dispatcher.Forget(id)
+	}
+	var event *models.AuditEvent
+	if s.Audit != nil {
+		event = s.auditEvent(ctx, "EraseUser")
+	}
+	qctx, cancel := s.queryContext(ctx, "EraseUser")
+	defer cancel()
+	_, user, err := s.Users.EraseUserReturning(qctx, id, event)
+	forgotten()
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "EraseUser: user not found")
+	}
+	if err != nil {
+		logger.Error("error erasing user", "user_id", id, "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	setLastWrite(ctx)
+
+	s.publish(ctx, pb.WatchResponse_ERASE, user.ToUserResponse())
+
+	return &pb.EraseUserResponse{}, nil
+}
+
+// Parses required user id. Returned error is grpc status.
+func parseUserID(method, id string) (uuid.UUID, error) {
+	if id == "" {
+		return uuid.Nil, status.Errorf(codes.InvalidArgument, "%s: id must not be empty", method)
+	}
+	uid, err := uuid.Parse(id)
+	if err != nil {
+		return uuid.Nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	return uid, nil
+}
@@ -0,0 +1,141 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestExportAndEraseUser(t *testing.T) {
+	bus := events.NewMemoryBus()
+	defer bus.Close()
+	sub, err := bus.Subscribe(context.Background())
+	if err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+	s := newTestService()
+	s.Publisher = bus
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-forwarded-for", "10.0.0.1"))
+
+	user, err := s.AddUser(ctx, &pb.AddUserRequest{FirstName: "Erin", Email: "erin@email.com", Password: "secret", Country: "UK"})
+	if err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to add user: %v", err)
+	}
+	if _, err := s.ModifyUser(ctx, &pb.ModifyUserRequest{Id: user.Id, Country: stringPtr("LV")}); err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to modify user: %v", err)
+	}
+
+	// Webhook event of the user could not be delivered
+	uid := uuid.MustParse(user.Id)
+	deadLetter := &models.WebhookDeadLetter{WebhookID: uuid.New(), UserID: uid, Method: "UPDATE", Payload: []byte(`{"user":{"email":"erin@email.com"}}`)}
+	if err := s.Webhooks.CreateWebhookDeadLetter(ctx, deadLetter); err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to create dead letter: %v", err)
+	}
+
+	// Export holds stored user data without password, its audit trail and
+	// undelivered webhook events
+	body, err := s.ExportUserData(ctx, &pb.ExportUserDataRequest{Id: user.Id})
+	if err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to export user: %v", err)
+	}
+	if body.ContentType != "application/json" {
+		t.Errorf("TestExportAndEraseUser: export content type %s, wanted application/json", body.ContentType)
+	}
+	export := &pb.UserDataExport{}
+	if err := protojson.Unmarshal(body.Data, export); err != nil {
+		t.Fatalf("TestExportAndEraseUser: export is not valid JSON: %v", err)
+	}
+	if export.User.Email != "erin@email.com" || export.User.Country != "LV" || export.User.Password != "" {
+		t.Errorf("TestExportAndEraseUser: exported user %v", export.User)
+	}
+	if len(export.AuditEvents) != 2 || export.ExportedAt == nil {
+		t.Errorf("TestExportAndEraseUser: expected 2 audit events and export time. Got: %d, %v", len(export.AuditEvents), export.ExportedAt)
+	}
+	if len(export.WebhookDeadLetters) != 1 || !strings.Contains(export.WebhookDeadLetters[0].Payload, "erin@email.com") {
+		t.Errorf("TestExportAndEraseUser: expected dead letter with user data. Got: %v", export.WebhookDeadLetters)
+	}
+
+	// Personal data is anonymized, id is kept
+	if _, err := s.EraseUser(ctx, &pb.EraseUserRequest{Id: user.Id}); err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to erase user: %v", err)
+	}
+	erased, err := s.GetUser(context.Background(), &pb.GetUserRequest{Id: user.Id})
+	if err != nil {
+		t.Fatalf("TestExportAndEraseUser: erased user should exist: %v", err)
+	}
+	if erased.FirstName != "" || erased.Password != "" || erased.Country != "" || !strings.HasSuffix(erased.Email, "@erased.invalid") {
+		t.Errorf("TestExportAndEraseUser: user was not anonymized: %v", erased)
+	}
+
+	// Undelivered webhook events are deleted
+	deadLetters, err := s.Webhooks.ListUserDeadLetters(context.Background(), uid)
+	if err != nil || len(deadLetters) != 0 {
+		t.Errorf("TestExportAndEraseUser: dead letters of erased user should be deleted. Got: %v, %v", deadLetters, err)
+	}
+
+	// Recorded values of audit events are erased as well
+	audit, err := s.ListAuditEvents(context.Background(), &pb.ListAuditEventsRequest{UserId: user.Id})
+	if err != nil {
+		t.Fatalf("TestExportAndEraseUser: failed to list audit events: %v", err)
+	}
+	if len(audit.Events) != 3 || audit.Events[2].Method != "EraseUser" {
+		t.Fatalf("TestExportAndEraseUser: expected erasure to be recorded. Got: %v", audit.Events)
+	}
+	for _, e := range audit.Events {
+		if e.UserId != user.Id || e.ClientIp != "[ERASED]" {
+			t.Errorf("TestExportAndEraseUser: audit event %s was not erased: %v", e.Method, e)
+		}
+		for _, c := range e.Changes {
+			if (c.Old != "" && c.Old != "[ERASED]") || (c.New != "" && c.New != "[ERASED]") {
+				t.Errorf("TestExportAndEraseUser: %s change of %s was not erased: %v", e.Method, c.Field, c)
+			}
+		}
+	}
+
+	// Erasure is published with anonymized user
+	timeout := time.After(time.Second)
+	for erasedEvent := false; !erasedEvent; {
+		select {
+		case event := <-sub.Events():
+			if event.Method == pb.WatchResponse_ERASE {
+				erasedEvent = true
+				if event.User.Id != user.Id || event.User.Email != erased.Email {
+					t.Errorf("TestExportAndEraseUser: ERASE event has user %v", event.User)
+				}
+			}
+		case <-timeout:
+			t.Fatalf("TestExportAndEraseUser: ERASE event was not published")
+		}
+	}
+
+	// Email of erased user can be used again and erasing again is allowed
+	if _, err := s.AddUser(ctx, &pb.AddUserRequest{Email: "erin@email.com"}); err != nil {
+		t.Errorf("TestExportAndEraseUser: email of erased user should be free: %v", err)
+	}
+	if _, err := s.EraseUser(ctx, &pb.EraseUserRequest{Id: user.Id}); err != nil {
+		t.Errorf("TestExportAndEraseUser: erasing user again failed: %v", err)
+	}
+
+	for _, id := range []string{"", "invalid", "cc9b61e3-0cba-473f-8e95-944661c46051"} {
+		_, err := s.EraseUser(ctx, &pb.EraseUserRequest{Id: id})
+		_, exportErr := s.ExportUserData(ctx, &pb.ExportUserDataRequest{Id: id})
+		want := codes.InvalidArgument
+		if id == "cc9b61e3-0cba-473f-8e95-944661c46051" {
+			want = codes.NotFound
+		}
+		if status.Code(err) != want || status.Code(exportErr) != want {
+			t.Errorf("TestExportAndEraseUser(%q): got %v and %v, wanted %s", id, err, exportErr, want)
+		}
+	}
+}
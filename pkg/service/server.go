@@ -2,76 +2,353 @@ package service
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
-	"os"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/go-redis/redis/v8"
 	"github.com/grpc-ecosystem/grpc-gateway/v2/runtime"
+	"github.com/kroksys/user-service-example/pkg/cache"
+	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/logging"
 	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/tracing"
+	"github.com/kroksys/user-service-example/pkg/webhook"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/contrib/instrumentation/google.golang.org/grpc/otelgrpc"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials/insecure"
 	"google.golang.org/grpc/health"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
+// Default address of redis server.
+const DefaultRedisAddr = "localhost:6379"
+
+// Defaults of redis connection attempts on startup.
+const (
+	DefaultRedisConnectAttempts = 10
+	DefaultRedisConnectBackoff  = 500 * time.Millisecond
+)
+
+// Longest delay between redis connection attempts.
+const maxRedisConnectBackoff = 30 * time.Second
+
+// Options of grpc and HTTP servers. Zero values use defaults.
+type Options struct {
+	// Event bus user changes are published to. Redis when Driver is empty.
+	EventBus events.Config
+
+	// Redis server used by redis event bus and redis cache.
+	Redis RedisOptions
+
+	// Cache of GetUser and ListUsers results. Disabled when Driver is empty.
+	Cache cache.Config
+
+	// Personal data is encrypted in the database. Redis cache is refused
+	// because it would store users in plaintext.
+	Encrypted bool
+
+	// Events buffered for each Watch stream and what happens when buffer
+	// of a slow client is full.
+	WatchBufferSize     int
+	WatchOverflowPolicy events.OverflowPolicy
+
+	// Reads go to primary database for this long after client's write.
+	// DefaultReadYourWritesWindow when zero.
+	ReadYourWritesWindow time.Duration
+
+	// Time limits of database queries. Not limited when zero.
+	QueryTimeouts QueryTimeouts
+
+	// Delay between dependency checks. defaultHealthCheckInterval when zero.
+	HealthCheckInterval time.Duration
+
+	// Origins allowed to open websocket connections. Only same origin is
+	// allowed when empty.
+	WebsocketAllowedOrigins []string
+
+	// Private networks webhooks may be delivered to in CIDR notation.
+	// Only public addresses are allowed when empty.
+	WebhookAllowedNetworks []string
+
+	// Networks of proxies allowed to set X-Actor and X-Forwarded-For in
+	// CIDR notation. DefaultTrustedProxies when empty.
+	TrustedProxies []string
+}
+
+// Returns parsed trusted proxies of the options.
+func (o Options) trustedProxies() ([]netip.Prefix, error) {
+	if len(o.TrustedProxies) == 0 {
+		return ParseTrustedProxies(DefaultTrustedProxies)
+	}
+	return ParseTrustedProxies(o.TrustedProxies)
+}
+
+// Connection options of redis server.
+type RedisOptions struct {
+	// Server address. DefaultRedisAddr when empty.
+	Addr     string
+	Password string
+	DB       int
+
+	// Number of connection attempts on startup. Delay between attempts
+	// starts at ConnectBackoff and is doubled up to 30 seconds.
+	// DefaultRedisConnectAttempts and DefaultRedisConnectBackoff when zero.
+	ConnectAttempts int
+	ConnectBackoff  time.Duration
+}
+
+// Grpc server with event bus and webhook dispatcher it uses. Event bus and
+// dispatcher are closed after the server stops.
+type Server struct {
+	*grpc.Server
+
+	health      *health.Server
+	stopChecker context.CancelFunc
+	hub         *events.Hub
+	dispatcher  *webhook.Dispatcher
+	bus         events.Bus
+	cache       cache.Store
+
+	closeOnce sync.Once
+}
+
 // Starts grpc server listening on provided addr.
-// Registers healthcheck and user service.
-// Returns grpc.Server that should be used to defer server.GracefulStop().
-func StartGrpcServer(ctx context.Context, addr string) (*grpc.Server, error) {
+// Registers healthcheck and user service using provided repositories.
+// Returns Server that should be used to defer server.Shutdown() or
+// server.GracefulStop().
+func StartGrpcServer(ctx context.Context, addr string, repos db.Repositories, opts Options) (*Server, error) {
+	// Buffering of events for slow Watch clients
+	watchOverflowPolicy, err := events.ParseOverflowPolicy(string(opts.WatchOverflowPolicy))
+	if err != nil {
+		return nil, err
+	}
+
+	trustedProxies, err := opts.trustedProxies()
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Encrypted && opts.Cache.Driver == "redis" {
+		return nil, errors.New("redis cache is not supported when personal data is encrypted")
+	}
+
 	// Try to open TCP port for grpc server
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return nil, fmt.Errorf("failed to listen: %v", err)
 	}
 
-	server := grpc.NewServer()
+	// Everything opened so far is released when the server fails to start
+	var (
+		bus        events.Bus
+		dispatcher *webhook.Dispatcher
+		hub        *events.Hub
+		store      cache.Store
+		started    bool
+	)
+	defer func() {
+		if started {
+			return
+		}
+		lis.Close()
+		if hub != nil {
+			hub.Close()
+		}
+		if dispatcher != nil {
+			dispatcher.Close()
+		}
+		if store != nil {
+			store.Close()
+		}
+		if bus != nil {
+			bus.Close()
+		}
+	}()
+
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(otelgrpc.UnaryServerInterceptor(), unaryLogging, unaryMetrics),
+		grpc.ChainStreamInterceptor(otelgrpc.StreamServerInterceptor(), streamLogging, streamMetrics),
+	)
+
+	// Open event bus used to publish and watch user changes
+	bus, err = openEventBus(ctx, opts.EventBus, opts.Redis)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open event bus: %v", err)
+	}
+
+	// Webhooks are delivered for changes made through this instance
+	webhookPolicy, err := webhook.NewAddressPolicy(opts.WebhookAllowedNetworks)
+	if err != nil {
+		return nil, err
+	}
+	dispatcher = webhook.NewDispatcher(repos.Webhooks, webhookPolicy)
 
-	// Connect to redis server
-	redisClient, err := connectToRedis()
+	// All Watch streams share a single subscription to the event bus
+	hub = events.NewHub(bus, opts.WatchBufferSize, watchOverflowPolicy)
+	if err := hub.Start(ctx); err != nil {
+		return nil, fmt.Errorf("failed to subscribe to event bus: %v", err)
+	}
+
+	// Cached reads are invalidated by changes received from event bus
+	users := repos.Users
+	store, err = openCacheStore(ctx, opts.Cache, opts.Redis, bus)
 	if err != nil {
-		return nil, fmt.Errorf("failed to connect to redis server: %v", err)
+		return nil, fmt.Errorf("failed to open cache: %v", err)
+	}
+	if store != nil {
+		cachedUsers := cache.NewUsers(repos.Users, store, opts.Cache)
+		go cachedUsers.Watch(ctx, hub)
+		users = cachedUsers
 	}
 
 	// Register user service
 	pb.RegisterUserServiceServer(server, UserService{
-		Redis: redisClient,
+		Users:                users,
+		ReadYourWritesWindow: opts.ReadYourWritesWindow,
+		QueryTimeouts:        opts.QueryTimeouts,
+		Webhooks:             repos.Webhooks,
+		WebhookPolicy:        webhookPolicy,
+		Dispatcher:           dispatcher,
+		Audit:                repos.Audit,
+		TrustedProxies:       trustedProxies,
+		Publisher:            events.MultiPublisher{bus, dispatcher},
+		Subscriber:           hub,
 	})
 
-	// Register healthckech service and setting status to serving
+	// Register healthcheck service. Status is NOT_SERVING while database
+	// or event bus is unreachable.
 	healthServer := health.NewServer()
-	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
-	healthServer.SetServingStatus(pb.UserService_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	checker := newHealthChecker(healthServer, opts.HealthCheckInterval, healthCheck{name: "database", check: repos.Ping})
+	if pinger, ok := bus.(events.Pinger); ok {
+		checker.checks = append(checker.checks, healthCheck{name: "event bus", check: pinger.Ping})
+	}
+	checkerCtx, stopChecker := context.WithCancel(ctx)
+	checker.check(checkerCtx)
+	go checker.run(checkerCtx)
 	healthpb.RegisterHealthServer(server, healthServer)
 
+	s := &Server{
+		Server:      server,
+		health:      healthServer,
+		stopChecker: stopChecker,
+		hub:         hub,
+		dispatcher:  dispatcher,
+		bus:         bus,
+		cache:       store,
+	}
+	started = true
 	go func() {
 		if err := server.Serve(lis); err != nil {
-			log.Printf("grpc server stopped with error: %v\n", err)
+			slog.Error("grpc server stopped", "error", err)
 		}
-		redisClient.Close()
 	}()
 
-	return server, nil
+	return s, nil
+}
+
+// Reports NOT_SERVING to health checks so load balancers stop sending new
+// requests. Status is not changed by dependency checks anymore.
+func (s *Server) SetNotServing() {
+	s.stopChecker()
+	s.health.Shutdown()
+}
+
+// Ends all Watch streams. Clients receive end of stream instead of an error.
+func (s *Server) CloseWatchStreams() {
+	s.hub.Close()
+}
+
+// Stops the server gracefully: health status is set to NOT_SERVING, Watch
+// streams are closed and running requests finished. Server is stopped
+// forcefully when ctx expires. Webhook dispatcher and event bus are closed
+// after the server stops.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.SetNotServing()
+	s.CloseWatchStreams()
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Server.GracefulStop()
+		close(stopped)
+	}()
+
+	var err error
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		err = fmt.Errorf("graceful stop timed out, stopping forcefully: %v", ctx.Err())
+		s.Server.Stop()
+		<-stopped
+	}
+	s.close()
+	return err
+}
+
+// Closes Watch streams, waits for running requests and releases resources.
+func (s *Server) GracefulStop() {
+	s.CloseWatchStreams()
+	s.Server.GracefulStop()
+	s.close()
+}
+
+// Closes all connections and releases resources.
+func (s *Server) Stop() {
+	s.Server.Stop()
+	s.close()
+}
+
+// Releases resources used by the server once.
+func (s *Server) close() {
+	s.closeOnce.Do(func() {
+		s.stopChecker()
+		s.hub.Close()
+		s.dispatcher.Close()
+		s.bus.Close()
+		if s.cache != nil {
+			s.cache.Close()
+		}
+	})
 }
 
 // Starts HTTP gin API server that proxies the requests to grpc server.
 // returns http.Server and error. The server repose souhld be used to defer server.Shutdown().
-func StartHTTPServer(ctx context.Context, addr, grpcAddr string) (*http.Server, error) {
+// Connection to grpc server is closed when ctx is done.
+func StartHTTPServer(ctx context.Context, addr, grpcAddr string, opts Options) (*http.Server, error) {
+	trustedProxies, err := opts.trustedProxies()
+	if err != nil {
+		return nil, err
+	}
 	conn, err := grpc.DialContext(
 		ctx,
 		grpcAddr,
 		grpc.WithBlock(),
 		grpc.WithTransportCredentials(insecure.NewCredentials()),
+		// Trace context of HTTP requests is passed to grpc server
+		grpc.WithChainUnaryInterceptor(otelgrpc.UnaryClientInterceptor()),
+		grpc.WithChainStreamInterceptor(otelgrpc.StreamClientInterceptor()),
 	)
 	if err != nil {
 		return nil, fmt.Errorf("failed to dial a grpc server: %v", err)
 	}
 
-	// Grpc to Rest API
-	mux := runtime.NewServeMux()
+	// Grpc to Rest API. X-Last-Write header is passed both ways so HTTP
+	// clients can read their own writes when replicas are used. X-Request-Id
+	// is passed to grpc server so both log the same request id.
+	mux := runtime.NewServeMux(
+		runtime.WithIncomingHeaderMatcher(gatewayIncomingHeader),
+		runtime.WithOutgoingHeaderMatcher(gatewayOutgoingHeader),
+	)
 	err = pb.RegisterUserServiceHandler(ctx, mux, conn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to register gateway: %v", err)
@@ -80,38 +357,176 @@ func StartHTTPServer(ctx context.Context, addr, grpcAddr string) (*http.Server,
 	// Gin HTTP server
 	gin.SetMode(gin.ReleaseMode)
 	server := gin.New()
-	server.Use(gin.Logger())
-	server.Group("v1/*{grpc_gateway}").Any("", gin.WrapH(mux))
+	server.Use(otelgin.Middleware(tracing.ServiceName), httpLogging, httpMetrics)
+	server.Group("v1/*{grpc_gateway}").Any("", dropUntrustedActor(trustedProxies), gin.WrapH(mux))
+
+	// Browser friendly Watch streams sharing a single grpc Watch stream
+	watchCtx, stopWatcher := context.WithCancel(ctx)
+	watcher := newWatchBroadcaster(pb.NewUserServiceClient(conn))
+	go watcher.run(watchCtx)
+	server.GET("watch/sse", watcher.sseHandler)
+	server.GET("watch/ws", watcher.websocketHandler(newWebsocketUpgrader(opts.WebsocketAllowedOrigins)))
+
+	// Prometheus metrics
+	server.GET("metrics", gin.WrapH(promhttp.Handler()))
 
 	// Start the server
 	srv := &http.Server{
 		Addr:    addr,
 		Handler: server,
 	}
+
+	// Browser Watch streams would otherwise block Shutdown and the grpc
+	// Watch stream of the watcher would block grpc server GracefulStop
+	srv.RegisterOnShutdown(func() {
+		stopWatcher()
+		watcher.close()
+	})
+
+	// Proxied requests are finished during Shutdown before the connection
+	// to grpc server is closed
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
-			log.Printf("http server stopped with error: %v\n", err)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			slog.Error("http server stopped", "error", err)
 		}
 	}()
 
 	return srv, nil
 }
 
-// Connects to local redis server
-func connectToRedis() (*redis.Client, error) {
-	redisAddr := "localhost:6379"
-	if os.Getenv("USERSERVICE_REDIS_HOST") != "" {
-		redisAddr = os.Getenv("USERSERVICE_REDIS_HOST")
+// Passes X-Last-Write, X-Request-Id and X-Actor request headers to grpc
+// metadata in addition to default gateway headers.
+func gatewayIncomingHeader(key string) (string, bool) {
+	if strings.EqualFold(key, LastWriteHeader) {
+		return LastWriteHeader, true
+	}
+	if strings.EqualFold(key, logging.RequestIDHeader) {
+		return logging.RequestIDHeader, true
+	}
+	if strings.EqualFold(key, ActorHeader) {
+		return ActorHeader, true
+	}
+	return runtime.DefaultHeaderMatcher(key)
+}
+
+// Removes X-Actor header of requests not sent by a trusted proxy, the grpc
+// server trusts all requests of the gateway.
+func dropUntrustedActor(trusted []netip.Prefix) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !isTrustedProxy(trusted, c.Request.RemoteAddr) {
+			c.Request.Header.Del(ActorHeader)
+		}
+	}
+}
+
+// Sends x-last-write grpc header as X-Last-Write response header. Request
+// id is already set by httpLogging. Other headers are prefixed same as by
+// default.
+func gatewayOutgoingHeader(key string) (string, bool) {
+	if key == LastWriteHeader {
+		return http.CanonicalHeaderKey(LastWriteHeader), true
+	}
+	if key == logging.RequestIDHeader {
+		return "", false
+	}
+	return runtime.MetadataHeaderPrefix + key, true
+}
+
+// Opens event bus selected by cfg.Driver: redis (default), nats, kafka or
+// memory. Redis bus connects to the server described by redisOpts.
+func openEventBus(ctx context.Context, cfg events.Config, redisOpts RedisOptions) (events.Bus, error) {
+	if cfg.Driver == "" {
+		cfg.Driver = "redis"
+	}
+	if cfg.Driver == "redis" {
+		codec, err := events.NewCodec(cfg.Encoding, cfg.Source)
+		if err != nil {
+			return nil, err
+		}
+		if events.RequiresHeaders(codec) {
+			return nil, fmt.Errorf("event encoding %q is not supported by redis event bus", cfg.Encoding)
+		}
+		redisClient, err := connectToRedis(ctx, redisOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis server: %v", err)
+		}
+		bus := events.NewRedisBus(redisClient, cfg.Topic)
+		bus.Codec = codec
+		return bus, nil
+	}
+	return events.Open(cfg)
+}
+
+// Opens cache store selected by cfg.Driver: redis or memory. Returns nil
+// when cache is disabled. Redis cache shares the client of redis event
+// bus, so a single connection pool is used.
+func openCacheStore(ctx context.Context, cfg cache.Config, redisOpts RedisOptions, bus events.Bus) (cache.Store, error) {
+	switch cfg.Driver {
+	case "":
+		return nil, nil
+	case "memory":
+		return cache.NewMemoryStore(), nil
+	case "redis":
+		if redisBus, ok := bus.(*events.RedisBus); ok {
+			return cache.NewSharedRedisStore(redisBus.Client), nil
+		}
+		redisClient, err := connectToRedis(ctx, redisOpts)
+		if err != nil {
+			return nil, fmt.Errorf("failed to connect to redis server: %v", err)
+		}
+		return cache.NewRedisStore(redisClient), nil
+	}
+	return nil, fmt.Errorf("unsupported cache driver: %q", cfg.Driver)
+}
+
+// Connects to redis server. Waiting between attempts ends when ctx is done.
+func connectToRedis(ctx context.Context, opts RedisOptions) (*redis.Client, error) {
+	redisAddr := DefaultRedisAddr
+	if opts.Addr != "" {
+		redisAddr = opts.Addr
+	}
+	attempts := opts.ConnectAttempts
+	if attempts == 0 {
+		attempts = DefaultRedisConnectAttempts
+	}
+	backoff := opts.ConnectBackoff
+	if backoff == 0 {
+		backoff = DefaultRedisConnectBackoff
 	}
 
 	rdb := redis.NewClient(&redis.Options{
-		Addr:    redisAddr,
-		DB:      0,
-		Network: "tcp",
+		Addr:     redisAddr,
+		Password: opts.Password,
+		DB:       opts.DB,
+		Network:  "tcp",
 	})
-	_, err := rdb.Ping(context.Background()).Result()
-	if err != nil {
-		return nil, err
+	// Retried with exponential backoff, so the service can start together
+	// with redis
+	for attempt := 1; ; attempt++ {
+		_, err := rdb.Ping(ctx).Result()
+		if err == nil {
+			return rdb, nil
+		}
+		if attempt >= attempts {
+			rdb.Close()
+			return nil, err
+		}
+		slog.Warn("redis connection attempt failed, retrying", "attempt", attempt, "backoff", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			rdb.Close()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+		backoff *= 2
+		if backoff > maxRedisConnectBackoff {
+			backoff = maxRedisConnectBackoff
+		}
 	}
-	return rdb, nil
 }
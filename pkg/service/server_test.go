@@ -1,12 +1,37 @@
 package service
 
 import (
+	"bytes"
 	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/gin-gonic/gin"
+	"github.com/go-redis/redis/v8"
+	"github.com/kroksys/user-service-example/pkg/cache"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/logging"
 	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/tracing"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 )
 
 var (
@@ -18,13 +43,13 @@ func TestServer(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	grpcServer, err := StartGrpcServer(ctx, grpcAddr)
+	grpcServer, err := StartGrpcServer(ctx, grpcAddr, testRepos, testOptions)
 	if err != nil {
 		t.Fatalf("Error starting GRPC server: %v\n", err)
 	}
 	defer grpcServer.GracefulStop()
 
-	httpServer, err := StartHTTPServer(ctx, apiAddr, grpcAddr)
+	httpServer, err := StartHTTPServer(ctx, apiAddr, grpcAddr, testOptions)
 	if err != nil {
 		t.Fatalf("Error starting HTTP server: %v\n", err)
 	}
@@ -48,4 +73,339 @@ func TestServer(t *testing.T) {
 		t.Errorf("TestServer: healthchek service responded with a status other than SERVING. Got status: %s", resp.Status.String())
 	}
 
+	// Writes through REST API return time of the write
+	httpResp, err := http.Post("http://"+apiAddr+"/v1/users", "application/json", strings.NewReader(`{"email":"rest@email.com"}`))
+	if err != nil {
+		t.Fatalf("TestServer: failed to add user through REST API: %v", err)
+	}
+	added := &pb.UserResponse{}
+	body, _ := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		t.Errorf("TestServer: adding user through REST API responded with status %d", httpResp.StatusCode)
+	}
+	if httpResp.Header.Get("X-Last-Write") == "" {
+		t.Errorf("TestServer: REST API response is missing X-Last-Write header")
+	}
+	if err := protojson.Unmarshal(body, added); err != nil {
+		t.Fatalf("TestServer: invalid REST API response %s: %v", body, err)
+	}
+
+	// User data is exported as a JSON document
+	httpResp, err = http.Get("http://" + apiAddr + "/v1/users/" + added.Id + "/export")
+	if err != nil {
+		t.Fatalf("TestServer: failed to export user through REST API: %v", err)
+	}
+	body, _ = io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	export := &pb.UserDataExport{}
+	if err := protojson.Unmarshal(body, export); err != nil || export.User.GetEmail() != "rest@email.com" {
+		t.Errorf("TestServer: export responded with %s: %v", body, err)
+	}
+	if httpResp.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("TestServer: export responded with content type %s", httpResp.Header.Get("Content-Type"))
+	}
+
+	// Requests are counted at /metrics
+	httpResp, err = http.Get("http://" + apiAddr + "/metrics")
+	if err != nil {
+		t.Fatalf("TestServer: failed to get metrics: %v", err)
+	}
+	metrics, _ := io.ReadAll(httpResp.Body)
+	httpResp.Body.Close()
+	for _, want := range []string{
+		`userservice_grpc_requests_total{code="OK",method="/user.v1.UserService/AddUser"}`,
+		`userservice_http_requests_total{code="200",method="POST",route="/v1/*{grpc_gateway}"}`,
+	} {
+		if !strings.Contains(string(metrics), want) {
+			t.Errorf("TestServer: metrics are missing %s", want)
+		}
+	}
+
+	// Command line and memory stats are not exposed on the API port
+	httpResp, err = http.Get("http://" + apiAddr + "/debug/vars")
+	if err != nil {
+		t.Fatalf("TestServer: failed to get debug vars: %v", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusNotFound {
+		t.Errorf("TestServer: /debug/vars responded with %d, expected 404", httpResp.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	grpcServer, err := StartGrpcServer(ctx, grpcAddr, testRepos, testOptions)
+	if err != nil {
+		t.Fatalf("Error starting GRPC server: %v\n", err)
+	}
+	defer grpcServer.Stop()
+
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("TestShutdown could not create grpc client: %v", err)
+	}
+	defer conn.Close()
+
+	stream, err := pb.NewUserServiceClient(conn).Watch(context.Background(), &pb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("TestShutdown could not watch users: %v", err)
+	}
+	// Wait for the stream to subscribe
+	for i := 0; i < 100 && grpcServer.hub.Len() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// Health status changes before the server stops
+	grpcServer.SetNotServing()
+	resp, err := healthpb.NewHealthClient(conn).Check(context.Background(), &healthpb.HealthCheckRequest{
+		Service: pb.UserService_ServiceDesc.ServiceName,
+	})
+	if err != nil {
+		t.Fatalf("TestShutdown: healthchek service responded with error: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Errorf("TestShutdown: expected NOT_SERVING status after SetNotServing. Got status: %s", resp.Status.String())
+	}
+
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancelShutdown()
+	if err := grpcServer.Shutdown(shutdownCtx); err != nil {
+		t.Errorf("TestShutdown: failed to shut down: %v", err)
+	}
+
+	// Watch stream is closed without an error
+	if _, err := stream.Recv(); err != io.EOF {
+		t.Errorf("TestShutdown: expected Watch stream to end with EOF. Got: %v", err)
+	}
+}
+
+func TestTracing(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTracerProvider(trace.NewNoopTracerProvider())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	grpcAddr, apiAddr := "localhost:1993", "localhost:1994"
+	grpcServer, err := StartGrpcServer(ctx, grpcAddr, testRepos, testOptions)
+	if err != nil {
+		t.Fatalf("Error starting GRPC server: %v\n", err)
+	}
+	defer grpcServer.GracefulStop()
+	httpServer, err := StartHTTPServer(ctx, apiAddr, grpcAddr, testOptions)
+	if err != nil {
+		t.Fatalf("Error starting HTTP server: %v\n", err)
+	}
+	defer httpServer.Shutdown(context.Background())
+
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("TestTracing could not create grpc client: %v", err)
+	}
+	defer conn.Close()
+	stream, err := pb.NewUserServiceClient(conn).Watch(ctx, &pb.WatchRequest{})
+	if err != nil {
+		t.Fatalf("TestTracing: failed to watch: %v", err)
+	}
+	if _, err := stream.Header(); err != nil {
+		t.Fatalf("TestTracing: failed to watch: %v", err)
+	}
+
+	httpResp, err := http.Post("http://"+apiAddr+"/v1/users", "application/json", strings.NewReader(`{"email":"traced@email.com"}`))
+	if err != nil {
+		t.Fatalf("TestTracing: failed to add user through REST API: %v", err)
+	}
+	httpResp.Body.Close()
+	event, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("TestTracing: failed to receive event: %v", err)
+	}
+
+	// HTTP request, grpc call and publish share a trace carried by the event
+	traceID := trace.SpanContextFromContext(tracing.Extract(context.Background(), event)).TraceID()
+	if !traceID.IsValid() {
+		t.Fatalf("TestTracing: event has no trace context: %v", event.Metadata)
+	}
+	spans := map[string]bool{}
+	for _, span := range recorder.Ended() {
+		if span.SpanContext().TraceID() == traceID {
+			spans[span.Name()] = true
+		}
+	}
+	for _, name := range []string{"/v1/*{grpc_gateway}", "user.v1.UserService/AddUser", "publish CREATE"} {
+		if !spans[name] {
+			t.Errorf("TestTracing: span %s is missing from the trace, got %v", name, spans)
+		}
+	}
+}
+
+// Buffer safe for concurrent writes of loggers.
+type logBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *logBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *logBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestRequestID(t *testing.T) {
+	logs := &logBuffer{}
+	defaultLogger := slog.Default()
+	if err := logging.Setup(logs, logging.Config{}); err != nil {
+		t.Fatalf("TestRequestID: %v", err)
+	}
+	defer slog.SetDefault(defaultLogger)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	grpcAddr, apiAddr := "localhost:1995", "localhost:1996"
+	grpcServer, err := StartGrpcServer(ctx, grpcAddr, testRepos, testOptions)
+	if err != nil {
+		t.Fatalf("Error starting GRPC server: %v\n", err)
+	}
+	defer grpcServer.GracefulStop()
+	httpServer, err := StartHTTPServer(ctx, apiAddr, grpcAddr, testOptions)
+	if err != nil {
+		t.Fatalf("Error starting HTTP server: %v\n", err)
+	}
+	defer httpServer.Shutdown(context.Background())
+	waitForListener(t, apiAddr)
+
+	// Request id of HTTP request is used by grpc server and sent back
+	req, _ := http.NewRequest(http.MethodPost, "http://"+apiAddr+"/v1/users", strings.NewReader(`{"email":"logged@email.com","password":"secret"}`))
+	req.Header.Set("X-Request-Id", "rest-request-1")
+	httpResp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("TestRequestID: failed to add user through REST API: %v", err)
+	}
+	httpResp.Body.Close()
+	if got := httpResp.Header.Values("X-Request-Id"); len(got) != 1 || got[0] != "rest-request-1" {
+		t.Errorf("TestRequestID: X-Request-Id=%v, wanted rest-request-1", got)
+	}
+	for _, want := range []string{
+		`"msg":"request finished","request_id":"rest-request-1","method":"/user.v1.UserService/AddUser"`,
+		`"msg":"http request finished","request_id":"rest-request-1"`,
+	} {
+		if !strings.Contains(logs.String(), want) {
+			t.Errorf("TestRequestID: logs are missing %s:\n%s", want, logs.String())
+		}
+	}
+
+	// Id is generated when client does not send one
+	httpResp, err = http.Get("http://" + apiAddr + "/v1/users")
+	if err != nil {
+		t.Fatalf("TestRequestID: failed to list users through REST API: %v", err)
+	}
+	httpResp.Body.Close()
+	if httpResp.Header.Get("X-Request-Id") == "" {
+		t.Errorf("TestRequestID: REST API response is missing X-Request-Id header")
+	}
+
+	// Grpc clients receive request id in header
+	conn, err := grpc.Dial(grpcAddr, grpc.WithInsecure())
+	if err != nil {
+		t.Fatalf("TestRequestID could not create grpc client: %v", err)
+	}
+	defer conn.Close()
+	var header metadata.MD
+	ctx = metadata.AppendToOutgoingContext(ctx, logging.RequestIDHeader, "grpc-request-1")
+	_, err = pb.NewUserServiceClient(conn).AddUser(ctx, &pb.AddUserRequest{Email: "logged@email.com"}, grpc.Header(&header))
+	if status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("TestRequestID: AddUser error %v, wanted AlreadyExists", err)
+	}
+	if got := header.Get(logging.RequestIDHeader); len(got) != 1 || got[0] != "grpc-request-1" {
+		t.Errorf("TestRequestID: x-request-id=%v, wanted grpc-request-1", got)
+	}
+	if !strings.Contains(logs.String(), `"msg":"email already exists","request_id":"grpc-request-1","method":"/user.v1.UserService/AddUser","email":"l***@email.com"`) {
+		t.Errorf("TestRequestID: logs are missing masked email of grpc-request-1:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "logged@email.com") || strings.Contains(logs.String(), "secret") {
+		t.Errorf("TestRequestID: logs contain email or password:\n%s", logs.String())
+	}
+}
+
+// Waits until HTTP server started in background accepts connections.
+func waitForListener(t *testing.T, addr string) {
+	require.Eventually(t, func() bool {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestDropUntrustedActor(t *testing.T) {
+	trusted, err := ParseTrustedProxies([]string{"10.0.0.0/8"})
+	require.NoError(t, err)
+	drop := dropUntrustedActor(trusted)
+	for remote, kept := range map[string]bool{
+		"10.1.2.3:4000":    true,
+		"203.0.113.5:4000": false,
+		"127.0.0.1:4000":   false,
+	} {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest(http.MethodPost, "/v1/users", nil)
+		c.Request.RemoteAddr = remote
+		c.Request.Header.Set("X-Actor", "admin@company.com")
+		drop(c)
+		require.Equal(t, kept, c.Request.Header.Get("X-Actor") != "", remote)
+	}
+}
+
+func TestStartGrpcServerFailure(t *testing.T) {
+	// Port is released when event bus can't be opened
+	opts := testOptions
+	opts.EventBus.Driver = "unknown"
+	_, err := StartGrpcServer(context.Background(), grpcAddr, testRepos, opts)
+	require.Error(t, err)
+
+	lis, err := net.Listen("tcp", grpcAddr)
+	require.NoError(t, err)
+	lis.Close()
+}
+
+func TestOpenCacheStoreSharesRedisClient(t *testing.T) {
+	client := redis.NewClient(&redis.Options{Addr: "127.0.0.1:1"})
+	store, err := openCacheStore(context.Background(), cache.Config{Driver: "redis"}, RedisOptions{}, events.NewRedisBus(client, ""))
+	require.NoError(t, err)
+
+	// Client stays open for the event bus
+	require.NoError(t, store.Close())
+	require.NoError(t, client.Close())
+}
+
+func TestConnectToRedisRetries(t *testing.T) {
+	start := time.Now()
+	_, err := connectToRedis(context.Background(), RedisOptions{Addr: "127.0.0.1:1", ConnectAttempts: 3, ConnectBackoff: 10 * time.Millisecond})
+	require.Error(t, err)
+
+	// Waited 10ms and 20ms between attempts
+	if time.Since(start) < 30*time.Millisecond {
+		t.Errorf("TestConnectToRedisRetries: expected to wait between connection attempts")
+	}
+
+	// Waiting stops when context is done
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start = time.Now()
+	_, err = connectToRedis(ctx, RedisOptions{Addr: "127.0.0.1:1", ConnectAttempts: 10, ConnectBackoff: time.Minute})
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	if time.Since(start) > 5*time.Second {
+		t.Errorf("TestConnectToRedisRetries: expected to stop waiting when context is done")
+	}
 }
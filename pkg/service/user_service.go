@@ -2,28 +2,107 @@ package service
 
 import (
 	"context"
-	"log"
+	"errors"
+	"net/netip"
+	"strconv"
+	"time"
 
-	"github.com/go-redis/redis/v8"
 	"github.com/google/uuid"
 	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
+	"github.com/kroksys/user-service-example/pkg/logging"
 	"github.com/kroksys/user-service-example/pkg/models"
 	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/tracing"
+	"github.com/kroksys/user-service-example/pkg/webhook"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/proto"
 )
 
+// Header with unix time in milliseconds of client's last write.
+const LastWriteHeader = "x-last-write"
+
+// Default time reads go to primary database after client's write. It
+// should be longer than replication lag.
+const DefaultReadYourWritesWindow = 5 * time.Second
+
+// Allowed difference between clocks of service instances. LastWriteHeader
+// later than now by more is ignored, so clients can't pin their reads to
+// the primary database.
+const lastWriteClockSkew = time.Second
+
+// Number of users read by a single query of Watch snapshot.
+const snapshotPageSize = 100
+
+// Default time limit of database queries made by a single RPC.
+const DefaultQueryTimeout = 5 * time.Second
+
+// Time limits of database queries per RPC. Zero means queries are limited
+// only by client's deadline.
+type QueryTimeouts struct {
+	Default time.Duration
+
+	// Overrides default by RPC name, e.g. "ListUsers".
+	Methods map[string]time.Duration
+}
+
+// Returns query time limit of the RPC.
+func (t QueryTimeouts) For(method string) time.Duration {
+	if d, ok := t.Methods[method]; ok {
+		return d
+	}
+	return t.Default
+}
+
 // Protobuf generated user service implementation
 type UserService struct {
 	pb.UnimplementedUserServiceServer
-	Redis *redis.Client
+
+	// Storage of users
+	Users db.UserRepository
+
+	// Reads are sent to primary database instead of replicas for this
+	// long after client's last write. Zero uses DefaultReadYourWritesWindow.
+	ReadYourWritesWindow time.Duration
+
+	// Time limits of database queries made by RPCs.
+	QueryTimeouts QueryTimeouts
+
+	// Storage of webhooks
+	Webhooks db.WebhookRepository
+
+	// Addresses webhooks may be registered with. Only public addresses are
+	// allowed when nil.
+	WebhookPolicy *webhook.AddressPolicy
+
+	// Dispatcher delivering webhooks. It lists webhooks again after they
+	// are registered or deleted.
+	Dispatcher *webhook.Dispatcher
+
+	// Audit trail of user changes. Changes are not recorded when nil.
+	Audit db.AuditRepository
+
+	// Networks of proxies allowed to set actor and client address recorded
+	// in the audit trail. Nothing is trusted when empty.
+	TrustedProxies []netip.Prefix
+
+	// Publishes user changes. Changes are not published when nil.
+	Publisher events.EventPublisher
+
+	// Used by Watch to receive user changes. Should be events.Hub so all
+	// streams share one subscription and slow clients are buffered.
+	Subscriber events.EventSubscriber
 }
 
 func (s UserService) AddUser(ctx context.Context, in *pb.AddUserRequest) (*pb.UserResponse, error) {
-	log.Println("UserService:AddUser")
+	logger := logging.FromContext(ctx)
 	if in.Email == "" {
-		log.Println("UserService:AddUser empty email address provided")
+		logger.Debug("empty email address provided")
 		return nil, status.Errorf(codes.InvalidArgument, "AddUser: email must not be empty")
 	}
 	userRec := models.User{
@@ -34,45 +113,34 @@ func (s UserService) AddUser(ctx context.Context, in *pb.AddUserRequest) (*pb.Us
 		Email:     in.Email,
 		Country:   in.Country,
 	}
-	err := db.CreateUser(&userRec)
+	qctx, cancel := s.queryContext(ctx, "AddUser")
+	defer cancel()
+	err := s.Users.CreateUser(qctx, &userRec)
 	if err != nil {
-		log.Printf("UserService:AddUser error creating user %s\n", err.Error())
-		return nil, status.Errorf(codes.Internal, err.Error())
+		if errors.Is(err, db.ErrDuplicateEmail) {
+			logger.Info("email already exists", "email", in.Email)
+			return nil, status.Errorf(codes.AlreadyExists, "AddUser: email already exists")
+		}
+		logger.Error("error creating user", "error", err)
+		return nil, dbStatus(qctx, err)
 	}
 
+	setLastWrite(ctx)
 	resp := userRec.ToUserResponse()
 
-	// Publish changes to redis pubsub
-	if s.Redis != nil {
-		data, err := proto.Marshal(&pb.WatchResponse{
-			Method: pb.WatchResponse_CREATE,
-			User:   resp,
-		})
-		if err != nil {
-			log.Printf("AddUser failed to marshal data for publishing user changes %v\n", err)
-		} else {
-			if err := s.Redis.Publish(ctx, "users", data).Err(); err != nil {
-				log.Printf("AddUser publish user changes err: %v\n", err)
-			}
-		}
-	}
+	s.audit(ctx, "AddUser", userRec.ID, nil, &userRec)
+	s.publish(ctx, pb.WatchResponse_CREATE, resp)
 
-	return userRec.ToUserResponse(), nil
+	return resp, nil
 }
 
 func (s UserService) ModifyUser(ctx context.Context, in *pb.ModifyUserRequest) (*pb.UserResponse, error) {
-	log.Println("UserService:ModifyUser")
-	// Checking id and creating user record from it
-	if in.Id == "" {
-		log.Println("UserService:ModifyUser empty id provided")
-		return nil, status.Errorf(codes.InvalidArgument, "ModifyUser: id must not be empty")
-	}
-	id, err := uuid.Parse(in.Id)
+	logger := logging.FromContext(ctx)
+	id, err := parseUserID("ModifyUser", in.Id)
 	if err != nil {
-		log.Printf("UserService:ModifyUser could not parse id to uuid %s\n", err.Error())
-		return nil, status.Errorf(codes.Internal, err.Error())
+		logger.Debug("invalid id provided", "id", in.Id, "error", err)
+		return nil, err
 	}
-	userRec := &models.User{ID: id}
 
 	// Because each of provided fields from ModifyUserRequest are optinal
 	// it is possible to update only provided data.
@@ -96,101 +164,144 @@ func (s UserService) ModifyUser(ctx context.Context, in *pb.ModifyUserRequest) (
 		updateMap["country"] = in.GetCountry()
 	}
 
-	// Update and handle error if exists
-	err = db.UpdateUserByMap(userRec, updateMap)
+	// Update and handle error if exists. User is read from primary within
+	// the update transaction, so audit trail records exactly the changed
+	// fields and response holds the update.
+	qctx, cancel := s.queryContext(ctx, "ModifyUser")
+	defer cancel()
+	before, userRec, err := s.Users.UpdateUserByMapReturning(qctx, id, updateMap)
+	if errors.Is(err, db.ErrNotFound) {
+		logger.Info("user not found", "user_id", id)
+		return nil, status.Errorf(codes.NotFound, "ModifyUser: user not found")
+	}
 	if err != nil {
-		log.Printf("UserService:ModifyUser error updating user %s\n", err.Error())
-		return nil, status.Errorf(codes.Internal, err.Error())
+		if errors.Is(err, db.ErrDuplicateEmail) {
+			logger.Info("email already exists", "email", in.GetEmail())
+			return nil, status.Errorf(codes.AlreadyExists, "ModifyUser: email already exists")
+		}
+		logger.Error("error updating user", "user_id", id, "error", err)
+		return nil, dbStatus(qctx, err)
 	}
+	setLastWrite(ctx)
 
 	resp := userRec.ToUserResponse()
 
-	// Publish changes to redis pubsub
-	if s.Redis != nil {
-		data, err := proto.Marshal(&pb.WatchResponse{
-			Method: pb.WatchResponse_UPDATE,
-			User:   resp,
-		})
-		if err != nil {
-			log.Printf("ModifyUser failed to marshal data for publishing user changes %v\n", err)
-		} else {
-			if err := s.Redis.Publish(ctx, "users", data).Err(); err != nil {
-				log.Printf("ModifyUser publish user changes err: %v\n", err)
-			}
-		}
-	}
+	s.audit(ctx, "ModifyUser", id, before, userRec)
+	s.publish(ctx, pb.WatchResponse_UPDATE, resp)
 
 	return resp, nil
 }
 
 func (s UserService) RemoveUser(ctx context.Context, in *pb.RemoveUserRequest) (*pb.RemoveUserResponse, error) {
-	log.Println("UserService:RemoveUser")
-	if in.Id == "" {
-		log.Println("UserService:RemoveUser empty id provided")
-		return nil, status.Errorf(codes.InvalidArgument, "RemoveUser: id must not be empty")
-	}
-	uid, err := uuid.Parse(in.Id)
+	logger := logging.FromContext(ctx)
+	uid, err := parseUserID("RemoveUser", in.Id)
 	if err != nil {
-		log.Printf("UserService:RemoveUser could not parse id to uuid %s\n", err.Error())
-		return nil, status.Errorf(codes.Internal, err.Error())
+		logger.Debug("invalid id provided", "id", in.Id, "error", err)
+		return nil, err
 	}
 
-	err = db.DeleteUser(uid)
+	qctx, cancel := s.queryContext(ctx, "RemoveUser")
+	defer cancel()
+	before, err := s.Users.DeleteUserReturning(qctx, uid)
 	if err != nil {
-		log.Printf("UserService:RemoveUser error deleting user %s\n", err.Error())
-		status.Errorf(codes.Internal, err.Error())
-	}
-
-	// Publish changes to redis pubsub
-	if s.Redis != nil {
-		data, err := proto.Marshal(&pb.WatchResponse{
-			Method: pb.WatchResponse_DELETE,
-			User: &pb.UserResponse{
-				Id: in.Id,
-			},
-		})
-		if err != nil {
-			log.Printf("RemoveUser failed to marshal data for publishing user changes %v\n", err)
-		} else {
-			if err := s.Redis.Publish(ctx, "users", data).Err(); err != nil {
-				log.Printf("RemoveUser publish user changes err: %v\n", err)
-			}
-		}
+		logger.Error("error deleting user", "user_id", uid, "error", err)
+		return nil, dbStatus(qctx, err)
 	}
+	// Removing missing user changes nothing, so nothing is published
+	if before == nil {
+		logger.Info("user not found", "user_id", uid)
+		return nil, status.Errorf(codes.NotFound, "RemoveUser: user not found")
+	}
+	setLastWrite(ctx)
+
+	s.audit(ctx, "RemoveUser", uid, before, nil)
+	s.publish(ctx, pb.WatchResponse_DELETE, &pb.UserResponse{Id: in.Id})
 
 	return &pb.RemoveUserResponse{}, nil
 }
 
-func (UserService) ListUsers(ctx context.Context, in *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
-	log.Println("UserService:ListUsers")
-	users, err := db.ListUsers(int(in.GetLimit()), int(in.GetOffset()), in.GetCountry())
+func (s UserService) GetUser(ctx context.Context, in *pb.GetUserRequest) (*pb.UserResponse, error) {
+	logger := logging.FromContext(ctx)
+	if in.Id == "" {
+		logger.Debug("empty id provided")
+		return nil, status.Errorf(codes.InvalidArgument, "GetUser: id must not be empty")
+	}
+	id, err := uuid.Parse(in.Id)
+	if err != nil {
+		logger.Debug("could not parse id to uuid", "id", in.Id, "error", err)
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	qctx, cancel := s.queryContext(ctx, "GetUser")
+	defer cancel()
+	user, err := s.readUsers(ctx).GetUser(qctx, id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, status.Errorf(codes.NotFound, "GetUser: user not found")
+	}
+	if err != nil {
+		logger.Error("error reading user", "user_id", id, "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	// Reads don't return passwords, cached users don't have them
+	resp := user.ToUserResponse()
+	resp.Password = ""
+	return resp, nil
+}
+
+func (s UserService) ListUsers(ctx context.Context, in *pb.ListUsersRequest) (*pb.ListUsersResponse, error) {
+	qctx, cancel := s.queryContext(ctx, "ListUsers")
+	defer cancel()
+	users, err := s.readUsers(ctx).ListUsers(qctx, int(in.GetLimit()), int(in.GetOffset()), in.GetCountry())
 	if err != nil {
-		log.Printf("UserService:ListUsers error listing user %s\n", err.Error())
-		return nil, status.Errorf(codes.Internal, err.Error())
+		logging.FromContext(ctx).Error("error listing users", "error", err)
+		return nil, dbStatus(qctx, err)
 	}
 	result := []*pb.UserResponse{}
 	for _, u := range users {
-		result = append(result, u.ToUserResponse())
+		user := u.ToUserResponse()
+		user.Password = ""
+		result = append(result, user)
 	}
 	return &pb.ListUsersResponse{Users: result}, nil
 }
 
 func (s UserService) Watch(in *pb.WatchRequest, stream pb.UserService_WatchServer) error {
-	pubsub := s.Redis.Subscribe(stream.Context(), "users")
-	defer pubsub.Close()
+	if s.Subscriber == nil {
+		return status.Errorf(codes.Unavailable, "Watch: event subscriber is not configured")
+	}
+	sub, err := s.subscribe(stream.Context(), in.GetSnapshot())
+	if err != nil {
+		logging.FromContext(stream.Context()).Error("error subscribing to user changes", "error", err)
+		return status.Errorf(codes.Unavailable, err.Error())
+	}
+	defer sub.Close()
+	watchStreams.WithLabelValues("grpc").Inc()
+	defer watchStreams.WithLabelValues("grpc").Dec()
+
+	// Headers tell the client that changes are being received, so it can
+	// list users without missing changes made in between.
+	if err := stream.SendHeader(metadata.MD{}); err != nil {
+		return err
+	}
+	if in.GetSnapshot() {
+		if err := s.sendSnapshot(stream); err != nil {
+			return err
+		}
+	}
 
-	var err error
 	for {
 		select {
 		// Client closed stream
 		case <-stream.Context().Done():
 			return nil
 		// Notify Client about User changes
-		case data := <-pubsub.Channel():
-			resp := &pb.WatchResponse{}
-			err = proto.Unmarshal([]byte(data.Payload), resp)
-			if err != nil {
-				return err
+		case resp, ok := <-sub.Events():
+			if !ok {
+				if sub.Err() == events.ErrBufferOverflow {
+					logging.FromContext(stream.Context()).Warn("client too slow, disconnecting")
+					return status.Errorf(codes.ResourceExhausted, "Watch: client is too slow to receive user changes")
+				}
+				// Server is shutting down
+				return nil
 			}
 			if err := stream.Send(resp); err != nil {
 				return err
@@ -198,3 +309,126 @@ func (s UserService) Watch(in *pb.WatchRequest, stream pb.UserService_WatchServe
 		}
 	}
 }
+
+// Subscribes to user changes. Clients requesting a snapshot keep a copy
+// of users, so they are disconnected instead of silently missing changes
+// when the subscriber buffers events.
+func (s UserService) subscribe(ctx context.Context, snapshot bool) (events.Subscription, error) {
+	if ps, ok := s.Subscriber.(events.PolicySubscriber); ok && snapshot {
+		return ps.SubscribeWithPolicy(ctx, events.Disconnect)
+	}
+	return s.Subscriber.Subscribe(ctx)
+}
+
+// Sends all users as SNAPSHOT events followed by SNAPSHOT_END. Changes
+// made while listing are received by the subscription and sent after the
+// snapshot. Pages follow the last sent user, so users deleted meanwhile
+// don't shift the next page.
+func (s UserService) sendSnapshot(stream pb.UserService_WatchServer) error {
+	users := s.readUsers(stream.Context())
+	var last *models.User
+	for {
+		page, err := s.snapshotPage(stream.Context(), users, last)
+		if err != nil {
+			return err
+		}
+		for i := range page {
+			user := page[i].ToUserResponse()
+			user.Password = ""
+			if err := stream.Send(&pb.WatchResponse{Method: pb.WatchResponse_SNAPSHOT, User: user}); err != nil {
+				return err
+			}
+			last = &page[i]
+		}
+		if len(page) < snapshotPageSize {
+			return stream.Send(&pb.WatchResponse{Method: pb.WatchResponse_SNAPSHOT_END})
+		}
+	}
+}
+
+// Reads a page of Watch snapshot limited by ListUsers query timeout.
+func (s UserService) snapshotPage(ctx context.Context, users db.UserRepository, after *models.User) ([]models.User, error) {
+	qctx, cancel := s.queryContext(ctx, "ListUsers")
+	defer cancel()
+	page, err := users.ListUsersAfter(qctx, after, snapshotPageSize)
+	if err != nil {
+		logging.FromContext(ctx).Error("error listing users for watch snapshot", "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	return page, nil
+}
+
+// Returns context for database queries of the RPC limited by its query
+// timeout. Client's deadline is kept when it is earlier.
+func (s UserService) queryContext(ctx context.Context, method string) (context.Context, context.CancelFunc) {
+	if d := s.QueryTimeouts.For(method); d > 0 {
+		return context.WithTimeout(ctx, d)
+	}
+	return context.WithCancel(ctx)
+}
+
+// Converts database error to grpc status. Queries aborted by exceeded
+// deadline or canceled request are not reported as internal errors.
+func dbStatus(ctx context.Context, err error) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded) || errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return status.Errorf(codes.DeadlineExceeded, "database query timed out")
+	case errors.Is(err, context.Canceled) || errors.Is(ctx.Err(), context.Canceled):
+		return status.Errorf(codes.Canceled, "request canceled")
+	}
+	return status.Errorf(codes.Internal, err.Error())
+}
+
+// Returns repository for reads. Primary database is used when client
+// sent LastWriteHeader of a write made within ReadYourWritesWindow. Times
+// in the future beyond lastWriteClockSkew are ignored.
+func (s UserService) readUsers(ctx context.Context) db.UserRepository {
+	window := s.ReadYourWritesWindow
+	if window == 0 {
+		window = DefaultReadYourWritesWindow
+	}
+	md, _ := metadata.FromIncomingContext(ctx)
+	for _, v := range md.Get(LastWriteHeader) {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		age := time.Since(time.UnixMilli(ms))
+		if age < window && age > -lastWriteClockSkew {
+			return s.Users.Primary()
+		}
+	}
+	return s.Users
+}
+
+// Sends time of the write to the client in LastWriteHeader. Client should
+// send it back with following reads to see its own writes.
+func setLastWrite(ctx context.Context) {
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	grpc.SetHeader(ctx, metadata.Pairs(LastWriteHeader, now))
+}
+
+// Publishes user changes to event publisher if it is configured. Password
+// of the user is cleared.
+func (s UserService) publish(ctx context.Context, method pb.WatchResponse_METHOD, user *pb.UserResponse) {
+	if s.Publisher == nil {
+		return
+	}
+	ctx, span := tracing.Tracer().Start(ctx, "publish "+method.String(), trace.WithSpanKind(trace.SpanKindProducer))
+	defer span.End()
+	// Events are read by watchers, webhooks and consumers outside the
+	// service, so they never carry the password
+	user = proto.Clone(user).(*pb.UserResponse)
+	user.Password = ""
+	event := &pb.WatchResponse{
+		Method: method,
+		User:   user,
+	}
+	tracing.Inject(ctx, event)
+	err := s.Publisher.Publish(ctx, event)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, err.Error())
+		logging.FromContext(ctx).Error("error publishing user changes", "event", method.String(), "error", err)
+	}
+}
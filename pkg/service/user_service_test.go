@@ -2,42 +2,63 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"log"
 	"os"
+	"strconv"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/kroksys/user-service-example/pkg/db"
+	"github.com/kroksys/user-service-example/pkg/events"
 	"github.com/kroksys/user-service-example/pkg/models"
 	"github.com/kroksys/user-service-example/pkg/pb/v1"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
+// Repositories backed by testing database
+var testRepos db.Repositories
+
+// Watch is tested using in-process event bus, so redis is not required.
+var testOptions = Options{EventBus: events.Config{Driver: "memory"}}
+
+// Creates user service using testing database
+func newTestService() UserService {
+	return UserService{Users: testRepos.Users, Webhooks: testRepos.Webhooks, Audit: testRepos.Audit}
+}
+
 func init() {
-	// Use real database connection provided by docker-compose.
-	testDatabaseConnectionString := "user:userpw@tcp(localhost:3306)/users?parseTime=true"
-	if os.Getenv("USERSERVICE_TEST_CONNECTION_STRING") != "" {
-		testDatabaseConnectionString = os.Getenv("USERSERVICE_TEST_CONNECTION_STRING")
+	// In-memory repositories are used by default. Real database, like the one
+	// provided by docker-compose, is used when connection string is set.
+	testDatabaseConnectionString := os.Getenv("USERSERVICE_TEST_CONNECTION_STRING")
+	if testDatabaseConnectionString == "" {
+		testRepos = db.NewMemoryRepositories()
+		return
 	}
-	err := db.Connect(testDatabaseConnectionString)
+	database, err := db.Connect(testDatabaseConnectionString)
 	if err != nil {
 		log.Fatalf("user_service_test.go: could not connect to testing database: %v", err)
 	}
 
-	// Cleanup database
-	err = db.DB.Migrator().DropTable(&models.User{})
+	// Cleanup database, tables are created again by migrations
+	err = database.Migrator().DropTable("audit_events", "webhook_dead_letters", "webhook_deliveries", "webhooks", "users", "schema_migrations")
 	if err != nil {
-		log.Fatalf("user_service_test.go: could not drop user table: %v", err)
+		log.Fatalf("user_service_test.go: could not drop tables: %v", err)
 	}
-	err = db.DB.Migrator().CreateTable(&models.User{})
+	err = db.Migrate(database)
 	if err != nil {
-		log.Fatalf("user_service_test.go: could not create user table: %v", err)
+		log.Fatalf("user_service_test.go: could not migrate database: %v", err)
 	}
+	testRepos = db.NewGormRepositories(database)
 }
 
 func TestAddUser(t *testing.T) {
-	s := UserService{}
+	s := newTestService()
 	testEmail := "john.doe@email.com"
 
 	// Try to add user without email address
@@ -67,8 +88,36 @@ func TestAddUser(t *testing.T) {
 	}
 }
 
+func TestPublishOmitsPassword(t *testing.T) {
+	bus := events.NewMemoryBus()
+	defer bus.Close()
+	sub, err := bus.Subscribe(context.Background())
+	if err != nil {
+		t.Fatalf("TestPublishOmitsPassword: failed to subscribe: %v", err)
+	}
+	defer sub.Close()
+	s := newTestService()
+	s.Publisher = bus
+
+	resp, err := s.AddUser(context.Background(), &pb.AddUserRequest{Email: "publish@email.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("TestPublishOmitsPassword: failed to add user: %v", err)
+	}
+	if resp.Password != "secret" {
+		t.Errorf("TestPublishOmitsPassword: response password %q, wanted secret", resp.Password)
+	}
+	select {
+	case event := <-sub.Events():
+		if event.User.Id != resp.Id || event.User.Password != "" {
+			t.Errorf("TestPublishOmitsPassword: published user %v", event.User)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("TestPublishOmitsPassword: CREATE event was not published")
+	}
+}
+
 func TestModifyUser(t *testing.T) {
-	s := UserService{}
+	s := newTestService()
 	testEmail := "john2.doe@email.com"
 
 	// Try to modify user without id
@@ -118,13 +167,13 @@ func TestModifyUser(t *testing.T) {
 	// Try to enter invalid UUID
 	req.Id = "asdvd-asdv-asd-asddd"
 	_, err = s.ModifyUser(context.Background(), req)
-	if err == nil {
-		t.Errorf("TestModifyUser updating user with invalid uuid should return error. Got: nil")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestModifyUser updating user with invalid uuid should return InvalidArgument. Got: %v", err)
 	}
 }
 
 func TestRemoveUser(t *testing.T) {
-	s := UserService{}
+	s := newTestService()
 	testEmail := "john3.doe@email.com"
 
 	// Creating user for removal
@@ -142,8 +191,8 @@ func TestRemoveUser(t *testing.T) {
 
 	// Try to enter invalid UUID
 	_, err = s.RemoveUser(context.Background(), &pb.RemoveUserRequest{Id: "asdvd-asdv-asd-asddd"})
-	if err == nil {
-		t.Errorf("TestRemoveUser remove user with invalid uuid should return error. Got: nil")
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestRemoveUser remove user with invalid uuid should return InvalidArgument. Got: %v", err)
 	}
 
 	// Final valid removal
@@ -151,10 +200,128 @@ func TestRemoveUser(t *testing.T) {
 	if err != nil {
 		t.Errorf("TestRemoveUser: failed to remove user: %v", err)
 	}
+
+	// User is already removed
+	_, err = s.RemoveUser(context.Background(), &pb.RemoveUserRequest{Id: userRec.Id})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("TestRemoveUser: removing missing user should return NotFound. Got: %v", err)
+	}
+}
+
+func TestGetUser(t *testing.T) {
+	s := newTestService()
+	userRec, err := s.AddUser(context.Background(), &pb.AddUserRequest{Email: "john4.doe@email.com", Country: "UK", Password: "secret"})
+	if err != nil {
+		t.Fatalf("TestGetUser: failed to add user: %v", err)
+	}
+
+	// Password is not returned, with or without the cache
+	resp, err := s.GetUser(context.Background(), &pb.GetUserRequest{Id: userRec.Id})
+	if err != nil {
+		t.Errorf("TestGetUser: failed to get user: %v", err)
+	}
+	if resp.GetEmail() != userRec.Email || resp.GetCountry() != userRec.Country || resp.GetPassword() != "" {
+		t.Errorf("TestGetUser: got %v, wanted %v without password", resp, userRec)
+	}
+	list, err := s.ListUsers(context.Background(), &pb.ListUsersRequest{Country: "UK"})
+	if err != nil || len(list.Users) != 1 || list.Users[0].Password != "" {
+		t.Errorf("TestGetUser: expected listed user without password. Got: %v, %v", list, err)
+	}
+
+	_, err = s.GetUser(context.Background(), &pb.GetUserRequest{})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestGetUser: empty id should return InvalidArgument. Got: %v", err)
+	}
+	_, err = s.GetUser(context.Background(), &pb.GetUserRequest{Id: uuid.NewString()})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("TestGetUser: missing user should return NotFound. Got: %v", err)
+	}
+}
+
+// Replica which has not received any data from primary yet.
+type laggingReplica struct {
+	db.UserRepository
+	primary db.UserRepository
+}
+
+func (r laggingReplica) Primary() db.UserRepository {
+	return r.primary
+}
+
+func TestReadYourWrites(t *testing.T) {
+	primary := db.NewMemoryUserRepository()
+	s := UserService{Users: laggingReplica{UserRepository: db.NewMemoryUserRepository(), primary: primary}}
+	u := models.User{Email: "john@email.com"}
+	if err := primary.CreateUser(context.Background(), &u); err != nil {
+		t.Fatalf("TestReadYourWrites: failed to add user: %v", err)
+	}
+	req := &pb.GetUserRequest{Id: u.ID.String()}
+
+	// Without header reads go to replica
+	_, err := s.GetUser(context.Background(), req)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("TestReadYourWrites: read without header should go to replica. Got: %v", err)
+	}
+
+	// Recent write makes reads go to primary
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(LastWriteHeader, now))
+	if _, err := s.GetUser(ctx, req); err != nil {
+		t.Errorf("TestReadYourWrites: read after write should go to primary. Got: %v", err)
+	}
+	resp, err := s.ListUsers(ctx, &pb.ListUsersRequest{})
+	if err != nil || len(resp.Users) != 1 {
+		t.Errorf("TestReadYourWrites: list after write should go to primary. Got: %v, %v", resp, err)
+	}
+
+	// Old write is already replicated
+	old := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(LastWriteHeader, old))
+	_, err = s.GetUser(ctx, req)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("TestReadYourWrites: read long after write should go to replica. Got: %v", err)
+	}
+
+	// Writes can't be made in the future
+	future := strconv.FormatInt(time.Now().Add(time.Minute).UnixMilli(), 10)
+	ctx = metadata.NewIncomingContext(context.Background(), metadata.Pairs(LastWriteHeader, future))
+	_, err = s.GetUser(ctx, req)
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("TestReadYourWrites: read with future write time should go to replica. Got: %v", err)
+	}
+}
+
+// Repository with list query slower than any deadline.
+type slowUsers struct {
+	db.UserRepository
+}
+
+func (r slowUsers) ListUsers(ctx context.Context, limit, offset int, country string) ([]models.User, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestQueryTimeout(t *testing.T) {
+	s := UserService{
+		Users:         slowUsers{db.NewMemoryUserRepository()},
+		QueryTimeouts: QueryTimeouts{Methods: map[string]time.Duration{"ListUsers": 10 * time.Millisecond}},
+	}
+	_, err := s.ListUsers(context.Background(), &pb.ListUsersRequest{})
+	if status.Code(err) != codes.DeadlineExceeded {
+		t.Errorf("TestQueryTimeout: slow query should return DeadlineExceeded. Got: %v", err)
+	}
+
+	// Canceled request is not an internal error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = s.GetUser(ctx, &pb.GetUserRequest{Id: uuid.NewString()})
+	if status.Code(err) != codes.Canceled {
+		t.Errorf("TestQueryTimeout: canceled request should return Canceled. Got: %v", err)
+	}
 }
 
 func TestListUsers(t *testing.T) {
-	s := UserService{}
+	s := newTestService()
 	populateDatabase(s)
 	resp, err := s.ListUsers(context.Background(), &pb.ListUsersRequest{})
 	if err != nil {
@@ -195,7 +362,7 @@ func TestWatch(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
-	grpcServer, err := StartGrpcServer(ctx, grpcAddr)
+	grpcServer, err := StartGrpcServer(ctx, grpcAddr, testRepos, testOptions)
 	if err != nil {
 		t.Fatalf("Error starting GRPC server: %v\n", err)
 	}
@@ -249,6 +416,109 @@ func TestWatch(t *testing.T) {
 	}
 }
 
+// Watch stream collecting sent events.
+type watchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events chan *pb.WatchResponse
+}
+
+func (s watchStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s watchStream) SendHeader(metadata.MD) error {
+	return nil
+}
+
+func (s watchStream) Send(event *pb.WatchResponse) error {
+	s.events <- event
+	return nil
+}
+
+func TestWatchSnapshot(t *testing.T) {
+	replica := db.NewMemoryUserRepository()
+	bus := events.NewMemoryBus()
+	s := UserService{
+		Users:      laggingReplica{UserRepository: replica, primary: db.NewMemoryUserRepository()},
+		Subscriber: bus,
+	}
+	// More users than a single snapshot query reads
+	users := []models.User{}
+	for i := 0; i < snapshotPageSize+1; i++ {
+		user := models.User{Email: fmt.Sprintf("john%d@email.com", i)}
+		if err := replica.CreateUser(context.Background(), &user); err != nil {
+			t.Fatalf("TestWatchSnapshot: failed to add user: %v", err)
+		}
+		users = append(users, user)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := watchStream{ctx: ctx, events: make(chan *pb.WatchResponse)}
+	go s.Watch(&pb.WatchRequest{Snapshot: true}, stream)
+
+	// Snapshot is read from replica. User deleted after the first page
+	// was read doesn't make the next page skip a user.
+	for i := 0; i < snapshotPageSize+1; i++ {
+		event := <-stream.events
+		if event.Method != pb.WatchResponse_SNAPSHOT || event.User.Id != users[i].ID.String() {
+			t.Fatalf("TestWatchSnapshot: expected SNAPSHOT event of user %d. Got: %v", i, event)
+		}
+		if i == 0 {
+			replica.DeleteUser(context.Background(), users[0].ID)
+		}
+	}
+
+	if event := <-stream.events; event.Method != pb.WatchResponse_SNAPSHOT_END {
+		t.Fatalf("TestWatchSnapshot: expected SNAPSHOT_END event after users. Got: %v", event)
+	}
+
+	// Changes follow the snapshot
+	bus.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: &pb.UserResponse{Id: "1"}})
+	if event := <-stream.events; event.Method != pb.WatchResponse_CREATE {
+		t.Errorf("TestWatchSnapshot: expected CREATE event after snapshot. Got: %v", event)
+	}
+}
+
+func TestWatchSnapshotOverflow(t *testing.T) {
+	bus := events.NewMemoryBus()
+	hub := events.NewHub(bus, 1, events.DropOldest)
+	if err := hub.Start(context.Background()); err != nil {
+		t.Fatalf("TestWatchSnapshotOverflow: failed to start hub: %v", err)
+	}
+	defer hub.Close()
+	s := UserService{Users: db.NewMemoryUserRepository(), Subscriber: hub}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	stream := watchStream{ctx: ctx, events: make(chan *pb.WatchResponse)}
+	result := make(chan error, 1)
+	go func() { result <- s.Watch(&pb.WatchRequest{Snapshot: true}, stream) }()
+	if event := <-stream.events; event.Method != pb.WatchResponse_SNAPSHOT_END {
+		t.Fatalf("TestWatchSnapshotOverflow: expected SNAPSHOT_END event. Got: %v", event)
+	}
+
+	// Client doesn't read changes, so they don't fit the buffer. Hub drops
+	// oldest changes, but the snapshot stream must not miss any.
+	for i := 0; i < 5; i++ {
+		bus.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{Id: "1"}})
+	}
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case <-stream.events:
+		case err := <-result:
+			if status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("TestWatchSnapshotOverflow: expected ResourceExhausted. Got: %v", err)
+			}
+			return
+		case <-timeout:
+			t.Fatal("TestWatchSnapshotOverflow: stream was not closed")
+		}
+	}
+}
+
 func populateDatabase(s UserService) {
 	s.AddUser(context.Background(), &pb.AddUserRequest{Email: "john1@email.com", Country: "AU"})
 	s.AddUser(context.Background(), &pb.AddUserRequest{Email: "john2@email.com", Country: "AU"})
@@ -0,0 +1,356 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+const (
+	// Number of recent events kept to resume streams using Last-Event-ID.
+	watchHistorySize = 1000
+
+	// Buffer of each browser client. Slow clients are disconnected when it is
+	// full and can resume using last received event id.
+	watchClientBuffer = 100
+
+	// Interval of SSE comments and websocket pings keeping connections open.
+	watchHeartbeat = 15 * time.Second
+
+	// Delay before grpc Watch stream is opened again after an error.
+	watchRetryDelay = time.Second
+)
+
+// Event received from grpc Watch with an id assigned by the gateway.
+type watchEvent struct {
+	ID    string
+	Seq   uint64
+	Event *pb.WatchResponse
+}
+
+// Holds a single grpc Watch stream and broadcasts received events to
+// browser clients connected over SSE or WebSocket. Recent events are kept in
+// memory so clients can resume after reconnecting to the same instance.
+type watchBroadcaster struct {
+	client pb.UserServiceClient
+
+	// Identifies broadcaster instance so ids from another process are not
+	// used to resume.
+	epoch string
+
+	mu      sync.Mutex
+	seq     uint64
+	history []watchEvent
+	clients map[chan watchEvent]struct{}
+	closed  bool
+}
+
+func newWatchBroadcaster(client pb.UserServiceClient) *watchBroadcaster {
+	return &watchBroadcaster{
+		client:  client,
+		epoch:   strconv.FormatInt(time.Now().UnixNano(), 36),
+		clients: map[chan watchEvent]struct{}{},
+	}
+}
+
+// Reads grpc Watch stream until context is canceled. Stream is reopened
+// when it fails.
+func (b *watchBroadcaster) run(ctx context.Context) {
+	for {
+		stream, err := b.client.Watch(ctx, &pb.WatchRequest{})
+		if err == nil {
+			for {
+				resp, recvErr := stream.Recv()
+				if recvErr != nil {
+					err = recvErr
+					break
+				}
+				b.broadcast(resp)
+			}
+		}
+		if ctx.Err() != nil {
+			return
+		}
+		slog.Warn("watch gateway: grpc watch stream failed", "error", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(watchRetryDelay):
+		}
+	}
+}
+
+// Stores event in history and sends it to connected clients. Clients which
+// buffer is full are disconnected. Passwords are never sent to browsers and
+// earlier events of deleted or erased users are removed from history.
+func (b *watchBroadcaster) broadcast(resp *pb.WatchResponse) {
+	resp = proto.Clone(resp).(*pb.WatchResponse)
+	if resp.User != nil {
+		resp.User.Password = ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.seq++
+	event := watchEvent{
+		ID:    fmt.Sprintf("%s-%d", b.epoch, b.seq),
+		Seq:   b.seq,
+		Event: resp,
+	}
+	if id := resp.GetUser().GetId(); id != "" && (resp.Method == pb.WatchResponse_DELETE || resp.Method == pb.WatchResponse_ERASE) {
+		b.forget(id)
+	}
+	b.history = append(b.history, event)
+	if len(b.history) > watchHistorySize {
+		b.history = b.history[len(b.history)-watchHistorySize:]
+	}
+
+	for ch := range b.clients {
+		select {
+		case ch <- event:
+		default:
+			delete(b.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+// Removes events of the user from history. Must be called with mu held.
+func (b *watchBroadcaster) forget(userID string) {
+	kept := b.history[:0]
+	for _, e := range b.history {
+		if e.Event.GetUser().GetId() != userID {
+			kept = append(kept, e)
+		}
+	}
+	// Removed events are not referenced by the backing array anymore
+	clear(b.history[len(kept):])
+	b.history = kept
+}
+
+// Registers a client. Events after lastEventID still in history are
+// returned as backlog. Returned channel is closed when client is too slow
+// or broadcaster is closed.
+func (b *watchBroadcaster) subscribe(lastEventID string) ([]watchEvent, chan watchEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	ch := make(chan watchEvent, watchClientBuffer)
+	if b.closed {
+		close(ch)
+		return nil, ch
+	}
+
+	backlog := []watchEvent{}
+	if seq, ok := b.parseID(lastEventID); ok {
+		for _, e := range b.history {
+			if e.Seq > seq {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	b.clients[ch] = struct{}{}
+	return backlog, ch
+}
+
+func (b *watchBroadcaster) unsubscribe(ch chan watchEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.clients[ch]; ok {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+// Disconnects all clients so HTTP server can shut down.
+func (b *watchBroadcaster) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for ch := range b.clients {
+		delete(b.clients, ch)
+		close(ch)
+	}
+}
+
+func (b *watchBroadcaster) isClosed() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.closed
+}
+
+// Returns sequence number of event id created by this broadcaster.
+func (b *watchBroadcaster) parseID(id string) (uint64, bool) {
+	epoch, seq, found := strings.Cut(id, "-")
+	if !found || epoch != b.epoch {
+		return 0, false
+	}
+	n, err := strconv.ParseUint(seq, 10, 64)
+	return n, err == nil
+}
+
+// Streams events as text/event-stream. Reconnecting clients send
+// Last-Event-ID header (or last_event_id query parameter) to receive events
+// they have missed.
+func (b *watchBroadcaster) sseHandler(c *gin.Context) {
+	lastEventID := c.GetHeader("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = c.Query("last_event_id")
+	}
+	backlog, ch := b.subscribe(lastEventID)
+	defer b.unsubscribe(ch)
+	watchStreams.WithLabelValues("sse").Inc()
+	defer watchStreams.WithLabelValues("sse").Dec()
+
+	w := c.Writer
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	// Ask browsers to reconnect quickly
+	fmt.Fprintf(w, "retry: %d\n\n", watchRetryDelay.Milliseconds())
+	for _, e := range backlog {
+		if err := writeSSE(w, e); err != nil {
+			return
+		}
+	}
+	w.Flush()
+
+	heartbeat := time.NewTicker(watchHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-c.Request.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return
+			}
+			w.Flush()
+		case e, ok := <-ch:
+			if !ok {
+				return
+			}
+			if err := writeSSE(w, e); err != nil {
+				return
+			}
+			w.Flush()
+		}
+	}
+}
+
+// Writes single SSE event with method as event name and WatchResponse as
+// JSON data.
+func writeSSE(w gin.ResponseWriter, e watchEvent) error {
+	data, err := protojson.Marshal(e.Event)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", e.ID, e.Event.Method.String(), data)
+	return err
+}
+
+// Streams events as websocket text messages in the same {"result": ...}
+// envelope grpc-gateway uses for streams, extended with event id. Clients
+// resume using last_event_id query parameter.
+func (b *watchBroadcaster) websocketHandler(upgrader *websocket.Upgrader) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
+		if err != nil {
+			// Upgrader already responded with an error
+			return
+		}
+		defer conn.Close()
+
+		backlog, ch := b.subscribe(c.Query("last_event_id"))
+		defer b.unsubscribe(ch)
+		watchStreams.WithLabelValues("websocket").Inc()
+		defer watchStreams.WithLabelValues("websocket").Dec()
+
+		// Read messages to process control frames and detect closed connection
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				if _, _, err := conn.ReadMessage(); err != nil {
+					return
+				}
+			}
+		}()
+
+		for _, e := range backlog {
+			if err := writeWebsocket(conn, e); err != nil {
+				return
+			}
+		}
+
+		heartbeat := time.NewTicker(watchHeartbeat)
+		defer heartbeat.Stop()
+		for {
+			select {
+			case <-closed:
+				return
+			case <-heartbeat.C:
+				if err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(watchHeartbeat)); err != nil {
+					return
+				}
+			case e, ok := <-ch:
+				if !ok {
+					msg := websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "client too slow")
+					if b.isClosed() {
+						msg = websocket.FormatCloseMessage(websocket.CloseGoingAway, "server is shutting down")
+					}
+					conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+					return
+				}
+				if err := writeWebsocket(conn, e); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
+
+func writeWebsocket(conn *websocket.Conn, e watchEvent) error {
+	data, err := protojson.Marshal(e.Event)
+	if err != nil {
+		return err
+	}
+	msg := fmt.Sprintf(`{"id":%q,"result":%s}`, e.ID, data)
+	return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+}
+
+// Creates websocket upgrader accepting provided origins. "*" accepts any
+// origin, empty list accepts only same origin requests.
+func newWebsocketUpgrader(allowedOrigins []string) *websocket.Upgrader {
+	upgrader := &websocket.Upgrader{}
+	if len(allowedOrigins) == 0 {
+		return upgrader
+	}
+	upgrader.CheckOrigin = func(r *http.Request) bool {
+		origin := r.Header.Get("Origin")
+		for _, allowed := range allowedOrigins {
+			if allowed == "*" || allowed == origin {
+				return true
+			}
+		}
+		return false
+	}
+	return upgrader
+}
@@ -0,0 +1,149 @@
+package service
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestWatchServer() (*watchBroadcaster, *httptest.Server) {
+	b := newWatchBroadcaster(nil)
+	gin.SetMode(gin.ReleaseMode)
+	engine := gin.New()
+	engine.GET("watch/sse", b.sseHandler)
+	engine.GET("watch/ws", b.websocketHandler(newWebsocketUpgrader(nil)))
+	return b, httptest.NewServer(engine)
+}
+
+// Reads SSE stream until an event with data is received.
+func readSSEEvent(t *testing.T, r *bufio.Reader) map[string]string {
+	event := map[string]string{}
+	for {
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			if event["data"] != "" {
+				return event
+			}
+			continue
+		}
+		if key, value, ok := strings.Cut(line, ": "); ok {
+			event[key] = value
+		}
+	}
+}
+
+func TestWatchSSE(t *testing.T) {
+	b, srv := newTestWatchServer()
+	defer srv.Close()
+
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: &pb.UserResponse{Id: "1"}})
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{Id: "1"}})
+
+	// Resume after first event should replay the second one
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/watch/sse", nil)
+	req.Header.Set("Last-Event-ID", b.history[0].ID)
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	r := bufio.NewReader(resp.Body)
+	event := readSSEEvent(t, r)
+	require.Equal(t, b.history[1].ID, event["id"])
+	require.Equal(t, "UPDATE", event["event"])
+	require.Contains(t, event["data"], `"method":"UPDATE"`)
+
+	// Live event
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_DELETE, User: &pb.UserResponse{Id: "1"}})
+	}()
+	event = readSSEEvent(t, r)
+	require.Equal(t, "DELETE", event["event"])
+}
+
+func TestWatchWebsocket(t *testing.T) {
+	b, srv := newTestWatchServer()
+	defer srv.Close()
+
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: &pb.UserResponse{Id: "1"}})
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/watch/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// New clients without last event id receive only new events
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{Id: "1"}})
+	}()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, msg, err := conn.ReadMessage()
+	require.NoError(t, err)
+	require.Contains(t, string(msg), `"id":"`+b.history[1].ID+`"`)
+	require.Contains(t, string(msg), `"method":"UPDATE"`)
+}
+
+func TestWatchHistory(t *testing.T) {
+	b := newWatchBroadcaster(nil)
+	user := &pb.UserResponse{Id: "1", Password: "secret"}
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: user})
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_CREATE, User: &pb.UserResponse{Id: "2"}})
+	require.Equal(t, "secret", user.Password)
+	require.Empty(t, b.history[0].Event.User.Password)
+
+	// Earlier events of erased user are not replayed
+	b.broadcast(&pb.WatchResponse{Method: pb.WatchResponse_ERASE, User: &pb.UserResponse{Id: "1"}})
+	require.Len(t, b.history, 2)
+	require.Equal(t, "2", b.history[0].Event.User.Id)
+	require.Equal(t, pb.WatchResponse_ERASE, b.history[1].Event.Method)
+}
+
+func TestWatchClose(t *testing.T) {
+	b, srv := newTestWatchServer()
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/watch/sse")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/watch/ws"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	// Wait for both clients to subscribe
+	require.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.clients) == 2
+	}, time.Second, 10*time.Millisecond)
+	b.close()
+
+	// SSE stream ends
+	_, err = io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	// Websocket is closed with going away code
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, _, err = conn.ReadMessage()
+	require.True(t, websocket.IsCloseError(err, websocket.CloseGoingAway), "unexpected error: %v", err)
+
+	// New clients are disconnected immediately
+	backlog, ch := b.subscribe("")
+	require.Empty(t, backlog)
+	_, ok := <-ch
+	require.False(t, ok)
+}
@@ -0,0 +1,118 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/logging"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/kroksys/user-service-example/pkg/webhook"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (s UserService) RegisterWebhook(ctx context.Context, in *pb.RegisterWebhookRequest) (*pb.WebhookResponse, error) {
+	logger := logging.FromContext(ctx)
+	policy := s.WebhookPolicy
+	if policy == nil {
+		policy = &webhook.AddressPolicy{}
+	}
+	// Deliveries are checked again when connecting, registration check
+	// reports forbidden addresses early
+	err := policy.CheckURL(ctx, in.Url)
+	if errors.Is(err, webhook.ErrForbiddenAddress) {
+		logger.Info("forbidden webhook address", "url", in.Url, "error", err)
+		return nil, status.Errorf(codes.InvalidArgument, "RegisterWebhook: url must not point to loopback, private or link-local address")
+	}
+	if err != nil {
+		logger.Debug("invalid url provided", "url", in.Url)
+		return nil, status.Errorf(codes.InvalidArgument, "RegisterWebhook: url must be valid http or https url")
+	}
+
+	secret := in.Secret
+	if secret == "" {
+		secret, err = generateSecret()
+		if err != nil {
+			logger.Error("error generating secret", "error", err)
+			return nil, status.Errorf(codes.Internal, err.Error())
+		}
+	}
+
+	methods := []string{}
+	for _, m := range in.Methods {
+		if m == pb.WatchResponse_SNAPSHOT || m == pb.WatchResponse_SNAPSHOT_END {
+			return nil, status.Errorf(codes.InvalidArgument, "RegisterWebhook: SNAPSHOT events are not delivered to webhooks")
+		}
+		methods = append(methods, m.String())
+	}
+
+	hook := models.Webhook{
+		URL:     in.Url,
+		Methods: strings.Join(methods, ","),
+		Secret:  secret,
+	}
+	qctx, cancel := s.queryContext(ctx, "RegisterWebhook")
+	defer cancel()
+	err = s.Webhooks.CreateWebhook(qctx, &hook)
+	if err != nil {
+		logger.Error("error creating webhook", "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	if s.Dispatcher != nil {
+		s.Dispatcher.Invalidate()
+	}
+	return hook.ToWebhookResponse(true), nil
+}
+
+func (s UserService) ListWebhooks(ctx context.Context, in *pb.ListWebhooksRequest) (*pb.ListWebhooksResponse, error) {
+	qctx, cancel := s.queryContext(ctx, "ListWebhooks")
+	defer cancel()
+	webhooks, err := s.Webhooks.ListWebhooks(qctx)
+	if err != nil {
+		logging.FromContext(ctx).Error("error listing webhooks", "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	result := []*pb.WebhookResponse{}
+	for _, w := range webhooks {
+		result = append(result, w.ToWebhookResponse(false))
+	}
+	return &pb.ListWebhooksResponse{Webhooks: result}, nil
+}
+
+func (s UserService) DeleteWebhook(ctx context.Context, in *pb.DeleteWebhookRequest) (*pb.DeleteWebhookResponse, error) {
+	logger := logging.FromContext(ctx)
+	if in.Id == "" {
+		logger.Debug("empty id provided")
+		return nil, status.Errorf(codes.InvalidArgument, "DeleteWebhook: id must not be empty")
+	}
+	id, err := uuid.Parse(in.Id)
+	if err != nil {
+		logger.Debug("could not parse id to uuid", "id", in.Id, "error", err)
+		return nil, status.Errorf(codes.InvalidArgument, err.Error())
+	}
+	qctx, cancel := s.queryContext(ctx, "DeleteWebhook")
+	defer cancel()
+	err = s.Webhooks.DeleteWebhook(qctx, id)
+	if err != nil {
+		logger.Error("error deleting webhook", "webhook_id", id, "error", err)
+		return nil, dbStatus(qctx, err)
+	}
+	if s.Dispatcher != nil {
+		s.Dispatcher.Invalidate()
+	}
+	return &pb.DeleteWebhookResponse{}, nil
+}
+
+// Generates random hex encoded secret used to sign webhook payloads.
+func generateSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
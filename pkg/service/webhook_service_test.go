@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWebhooks(t *testing.T) {
+	s := newTestService()
+
+	// Invalid url should be rejected
+	_, err := s.RegisterWebhook(context.Background(), &pb.RegisterWebhookRequest{Url: "ftp://example.com"})
+	if err == nil {
+		t.Errorf("TestWebhooks: registering webhook with invalid url should return error. Got: nil")
+	}
+
+	// Loopback, private and link-local addresses should be rejected
+	for _, url := range []string{
+		"http://localhost:8080/hook",
+		"http://127.0.0.1:9001/v1/users",
+		"http://169.254.169.254/latest/meta-data",
+		"https://10.0.0.5/hook",
+		"http://[::1]/hook",
+	} {
+		_, err = s.RegisterWebhook(context.Background(), &pb.RegisterWebhookRequest{Url: url})
+		if status.Code(err) != codes.InvalidArgument {
+			t.Errorf("TestWebhooks: registering webhook with url %s should return InvalidArgument. Got: %v", url, err)
+		}
+	}
+
+	// Snapshots are sent only to Watch streams
+	_, err = s.RegisterWebhook(context.Background(), &pb.RegisterWebhookRequest{
+		Url:     "http://203.0.113.10/hook",
+		Methods: []pb.WatchResponse_METHOD{pb.WatchResponse_SNAPSHOT},
+	})
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("TestWebhooks: registering webhook for SNAPSHOT events should return InvalidArgument. Got: %v", err)
+	}
+
+	// Register webhook receiving only DELETE events, secret should be generated
+	resp, err := s.RegisterWebhook(context.Background(), &pb.RegisterWebhookRequest{
+		Url:     "http://203.0.113.10/hook",
+		Methods: []pb.WatchResponse_METHOD{pb.WatchResponse_DELETE},
+	})
+	if err != nil {
+		t.Fatalf("TestWebhooks: failed to register webhook: %v", err)
+	}
+	if resp.Secret == "" {
+		t.Errorf("TestWebhooks: secret should be generated when not provided")
+	}
+	if len(resp.Methods) != 1 || resp.Methods[0] != pb.WatchResponse_DELETE {
+		t.Errorf("TestWebhooks: expected methods [DELETE]. Got: %v", resp.Methods)
+	}
+
+	// Listed webhooks should not expose secret
+	list, err := s.ListWebhooks(context.Background(), &pb.ListWebhooksRequest{})
+	if err != nil {
+		t.Fatalf("TestWebhooks: failed to list webhooks: %v", err)
+	}
+	found := false
+	for _, w := range list.Webhooks {
+		if w.Id == resp.Id {
+			found = true
+			if w.Secret != "" {
+				t.Errorf("TestWebhooks: listed webhook should not contain secret")
+			}
+		}
+	}
+	if !found {
+		t.Errorf("TestWebhooks: registered webhook %s was not listed", resp.Id)
+	}
+
+	// Delete webhook
+	_, err = s.DeleteWebhook(context.Background(), &pb.DeleteWebhookRequest{Id: resp.Id})
+	if err != nil {
+		t.Errorf("TestWebhooks: failed to delete webhook: %v", err)
+	}
+	_, err = s.DeleteWebhook(context.Background(), &pb.DeleteWebhookRequest{})
+	if err == nil {
+		t.Errorf("TestWebhooks: deleting webhook without id should return error. Got: nil")
+	}
+}
@@ -0,0 +1,131 @@
+// Package tracing configures OpenTelemetry tracing of the service and
+// carries trace context in published user changes.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.12.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name of the service in exported spans.
+const ServiceName = "user-service"
+
+// Name of tracers of this module.
+const instrumentationName = "github.com/kroksys/user-service-example"
+
+// Config used to select and configure span exporter.
+type Config struct {
+	// Exporter name: otlp, stdout or file. Tracing is disabled when empty.
+	Exporter string
+
+	// OTLP gRPC collector address or path of the file spans are written
+	// to. OTLP exporter uses OTEL_EXPORTER_OTLP_* environment variables
+	// when empty.
+	Endpoint string
+
+	// Fraction of traces sampled when parent span is not sampled
+	// already, 0 to 1.
+	SampleRatio float64
+}
+
+// Sets global tracer provider and W3C trace context propagation. Returned
+// function flushes and stops the exporter. Spans are not recorded when
+// exporter is empty.
+func Setup(ctx context.Context, cfg Config) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	if cfg.Exporter == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	exporter, closeOutput, err := newExporter(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(cfg.SampleRatio))),
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(ServiceName))),
+	)
+	otel.SetTracerProvider(provider)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closeErr := closeOutput(); err == nil {
+			err = closeErr
+		}
+		return err
+	}, nil
+}
+
+// Creates exporter selected by cfg.Exporter. Returned function closes
+// the file spans are written to.
+func newExporter(ctx context.Context, cfg Config) (sdktrace.SpanExporter, func() error, error) {
+	noClose := func() error { return nil }
+	switch cfg.Exporter {
+	case "otlp":
+		opts := []otlptracegrpc.Option{}
+		if cfg.Endpoint != "" {
+			opts = append(opts, otlptracegrpc.WithEndpoint(cfg.Endpoint), otlptracegrpc.WithInsecure())
+		}
+		exporter, err := otlptracegrpc.New(ctx, opts...)
+		return exporter, noClose, err
+	case "stdout":
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+		return exporter, noClose, err
+	case "file":
+		if cfg.Endpoint == "" {
+			return nil, nil, fmt.Errorf("file exporter requires endpoint path")
+		}
+		f, err := os.OpenFile(cfg.Endpoint, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, nil, err
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(f))
+		if err != nil {
+			f.Close()
+			return nil, nil, err
+		}
+		return exporter, f.Close, nil
+	}
+	return nil, nil, fmt.Errorf("unsupported tracing exporter: %q", cfg.Exporter)
+}
+
+// Returns tracer of this module.
+func Tracer() trace.Tracer {
+	return otel.Tracer(instrumentationName)
+}
+
+// Stores trace context of ctx in event metadata.
+func Inject(ctx context.Context, event *pb.WatchResponse) {
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(ctx, carrier)
+	if len(carrier) == 0 {
+		return
+	}
+	if event.Metadata == nil {
+		event.Metadata = map[string]string{}
+	}
+	for k, v := range carrier {
+		event.Metadata[k] = v
+	}
+}
+
+// Returns ctx with trace context read from event metadata, so spans
+// handling the event can be linked to the request that made the change.
+func Extract(ctx context.Context, event *pb.WatchResponse) context.Context {
+	return otel.GetTextMapPropagator().Extract(ctx, propagation.MapCarrier(event.GetMetadata()))
+}
@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	stop, err := Setup(context.Background(), Config{Exporter: "file", Endpoint: path, SampleRatio: 1})
+	require.NoError(t, err)
+
+	ctx, span := Tracer().Start(context.Background(), "AddUser")
+	event := &pb.WatchResponse{Method: pb.WatchResponse_CREATE}
+	Inject(ctx, event)
+	span.End()
+	require.NoError(t, stop(context.Background()))
+
+	// Trace context is carried by event metadata
+	require.Contains(t, event.Metadata["traceparent"], span.SpanContext().TraceID().String())
+	linked := trace.SpanContextFromContext(Extract(context.Background(), event))
+	require.Equal(t, span.SpanContext().TraceID(), linked.TraceID())
+	require.Equal(t, span.SpanContext().SpanID(), linked.SpanID())
+
+	// Spans are flushed to the file on stop
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	require.Contains(t, string(data), `"Name":"AddUser"`)
+}
+
+func TestSetupErrors(t *testing.T) {
+	_, err := Setup(context.Background(), Config{Exporter: "zipkin"})
+	require.ErrorContains(t, err, "unsupported tracing exporter")
+
+	_, err = Setup(context.Background(), Config{Exporter: "file"})
+	require.ErrorContains(t, err, "requires endpoint")
+
+	// Disabled tracing does not add metadata
+	stop, err := Setup(context.Background(), Config{})
+	require.NoError(t, err)
+	require.NoError(t, stop(context.Background()))
+	event := &pb.WatchResponse{}
+	Inject(context.Background(), event)
+	require.Empty(t, event.Metadata)
+}
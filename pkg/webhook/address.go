@@ -0,0 +1,118 @@
+package webhook
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Returned when webhook url points to an address forbidden by AddressPolicy.
+var ErrForbiddenAddress = errors.New("webhook: address is not allowed")
+
+// Loopback, private, link-local and other special purpose networks. Webhooks
+// must not reach the service itself or internal infrastructure, such as
+// cloud metadata endpoint at 169.254.169.254.
+var blockedNetworks = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("10.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("169.254.0.0/16"),
+	netip.MustParsePrefix("172.16.0.0/12"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("192.168.0.0/16"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("224.0.0.0/4"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("::/128"),
+	netip.MustParsePrefix("::1/128"),
+	netip.MustParsePrefix("fc00::/7"),
+	netip.MustParsePrefix("fe80::/10"),
+	netip.MustParsePrefix("ff00::/8"),
+}
+
+// Decides which addresses webhooks may be delivered to. Blocked networks
+// are rejected unless they are within explicitly allowed networks.
+type AddressPolicy struct {
+	allowed []netip.Prefix
+}
+
+// Creates policy allowing provided networks in CIDR notation in addition
+// to public addresses.
+func NewAddressPolicy(allowedNetworks []string) (*AddressPolicy, error) {
+	p := &AddressPolicy{}
+	for _, network := range allowedNetworks {
+		prefix, err := netip.ParsePrefix(network)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %v", network, err)
+		}
+		p.allowed = append(p.allowed, prefix.Masked())
+	}
+	return p, nil
+}
+
+// Returns ErrForbiddenAddress when address is in blocked network.
+func (p *AddressPolicy) CheckAddr(addr netip.Addr) error {
+	addr = addr.Unmap()
+	for _, prefix := range p.allowed {
+		if prefix.Contains(addr) {
+			return nil
+		}
+	}
+	for _, prefix := range blockedNetworks {
+		if prefix.Contains(addr) {
+			return fmt.Errorf("%w: %s", ErrForbiddenAddress, addr)
+		}
+	}
+	return nil
+}
+
+// Validates webhook url and addresses its host resolves to. Hosts that
+// can't be resolved are accepted, addresses are checked again on every
+// delivery because DNS records may change after registration.
+func (p *AddressPolicy) CheckURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("url must be valid http or https url")
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil {
+		return p.CheckAddr(addr)
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", u.Hostname())
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if err := p.CheckAddr(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Creates http client connecting only to addresses allowed by the policy.
+// Addresses are checked after resolution so redirects and DNS rebinding
+// can't reach blocked networks. Proxies are not used because they would
+// connect on behalf of the client.
+func (p *AddressPolicy) Client(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 30 * time.Second,
+		Control: func(network, address string, c syscall.RawConn) error {
+			addrPort, err := netip.ParseAddrPort(address)
+			if err != nil {
+				return err
+			}
+			return p.CheckAddr(addrPort.Addr())
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
@@ -0,0 +1,479 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+// Storage used by dispatcher to find webhooks and record deliveries.
+type Store interface {
+	ListWebhooks(ctx context.Context) ([]models.Webhook, error)
+	CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error
+	CreateWebhookDeadLetter(ctx context.Context, d *models.WebhookDeadLetter) error
+}
+
+// JSON body posted to webhooks.
+type Payload struct {
+	ID         string          `json:"id"`
+	Method     string          `json:"method"`
+	OccurredAt time.Time       `json:"occurred_at"`
+	User       json.RawMessage `json:"user"`
+}
+
+// Dispatcher delivers published events to registered webhooks. It implements
+// events.EventPublisher so it only delivers events originating from this
+// service instance and every event is delivered once per webhook.
+type Dispatcher struct {
+	Store  Store
+	Client *http.Client
+
+	// Total number of delivery attempts before event is dead-lettered.
+	MaxAttempts int
+
+	// Delay before the first retry. Doubled after every failed attempt
+	// up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+
+	// How long listed webhooks are reused before they are listed again.
+	// Changes made through other instances are seen after ListTTL.
+	ListTTL time.Duration
+
+	// Number of concurrent deliveries and number of delivery attempts
+	// waiting for a worker. Deliveries exceeding the queue are
+	// dead-lettered. Changing them after the first Publish has no effect.
+	Workers   int
+	QueueSize int
+
+	mu         sync.Mutex
+	webhooks   []models.Webhook
+	listedAt   time.Time
+	generation int
+	retries    map[*delivery]*time.Timer
+	closed     bool
+	// Deliveries not yet delivered or dead-lettered and number of Forget
+	// calls in progress by user
+	pending map[*delivery]struct{}
+	erasing map[uuid.UUID]int
+
+	// Held for reading while dead letter is stored, so Forget can wait
+	// for dead letters being stored
+	deadLetters sync.RWMutex
+
+	start   sync.Once
+	queue   chan *delivery
+	stop    chan struct{}
+	workers sync.WaitGroup
+	// Deliveries not yet delivered or dead-lettered
+	wg sync.WaitGroup
+}
+
+// Delivery of one event to one webhook.
+type delivery struct {
+	webhook  models.Webhook
+	eventID  uuid.UUID
+	userID   uuid.UUID
+	method   pb.WatchResponse_METHOD
+	body     []byte
+	attempts int
+	backoff  time.Duration
+	lastErr  string
+	// Delivery of erased user is neither attempted nor dead-lettered.
+	// Guarded by mu.
+	dropped bool
+}
+
+// Creates dispatcher with default retry policy: 8 attempts starting with
+// 1s backoff capped at 5 minutes, delivered by 10 workers. Http client
+// connects only to addresses allowed by the policy, nil policy allows
+// public addresses only.
+func NewDispatcher(store Store, policy *AddressPolicy) *Dispatcher {
+	if policy == nil {
+		policy = &AddressPolicy{}
+	}
+	return &Dispatcher{
+		Store:          store,
+		Client:         policy.Client(10 * time.Second),
+		MaxAttempts:    8,
+		InitialBackoff: time.Second,
+		MaxBackoff:     5 * time.Minute,
+		ListTTL:        10 * time.Second,
+		Workers:        10,
+		QueueSize:      1000,
+	}
+}
+
+// Queues delivery of the event to every webhook accepting its method.
+// Returned error only reports failure to load webhooks.
+func (d *Dispatcher) Publish(ctx context.Context, event *pb.WatchResponse) error {
+	webhooks, err := d.listWebhooks(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list webhooks: %v", err)
+	}
+
+	eventID := uuid.New()
+	// Missing or invalid id leaves dead letters without user
+	userID, _ := uuid.Parse(event.GetUser().GetId())
+	var body []byte
+	for _, w := range webhooks {
+		if !w.Accepts(event.Method) {
+			continue
+		}
+		if body == nil {
+			body, err = encodePayload(eventID, event)
+			if err != nil {
+				return err
+			}
+		}
+		job := &delivery{
+			webhook: w,
+			eventID: eventID,
+			userID:  userID,
+			method:  event.Method,
+			body:    body,
+			backoff: d.InitialBackoff,
+		}
+		d.track(job)
+		d.enqueue(job)
+	}
+	return nil
+}
+
+// Drops pending deliveries of the user, so they are neither attempted
+// again nor dead-lettered, and waits for dead letters being stored.
+// Deliveries of events published until returned function is called are
+// dropped as well. Used by erasure of the user, so no dead letter holding
+// its data is stored after its dead letters are deleted.
+func (d *Dispatcher) Forget(userID uuid.UUID) (done func()) {
+	d.start.Do(d.startWorkers)
+	d.mu.Lock()
+	d.erasing[userID]++
+	stopped := []*delivery{}
+	for job := range d.pending {
+		if job.userID != userID {
+			continue
+		}
+		job.dropped = true
+		if timer, ok := d.retries[job]; ok {
+			timer.Stop()
+			delete(d.retries, job)
+			stopped = append(stopped, job)
+		}
+	}
+	d.mu.Unlock()
+	for _, job := range stopped {
+		d.finish(job)
+	}
+	d.deadLetters.Lock()
+	d.deadLetters.Unlock()
+
+	return func() {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.erasing[userID]--; d.erasing[userID] == 0 {
+			delete(d.erasing, userID)
+		}
+	}
+}
+
+// Adds the delivery to pending ones. Deliveries of users being erased are
+// dropped.
+func (d *Dispatcher) track(job *delivery) {
+	d.start.Do(d.startWorkers)
+	d.wg.Add(1)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	job.dropped = d.erasing[job.userID] > 0
+	d.pending[job] = struct{}{}
+}
+
+// Removes delivered, dead-lettered or dropped delivery from pending ones.
+func (d *Dispatcher) finish(job *delivery) {
+	d.mu.Lock()
+	delete(d.pending, job)
+	d.mu.Unlock()
+	d.wg.Done()
+}
+
+// Reports whether the delivery was dropped by Forget.
+func (d *Dispatcher) isDropped(job *delivery) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return job.dropped
+}
+
+// Drops listed webhooks so the next event lists them again. Called after
+// webhooks are registered or deleted through this instance.
+func (d *Dispatcher) Invalidate() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.webhooks = nil
+	d.listedAt = time.Time{}
+	d.generation++
+}
+
+// Stops retrying pending deliveries and waits for queued and running ones.
+// Deliveries waiting for retry are dead-lettered.
+func (d *Dispatcher) Close() error {
+	d.start.Do(d.startWorkers)
+	d.mu.Lock()
+	if d.closed {
+		d.mu.Unlock()
+		d.wg.Wait()
+		return nil
+	}
+	d.closed = true
+	stopped := []*delivery{}
+	for job, timer := range d.retries {
+		timer.Stop()
+		stopped = append(stopped, job)
+	}
+	d.retries = nil
+	close(d.stop)
+	d.mu.Unlock()
+
+	for _, job := range stopped {
+		d.fail(job, "dispatcher stopped")
+	}
+	d.workers.Wait()
+	d.wg.Wait()
+	return nil
+}
+
+// Returns webhooks listed less than ListTTL ago or lists them from store.
+func (d *Dispatcher) listWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	d.mu.Lock()
+	if !d.listedAt.IsZero() && time.Since(d.listedAt) < d.ListTTL {
+		webhooks := d.webhooks
+		d.mu.Unlock()
+		return webhooks, nil
+	}
+	generation := d.generation
+	d.mu.Unlock()
+
+	webhooks, err := d.Store.ListWebhooks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	d.mu.Lock()
+	// Webhooks changed while listing are listed again by the next event
+	if generation == d.generation {
+		d.webhooks = webhooks
+		d.listedAt = time.Now()
+	}
+	d.mu.Unlock()
+	return webhooks, nil
+}
+
+func (d *Dispatcher) startWorkers() {
+	d.queue = make(chan *delivery, d.QueueSize)
+	d.stop = make(chan struct{})
+	d.retries = map[*delivery]*time.Timer{}
+	d.pending = map[*delivery]struct{}{}
+	d.erasing = map[uuid.UUID]int{}
+	for i := 0; i < d.Workers; i++ {
+		d.workers.Add(1)
+		go d.work()
+	}
+}
+
+// Attempts queued deliveries. After stop it attempts deliveries already
+// queued and exits.
+func (d *Dispatcher) work() {
+	defer d.workers.Done()
+	for {
+		select {
+		case job := <-d.queue:
+			d.attempt(job)
+		case <-d.stop:
+			for {
+				select {
+				case job := <-d.queue:
+					d.attempt(job)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Queues delivery attempt. Delivery is dead-lettered when dispatcher is
+// closed or the queue is full.
+func (d *Dispatcher) enqueue(job *delivery) {
+	d.start.Do(d.startWorkers)
+	d.mu.Lock()
+	reason := ""
+	if d.closed {
+		reason = "dispatcher stopped"
+	} else {
+		select {
+		case d.queue <- job:
+		default:
+			reason = "delivery queue is full"
+		}
+	}
+	d.mu.Unlock()
+	if reason != "" {
+		d.fail(job, reason)
+	}
+}
+
+// Posts the payload once. Every attempt is logged and failed attempts are
+// retried with exponential backoff until MaxAttempts is reached. Delivery
+// outlives the request publishing the event so it is not bound to its context.
+func (d *Dispatcher) attempt(job *delivery) {
+	if d.isDropped(job) {
+		d.finish(job)
+		return
+	}
+	job.attempts++
+	start := time.Now()
+	statusCode, err := d.post(job.webhook, job.eventID, job.body)
+
+	record := &models.WebhookDelivery{
+		WebhookID:  job.webhook.ID,
+		EventID:    job.eventID,
+		Method:     job.method.String(),
+		Attempt:    job.attempts,
+		StatusCode: statusCode,
+		Success:    err == nil,
+		Duration:   time.Since(start),
+	}
+	if err != nil {
+		record.Error = err.Error()
+		job.lastErr = err.Error()
+	}
+	if err := d.Store.CreateWebhookDelivery(context.Background(), record); err != nil {
+		slog.Error("webhook: failed to store delivery", "event_id", job.eventID, "error", err)
+	}
+	if record.Success {
+		d.finish(job)
+		return
+	}
+	if job.attempts >= d.MaxAttempts {
+		d.deadLetter(job)
+		d.finish(job)
+		return
+	}
+	d.retry(job)
+}
+
+// Queues the delivery again after backoff. Timers don't hold workers, so
+// failing webhooks don't delay deliveries to other webhooks.
+func (d *Dispatcher) retry(job *delivery) {
+	d.mu.Lock()
+	if job.dropped {
+		d.mu.Unlock()
+		d.finish(job)
+		return
+	}
+	if d.closed {
+		d.mu.Unlock()
+		d.fail(job, "dispatcher stopped")
+		return
+	}
+	d.retries[job] = time.AfterFunc(job.backoff, func() {
+		d.mu.Lock()
+		_, pending := d.retries[job]
+		delete(d.retries, job)
+		d.mu.Unlock()
+		// Retries removed by Close are dead-lettered by it
+		if pending {
+			d.enqueue(job)
+		}
+	})
+	job.backoff *= 2
+	if job.backoff > d.MaxBackoff {
+		job.backoff = d.MaxBackoff
+	}
+	d.mu.Unlock()
+}
+
+// Dead-letters delivery that won't be attempted again.
+func (d *Dispatcher) fail(job *delivery, reason string) {
+	if job.lastErr != "" {
+		reason += ", last error: " + job.lastErr
+	}
+	job.lastErr = reason
+	d.deadLetter(job)
+	d.finish(job)
+}
+
+// Stores undelivered payload so it can be inspected and replayed later.
+// Dropped deliveries are not stored.
+func (d *Dispatcher) deadLetter(job *delivery) {
+	d.deadLetters.RLock()
+	defer d.deadLetters.RUnlock()
+	if d.isDropped(job) {
+		return
+	}
+	err := d.Store.CreateWebhookDeadLetter(context.Background(), &models.WebhookDeadLetter{
+		WebhookID: job.webhook.ID,
+		EventID:   job.eventID,
+		UserID:    job.userID,
+		Method:    job.method.String(),
+		Payload:   job.body,
+		Attempts:  job.attempts,
+		LastError: job.lastErr,
+	})
+	if err != nil {
+		slog.Error("webhook: failed to dead-letter event", "event_id", job.eventID, "error", err)
+	}
+}
+
+// Sends signed payload to the webhook. Any non 2xx status is an error.
+func (d *Dispatcher) post(w models.Webhook, eventID uuid.UUID, body []byte) (int, error) {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookIDHeader, w.ID.String())
+	req.Header.Set(EventIDHeader, eventID.String())
+	req.Header.Set(TimestampHeader, fmt.Sprint(now.Unix()))
+	req.Header.Set(SignatureHeader, Sign(w.Secret, now, body))
+
+	resp, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+// Encodes event as webhook payload.
+func encodePayload(eventID uuid.UUID, event *pb.WatchResponse) ([]byte, error) {
+	user := event.GetUser()
+	if user == nil {
+		user = &pb.UserResponse{}
+	}
+	userJSON, err := protojson.Marshal(user)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode webhook payload: %v", err)
+	}
+	return json.Marshal(Payload{
+		ID:         eventID.String(),
+		Method:     event.Method.String(),
+		OccurredAt: time.Now().UTC(),
+		User:       userJSON,
+	})
+}
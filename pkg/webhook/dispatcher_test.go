@@ -0,0 +1,282 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kroksys/user-service-example/pkg/models"
+	"github.com/kroksys/user-service-example/pkg/pb/v1"
+	"github.com/stretchr/testify/require"
+)
+
+// In-memory store used to inspect dispatcher results
+type testStore struct {
+	mu          sync.Mutex
+	webhooks    []models.Webhook
+	deliveries  []models.WebhookDelivery
+	deadLetters []models.WebhookDeadLetter
+	lists       int
+}
+
+func (s *testStore) ListWebhooks(ctx context.Context) ([]models.Webhook, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lists++
+	return s.webhooks, nil
+}
+
+func (s *testStore) CreateWebhookDelivery(ctx context.Context, d *models.WebhookDelivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deliveries = append(s.deliveries, *d)
+	return nil
+}
+
+func (s *testStore) CreateWebhookDeadLetter(ctx context.Context, d *models.WebhookDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deadLetters = append(s.deadLetters, *d)
+	return nil
+}
+
+// Test receivers listen on loopback addresses which are blocked by default
+func newTestDispatcher(store Store) *Dispatcher {
+	policy, _ := NewAddressPolicy([]string{"127.0.0.0/8"})
+	d := NewDispatcher(store, policy)
+	d.MaxAttempts = 3
+	d.InitialBackoff = time.Millisecond
+	d.MaxBackoff = 5 * time.Millisecond
+	return d
+}
+
+func TestDispatcherDelivers(t *testing.T) {
+	secret := "the secret"
+	received := make(chan Payload, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !Verify(secret, r.Header.Get(SignatureHeader), r.Header.Get(TimestampHeader), body, time.Minute) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		p := Payload{}
+		json.Unmarshal(body, &p)
+		received <- p
+	}))
+	defer receiver.Close()
+
+	store := &testStore{webhooks: []models.Webhook{
+		{ID: uuid.New(), URL: receiver.URL, Secret: secret},
+		{ID: uuid.New(), URL: receiver.URL, Secret: secret, Methods: "DELETE"},
+	}}
+	d := newTestDispatcher(store)
+
+	err := d.Publish(context.Background(), &pb.WatchResponse{
+		Method: pb.WatchResponse_CREATE,
+		User:   &pb.UserResponse{Id: "1", Email: "john@email.com"},
+	})
+	require.NoError(t, err)
+	d.Close()
+
+	select {
+	case p := <-received:
+		require.Equal(t, "CREATE", p.Method)
+		user := map[string]interface{}{}
+		require.NoError(t, json.Unmarshal(p.User, &user))
+		require.Equal(t, "john@email.com", user["email"])
+	default:
+		t.Fatal("TestDispatcherDelivers: receiver did not get the event")
+	}
+
+	// Only the webhook accepting CREATE should be called
+	require.Len(t, store.deliveries, 1)
+	require.True(t, store.deliveries[0].Success)
+	require.Empty(t, store.deadLetters)
+}
+
+func TestDispatcherRetries(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer receiver.Close()
+
+	store := &testStore{webhooks: []models.Webhook{{ID: uuid.New(), URL: receiver.URL}}}
+	d := newTestDispatcher(store)
+	require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE}))
+	d.wg.Wait()
+
+	require.Len(t, store.deliveries, 3)
+	require.False(t, store.deliveries[0].Success)
+	require.Equal(t, http.StatusInternalServerError, store.deliveries[0].StatusCode)
+	require.True(t, store.deliveries[2].Success)
+	require.Empty(t, store.deadLetters)
+}
+
+func TestDispatcherDeadLetter(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	store := &testStore{webhooks: []models.Webhook{{ID: uuid.New(), URL: receiver.URL}}}
+	d := newTestDispatcher(store)
+	userID := uuid.New()
+	require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_DELETE, User: &pb.UserResponse{Id: userID.String()}}))
+	d.wg.Wait()
+
+	require.Len(t, store.deliveries, 3)
+	require.Len(t, store.deadLetters, 1)
+	require.Equal(t, userID, store.deadLetters[0].UserID)
+	require.Equal(t, 3, store.deadLetters[0].Attempts)
+	require.Equal(t, "DELETE", store.deadLetters[0].Method)
+	require.NotEmpty(t, store.deadLetters[0].Payload)
+}
+
+func TestDispatcherForget(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer receiver.Close()
+
+	store := &testStore{webhooks: []models.Webhook{{ID: uuid.New(), URL: receiver.URL}}}
+	d := newTestDispatcher(store)
+	d.InitialBackoff = time.Hour
+	erased, kept := uuid.New(), uuid.New()
+	for _, id := range []uuid.UUID{erased, kept} {
+		require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{Id: id.String()}}))
+	}
+	require.Eventually(t, func() bool {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return len(d.retries) == 2
+	}, time.Second, time.Millisecond)
+
+	// Retry of the erased user and its events published during erasure
+	// are dropped, other retries are dead-lettered on close
+	done := d.Forget(erased)
+	require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_UPDATE, User: &pb.UserResponse{Id: erased.String()}}))
+	done()
+	d.Close()
+
+	require.Len(t, store.deliveries, 2)
+	require.Len(t, store.deadLetters, 1)
+	require.Equal(t, kept, store.deadLetters[0].UserID)
+	require.Empty(t, d.pending)
+}
+
+func TestDispatcherBlocksPrivateAddresses(t *testing.T) {
+	var calls int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+	}))
+	defer receiver.Close()
+
+	store := &testStore{webhooks: []models.Webhook{{ID: uuid.New(), URL: receiver.URL}}}
+	d := NewDispatcher(store, nil)
+	d.MaxAttempts = 1
+	require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_CREATE}))
+	d.Close()
+
+	require.Zero(t, atomic.LoadInt32(&calls))
+	require.Len(t, store.deadLetters, 1)
+	require.Contains(t, store.deadLetters[0].LastError, ErrForbiddenAddress.Error())
+}
+
+func TestDispatcherListCache(t *testing.T) {
+	store := &testStore{}
+	d := newTestDispatcher(store)
+	d.ListTTL = time.Hour
+	event := &pb.WatchResponse{Method: pb.WatchResponse_CREATE}
+	require.NoError(t, d.Publish(context.Background(), event))
+	require.NoError(t, d.Publish(context.Background(), event))
+	require.Equal(t, 1, store.lists)
+
+	d.Invalidate()
+	require.NoError(t, d.Publish(context.Background(), event))
+	require.Equal(t, 2, store.lists)
+	d.Close()
+}
+
+func TestDispatcherQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer receiver.Close()
+
+	webhooks := []models.Webhook{}
+	for i := 0; i < 3; i++ {
+		webhooks = append(webhooks, models.Webhook{ID: uuid.New(), URL: receiver.URL})
+	}
+	store := &testStore{webhooks: webhooks}
+	d := newTestDispatcher(store)
+	d.Workers = 1
+	d.QueueSize = 1
+	require.NoError(t, d.Publish(context.Background(), &pb.WatchResponse{Method: pb.WatchResponse_CREATE}))
+
+	// One delivery is running or queued, at most two fit, the rest is
+	// dead-lettered without waiting
+	require.Eventually(t, func() bool {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return len(store.deadLetters) >= 1
+	}, time.Second, time.Millisecond)
+	close(release)
+	d.Close()
+	require.Contains(t, store.deadLetters[0].LastError, "delivery queue is full")
+	require.Equal(t, 3, len(store.deliveries)+len(store.deadLetters))
+}
+
+func TestAddressPolicy(t *testing.T) {
+	policy, err := NewAddressPolicy([]string{"10.1.0.0/16"})
+	require.NoError(t, err)
+	ctx := context.Background()
+	for _, url := range []string{
+		"http://127.0.0.1/hook",
+		"http://169.254.169.254/latest/meta-data",
+		"http://192.168.1.1/hook",
+		"http://10.2.0.1/hook",
+		"http://[::1]/hook",
+		"http://[::ffff:127.0.0.1]/hook",
+		"http://localhost/hook",
+	} {
+		require.ErrorIs(t, policy.CheckURL(ctx, url), ErrForbiddenAddress, url)
+	}
+	for _, url := range []string{
+		"http://203.0.113.10/hook",
+		"https://10.1.2.3/hook",
+		"https://[2001:db8::1]/hook",
+	} {
+		require.NoError(t, policy.CheckURL(ctx, url), url)
+	}
+	require.Error(t, policy.CheckURL(ctx, "ftp://example.com"))
+	require.Error(t, policy.CheckURL(ctx, "http:///hook"))
+
+	_, err = NewAddressPolicy([]string{"10.0.0.1"})
+	require.Error(t, err)
+}
+
+func TestVerify(t *testing.T) {
+	body := []byte(`{"id":"1"}`)
+	now := time.Now()
+	sig := Sign("secret", now, body)
+	ts := strconv.FormatInt(now.Unix(), 10)
+
+	require.True(t, Verify("secret", sig, ts, body, time.Minute))
+	require.False(t, Verify("other", sig, ts, body, time.Minute))
+	require.False(t, Verify("secret", sig, ts, []byte(`{"id":"2"}`), time.Minute))
+
+	old := now.Add(-time.Hour)
+	require.False(t, Verify("secret", Sign("secret", old, body), strconv.FormatInt(old.Unix(), 10), body, time.Minute))
+}
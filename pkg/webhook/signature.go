@@ -0,0 +1,54 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// Header holding payload signature: "sha256=<hex encoded hmac>".
+	SignatureHeader = "X-Webhook-Signature"
+
+	// Header holding unix timestamp used when signing the payload.
+	TimestampHeader = "X-Webhook-Timestamp"
+
+	// Header holding id of the delivered event. Same for all retries.
+	EventIDHeader = "X-Webhook-Event-Id"
+
+	// Header holding id of the webhook subscription.
+	WebhookIDHeader = "X-Webhook-Id"
+
+	signaturePrefix = "sha256="
+)
+
+// Signs "<timestamp>.<body>" with HMAC-SHA256 using webhook secret.
+// Including timestamp in signature allows receivers to reject replays.
+func Sign(secret string, timestamp time.Time, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp.Unix(), 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verifies signature and timestamp headers received by a webhook receiver.
+// Signatures older than tolerance are rejected, zero tolerance disables the
+// check.
+func Verify(secret, signature, timestamp string, body []byte, tolerance time.Duration) bool {
+	if !strings.HasPrefix(signature, signaturePrefix) {
+		return false
+	}
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	ts := time.Unix(unix, 0)
+	if tolerance > 0 && time.Since(ts) > tolerance {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(Sign(secret, ts, body)))
+}